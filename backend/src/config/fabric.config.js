@@ -1,6 +1,7 @@
 const { Gateway, Wallets } = require('fabric-network');
 const path = require('path');
 const fs = require('fs');
+const crypto = require('crypto');
 const logger = require('../utils/logger');
 
 class FabricConfig {
@@ -108,6 +109,34 @@ class FabricConfig {
         }
     }
 
+    /**
+     * Sign a record as its author with the user's enrolled key
+     * Mirrors the chaincode's canonical record digest (one field per line after a domain prefix)
+     * @param {string} userId - User identity
+     * @param {Object} record - recordId, patientId, ipfsHash, checksum and recordType
+     * @returns {string} - Base64 signature
+     */
+    async signRecord(userId, { recordId, patientId, ipfsHash, checksum, recordType }) {
+        const wallet = await this.getWallet();
+        const identity = await wallet.get(userId);
+        if (!identity) {
+            throw new Error(`Identity ${userId} does not exist in wallet`);
+        }
+
+        const message = [
+            'medledger-record-signature-v1',
+            recordId,
+            patientId,
+            ipfsHash || '',
+            checksum.toLowerCase(),
+            recordType
+        ].join('\n');
+
+        return crypto
+            .sign('sha256', Buffer.from(message), identity.credentials.privateKey)
+            .toString('base64');
+    }
+
     /**
      * Invoke chaincode transaction
      * @param {string} userId - User identity
@@ -62,6 +62,32 @@ router.post('/ehr/upload', verifyToken, requirePatient, upload.single('file'), a
             });
         }
 
+        // The chaincode only accepts record types from its vocabulary, so check before
+        // encrypting and uploading anything
+        if (!recordType) {
+            fs.unlinkSync(req.file.path);
+            return res.status(400).json({
+                success: false,
+                message: 'recordType is required'
+            });
+        }
+
+        const vocabulary = await fabricConfig.queryChaincode(patientId, 'GetRecordTypeVocabulary');
+        let canonicalRecordType = recordType;
+        if (vocabulary && vocabulary.length > 0) {
+            canonicalRecordType = vocabulary.find(
+                (allowed) => allowed.toLowerCase() === recordType.toLowerCase()
+            );
+            if (!canonicalRecordType) {
+                fs.unlinkSync(req.file.path);
+                return res.status(400).json({
+                    success: false,
+                    message: `recordType "${recordType}" is not in the record type vocabulary`,
+                    details: vocabulary
+                });
+            }
+        }
+
         // Read uploaded file
         const filePath = req.file.path;
         const fileBuffer = fs.readFileSync(filePath);
@@ -82,6 +108,15 @@ router.post('/ehr/upload', verifyToken, requirePatient, upload.single('file'), a
         // Generate unique record ID
         const recordId = `EHR-${uuidv4()}`;
 
+        // Sign the record as its author
+        const authorSignature = await fabricConfig.signRecord(patientId, {
+            recordId,
+            patientId,
+            ipfsHash,
+            checksum,
+            recordType: canonicalRecordType
+        });
+
         // Store metadata on blockchain
         logger.info('Storing metadata on blockchain');
         await fabricConfig.invokeTransaction(
@@ -91,8 +126,9 @@ router.post('/ehr/upload', verifyToken, requirePatient, upload.single('file'), a
             patientId,
             ipfsHash,
             encryptedKey,
-            recordType || req.file.originalname,
-            checksum
+            canonicalRecordType,
+            checksum,
+            authorSignature
         );
 
         // Delete temporary file
@@ -104,7 +140,7 @@ router.post('/ehr/upload', verifyToken, requirePatient, upload.single('file'), a
             data: {
                 recordId,
                 ipfsHash,
-                recordType: recordType || req.file.originalname,
+                recordType: canonicalRecordType,
                 checksum,
                 timestamp: new Date().toISOString()
             }
@@ -201,8 +237,8 @@ router.post('/consent/grant', verifyToken, requirePatient, validate(schemas.gran
         // Generate consent ID
         const consentId = `${patientId}-${doctorId}-${recordId || '*'}`;
 
-        // Grant consent on blockchain
-        await fabricConfig.invokeTransaction(
+        // Grant consent on blockchain (returns the patient's consent receipt)
+        const receipt = await fabricConfig.invokeTransaction(
             patientId,
             'GrantConsent',
             consentId,
@@ -220,7 +256,8 @@ router.post('/consent/grant', verifyToken, requirePatient, validate(schemas.gran
                 patientId,
                 doctorId,
                 recordId: recordId || 'All records',
-                expiryDays
+                expiryDays,
+                receipt
             }
         });
     } catch (error) {
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Amendment request states (HIPAA 45 CFR 164.526 right to amend)
+const (
+	AmendmentSubmitted         = "SUBMITTED"
+	AmendmentUnderReview       = "UNDER_REVIEW"
+	AmendmentAccepted          = "ACCEPTED"
+	AmendmentAmended           = "AMENDED"
+	AmendmentDenied            = "DENIED"
+	AmendmentDisagreementFiled = "DISAGREEMENT_FILED"
+	AmendmentRebutted          = "REBUTTED"
+	AmendmentWithdrawn         = "WITHDRAWN"
+)
+
+const (
+	amendmentRequestDocType = "amendmentRequest"
+	amendmentResponseDays   = 60 // Initial response window
+	amendmentExtensionDays  = 30 // One extension allowed
+)
+
+// AmendmentRequest is a patient's request to correct a record
+type AmendmentRequest struct {
+	DocType           string                  `json:"docType"`
+	RequestID         string                  `json:"requestId"`
+	RecordID          string                  `json:"recordId"`
+	PatientID         string                  `json:"patientId"`
+	AssignedOrg       string                  `json:"assignedOrg"` // Author organization that must respond
+	RequestedChange   string                  `json:"requestedChange"`
+	Justification     string                  `json:"justification"`
+	Status            string                  `json:"status"`
+	SubmittedAt       time.Time               `json:"submittedAt"`
+	DueDate           time.Time               `json:"dueDate"`
+	Extended          bool                    `json:"extended"`
+	ExtensionReason   string                  `json:"extensionReason"`
+	ReviewedBy        string                  `json:"reviewedBy"`
+	DecidedAt         time.Time               `json:"decidedAt"`
+	DenialReason      string                  `json:"denialReason"`
+	Disagreement      string                  `json:"disagreement"` // Patient's statement of disagreement
+	Rebuttal          string                  `json:"rebuttal"`
+	AmendmentRecordID string                  `json:"amendmentRecordId"` // Version created for an accepted request
+	History           []AmendmentRequestEvent `json:"history"`
+}
+
+// AmendmentRequestEvent records one state change of an amendment request
+type AmendmentRequestEvent struct {
+	Status    string    `json:"status"`
+	ActorID   string    `json:"actorId"`
+	Timestamp time.Time `json:"timestamp"`
+	Note      string    `json:"note"`
+}
+
+// FileAmendmentRequest lets a patient request a correction to one of their records
+func (s *SmartContract) FileAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	recordID string,
+	requestedChange string,
+	justification string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if requestedChange == "" {
+		return fmt.Errorf("requested change is required")
+	}
+
+	record, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	err = requireActive(record)
+	if err != nil {
+		return err
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, record.PatientID)
+	if err != nil {
+		return err
+	}
+
+	requestKey, err := ctx.GetStub().CreateCompositeKey(amendmentRequestDocType, []string{requestID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	existing, err := ctx.GetStub().GetState(requestKey)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("amendment request %s already exists", requestID)
+	}
+
+	// Route to the organization that authored the record; patient uploads go to admins
+	assignedOrg := record.AuthorOrg
+	if record.CreatedBy == record.PatientID {
+		assignedOrg = ""
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	request := AmendmentRequest{
+		DocType:         amendmentRequestDocType,
+		RequestID:       requestID,
+		RecordID:        recordID,
+		PatientID:       record.PatientID,
+		AssignedOrg:     assignedOrg,
+		RequestedChange: requestedChange,
+		Justification:   justification,
+		Status:          AmendmentSubmitted,
+		SubmittedAt:     now,
+		DueDate:         now.AddDate(0, 0, amendmentResponseDays),
+		History: []AmendmentRequestEvent{{
+			Status:    AmendmentSubmitted,
+			ActorID:   callerID,
+			Timestamp: now,
+			Note:      requestedChange,
+		}},
+	}
+
+	err = s.putAmendmentRequest(ctx, &request)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionAmendmentRequest, callerID, record.PatientID, recordID, record.PatientID, true,
+		fmt.Sprintf("Amendment request %s filed, routed to %s, due %s",
+			requestID, routedTo(request.AssignedOrg), request.DueDate.Format(time.RFC3339)))
+}
+
+// StartAmendmentReview marks a request as under review by the author organization
+func (s *SmartContract) StartAmendmentReview(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, false,
+		[]string{AmendmentSubmitted}, AmendmentUnderReview, "",
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			request.ReviewedBy = callerID
+			return nil
+		})
+}
+
+// ExtendAmendmentDeadline uses the single 30-day extension, with a written reason
+func (s *SmartContract) ExtendAmendmentDeadline(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	reason string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, false,
+		[]string{AmendmentSubmitted, AmendmentUnderReview}, "", reason,
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			if reason == "" {
+				return fmt.Errorf("extension reason is required")
+			}
+			if request.Extended {
+				return fmt.Errorf("amendment request %s has already been extended", requestID)
+			}
+			if now.After(request.DueDate) {
+				return fmt.Errorf("amendment request %s is already overdue", requestID)
+			}
+			request.Extended = true
+			request.ExtensionReason = reason
+			request.DueDate = request.DueDate.AddDate(0, 0, amendmentExtensionDays)
+			return nil
+		})
+}
+
+// AcceptAmendmentRequest records that the author organization agreed to amend the record
+func (s *SmartContract) AcceptAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, false,
+		[]string{AmendmentUnderReview}, AmendmentAccepted, "",
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			request.ReviewedBy = callerID
+			request.DecidedAt = now
+			return nil
+		})
+}
+
+// LinkAmendmentToRequest links an accepted request to the version created by AmendEHR
+func (s *SmartContract) LinkAmendmentToRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	amendmentRecordID string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, false,
+		[]string{AmendmentAccepted}, AmendmentAmended, amendmentRecordID,
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			lineage, err := s.recordLineage(ctx, amendmentRecordID)
+			if err != nil {
+				return err
+			}
+
+			// The amendment must descend from the record the patient asked to correct
+			for _, versionID := range lineage[1:] {
+				if versionID == request.RecordID {
+					request.AmendmentRecordID = amendmentRecordID
+					return nil
+				}
+			}
+			return fmt.Errorf("record %s is not an amendment of %s", amendmentRecordID, request.RecordID)
+		})
+}
+
+// DenyAmendmentRequest denies a request with the reason the patient must be given
+func (s *SmartContract) DenyAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	denialReason string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, false,
+		[]string{AmendmentUnderReview}, AmendmentDenied, denialReason,
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			if denialReason == "" {
+				return fmt.Errorf("denial reason is required")
+			}
+			request.ReviewedBy = callerID
+			request.DecidedAt = now
+			request.DenialReason = denialReason
+			return nil
+		})
+}
+
+// FileStatementOfDisagreement lets the patient disagree with a denial
+func (s *SmartContract) FileStatementOfDisagreement(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	statement string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, true,
+		[]string{AmendmentDenied}, AmendmentDisagreementFiled, statement,
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			if statement == "" {
+				return fmt.Errorf("statement of disagreement is required")
+			}
+			request.Disagreement = statement
+			return nil
+		})
+}
+
+// RebutStatementOfDisagreement records the author organization's rebuttal
+func (s *SmartContract) RebutStatementOfDisagreement(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	rebuttal string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, false,
+		[]string{AmendmentDisagreementFiled}, AmendmentRebutted, rebuttal,
+		func(request *AmendmentRequest, callerID string, now time.Time) error {
+			if rebuttal == "" {
+				return fmt.Errorf("rebuttal is required")
+			}
+			request.Rebuttal = rebuttal
+			return nil
+		})
+}
+
+// WithdrawAmendmentRequest lets the patient withdraw a request before it is decided
+func (s *SmartContract) WithdrawAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+) error {
+	return s.transitionAmendmentRequest(ctx, requestID, true,
+		[]string{AmendmentSubmitted, AmendmentUnderReview}, AmendmentWithdrawn, "", nil)
+}
+
+// GetAmendmentRequest retrieves an amendment request
+func (s *SmartContract) GetAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+) (*AmendmentRequest, error) {
+	request, err := s.readAmendmentRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Visible to the patient and to the organization handling it
+	if s.RequirePatientOrAdmin(ctx, request.PatientID) != nil {
+		err = s.requireAmendmentReviewer(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return request, nil
+}
+
+// QueryAmendmentRequestsByOrg lists the requests routed to an organization. Admins and
+// the organization's reviewers may list them.
+func (s *SmartContract) QueryAmendmentRequestsByOrg(
+	ctx contractapi.TransactionContextInterface,
+	orgMSPID string,
+) ([]*AmendmentRequest, error) {
+	isReviewer, err := s.isAmendmentReviewer(ctx, orgMSPID)
+	if err != nil {
+		return nil, err
+	}
+	if !isReviewer {
+		return nil, fmt.Errorf("%w: only admins and reviewers of %s can list its amendment requests", errUnauthorized, orgMSPID)
+	}
+
+	return s.getAmendmentRequestQueryResult(ctx, map[string]interface{}{
+		"docType":     amendmentRequestDocType,
+		"assignedOrg": orgMSPID,
+	})
+}
+
+// QueryAmendmentRequestsByPatient lists the requests filed by a patient
+func (s *SmartContract) QueryAmendmentRequestsByPatient(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) ([]*AmendmentRequest, error) {
+	err := s.RequirePatientOrAdmin(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getAmendmentRequestQueryResult(ctx, map[string]interface{}{
+		"docType":   amendmentRequestDocType,
+		"patientId": patientID,
+	})
+}
+
+// QueryOverdueAmendmentRequests lists open requests routed to an organization that are past due
+func (s *SmartContract) QueryOverdueAmendmentRequests(
+	ctx contractapi.TransactionContextInterface,
+	orgMSPID string,
+) ([]*AmendmentRequest, error) {
+	requests, err := s.QueryAmendmentRequestsByOrg(ctx, orgMSPID)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var overdue []*AmendmentRequest
+	for _, request := range requests {
+		open := request.Status == AmendmentSubmitted || request.Status == AmendmentUnderReview
+		if open && now.After(request.DueDate) {
+			overdue = append(overdue, request)
+		}
+	}
+
+	return overdue, nil
+}
+
+// transitionAmendmentRequest applies one step of the request state machine. An empty
+// target status updates the request without changing its state.
+func (s *SmartContract) transitionAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+	byPatient bool,
+	from []string,
+	to string,
+	note string,
+	apply func(request *AmendmentRequest, callerID string, now time.Time) error,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	request, err := s.readAmendmentRequest(ctx, requestID)
+	if err != nil {
+		return err
+	}
+
+	// Patients act on their own requests, the author organization on everything else
+	if byPatient {
+		err = s.RequirePatientOrAdmin(ctx, request.PatientID)
+	} else {
+		err = s.requireAmendmentReviewer(ctx, request)
+	}
+	if err != nil {
+		return err
+	}
+
+	allowed := false
+	for _, status := range from {
+		if request.Status == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("amendment request %s is %s, expected one of %v", requestID, request.Status, from)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	if apply != nil {
+		err = apply(request, callerID, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	previousStatus := request.Status
+	if to != "" {
+		request.Status = to
+	}
+	request.History = append(request.History, AmendmentRequestEvent{
+		Status:    request.Status,
+		ActorID:   callerID,
+		Timestamp: now,
+		Note:      note,
+	})
+
+	err = s.putAmendmentRequest(ctx, request)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("Amendment request %s %s -> %s", requestID, previousStatus, request.Status)
+	if request.Extended && to == "" {
+		message = fmt.Sprintf("Amendment request %s extended to %s", requestID, request.DueDate.Format(time.RFC3339))
+	}
+	if now.After(request.DueDate) {
+		message += " (overdue)"
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionAmendmentRequest, callerID, request.PatientID, request.RecordID, request.PatientID, true, message)
+}
+
+// requireAmendmentReviewer allows admins and doctors of the organization the request is routed to
+func (s *SmartContract) requireAmendmentReviewer(
+	ctx contractapi.TransactionContextInterface,
+	request *AmendmentRequest,
+) error {
+	isReviewer, err := s.isAmendmentReviewer(ctx, request.AssignedOrg)
+	if err != nil {
+		return err
+	}
+	if !isReviewer {
+		return fmt.Errorf("%w: amendment request %s is routed to %s", errUnauthorized, request.RequestID, routedTo(request.AssignedOrg))
+	}
+
+	return nil
+}
+
+// isAmendmentReviewer checks whether the caller is an admin or a doctor of the given
+// organization. Requests routed to no organization are reviewed by admins only.
+func (s *SmartContract) isAmendmentReviewer(
+	ctx contractapi.TransactionContextInterface,
+	orgMSPID string,
+) (bool, error) {
+	role, err := s.GetCallerRole(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get caller role: %v", err)
+	}
+	if role == RoleAdmin {
+		return true, nil
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return role == RoleDoctor && orgMSPID != "" && callerOrg == orgMSPID, nil
+}
+
+// readAmendmentRequest loads an amendment request by ID
+func (s *SmartContract) readAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	requestID string,
+) (*AmendmentRequest, error) {
+	requestKey, err := ctx.GetStub().CreateCompositeKey(amendmentRequestDocType, []string{requestID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	requestJSON, err := ctx.GetStub().GetState(requestKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if requestJSON == nil {
+		return nil, fmt.Errorf("amendment request %s %w", requestID, errNotFound)
+	}
+
+	var request AmendmentRequest
+	err = json.Unmarshal(requestJSON, &request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal amendment request: %v", err)
+	}
+
+	return &request, nil
+}
+
+// putAmendmentRequest saves an amendment request
+func (s *SmartContract) putAmendmentRequest(
+	ctx contractapi.TransactionContextInterface,
+	request *AmendmentRequest,
+) error {
+	requestKey, err := ctx.GetStub().CreateCompositeKey(amendmentRequestDocType, []string{request.RequestID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal amendment request: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(requestKey, requestJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// getAmendmentRequestQueryResult executes a CouchDB query for amendment requests
+func (s *SmartContract) getAmendmentRequestQueryResult(
+	ctx contractapi.TransactionContextInterface,
+	selector map[string]interface{},
+) ([]*AmendmentRequest, error) {
+	queryJSON, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(string(queryJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var results []*AmendmentRequest
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var request AmendmentRequest
+		err = json.Unmarshal(queryResponse.Value, &request)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &request)
+	}
+
+	return results, nil
+}
+
+// routedTo describes who must respond to a request
+func routedTo(assignedOrg string) string {
+	if assignedOrg == "" {
+		return "admins"
+	}
+	return assignedOrg
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAmendmentRequestWorkflow tests routing, the accept path and the denial/disagreement path
+func TestAmendmentRequestWorkflow(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	otherOrgCtx := newTestContext(stub, newTestIdentity("doctor789", "ClinicMSP", map[string]string{"role": RoleDoctor}))
+
+	err := grantWriteConsent(s, stub, "tx0", "patient123", "doctor456")
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(doctorCtx, "EHR-001", "patient123", testCID("original"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(doctorCtx, "EHR-001", "patient123", testCID("original"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.FileAmendmentRequest(patientCtx, "AR-1", "EHR-001", "Potassium should read 4.1", "Lab resent corrected value")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx3", func() error {
+		return s.FileAmendmentRequest(patientCtx, "AR-2", "EHR-001", "Wrong allergy listed", "")
+	})
+	assert.NoError(t, err)
+
+	request, err := s.GetAmendmentRequest(patientCtx, "AR-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "HospitalMSP", request.AssignedOrg)
+	assert.Equal(t, AmendmentSubmitted, request.Status)
+	assert.Equal(t, 60*24, int(request.DueDate.Sub(request.SubmittedAt).Hours()))
+
+	// Only the author organization can review
+	err = inTx(stub, "tx4", func() error {
+		return s.StartAmendmentReview(otherOrgCtx, "AR-1")
+	})
+	assert.ErrorContains(t, err, "routed to HospitalMSP")
+
+	// Accept path: review, accept, amend and link
+	for i, step := range []func() error{
+		func() error { return s.StartAmendmentReview(doctorCtx, "AR-1") },
+		func() error { return s.ExtendAmendmentDeadline(doctorCtx, "AR-1", "Waiting on lab") },
+		func() error { return s.AcceptAmendmentRequest(doctorCtx, "AR-1") },
+		func() error {
+			return s.AmendEHR(doctorCtx, "EHR-001", "EHR-001-v2", testCID("corrected"), "key2", testChecksum("checksum2"), "Amendment request AR-1", testSignature(doctorCtx, "EHR-001-v2", "patient123", testCID("corrected"), testChecksum("checksum2"), "Lab Report"))
+		},
+		func() error { return s.LinkAmendmentToRequest(doctorCtx, "AR-1", "EHR-001-v2") },
+	} {
+		assert.NoError(t, inTx(stub, fmt.Sprintf("tx-accept-%d", i), step))
+	}
+
+	// An extension needs a written reason
+	err = inTx(stub, "tx5", func() error {
+		return s.ExtendAmendmentDeadline(doctorCtx, "AR-2", "")
+	})
+	assert.ErrorContains(t, err, "reason is required")
+
+	request, err = s.GetAmendmentRequest(doctorCtx, "AR-1")
+	assert.NoError(t, err)
+	assert.Equal(t, AmendmentAmended, request.Status)
+	assert.Equal(t, "EHR-001-v2", request.AmendmentRecordID)
+	assert.True(t, request.Extended)
+	assert.Equal(t, 90*24, int(request.DueDate.Sub(request.SubmittedAt).Hours()))
+	assert.Len(t, request.History, 5)
+
+	// Denial path: a reason is required and the patient may disagree
+	err = inTx(stub, "tx6", func() error {
+		return s.StartAmendmentReview(doctorCtx, "AR-2")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx7", func() error {
+		return s.DenyAmendmentRequest(doctorCtx, "AR-2", "")
+	})
+	assert.ErrorContains(t, err, "denial reason is required")
+
+	err = inTx(stub, "tx8", func() error {
+		return s.DenyAmendmentRequest(doctorCtx, "AR-2", "Allergy confirmed by patient interview")
+	})
+	assert.NoError(t, err)
+
+	// The doctor cannot file the patient's statement
+	err = inTx(stub, "tx9", func() error {
+		return s.FileStatementOfDisagreement(doctorCtx, "AR-2", "I have no such allergy")
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx10", func() error {
+		return s.FileStatementOfDisagreement(patientCtx, "AR-2", "I have no such allergy")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx11", func() error {
+		return s.RebutStatementOfDisagreement(doctorCtx, "AR-2", "Reaction documented in 2019 visit")
+	})
+	assert.NoError(t, err)
+
+	// Decided requests cannot be withdrawn
+	err = inTx(stub, "tx12", func() error {
+		return s.WithdrawAmendmentRequest(patientCtx, "AR-2")
+	})
+	assert.ErrorContains(t, err, "is REBUTTED")
+
+	request, err = s.GetAmendmentRequest(patientCtx, "AR-2")
+	assert.NoError(t, err)
+	assert.Equal(t, AmendmentRebutted, request.Status)
+	assert.Equal(t, "I have no such allergy", request.Disagreement)
+	assert.Equal(t, "Reaction documented in 2019 visit", request.Rebuttal)
+}
+
+// TestAmendmentRequestQueryAuthorization tests that request lists are limited to the patient,
+// the organization the requests are routed to and admins
+func TestAmendmentRequestQueryAuthorization(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newQueryContext(stub, patientIdentity("patient123"))
+	otherPatientCtx := newQueryContext(stub, patientIdentity("patient999"))
+	doctorCtx := newQueryContext(stub, doctorIdentity("doctor456"))
+	otherOrgCtx := newQueryContext(stub, newTestIdentity("doctor789", "ClinicMSP", map[string]string{"role": RoleDoctor}))
+	adminCtx := newQueryContext(stub, adminIdentity("admin1"))
+
+	err := grantWriteConsent(s, stub, "tx0", "patient123", "doctor456")
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(doctorCtx, "EHR-001", "patient123", testCID("original"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(doctorCtx, "EHR-001", "patient123", testCID("original"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.FileAmendmentRequest(patientCtx, "AR-1", "EHR-001", "Potassium should read 4.1", "")
+	})
+	assert.NoError(t, err)
+
+	// The organization's reviewers and admins list its requests
+	for _, ctx := range []*TransactionContext{doctorCtx, adminCtx} {
+		requests, err := s.QueryAmendmentRequestsByOrg(ctx, "HospitalMSP")
+		assert.NoError(t, err)
+		assert.Len(t, requests, 1)
+
+		_, err = s.QueryOverdueAmendmentRequests(ctx, "HospitalMSP")
+		assert.NoError(t, err)
+	}
+	for _, ctx := range []*TransactionContext{patientCtx, otherOrgCtx} {
+		_, err = s.QueryAmendmentRequestsByOrg(ctx, "HospitalMSP")
+		assert.ErrorIs(t, err, errUnauthorized)
+
+		_, err = s.QueryOverdueAmendmentRequests(ctx, "HospitalMSP")
+		assert.ErrorIs(t, err, errUnauthorized)
+	}
+
+	// Patients list their own requests only
+	for _, ctx := range []*TransactionContext{patientCtx, adminCtx} {
+		requests, err := s.QueryAmendmentRequestsByPatient(ctx, "patient123")
+		assert.NoError(t, err)
+		assert.Len(t, requests, 1)
+	}
+	for _, ctx := range []*TransactionContext{otherPatientCtx, doctorCtx} {
+		_, err = s.QueryAmendmentRequestsByPatient(ctx, "patient123")
+		assert.ErrorIs(t, err, errUnauthorized)
+	}
+}
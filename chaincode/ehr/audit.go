@@ -3,13 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
-	"github.com/google/uuid"
 )
 
-// CreateAuditLog creates an audit trail entry
+// CreateAuditLog creates an audit trail entry, linked into the global audit chain and the chain
+// of the patient it concerns. The patient is that of the committed record the entry names; the
+// contract's own entries name their patient, as their record may be written in the same
+// transaction and cannot be read back.
 func (s *SmartContract) CreateAuditLog(
 	ctx contractapi.TransactionContextInterface,
 	action string,
@@ -18,6 +19,31 @@ func (s *SmartContract) CreateAuditLog(
 	recordID string,
 	success bool,
 	message string,
+) error {
+	patientID := ""
+	if recordID != "" {
+		baseRecordID, _ := splitComponentRef(recordID)
+		metadata, err := s.lookupEHR(ctx, baseRecordID)
+		if err == nil && metadata != nil {
+			patientID = metadata.PatientID
+		}
+	}
+
+	return s.createAuditLog(ctx, action, actorID, targetID, recordID, patientID, success, message)
+}
+
+// createAuditLog creates an audit trail entry concerning a patient. Without a patient, an entry
+// of a patient acting concerns the patient themselves. The entry is derived from the transaction
+// alone, so every endorsing peer writes the same entry.
+func (s *SmartContract) createAuditLog(
+	ctx contractapi.TransactionContextInterface,
+	action string,
+	actorID string,
+	targetID string,
+	recordID string,
+	patientID string,
+	success bool,
+	message string,
 ) error {
 	// Get actor role
 	role, err := s.GetCallerRole(ctx)
@@ -25,37 +51,44 @@ func (s *SmartContract) CreateAuditLog(
 		role = "unknown"
 	}
 
-	// Generate unique log ID
-	logID := uuid.New().String()
+	if patientID == "" && role == RolePatient {
+		patientID = actorID
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
 
 	auditLog := AuditLog{
-		LogID:     logID,
 		Action:    action,
 		ActorID:   actorID,
 		ActorRole: role,
 		TargetID:  targetID,
 		RecordID:  recordID,
-		Timestamp: time.Now(),
+		PatientID: patientID,
+		Timestamp: now,
 		IPAddress: "", // Can be populated from client context
 		Success:   success,
 		Message:   message,
 	}
 
-	logJSON, err := json.Marshal(auditLog)
+	// Link to the audit chains, so removed or altered entries can be detected
+	compositeKey, err := s.chainAuditLog(ctx, &auditLog)
 	if err != nil {
-		return fmt.Errorf("failed to marshal audit log: %v", err)
+		return err
 	}
 
-	// Save to ledger with composite key
-	compositeKey, err := ctx.GetStub().CreateCompositeKey("audit", []string{action, actorID, logID})
+	logJSON, err := json.Marshal(auditLog)
 	if err != nil {
-		return fmt.Errorf("failed to create composite key: %v", err)
+		return fmt.Errorf("failed to marshal audit log: %v", err)
 	}
 
 	err = ctx.GetStub().PutState(compositeKey, logJSON)
 	if err != nil {
 		return fmt.Errorf("failed to put audit log: %v", err)
 	}
+	countAuditEntry(ctx)
 
 	return nil
 }
@@ -145,7 +178,7 @@ func (s *SmartContract) GetAllAuditLogs(
 	}
 
 	if role != RoleAdmin {
-		return nil, fmt.Errorf("unauthorized: only admin can retrieve all audit logs")
+		return nil, fmt.Errorf("%w: only admin can retrieve all audit logs", errUnauthorized)
 	}
 
 	// Query all audit logs
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ehr-blockchain/chaincode/auditchain"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	auditChainHeadObjectType = "auditChainHead"
+	auditSequenceObjectType  = "auditSequence"
+)
+
+// Audit chains: the global chain of every entry, and one chain per patient
+const (
+	auditChainGlobal  = "global"
+	auditChainPatient = "patient"
+)
+
+// maxAuditChainRange is the most entries VerifyAuditChain checks in one call
+const maxAuditChainRange = 1000
+
+// AuditChainHead is the last entry of an audit chain
+type AuditChainHead struct {
+	Sequence int    `json:"sequence"`
+	Hash     string `json:"hash"`
+}
+
+// AuditChainReport is the result of verifying a range of an audit chain
+type AuditChainReport struct {
+	PatientID    string             `json:"patientId,omitempty" metadata:",optional"` // Empty for the global chain
+	FromSequence int                `json:"fromSequence"`
+	ToSequence   int                `json:"toSequence"`
+	Head         AuditChainHead     `json:"head"`
+	Checked      int                `json:"checked"` // Entries found in the range
+	Valid        bool               `json:"valid"`
+	Breaks       []auditchain.Break `json:"breaks"`
+}
+
+// TransactionContext is the contract's transaction context. Fabric does not let a transaction
+// read its own writes, so it keeps the heads of the audit chains the transaction has extended
+// for the transaction's next entry. It also counts the transaction's writes and audit entries,
+// for requireAuditEntry.
+type TransactionContext struct {
+	contractapi.TransactionContext
+	tx *auditTransaction
+}
+
+// auditTransaction is what a context keeps about its current transaction
+type auditTransaction struct {
+	txID         string
+	heads        map[string]*AuditChainHead
+	writes       int
+	auditEntries int
+}
+
+// NewSmartContract returns the contract with its transaction context, and the check that every
+// transaction changing the ledger is audited
+func NewSmartContract() *SmartContract {
+	contract := new(SmartContract)
+	contract.TransactionContextHandler = new(TransactionContext)
+	contract.AfterTransaction = requireAuditEntry
+	return contract
+}
+
+// auditTransaction returns the context's state for the current transaction
+func (c *TransactionContext) auditTransaction() *auditTransaction {
+	// Contexts are created per transaction, but may be reused in tests
+	txID := c.GetStub().GetTxID()
+	if c.tx == nil || c.tx.txID != txID {
+		c.tx = &auditTransaction{txID: txID, heads: make(map[string]*AuditChainHead)}
+	}
+	return c.tx
+}
+
+// chainedAuditHeads returns the chain heads a transaction has extended, or nil when the
+// context cannot hold them
+func chainedAuditHeads(ctx contractapi.TransactionContextInterface) map[string]*AuditChainHead {
+	txCtx, ok := ctx.(*TransactionContext)
+	if !ok {
+		return nil
+	}
+	return txCtx.auditTransaction().heads
+}
+
+// chainAuditLog links an entry to the end of the global chain and, when it concerns a patient,
+// of the patient's chain, names it after the transaction and its position, and sets its hash. It
+// returns the key to store the entry under.
+//
+// Every audited transaction reads and moves the global head, so of two audited transactions
+// endorsed against the same head only the first to commit is valid; the other fails with
+// MVCC_READ_CONFLICT and must be resubmitted. The global chain thus bounds audited writes to
+// about one transaction per block.
+func (s *SmartContract) chainAuditLog(
+	ctx contractapi.TransactionContextInterface,
+	auditLog *AuditLog,
+) (string, error) {
+	global, err := s.auditChainHead(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	auditLog.Sequence = global.Sequence + 1
+	auditLog.PrevHash = global.Hash
+	auditLog.LogID = fmt.Sprintf("%s-%d", ctx.GetStub().GetTxID(), auditLog.Sequence)
+
+	var patient *AuditChainHead
+	if auditLog.PatientID != "" {
+		patient, err = s.auditChainHead(ctx, auditLog.PatientID)
+		if err != nil {
+			return "", err
+		}
+		auditLog.PatientSequence = patient.Sequence + 1
+		auditLog.PatientPrevHash = patient.Hash
+	}
+
+	auditLog.Hash = auditchain.Hash(auditChainEntry(auditLog))
+
+	logKey, err := ctx.GetStub().CreateCompositeKey("audit", []string{auditLog.Action, auditLog.ActorID, auditLog.LogID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = s.putAuditChainHead(ctx, "", &AuditChainHead{Sequence: auditLog.Sequence, Hash: auditLog.Hash}, logKey)
+	if err != nil {
+		return "", err
+	}
+	if patient != nil {
+		err = s.putAuditChainHead(ctx, auditLog.PatientID, &AuditChainHead{Sequence: auditLog.PatientSequence, Hash: auditLog.Hash}, logKey)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return logKey, nil
+}
+
+// auditChainHead returns the head of the global chain, or of a patient's chain. An empty chain
+// has a zero head.
+func (s *SmartContract) auditChainHead(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) (*AuditChainHead, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(auditChainHeadObjectType, auditChainAttributes(patientID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	heads := chainedAuditHeads(ctx)
+	if head, found := heads[key]; found {
+		return head, nil
+	}
+
+	headJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	head := &AuditChainHead{}
+	if headJSON != nil {
+		err = json.Unmarshal(headJSON, head)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal audit chain head: %v", err)
+		}
+	}
+
+	return head, nil
+}
+
+// putAuditChainHead moves a chain's head to a new entry and indexes the entry by its position
+func (s *SmartContract) putAuditChainHead(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	head *AuditChainHead,
+	logKey string,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(auditChainHeadObjectType, auditChainAttributes(patientID))
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	headJSON, err := json.Marshal(head)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit chain head: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, headJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put audit chain head: %v", err)
+	}
+
+	if heads := chainedAuditHeads(ctx); heads != nil {
+		heads[key] = head
+	}
+
+	sequenceKey, err := auditSequenceKey(ctx, patientID, head.Sequence)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().PutState(sequenceKey, []byte(logKey))
+	if err != nil {
+		return fmt.Errorf("failed to put audit sequence: %v", err)
+	}
+
+	return nil
+}
+
+// VerifyAuditChain checks a range of the global audit chain, or of a patient's chain, and reports
+// where entries were altered, removed or reordered. A toSequence of 0 checks as far towards the
+// head as one call may.
+func (s *SmartContract) VerifyAuditChain(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	fromSequence int,
+	toSequence int,
+) (*AuditChainReport, error) {
+	if patientID == "" {
+		err := s.RequireRole(ctx, RoleAdmin)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := s.RequirePatientOrAdmin(ctx, patientID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	head, err := s.auditChainHead(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if fromSequence < 1 {
+		fromSequence = 1
+	}
+	if toSequence == 0 {
+		toSequence = fromSequence + maxAuditChainRange - 1
+	}
+	if toSequence > head.Sequence {
+		toSequence = head.Sequence
+	}
+
+	var errs ValidationErrors
+	if toSequence-fromSequence+1 > maxAuditChainRange {
+		errs.add("toSequence", "must be at most %d entries after fromSequence", maxAuditChainRange)
+	}
+	if err := errs.errOrNil(); err != nil {
+		return nil, err
+	}
+
+	report := &AuditChainReport{
+		PatientID:    patientID,
+		FromSequence: fromSequence,
+		ToSequence:   toSequence,
+		Head:         *head,
+		Breaks:       []auditchain.Break{},
+	}
+	if toSequence < fromSequence {
+		report.Valid = true
+		return report, nil
+	}
+
+	// The entry before the range anchors its first link
+	prevHash := ""
+	if fromSequence > 1 {
+		previous, err := s.auditLogAt(ctx, patientID, fromSequence-1)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			prevHash = previous.Hash
+		}
+	}
+
+	entries := []*auditchain.Entry{}
+	for sequence := fromSequence; sequence <= toSequence; sequence++ {
+		auditLog, err := s.auditLogAt(ctx, patientID, sequence)
+		if err != nil {
+			return nil, err
+		}
+		if auditLog != nil {
+			entries = append(entries, auditChainEntry(auditLog))
+		}
+	}
+	report.Checked = len(entries)
+	report.Breaks = append(report.Breaks, auditchain.Verify(entries, patientID, fromSequence, toSequence, prevHash)...)
+
+	// The head must name the last entry, or entries after it were removed
+	if toSequence == head.Sequence && len(entries) > 0 && entries[len(entries)-1].Hash != head.Hash {
+		report.Breaks = append(report.Breaks, auditchain.Break{Sequence: head.Sequence, Reason: "chain head does not match the last entry"})
+	}
+
+	report.Valid = len(report.Breaks) == 0
+	return report, nil
+}
+
+// auditLogAt reads the entry at a position of a chain, or nil if there is none
+func (s *SmartContract) auditLogAt(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	sequence int,
+) (*AuditLog, error) {
+	sequenceKey, err := auditSequenceKey(ctx, patientID, sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	logKey, err := ctx.GetStub().GetState(sequenceKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if logKey == nil {
+		return nil, nil
+	}
+
+	logJSON, err := ctx.GetStub().GetState(string(logKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if logJSON == nil {
+		return nil, nil
+	}
+
+	var auditLog AuditLog
+	err = json.Unmarshal(logJSON, &auditLog)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal audit log: %v", err)
+	}
+
+	return &auditLog, nil
+}
+
+// auditSequenceKey is the key indexing the entry at a position of a chain. Positions are
+// zero-padded so the keys sort in chain order.
+func auditSequenceKey(ctx contractapi.TransactionContextInterface, patientID string, sequence int) (string, error) {
+	attributes := append(auditChainAttributes(patientID), fmt.Sprintf("%020d", sequence))
+	key, err := ctx.GetStub().CreateCompositeKey(auditSequenceObjectType, attributes)
+	if err != nil {
+		return "", fmt.Errorf("failed to create composite key: %v", err)
+	}
+	return key, nil
+}
+
+func auditChainAttributes(patientID string) []string {
+	if patientID == "" {
+		return []string{auditChainGlobal}
+	}
+	return []string{auditChainPatient, patientID}
+}
+
+// auditChainEntry converts an entry for the auditchain package
+func auditChainEntry(auditLog *AuditLog) *auditchain.Entry {
+	return &auditchain.Entry{
+		LogID:           auditLog.LogID,
+		Action:          auditLog.Action,
+		ActorID:         auditLog.ActorID,
+		ActorRole:       auditLog.ActorRole,
+		TargetID:        auditLog.TargetID,
+		RecordID:        auditLog.RecordID,
+		Timestamp:       auditLog.Timestamp,
+		IPAddress:       auditLog.IPAddress,
+		Success:         auditLog.Success,
+		Message:         auditLog.Message,
+		Sequence:        auditLog.Sequence,
+		PrevHash:        auditLog.PrevHash,
+		PatientID:       auditLog.PatientID,
+		PatientSequence: auditLog.PatientSequence,
+		PatientPrevHash: auditLog.PatientPrevHash,
+		Hash:            auditLog.Hash,
+	}
+}
@@ -0,0 +1,174 @@
+// Package auditchain verifies the hash chains that link audit log entries.
+//
+// Every entry is in the global chain, numbered from 1 by Sequence, and entries about a patient
+// are also in the patient's chain, numbered by PatientSequence. Each entry carries the hash of the
+// entry before it in each of its chains, and its own hash covers both links, so an entry that is
+// altered, removed or reordered breaks the chain at that point. The contract's VerifyAuditChain
+// and the auditverify command check chains the same way.
+//
+// Batches of the global chain are sealed with a Merkle root, so a single entry can be proven to
+// exist with VerifyProof without handing over the rest of the log.
+package auditchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// hashDomain separates entry hashes from other SHA-256 digests on the ledger
+const hashDomain = "medledger-audit-v1"
+
+// Entry is an audit log entry as returned by the contract's audit queries
+type Entry struct {
+	LogID           string    `json:"logId"`
+	Action          string    `json:"action"`
+	ActorID         string    `json:"actorId"`
+	ActorRole       string    `json:"actorRole"`
+	TargetID        string    `json:"targetId"`
+	RecordID        string    `json:"recordId"`
+	Timestamp       time.Time `json:"timestamp"`
+	IPAddress       string    `json:"ipAddress"`
+	Success         bool      `json:"success"`
+	Message         string    `json:"message"`
+	Sequence        int       `json:"sequence"`
+	PrevHash        string    `json:"prevHash"`
+	PatientID       string    `json:"patientId,omitempty"`
+	PatientSequence int       `json:"patientSequence,omitempty"`
+	PatientPrevHash string    `json:"patientPrevHash,omitempty"`
+	Hash            string    `json:"hash"`
+}
+
+// Break is a point where a chain does not hold
+type Break struct {
+	Sequence int    `json:"sequence"`
+	LogID    string `json:"logId,omitempty"`
+	Reason   string `json:"reason"`
+}
+
+// Hash returns the hex SHA-256 of an entry, over every field but the hash itself
+func Hash(entry *Entry) string {
+	// A JSON array keeps the encoding independent of field names and order
+	fields, err := json.Marshal([]interface{}{
+		hashDomain,
+		entry.LogID,
+		entry.Action,
+		entry.ActorID,
+		entry.ActorRole,
+		entry.TargetID,
+		entry.RecordID,
+		entry.Timestamp.UTC().Format(time.RFC3339Nano),
+		entry.IPAddress,
+		entry.Success,
+		entry.Message,
+		entry.Sequence,
+		entry.PrevHash,
+		entry.PatientID,
+		entry.PatientSequence,
+		entry.PatientPrevHash,
+	})
+	if err != nil {
+		// Strings, numbers and booleans always marshal
+		panic(err)
+	}
+
+	digest := sha256.Sum256(fields)
+	return hex.EncodeToString(digest[:])
+}
+
+// Link returns an entry's position in a chain and the hash of the entry before it. The global
+// chain has an empty patient ID. Entries outside the chain are at position 0.
+func Link(entry *Entry, patientID string) (int, string) {
+	if patientID == "" {
+		return entry.Sequence, entry.PrevHash
+	}
+	if entry.PatientID != patientID {
+		return 0, ""
+	}
+	return entry.PatientSequence, entry.PatientPrevHash
+}
+
+// Verify checks that entries form a chain running from position from to position to without
+// gaps. prevHash is the hash of the entry before from; it must be empty when from is 1, and is
+// not checked when empty otherwise. Entries outside the range are ignored.
+func Verify(entries []*Entry, patientID string, from int, to int, prevHash string) []Break {
+	breaks := []Break{}
+
+	inRange := []*Entry{}
+	for _, entry := range entries {
+		position, _ := Link(entry, patientID)
+		if position >= from && position <= to {
+			inRange = append(inRange, entry)
+		}
+	}
+	sort.SliceStable(inRange, func(i, j int) bool {
+		left, _ := Link(inRange[i], patientID)
+		right, _ := Link(inRange[j], patientID)
+		return left < right
+	})
+
+	expected := from
+	checkLink := prevHash != "" || from == 1
+	for _, entry := range inRange {
+		position, entryPrevHash := Link(entry, patientID)
+
+		switch {
+		case position < expected:
+			breaks = append(breaks, Break{Sequence: position, LogID: entry.LogID, Reason: "duplicate sequence number"})
+			continue
+		case position > expected:
+			breaks = append(breaks, Break{Sequence: expected, Reason: missingReason(expected, position-1)})
+			checkLink = false
+		}
+
+		hash := Hash(entry)
+		if hash != entry.Hash {
+			breaks = append(breaks, Break{Sequence: position, LogID: entry.LogID, Reason: "entry does not match its hash"})
+		}
+		if checkLink && entryPrevHash != prevHash {
+			breaks = append(breaks, Break{Sequence: position, LogID: entry.LogID, Reason: "previous hash does not match the entry before"})
+		}
+
+		prevHash = entry.Hash
+		checkLink = true
+		expected = position + 1
+	}
+
+	if expected <= to {
+		breaks = append(breaks, Break{Sequence: expected, Reason: missingReason(expected, to)})
+	}
+
+	return breaks
+}
+
+// VerifyAll checks a whole exported chain, from its first entry in the export to its last. An
+// export that starts past position 1 is checked from its first entry on.
+func VerifyAll(entries []*Entry, patientID string) (from int, to int, breaks []Break) {
+	for _, entry := range entries {
+		position, _ := Link(entry, patientID)
+		if position == 0 {
+			continue
+		}
+		if from == 0 || position < from {
+			from = position
+		}
+		if position > to {
+			to = position
+		}
+	}
+	if from == 0 {
+		return 0, 0, []Break{}
+	}
+
+	return from, to, Verify(entries, patientID, from, to, "")
+}
+
+func missingReason(from int, to int) string {
+	if from == to {
+		return "entry is missing"
+	}
+	return fmt.Sprintf("entries %d to %d are missing", from, to)
+}
@@ -0,0 +1,111 @@
+package auditchain
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// chain builds a global chain of n entries, every other one about patient123
+func chain(n int) []*Entry {
+	entries := []*Entry{}
+	prevHash, patientPrevHash, patientSequence := "", "", 0
+	for i := 1; i <= n; i++ {
+		entry := &Entry{
+			LogID:     fmt.Sprintf("log-%d", i),
+			Action:    "READ_EHR",
+			ActorID:   "doctor456",
+			Timestamp: time.Date(2026, 1, 1, 0, 0, i, 0, time.UTC),
+			Success:   true,
+			Sequence:  i,
+			PrevHash:  prevHash,
+		}
+		if i%2 == 1 {
+			patientSequence++
+			entry.PatientID = "patient123"
+			entry.PatientSequence = patientSequence
+			entry.PatientPrevHash = patientPrevHash
+		}
+		entry.Hash = Hash(entry)
+
+		prevHash = entry.Hash
+		if entry.PatientID != "" {
+			patientPrevHash = entry.Hash
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// TestVerify tests that intact chains verify in any order and that edits, removals and
+// reordering are reported where they happen
+func TestVerify(t *testing.T) {
+	entries := chain(6)
+	assert.Empty(t, Verify(entries, "", 1, 6, ""))
+	assert.Empty(t, Verify(entries, "patient123", 1, 3, ""))
+
+	shuffled := []*Entry{entries[3], entries[0], entries[5], entries[1], entries[4], entries[2]}
+	assert.Empty(t, Verify(shuffled, "", 1, 6, ""))
+
+	// A range is anchored by the hash before it
+	assert.Empty(t, Verify(entries, "", 3, 6, entries[1].Hash))
+	breaks := Verify(entries, "", 3, 6, entries[0].Hash)
+	if assert.Len(t, breaks, 1) {
+		assert.Equal(t, Break{Sequence: 3, LogID: "log-3", Reason: "previous hash does not match the entry before"}, breaks[0])
+	}
+
+	// Edited entries no longer match their hash
+	edited := *entries[2]
+	edited.Success = false
+	breaks = Verify([]*Entry{entries[0], entries[1], &edited, entries[3]}, "", 1, 4, "")
+	if assert.Len(t, breaks, 1) {
+		assert.Equal(t, Break{Sequence: 3, LogID: "log-3", Reason: "entry does not match its hash"}, breaks[0])
+	}
+
+	// Rehashing an edited entry breaks the link from the next one
+	edited.Hash = Hash(&edited)
+	breaks = Verify([]*Entry{entries[0], entries[1], &edited, entries[3]}, "", 1, 4, "")
+	if assert.Len(t, breaks, 1) {
+		assert.Equal(t, 4, breaks[0].Sequence)
+	}
+
+	// Removed entries leave gaps, in the patient's chain too
+	breaks = Verify([]*Entry{entries[0], entries[1], entries[3], entries[4], entries[5]}, "", 1, 6, "")
+	if assert.Len(t, breaks, 1) {
+		assert.Equal(t, Break{Sequence: 3, Reason: "entry is missing"}, breaks[0])
+	}
+	breaks = Verify([]*Entry{entries[0], entries[4]}, "patient123", 1, 3, "")
+	if assert.Len(t, breaks, 1) {
+		assert.Equal(t, Break{Sequence: 2, Reason: "entry is missing"}, breaks[0])
+	}
+	breaks = Verify(entries[:2], "", 1, 6, "")
+	if assert.Len(t, breaks, 1) {
+		assert.Equal(t, "entries 3 to 6 are missing", breaks[0].Reason)
+	}
+
+	// Renumbered entries collide with the originals
+	renumbered := *entries[3]
+	renumbered.Sequence = 3
+	breaks = Verify(append([]*Entry{&renumbered}, entries...), "", 1, 6, "")
+	assert.NotEmpty(t, breaks)
+}
+
+// TestVerifyAll tests that exports are checked from their first entry
+func TestVerifyAll(t *testing.T) {
+	entries := chain(5)
+
+	from, to, breaks := VerifyAll(entries[2:], "")
+	assert.Equal(t, 3, from)
+	assert.Equal(t, 5, to)
+	assert.Empty(t, breaks)
+
+	from, to, breaks = VerifyAll(entries, "patient123")
+	assert.Equal(t, 1, from)
+	assert.Equal(t, 3, to)
+	assert.Empty(t, breaks)
+
+	from, _, _ = VerifyAll(entries, "patient789")
+	assert.Equal(t, 0, from)
+}
@@ -0,0 +1,167 @@
+package auditchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Merkle trees over batches of entries follow RFC 6962: leaves and inner nodes are hashed with
+// distinct prefixes, and a tree of n leaves splits at the largest power of two below n.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// Proof shows that an entry is in a sealed batch of the global chain. The batch runs from
+// FromSequence to ToSequence and the entry is leaf Sequence - FromSequence of its tree.
+type Proof struct {
+	LogID        string    `json:"logId"`
+	Sequence     int       `json:"sequence"`
+	EntryHash    string    `json:"entryHash"`
+	SealNumber   int       `json:"sealNumber"`
+	FromSequence int       `json:"fromSequence"`
+	ToSequence   int       `json:"toSequence"`
+	SealedAt     time.Time `json:"sealedAt"`
+	Root         string    `json:"root"`
+	Path         []string  `json:"path"` // Sibling hashes from the leaf up
+}
+
+// MerkleRoot returns the root of the tree over entries' hashes, in chain order
+func MerkleRoot(entryHashes []string) (string, error) {
+	leaves, err := leafHashes(entryHashes)
+	if err != nil {
+		return "", err
+	}
+	if len(leaves) == 0 {
+		return "", fmt.Errorf("a batch needs at least one entry")
+	}
+	return hex.EncodeToString(treeHash(leaves)), nil
+}
+
+// InclusionPath returns the audit path of the entry at index in the tree over entries' hashes
+func InclusionPath(entryHashes []string, index int) ([]string, error) {
+	leaves, err := leafHashes(entryHashes)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= len(leaves) {
+		return nil, fmt.Errorf("index %d is outside a batch of %d entries", index, len(leaves))
+	}
+
+	path := []string{}
+	for _, node := range auditPath(leaves, index) {
+		path = append(path, hex.EncodeToString(node))
+	}
+	return path, nil
+}
+
+// VerifyInclusion checks that the entry hash is leaf index of a tree of size leaves with the
+// given root
+func VerifyInclusion(entryHash string, index int, size int, path []string, root string) error {
+	if index < 0 || index >= size {
+		return fmt.Errorf("index %d is outside a batch of %d entries", index, size)
+	}
+
+	leaves, err := leafHashes([]string{entryHash})
+	if err != nil {
+		return err
+	}
+
+	// RFC 9162, section 2.1.3.2
+	node := leaves[0]
+	fn, sn := index, size-1
+	for _, siblingHex := range path {
+		sibling, err := hex.DecodeString(siblingHex)
+		if err != nil || len(sibling) != sha256.Size {
+			return fmt.Errorf("path hash %q is not a hex SHA-256", siblingHex)
+		}
+		if sn == 0 {
+			return fmt.Errorf("path is longer than a batch of %d entries needs", size)
+		}
+
+		if fn%2 == 1 || fn == sn {
+			node = nodeHash(sibling, node)
+			for fn%2 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			node = nodeHash(node, sibling)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return fmt.Errorf("path is shorter than a batch of %d entries needs", size)
+	}
+	if hex.EncodeToString(node) != root {
+		return fmt.Errorf("path does not lead to root %s", root)
+	}
+	return nil
+}
+
+// VerifyProof checks that an entry, as handed over, is the one a proof is for and that the proof
+// leads to a root sealed on the ledger. The root must come from the ledger (GetAuditSeal), not
+// from the proof.
+func VerifyProof(entry *Entry, proof *Proof, sealedRoot string) error {
+	if entry.LogID != proof.LogID || entry.Sequence != proof.Sequence {
+		return fmt.Errorf("proof is for entry %s at %d, not %s at %d", proof.LogID, proof.Sequence, entry.LogID, entry.Sequence)
+	}
+	if Hash(entry) != proof.EntryHash {
+		return fmt.Errorf("entry %s does not match the hash in the proof", entry.LogID)
+	}
+	if proof.Root != sealedRoot {
+		return fmt.Errorf("proof is for root %s, not the sealed root %s", proof.Root, sealedRoot)
+	}
+
+	return VerifyInclusion(proof.EntryHash, proof.Sequence-proof.FromSequence, proof.ToSequence-proof.FromSequence+1, proof.Path, sealedRoot)
+}
+
+func leafHashes(entryHashes []string) ([][]byte, error) {
+	leaves := make([][]byte, len(entryHashes))
+	for i, entryHash := range entryHashes {
+		value, err := hex.DecodeString(entryHash)
+		if err != nil || len(value) != sha256.Size {
+			return nil, fmt.Errorf("entry hash %q is not a hex SHA-256", entryHash)
+		}
+		digest := sha256.Sum256(append([]byte{leafPrefix}, value...))
+		leaves[i] = digest[:]
+	}
+	return leaves, nil
+}
+
+func nodeHash(left []byte, right []byte) []byte {
+	digest := sha256.Sum256(append(append([]byte{nodePrefix}, left...), right...))
+	return digest[:]
+}
+
+// split is the largest power of two below n, for n > 1
+func split(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+func treeHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	return nodeHash(treeHash(leaves[:k]), treeHash(leaves[k:]))
+}
+
+func auditPath(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := split(len(leaves))
+	if index < k {
+		return append(auditPath(leaves[:k], index), treeHash(leaves[k:]))
+	}
+	return append(auditPath(leaves[k:], index-k), treeHash(leaves[:k]))
+}
@@ -0,0 +1,80 @@
+package auditchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEntryHashes(n int) []string {
+	hashes := []string{}
+	for i := 0; i < n; i++ {
+		digest := sha256.Sum256([]byte(fmt.Sprintf("entry-%d", i)))
+		hashes = append(hashes, hex.EncodeToString(digest[:]))
+	}
+	return hashes
+}
+
+// TestInclusion tests that every leaf of trees of every shape up to 17 leaves proves against
+// the root, and only at its own index
+func TestInclusion(t *testing.T) {
+	for size := 1; size <= 17; size++ {
+		hashes := testEntryHashes(size)
+		root, err := MerkleRoot(hashes)
+		assert.NoError(t, err)
+
+		for index := 0; index < size; index++ {
+			path, err := InclusionPath(hashes, index)
+			assert.NoError(t, err)
+			assert.NoError(t, VerifyInclusion(hashes[index], index, size, path, root), "size %d index %d", size, index)
+
+			if size > 1 {
+				other := (index + 1) % size
+				assert.Error(t, VerifyInclusion(hashes[other], index, size, path, root), "size %d index %d", size, index)
+				assert.Error(t, VerifyInclusion(hashes[index], other, size, path, root), "size %d index %d", size, index)
+			}
+		}
+	}
+
+	// Leaves and inner nodes are hashed apart, so two leaves do not pass for their parent
+	hashes := testEntryHashes(4)
+	root, err := MerkleRoot(hashes)
+	assert.NoError(t, err)
+	path, err := InclusionPath(hashes, 0)
+	assert.NoError(t, err)
+	assert.Error(t, VerifyInclusion(path[0], 0, 2, path[1:], root))
+
+	_, err = MerkleRoot([]string{})
+	assert.Error(t, err)
+	_, err = InclusionPath(hashes, 4)
+	assert.ErrorContains(t, err, "outside a batch")
+}
+
+// TestVerifyProof tests that proofs hold for the entry they were made for and the root sealed
+func TestVerifyProof(t *testing.T) {
+	entries := chain(5)
+	hashes := []string{}
+	for _, entry := range entries {
+		hashes = append(hashes, entry.Hash)
+	}
+	root, err := MerkleRoot(hashes)
+	assert.NoError(t, err)
+	path, err := InclusionPath(hashes, 2)
+	assert.NoError(t, err)
+
+	proof := &Proof{LogID: "log-3", Sequence: 3, EntryHash: entries[2].Hash, SealNumber: 1, FromSequence: 1, ToSequence: 5, Root: root, Path: path}
+	assert.NoError(t, VerifyProof(entries[2], proof, root))
+
+	assert.ErrorContains(t, VerifyProof(entries[1], proof, root), "proof is for entry log-3")
+
+	edited := *entries[2]
+	edited.Message = "nothing happened"
+	assert.ErrorContains(t, VerifyProof(&edited, proof, root), "does not match the hash in the proof")
+
+	other, err := MerkleRoot(hashes[:4])
+	assert.NoError(t, err)
+	assert.ErrorContains(t, VerifyProof(entries[2], proof, other), "not the sealed root")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ehr-blockchain/chaincode/auditchain"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// committedStateStub reads the state as it was before the transaction, like a Fabric peer, which
+// does not let a transaction read its own writes
+type committedStateStub struct {
+	*shimtest.MockStub
+	committed map[string][]byte
+}
+
+func (s *committedStateStub) GetState(key string) ([]byte, error) {
+	return s.committed[key], nil
+}
+
+// exportAuditLogs returns every audit log as an offline export
+func exportAuditLogs(t *testing.T, s *SmartContract, stub *shimtest.MockStub) []*auditchain.Entry {
+	logs, err := s.GetAllAuditLogs(newTestContext(stub, adminIdentity("admin1")))
+	assert.NoError(t, err)
+	exportJSON, err := json.Marshal(logs)
+	assert.NoError(t, err)
+
+	var entries []*auditchain.Entry
+	assert.NoError(t, json.Unmarshal(exportJSON, &entries))
+	return entries
+}
+
+// TestAuditChain tests that audit entries are chained globally and per patient, and that
+// altered and removed entries are reported by VerifyAuditChain and the offline verifier
+func TestAuditChain(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	otherPatientCtx := newTestContext(stub, patientIdentity("patient789"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+	keyID, err := registerEncryptionKey(s, stub, "tx2", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+	err = inTxWithTransient(stub, "tx3", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor456", "*"), "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+	err = inTx(stub, "tx4", func() error {
+		_, err := s.GetMyRecordKey(doctorCtx, "EHR-001")
+		return err
+	})
+	assert.NoError(t, err)
+	err = inTx(stub, "tx5", func() error {
+		return s.CreateEHRMetadata(otherPatientCtx, "EHR-002", "patient789", testCID("EHR-002"), "patient key", "Lab Report", testChecksum("EHR-002"),
+			testSignature(otherPatientCtx, "EHR-002", "patient789", testCID("EHR-002"), testChecksum("EHR-002"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	report, err := s.VerifyAuditChain(adminCtx, "", 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 5, report.Head.Sequence)
+	assert.Equal(t, 5, report.Checked)
+
+	// The doctor's key retrieval is in the patient's chain, the key registration is not
+	report, err = s.VerifyAuditChain(patientCtx, "patient123", 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 3, report.Checked)
+
+	_, err = s.VerifyAuditChain(patientCtx, "", 0, 0)
+	assert.ErrorContains(t, err, "requires role admin")
+	_, err = s.VerifyAuditChain(otherPatientCtx, "patient123", 0, 0)
+	assert.Error(t, err)
+
+	_, _, breaks := auditchain.VerifyAll(exportAuditLogs(t, s, stub), "")
+	assert.Empty(t, breaks)
+
+	// Entries written in one transaction chain on each other
+	committed := make(map[string][]byte)
+	for key, value := range stub.State {
+		committed[key] = value
+	}
+	txCtx := new(TransactionContext)
+	txCtx.SetStub(&committedStateStub{stub, committed})
+	txCtx.SetClientIdentity(adminIdentity("admin1"))
+	err = inTx(stub, "tx6", func() error {
+		err := s.CreateAuditLog(txCtx, ActionGetRecordKey, "admin1", "patient123", "EHR-001", true, "First")
+		if err != nil {
+			return err
+		}
+		return s.CreateAuditLog(txCtx, ActionGetRecordKey, "admin1", "patient123", "EHR-001", true, "Second")
+	})
+	assert.NoError(t, err)
+
+	report, err = s.VerifyAuditChain(adminCtx, "", 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 7, report.Head.Sequence)
+
+	// An entry altered in the world state no longer matches its hash
+	tampered, err := s.auditLogAt(adminCtx, "patient123", 3)
+	assert.NoError(t, err)
+	logKey := string(stub.State[mustAuditSequenceKey(t, stub, "patient123", 3)])
+	tampered.Success = false
+	tamperedJSON, err := json.Marshal(tampered)
+	assert.NoError(t, err)
+	stub.State[logKey] = tamperedJSON
+
+	report, err = s.VerifyAuditChain(patientCtx, "patient123", 0, 0)
+	assert.NoError(t, err)
+	assert.False(t, report.Valid)
+	if assert.Len(t, report.Breaks, 1) {
+		assert.Equal(t, auditchain.Break{Sequence: 3, LogID: tampered.LogID, Reason: "entry does not match its hash"}, report.Breaks[0])
+	}
+
+	// Removing an entry leaves a gap in both chains, and the offline verifier finds it too
+	removed, err := s.auditLogAt(adminCtx, "", 3)
+	assert.NoError(t, err)
+	assert.NoError(t, inTx(stub, "tamper1", func() error {
+		return stub.DelState(string(stub.State[mustAuditSequenceKey(t, stub, "", 3)]))
+	}))
+
+	report, err = s.VerifyAuditChain(adminCtx, "", 2, 0)
+	assert.NoError(t, err)
+	assert.False(t, report.Valid)
+	assert.Equal(t, 5, report.Checked)
+	assert.Contains(t, report.Breaks, auditchain.Break{Sequence: 3, Reason: "entry is missing"})
+	assert.Contains(t, report.Breaks, auditchain.Break{Sequence: 4, LogID: tampered.LogID, Reason: "entry does not match its hash"})
+
+	_, _, breaks = auditchain.VerifyAll(exportAuditLogs(t, s, stub), "")
+	assert.Contains(t, breaks, auditchain.Break{Sequence: removed.Sequence, Reason: "entry is missing"})
+	_, _, breaks = auditchain.VerifyAll(exportAuditLogs(t, s, stub), "patient123")
+	assert.Contains(t, breaks, auditchain.Break{Sequence: removed.PatientSequence, Reason: "entry is missing"})
+
+	// Removing the last entry leaves the head pointing past the chain
+	assert.NoError(t, inTx(stub, "tamper2", func() error {
+		return stub.DelState(string(stub.State[mustAuditSequenceKey(t, stub, "", 7)]))
+	}))
+	report, err = s.VerifyAuditChain(adminCtx, "", 4, 0)
+	assert.NoError(t, err)
+	assert.Contains(t, report.Breaks, auditchain.Break{Sequence: 7, Reason: "entry is missing"})
+}
+
+// TestAuditChainOfNewRecord tests that the entry of a record created by a doctor lands in the
+// patient's chain, although the record cannot be read back in its own transaction
+func TestAuditChainOfNewRecord(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := grantWriteConsent(s, stub, "tx1", "patient123", "doctor456")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	committed := make(map[string][]byte)
+	for key, value := range stub.State {
+		committed[key] = value
+	}
+	txCtx := new(TransactionContext)
+	txCtx.SetStub(&committedStateStub{stub, committed})
+	txCtx.SetClientIdentity(doctorIdentity("doctor456"))
+	err = inTx(stub, "tx2", func() error {
+		return s.CreateEHRMetadata(txCtx, "EHR-001", "patient123", testCID("EHR-001"), "key1", "Lab Report", testChecksum("EHR-001"),
+			testSignature(doctorCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	head, err := s.auditChainHead(patientCtx, "patient123")
+	assert.NoError(t, err)
+	created, err := s.auditLogAt(patientCtx, "patient123", head.Sequence)
+	assert.NoError(t, err)
+	if assert.NotNil(t, created) {
+		assert.Equal(t, ActionCreateEHR, created.Action)
+		assert.Equal(t, "doctor456", created.ActorID)
+		assert.Equal(t, "patient123", created.PatientID)
+	}
+}
+
+// TestAuditEntryIsDeterministic tests that every peer endorsing a transaction writes the same
+// entry, named after the transaction and stamped with its time
+func TestAuditEntryIsDeterministic(t *testing.T) {
+	s := new(SmartContract)
+	txTimestamp := timestamppb.New(time.Now().Truncate(time.Second))
+
+	endorse := func() *AuditLog {
+		stub := newTestStub()
+		patientCtx := newTestContext(stub, patientIdentity("patient123"))
+		err := inTx(stub, "tx1", func() error {
+			stub.TxTimestamp = txTimestamp
+			return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "key1", "Lab Report", testChecksum("EHR-001"),
+				testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+		})
+		assert.NoError(t, err)
+
+		auditLog, err := s.auditLogAt(patientCtx, "", 1)
+		assert.NoError(t, err)
+		if !assert.NotNil(t, auditLog) {
+			t.FailNow()
+		}
+		return auditLog
+	}
+
+	first := endorse()
+	second := endorse()
+	assert.Equal(t, "tx1-1", first.LogID)
+	assert.True(t, txTimestamp.AsTime().Equal(first.Timestamp))
+	assert.Equal(t, first.LogID, second.LogID)
+	assert.True(t, first.Timestamp.Equal(second.Timestamp))
+	assert.Equal(t, first.Hash, second.Hash)
+}
+
+func mustAuditSequenceKey(t *testing.T, stub *shimtest.MockStub, patientID string, sequence int) string {
+	key, err := auditSequenceKey(newTestContext(stub, adminIdentity("admin1")), patientID, sequence)
+	assert.NoError(t, err)
+	return key
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ehr-blockchain/chaincode/auditchain"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// EventAuditBatchSealed is emitted with the AuditSeal, for anchoring roots outside the ledger
+const EventAuditBatchSealed = "AuditBatchSealed"
+
+const (
+	auditSealObjectType = "auditSeal"
+	configAuditSealKey  = "lastAuditSeal"
+)
+
+// AuditSeal is the Merkle root over a batch of the global audit chain
+type AuditSeal struct {
+	SealNumber   int       `json:"sealNumber"`
+	FromSequence int       `json:"fromSequence"`
+	ToSequence   int       `json:"toSequence"`
+	Root         string    `json:"root"`
+	SealedBy     string    `json:"sealedBy"`
+	SealedAt     time.Time `json:"sealedAt"` // Transaction timestamp
+	TxID         string    `json:"txId"`
+}
+
+// SealAuditBatch computes the Merkle root over the entries of the global audit chain since the
+// last seal and stores it. Batches hold up to 1000 entries; a longer backlog is sealed over
+// several calls. The batch must verify as an intact chain.
+func (s *SmartContract) SealAuditBatch(
+	ctx contractapi.TransactionContextInterface,
+) (*AuditSeal, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := s.lastAuditSeal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := s.auditChainHead(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if head.Sequence <= last.ToSequence {
+		return nil, fmt.Errorf("no audit entries since seal %d", last.SealNumber)
+	}
+
+	fromSequence := last.ToSequence + 1
+	toSequence := head.Sequence
+	if toSequence-fromSequence+1 > maxAuditChainRange {
+		toSequence = fromSequence + maxAuditChainRange - 1
+	}
+
+	entryHashes, err := s.auditBatchHashes(ctx, fromSequence, toSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := auditchain.MerkleRoot(entryHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	seal := &AuditSeal{
+		SealNumber:   last.SealNumber + 1,
+		FromSequence: fromSequence,
+		ToSequence:   toSequence,
+		Root:         root,
+		SealedBy:     callerID,
+		SealedAt:     txTimestamp.AsTime(),
+		TxID:         ctx.GetStub().GetTxID(),
+	}
+
+	err = s.putStateEntity(ctx, auditSealObjectType, auditSealID(seal.SealNumber), seal)
+	if err != nil {
+		return nil, err
+	}
+	err = s.putStateEntity(ctx, configObjectType, configAuditSealKey, seal)
+	if err != nil {
+		return nil, err
+	}
+
+	sealJSON, err := json.Marshal(seal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %v", err)
+	}
+	err = ctx.GetStub().SetEvent(EventAuditBatchSealed, sealJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionSealAuditBatch, callerID, "", "", "", true,
+		fmt.Sprintf("Audit entries %d to %d sealed as seal %d with root %s", fromSequence, toSequence, seal.SealNumber, root))
+	if err != nil {
+		return nil, err
+	}
+
+	return seal, nil
+}
+
+// GetAuditSeal returns a seal by its number; 0 returns the latest
+func (s *SmartContract) GetAuditSeal(
+	ctx contractapi.TransactionContextInterface,
+	sealNumber int,
+) (*AuditSeal, error) {
+	if sealNumber == 0 {
+		last, err := s.lastAuditSeal(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if last.SealNumber == 0 {
+			return nil, fmt.Errorf("no audit batch has been sealed")
+		}
+		return last, nil
+	}
+
+	return s.readAuditSeal(ctx, sealNumber)
+}
+
+// GetAuditInclusionProof returns the proof that an audit entry is in its sealed batch, for
+// auditchain.VerifyProof. The entry must have been sealed.
+func (s *SmartContract) GetAuditInclusionProof(
+	ctx contractapi.TransactionContextInterface,
+	logID string,
+) (*auditchain.Proof, error) {
+	auditLog, err := s.auditLogByID(ctx, logID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Patients may prove entries of their own chain
+	role, err := s.GetCallerRole(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller role: %v", err)
+	}
+	if role != RoleAdmin {
+		err = s.RequirePatientOrAdmin(ctx, auditLog.PatientID)
+		if err != nil || auditLog.PatientID == "" {
+			return nil, fmt.Errorf("%w: only admin or the patient can prove audit entry %s", errUnauthorized, logID)
+		}
+	}
+
+	if auditLog.Sequence == 0 {
+		return nil, fmt.Errorf("audit entry %s predates the audit chain", logID)
+	}
+
+	seal, err := s.auditSealCovering(ctx, auditLog.Sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	entryHashes, err := s.auditBatchHashes(ctx, seal.FromSequence, seal.ToSequence)
+	if err != nil {
+		return nil, fmt.Errorf("audit batch of seal %d can no longer be proven: %v", seal.SealNumber, err)
+	}
+
+	// Entries altered since sealing no longer lead to the root
+	root, err := auditchain.MerkleRoot(entryHashes)
+	if err != nil {
+		return nil, err
+	}
+	if root != seal.Root {
+		return nil, fmt.Errorf("audit batch of seal %d no longer matches its sealed root", seal.SealNumber)
+	}
+
+	index := auditLog.Sequence - seal.FromSequence
+	if entryHashes[index] != auditchain.Hash(auditChainEntry(auditLog)) {
+		return nil, fmt.Errorf("audit entry %s does not match its hash", logID)
+	}
+
+	path, err := auditchain.InclusionPath(entryHashes, index)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditchain.Proof{
+		LogID:        logID,
+		Sequence:     auditLog.Sequence,
+		EntryHash:    entryHashes[index],
+		SealNumber:   seal.SealNumber,
+		FromSequence: seal.FromSequence,
+		ToSequence:   seal.ToSequence,
+		SealedAt:     seal.SealedAt,
+		Root:         seal.Root,
+		Path:         path,
+	}, nil
+}
+
+// auditBatchHashes returns the hashes of a range of the global chain, after checking that the
+// range is an intact chain
+func (s *SmartContract) auditBatchHashes(
+	ctx contractapi.TransactionContextInterface,
+	fromSequence int,
+	toSequence int,
+) ([]string, error) {
+	prevHash := ""
+	if fromSequence > 1 {
+		previous, err := s.auditLogAt(ctx, "", fromSequence-1)
+		if err != nil {
+			return nil, err
+		}
+		if previous != nil {
+			prevHash = previous.Hash
+		}
+	}
+
+	entries := []*auditchain.Entry{}
+	for sequence := fromSequence; sequence <= toSequence; sequence++ {
+		auditLog, err := s.auditLogAt(ctx, "", sequence)
+		if err != nil {
+			return nil, err
+		}
+		if auditLog != nil {
+			entries = append(entries, auditChainEntry(auditLog))
+		}
+	}
+
+	breaks := auditchain.Verify(entries, "", fromSequence, toSequence, prevHash)
+	if len(breaks) > 0 {
+		return nil, fmt.Errorf("audit chain is broken at %d: %s", breaks[0].Sequence, breaks[0].Reason)
+	}
+
+	entryHashes := []string{}
+	for _, entry := range entries {
+		entryHashes = append(entryHashes, entry.Hash)
+	}
+	return entryHashes, nil
+}
+
+// auditSealCovering finds the seal of the batch holding a position of the global chain by
+// binary search over the seals
+func (s *SmartContract) auditSealCovering(
+	ctx contractapi.TransactionContextInterface,
+	sequence int,
+) (*AuditSeal, error) {
+	last, err := s.lastAuditSeal(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sequence > last.ToSequence {
+		return nil, fmt.Errorf("audit entry %d is not sealed yet, entries are sealed up to %d", sequence, last.ToSequence)
+	}
+
+	low, high := 1, last.SealNumber
+	for low <= high {
+		middle := (low + high) / 2
+		seal, err := s.readAuditSeal(ctx, middle)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case sequence < seal.FromSequence:
+			high = middle - 1
+		case sequence > seal.ToSequence:
+			low = middle + 1
+		default:
+			return seal, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no seal covers audit entry %d", sequence)
+}
+
+// lastAuditSeal returns the latest seal, or a zero seal before the first
+func (s *SmartContract) lastAuditSeal(ctx contractapi.TransactionContextInterface) (*AuditSeal, error) {
+	var seal AuditSeal
+	_, err := s.readStateEntity(ctx, configObjectType, configAuditSealKey, &seal)
+	if err != nil {
+		return nil, err
+	}
+	return &seal, nil
+}
+
+func (s *SmartContract) readAuditSeal(
+	ctx contractapi.TransactionContextInterface,
+	sealNumber int,
+) (*AuditSeal, error) {
+	var seal AuditSeal
+	found, err := s.readStateEntity(ctx, auditSealObjectType, auditSealID(sealNumber), &seal)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("audit seal %d %w", sealNumber, errNotFound)
+	}
+	return &seal, nil
+}
+
+// auditLogByID finds an audit entry by its log ID
+func (s *SmartContract) auditLogByID(
+	ctx contractapi.TransactionContextInterface,
+	logID string,
+) (*AuditLog, error) {
+	queryJSON, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"logId": logID},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	logs, err := s.getAuditQueryResult(ctx, string(queryJSON))
+	if err != nil {
+		return nil, err
+	}
+	if len(logs) == 0 {
+		return nil, fmt.Errorf("audit entry %s %w", logID, errNotFound)
+	}
+
+	return logs[0], nil
+}
+
+// auditSealID zero-pads seal numbers so seals sort in order
+func auditSealID(sealNumber int) string {
+	return fmt.Sprintf("%010d", sealNumber)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ehr-blockchain/chaincode/auditchain"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAuditSeal tests that sealed audit entries can be proven one at a time against the sealed
+// root, and that altered entries cannot
+func TestAuditSeal(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newQueryContext(stub, patientIdentity("patient123"))
+	otherPatientCtx := newQueryContext(stub, patientIdentity("patient789"))
+	adminCtx := newQueryContext(stub, adminIdentity("admin1"))
+
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.SealAuditBatch(adminCtx)
+		return err
+	})
+	assert.ErrorContains(t, err, "no audit entries since seal 0")
+
+	for i, recordID := range []string{"EHR-001", "EHR-002", "EHR-003"} {
+		err = inTx(stub, "tx-create-"+string(rune('a'+i)), func() error {
+			return s.CreateEHRMetadata(patientCtx, recordID, "patient123", testCID(recordID), "patient key", "Lab Report", testChecksum(recordID),
+				testSignature(patientCtx, recordID, "patient123", testCID(recordID), testChecksum(recordID), "Lab Report"))
+		})
+		assert.NoError(t, err)
+	}
+
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.SealAuditBatch(patientCtx)
+		return err
+	})
+	assert.ErrorContains(t, err, "requires role admin")
+
+	var seal *AuditSeal
+	err = inTx(stub, "tx3", func() error {
+		var err error
+		seal, err = s.SealAuditBatch(adminCtx)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, seal.SealNumber)
+	assert.Equal(t, 1, seal.FromSequence)
+	assert.Equal(t, 3, seal.ToSequence)
+	assert.Equal(t, "tx3", seal.TxID)
+
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventAuditBatchSealed, event.EventName)
+
+	// The seal is audited and goes into the next batch
+	err = inTx(stub, "tx4", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-004", "patient123", testCID("EHR-004"), "patient key", "Lab Report", testChecksum("EHR-004"),
+			testSignature(patientCtx, "EHR-004", "patient123", testCID("EHR-004"), testChecksum("EHR-004"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	unsealed, err := s.auditLogAt(adminCtx, "", 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "EHR-004", unsealed.RecordID)
+	_, err = s.GetAuditInclusionProof(adminCtx, unsealed.LogID)
+	assert.ErrorContains(t, err, "is not sealed yet")
+
+	var second *AuditSeal
+	err = inTx(stub, "tx5", func() error {
+		var err error
+		second, err = s.SealAuditBatch(adminCtx)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, second.FromSequence)
+	assert.Equal(t, 5, second.ToSequence)
+
+	// A regulator checks one entry against the root sealed on the ledger
+	auditLog, err := s.auditLogAt(adminCtx, "", 2)
+	assert.NoError(t, err)
+	entryJSON, err := json.Marshal(auditLog)
+	assert.NoError(t, err)
+	var entry auditchain.Entry
+	assert.NoError(t, json.Unmarshal(entryJSON, &entry))
+
+	proof, err := s.GetAuditInclusionProof(adminCtx, entry.LogID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, proof.SealNumber)
+	sealed, err := s.GetAuditSeal(adminCtx, proof.SealNumber)
+	assert.NoError(t, err)
+	assert.NoError(t, auditchain.VerifyProof(&entry, proof, sealed.Root))
+
+	latest, err := s.GetAuditSeal(adminCtx, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, latest.SealNumber)
+	assert.Error(t, auditchain.VerifyProof(&entry, proof, latest.Root))
+
+	// Patients prove entries of their own chain only
+	_, err = s.GetAuditInclusionProof(patientCtx, entry.LogID)
+	assert.NoError(t, err)
+	_, err = s.GetAuditInclusionProof(otherPatientCtx, entry.LogID)
+	assert.ErrorContains(t, err, "unauthorized")
+
+	// An entry altered after sealing can no longer be proven
+	logKey := string(stub.State[mustAuditSequenceKey(t, stub, "", entry.Sequence)])
+	altered := *auditLog
+	altered.Message = "Nothing happened"
+	alteredJSON, err := json.Marshal(altered)
+	assert.NoError(t, err)
+	stub.State[logKey] = alteredJSON
+
+	_, err = s.GetAuditInclusionProof(adminCtx, entry.LogID)
+	assert.ErrorContains(t, err, "can no longer be proven")
+
+	entry.Message = altered.Message
+	assert.Error(t, auditchain.VerifyProof(&entry, proof, sealed.Root))
+}
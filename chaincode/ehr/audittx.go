@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// auditedStub counts the writes of a transaction, so that requireAuditEntry can tell whether it
+// changed the ledger
+type auditedStub struct {
+	shim.ChaincodeStubInterface
+	ctx *TransactionContext
+}
+
+// SetStub wraps the stub of every transaction so that its writes are counted
+func (c *TransactionContext) SetStub(stub shim.ChaincodeStubInterface) {
+	c.TransactionContext.SetStub(&auditedStub{ChaincodeStubInterface: stub, ctx: c})
+}
+
+func (s *auditedStub) PutState(key string, value []byte) error {
+	return s.counted(s.ChaincodeStubInterface.PutState(key, value))
+}
+
+func (s *auditedStub) DelState(key string) error {
+	return s.counted(s.ChaincodeStubInterface.DelState(key))
+}
+
+func (s *auditedStub) PutPrivateData(collection string, key string, value []byte) error {
+	return s.counted(s.ChaincodeStubInterface.PutPrivateData(collection, key, value))
+}
+
+func (s *auditedStub) DelPrivateData(collection string, key string) error {
+	return s.counted(s.ChaincodeStubInterface.DelPrivateData(collection, key))
+}
+
+func (s *auditedStub) PurgePrivateData(collection string, key string) error {
+	return s.counted(s.ChaincodeStubInterface.PurgePrivateData(collection, key))
+}
+
+func (s *auditedStub) counted(err error) error {
+	if err == nil {
+		s.ctx.auditTransaction().writes++
+	}
+	return err
+}
+
+// countAuditEntry records that the transaction wrote an audit entry
+func countAuditEntry(ctx contractapi.TransactionContextInterface) {
+	if txCtx, ok := ctx.(*TransactionContext); ok {
+		txCtx.auditTransaction().auditEntries++
+	}
+}
+
+// requireAuditEntry runs after every transaction function that succeeded, and fails the
+// transaction when it wrote to the world state or private data without writing an audit entry,
+// so a change never commits without a trace
+func requireAuditEntry(ctx contractapi.TransactionContextInterface) error {
+	txCtx, ok := ctx.(*TransactionContext)
+	if !ok {
+		return nil
+	}
+
+	tx := txCtx.auditTransaction()
+	if tx.writes > 0 && tx.auditEntries == 0 {
+		return fmt.Errorf("transaction %s made %d write(s) without an audit entry", tx.txID, tx.writes)
+	}
+
+	return nil
+}
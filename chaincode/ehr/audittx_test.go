@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingStub fails every write of one object type, as a peer would on a full or broken disk
+type failingStub struct {
+	*shimtest.MockStub
+	objectType string
+}
+
+func (s *failingStub) PutState(key string, value []byte) error {
+	if strings.HasPrefix(key, "\x00"+s.objectType+"\x00") {
+		return fmt.Errorf("disk full")
+	}
+	return s.MockStub.PutState(key, value)
+}
+
+// TestAuditWriteFailures tests that a transaction whose audit entry cannot be written fails,
+// rather than committing without it
+func TestAuditWriteFailures(t *testing.T) {
+	s := new(SmartContract)
+
+	for _, objectType := range []string{"audit", auditChainHeadObjectType, auditSequenceObjectType} {
+		stub := newTestStub()
+		patientCtx := newTestContext(stub, patientIdentity("patient123"))
+		patientCtx.SetStub(&failingStub{stub, objectType})
+
+		err := inTx(stub, "tx1", func() error {
+			return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+				testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+		})
+		assert.ErrorContains(t, err, "disk full", objectType)
+	}
+
+	// Reads that are audited fail too, so access is never granted untraced
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	patientCtx.SetStub(&failingStub{stub, "audit"})
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.RequestRecordAccess(patientCtx, "EHR-001")
+		return err
+	})
+	assert.ErrorContains(t, err, "failed to put audit log")
+}
+
+// TestRequireAuditEntry tests that the check run after every transaction fails transactions that
+// wrote without an audit entry, and passes audited transactions and reads
+func TestRequireAuditEntry(t *testing.T) {
+	contract := NewSmartContract()
+	assert.NotNil(t, contract.AfterTransaction)
+
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := new(TransactionContext)
+	ctx.SetStub(stub)
+	ctx.SetClientIdentity(patientIdentity("patient123"))
+
+	err := inTx(stub, "tx1", func() error {
+		err := ctx.GetStub().PutState("unaudited", []byte("{}"))
+		if err != nil {
+			return err
+		}
+		return requireAuditEntry(ctx)
+	})
+	assert.EqualError(t, err, "transaction tx1 made 1 write(s) without an audit entry")
+
+	err = inTx(stub, "tx2", func() error {
+		err := s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(ctx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+		if err != nil {
+			return err
+		}
+		return requireAuditEntry(ctx)
+	})
+	assert.NoError(t, err)
+
+	// Counts start afresh with every transaction
+	err = inTx(stub, "tx3", func() error {
+		_, err := s.QueryEHR(ctx, "EHR-001")
+		if err != nil {
+			return err
+		}
+		return requireAuditEntry(ctx)
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		err := ctx.GetStub().DelState("unaudited")
+		if err != nil {
+			return err
+		}
+		return requireAuditEntry(ctx)
+	})
+	assert.ErrorContains(t, err, "without an audit entry")
+}
+
+// auditProbeContract adds transactions that write with and without an audit entry to the contract
+// NewSmartContract returns
+type auditProbeContract struct {
+	*SmartContract
+}
+
+func (c *auditProbeContract) WriteUnaudited(ctx contractapi.TransactionContextInterface, key string) error {
+	return ctx.GetStub().PutState(key, []byte("{}"))
+}
+
+func (c *auditProbeContract) WriteAudited(ctx contractapi.TransactionContextInterface, key string) error {
+	err := ctx.GetStub().PutState(key, []byte("{}"))
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return c.createAuditLog(ctx, ActionCreateEHR, "patient123", "patient123", key, "patient123", true, "Probe written")
+}
+
+// TestChaincodeRequiresAuditEntry tests that the chaincode built from NewSmartContract, as the
+// peer runs it, fails transactions that write without an audit entry
+func TestChaincodeRequiresAuditEntry(t *testing.T) {
+	chaincode, err := contractapi.NewChaincode(&auditProbeContract{NewSmartContract()})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	stub := shimtest.NewMockStub("ehr", chaincode)
+	identity := patientIdentity("patient123")
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   identity.mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: identity.cert.Raw}),
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	stub.Creator = creator
+
+	response := stub.MockInvoke("tx1", [][]byte{[]byte("WriteUnaudited"), []byte("probe1")})
+	assert.Equal(t, int32(shim.ERROR), response.Status)
+	assert.Equal(t, "transaction tx1 made 1 write(s) without an audit entry", response.Message)
+
+	response = stub.MockInvoke("tx2", [][]byte{[]byte("WriteAudited"), []byte("probe2")})
+	assert.Equal(t, int32(shim.OK), response.Status, response.Message)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Consent scopes
+const (
+	ConsentScopeRead  = "read"
+	ConsentScopeWrite = "write"
+)
+
+// Acknowledgement statuses
+const (
+	AcknowledgementAcknowledged = "ACKNOWLEDGED"
+	AcknowledgementFlagged      = "FLAGGED"
+)
+
+// EventEHRAuthored is the chaincode event emitted when a record is written for a patient by someone else
+const EventEHRAuthored = "EHRAuthored"
+
+// credentialAttribute is the certificate attribute carrying a clinician's license number
+const credentialAttribute = "license"
+
+// RecordAcknowledgement is the patient's response to a record authored for them
+type RecordAcknowledgement struct {
+	Status    string    `json:"status"`
+	Note      string    `json:"note,omitempty" metadata:",optional"` // Why the record was flagged
+	Timestamp time.Time `json:"timestamp"`
+	TxID      string    `json:"txId"`
+}
+
+// EHRAuthoredEvent notifies the patient's applications of a new record to review
+type EHRAuthoredEvent struct {
+	RecordID   string    `json:"recordId"`
+	PatientID  string    `json:"patientId"`
+	AuthorID   string    `json:"authorId"`
+	AuthorOrg  string    `json:"authorOrg"`
+	RecordType string    `json:"recordType"`
+	Version    int       `json:"version"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// SetConsentScopes sets what a consent allows: read access, and for consents on all records,
+// writing new records for the patient
+func (s *SmartContract) SetConsentScopes(
+	ctx contractapi.TransactionContextInterface,
+	consentID string,
+	scopes []string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	consentJSON, err := ctx.GetStub().GetState(consentID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if consentJSON == nil {
+		return fmt.Errorf("consent %s %w", consentID, errNotFound)
+	}
+
+	var consent ConsentRecord
+	err = json.Unmarshal(consentJSON, &consent)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+
+	// Only the patient can widen their own consent
+	err = s.RequirePatientOrAdmin(ctx, consent.PatientID)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(scopes))
+	normalized := []string{}
+	for _, scope := range scopes {
+		if scope != ConsentScopeRead && scope != ConsentScopeWrite {
+			return fmt.Errorf("invalid consent scope %q: must be %s or %s", scope, ConsentScopeRead, ConsentScopeWrite)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+	sort.Strings(normalized)
+
+	// New records have no ID to consent to yet, so writing needs a consent on all records
+	if seen[ConsentScopeWrite] && consent.RecordID != "*" {
+		return fmt.Errorf("the %s scope requires a consent on all records (*)", ConsentScopeWrite)
+	}
+
+	consent.Scopes = normalized
+	consent.Timestamp, err = txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	consentJSON, err = json.Marshal(consent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal consent: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(consentID, consentJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionSetConsentScopes, callerID, consent.DoctorID, consent.RecordID, consent.PatientID, true,
+		fmt.Sprintf("Scopes of consent %s set to %v", consentID, normalized))
+}
+
+// AcknowledgeEHR lets the patient confirm a record written for them by a clinician
+func (s *SmartContract) AcknowledgeEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) error {
+	return s.respondToRecord(ctx, recordID, AcknowledgementAcknowledged, "")
+}
+
+// FlagEHR lets the patient dispute a record written for them by a clinician
+func (s *SmartContract) FlagEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	reason string,
+) error {
+	if reason == "" {
+		return fmt.Errorf("a reason is required to flag a record")
+	}
+
+	return s.respondToRecord(ctx, recordID, AcknowledgementFlagged, reason)
+}
+
+// respondToRecord stores the patient's acknowledgement or flag on one version of a record
+func (s *SmartContract) respondToRecord(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	status string,
+	note string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	err = requireActive(metadata)
+	if err != nil {
+		return err
+	}
+
+	if callerID != metadata.PatientID {
+		return fmt.Errorf("%w: only the patient can respond to record %s", errUnauthorized, recordID)
+	}
+
+	if metadata.CreatedBy == metadata.PatientID {
+		return fmt.Errorf("record %s was created by the patient", recordID)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	metadata.Acknowledgement = &RecordAcknowledgement{
+		Status:    status,
+		Note:      note,
+		Timestamp: now,
+		TxID:      ctx.GetStub().GetTxID(),
+	}
+
+	err = s.putEHRMetadata(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	if status == AcknowledgementFlagged {
+		err = s.createAuditLog(ctx, ActionFlagEHR, callerID, metadata.CreatedBy, recordID, metadata.PatientID, true,
+			fmt.Sprintf("Record flagged by patient: %s", note))
+		if err != nil {
+			return err
+		}
+	} else {
+		err = s.createAuditLog(ctx, ActionAcknowledgeEHR, callerID, metadata.CreatedBy, recordID, metadata.PatientID, true,
+			"Record acknowledged by patient")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requireRecordAuthor checks that the caller may write a new record for a patient: the patient,
+// an admin, or a credentialed doctor holding a write-scoped consent. It returns the doctor's credential.
+func (s *SmartContract) requireRecordAuthor(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) (string, error) {
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	role, err := s.GetCallerRole(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller role: %v", err)
+	}
+
+	// New records of a duplicate patient ID go to the surviving ID
+	err = s.requireUnmergedPatient(ctx, patientID)
+	if err != nil {
+		return "", err
+	}
+
+	switch role {
+	case RoleAdmin:
+		return "", nil
+	case RolePatient:
+		if callerID != patientID {
+			return "", fmt.Errorf("%w: patients can only create their own records", errUnauthorized)
+		}
+		return "", nil
+	case RoleDoctor:
+		credential, err := s.authorCredential(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		canWrite, err := s.hasWriteConsent(ctx, patientID, callerID)
+		if err != nil {
+			return "", err
+		}
+		if !canWrite {
+			return "", fmt.Errorf("%w: no write consent from patient %s", errUnauthorized, patientID)
+		}
+		return credential, nil
+	}
+
+	return "", fmt.Errorf("%w: role %s cannot create records", errUnauthorized, role)
+}
+
+// authorCredential returns the license of a doctor caller, rejecting doctors without one.
+// Other roles author records without a credential.
+func (s *SmartContract) authorCredential(ctx contractapi.TransactionContextInterface) (string, error) {
+	isDoctor, err := s.IsDoctor(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !isDoctor {
+		return "", nil
+	}
+
+	credential, found, err := ctx.GetClientIdentity().GetAttributeValue(credentialAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to get %s attribute: %v", credentialAttribute, err)
+	}
+	if !found || credential == "" {
+		return "", fmt.Errorf("%w: doctor certificate has no %s attribute", errUnauthorized, credentialAttribute)
+	}
+
+	return credential, nil
+}
+
+// hasWriteConsent checks for a consent on all of a patient's records that includes the write scope
+func (s *SmartContract) hasWriteConsent(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	doctorID string,
+) (bool, error) {
+	consentJSON, err := ctx.GetStub().GetState(consentIDFor(patientID, doctorID, "*"))
+	if err != nil {
+		return false, fmt.Errorf("failed to read consent: %v", err)
+	}
+	if consentJSON == nil {
+		return false, nil
+	}
+
+	var consent ConsentRecord
+	err = json.Unmarshal(consentJSON, &consent)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !consentInEffect(&consent, now) {
+		return false, nil
+	}
+
+	for _, scope := range consent.Scopes {
+		if scope == ConsentScopeWrite {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// notifyPatient emits EventEHRAuthored when a record was written by someone other than its patient
+func notifyPatient(ctx contractapi.TransactionContextInterface, metadata *EHRMetadata) error {
+	if metadata.CreatedBy == metadata.PatientID {
+		return nil
+	}
+
+	event := EHRAuthoredEvent{
+		RecordID:   metadata.RecordID,
+		PatientID:  metadata.PatientID,
+		AuthorID:   metadata.CreatedBy,
+		AuthorOrg:  metadata.AuthorOrg,
+		RecordType: metadata.RecordType,
+		Version:    metadata.Version,
+		Timestamp:  metadata.Timestamp,
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(EventEHRAuthored, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
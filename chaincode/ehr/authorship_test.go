@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestClinicianAuthoredRecords tests write-scoped consent, credentials and patient acknowledgement
+func TestClinicianAuthoredRecords(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	unlicensedCtx := newTestContext(stub, newTestIdentity("doctor789", "HospitalMSP", map[string]string{"role": RoleDoctor}))
+
+	create := func(identity *testIdentity, txID string, recordID string) error {
+		return inTx(stub, txID, func() error {
+			return s.CreateEHRMetadata(newTestContext(stub, identity), recordID, "patient123", testCID(recordID), "key1", "Discharge Summary", testChecksum(recordID), testSignature(newTestContext(stub, identity), recordID, "patient123", testCID(recordID), testChecksum(recordID), "Discharge Summary"))
+		})
+	}
+
+	// A read-only consent does not allow writing
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.GrantConsent(patientCtx, "patient123-doctor456-*", "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = create(doctorIdentity("doctor456"), "tx2", "EHR-001")
+	assert.ErrorContains(t, err, "no write consent")
+
+	// Write scope only applies to consents on all records
+	err = inTx(stub, "tx3", func() error {
+		_, err := s.GrantConsent(patientCtx, "patient123-doctor456-EHR-009", "patient123", "doctor456", "EHR-009", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx3a", func() error {
+		return s.SetConsentScopes(patientCtx, "patient123-doctor456-EHR-009", []string{ConsentScopeWrite})
+	})
+	assert.ErrorContains(t, err, "requires a consent on all records")
+
+	err = inTx(stub, "tx4", func() error {
+		return s.SetConsentScopes(doctorCtx, "patient123-doctor456-*", []string{ConsentScopeWrite})
+	})
+	assert.Error(t, err, "doctors cannot grant themselves write access")
+
+	err = inTx(stub, "tx5", func() error {
+		return s.SetConsentScopes(patientCtx, "patient123-doctor456-*", []string{ConsentScopeWrite, ConsentScopeRead, ConsentScopeWrite})
+	})
+	assert.NoError(t, err)
+
+	err = create(doctorIdentity("doctor456"), "tx6", "EHR-001")
+	assert.NoError(t, err)
+
+	metadata, err := s.QueryEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "doctor456", metadata.CreatedBy)
+	assert.Equal(t, "HospitalMSP", metadata.AuthorOrg)
+	assert.Equal(t, "MD-doctor456", metadata.AuthorCredential)
+
+	// The patient is notified
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventEHRAuthored, event.EventName)
+	var payload EHRAuthoredEvent
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, "EHR-001", payload.RecordID)
+	assert.Equal(t, "doctor456", payload.AuthorID)
+
+	// Uncredentialed authors are rejected even with consent
+	err = grantWriteConsent(s, stub, "tx7", "patient123", "doctor789")
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx8", func() error {
+		return s.CreateEHRMetadata(unlicensedCtx, "EHR-002", "patient123", testCID("EHR-002"), "key1", "Discharge Summary", testChecksum("EHR-002"), testSignature(unlicensedCtx, "EHR-002", "patient123", testCID("EHR-002"), testChecksum("EHR-002"), "Discharge Summary"))
+	})
+	assert.ErrorContains(t, err, "no license attribute")
+
+	// Only the patient responds to the record
+	err = inTx(stub, "tx9", func() error {
+		return s.AcknowledgeEHR(doctorCtx, "EHR-001")
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx10", func() error {
+		return s.FlagEHR(patientCtx, "EHR-001", "")
+	})
+	assert.ErrorContains(t, err, "reason is required")
+
+	err = inTx(stub, "tx11", func() error {
+		return s.FlagEHR(patientCtx, "EHR-001", "Medication list is not mine")
+	})
+	assert.NoError(t, err)
+
+	metadata, err = s.QueryEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	if assert.NotNil(t, metadata.Acknowledgement) {
+		assert.Equal(t, AcknowledgementFlagged, metadata.Acknowledgement.Status)
+		assert.Equal(t, "Medication list is not mine", metadata.Acknowledgement.Note)
+		assert.Equal(t, "tx11", metadata.Acknowledgement.TxID)
+	}
+
+	// Revoking the consent ends write access
+	err = inTx(stub, "tx12", func() error {
+		return s.RevokeConsent(patientCtx, "patient123-doctor456-*")
+	})
+	assert.NoError(t, err)
+
+	err = create(doctorIdentity("doctor456"), "tx13", "EHR-003")
+	assert.ErrorContains(t, err, "no write consent")
+
+	// Patients' own uploads need no acknowledgement
+	err = create(patientIdentity("patient123"), "tx14", "EHR-004")
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx15", func() error {
+		return s.AcknowledgeEHR(patientCtx, "EHR-004")
+	})
+	assert.ErrorContains(t, err, "created by the patient")
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// componentSeparator joins a bundle record ID and a component ID in consent record IDs
+const componentSeparator = "#"
+
+// maxBundleComponents bounds the size of a bundle manifest
+const maxBundleComponents = 100
+
+// EHRComponent is one document of a bundle record
+type EHRComponent struct {
+	ComponentID  string `json:"componentId"`
+	IPFSHash     string `json:"ipfsHash"`
+	Checksum     string `json:"checksum"` // SHA-256 of the component file
+	MimeType     string `json:"mimeType"`
+	Size         int64  `json:"size"`                                        // Bytes
+	EncryptedKey string `json:"encryptedKey,omitempty" metadata:",optional"` // Falls back to the bundle key
+	Title        string `json:"title,omitempty" metadata:",optional"`
+}
+
+// CreateEHRBundle creates a record made of several documents, such as the report, images and
+// summary of one encounter. The record checksum is computed over the component manifest.
+func (s *SmartContract) CreateEHRBundle(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	patientID string,
+	encryptedKey string,
+	recordType string,
+	components []EHRComponent,
+	authorSignature string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(components) == 0 {
+		return fmt.Errorf("a bundle needs at least one component")
+	}
+
+	// Patients write their own records, doctors need a credential and a write-scoped consent
+	credential, err := s.requireRecordAuthor(ctx, patientID)
+	if err != nil {
+		return err
+	}
+
+	// Check if record already exists, erased records keep their ID
+	exists, err := s.ehrRecordExists(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("record %s already exists", recordID)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	metadata := EHRMetadata{
+		RecordID:         recordID,
+		PatientID:        patientID,
+		EncryptedKey:     encryptedKey,
+		Timestamp:        now,
+		RecordType:       recordType,
+		Checksum:         bundleChecksum(components),
+		CreatedBy:        callerID,
+		AuthorOrg:        callerOrg,
+		AuthorCredential: credential,
+		Confidentiality:  ConfidentialityNormal,
+		Version:          1,
+		RootRecordID:     recordID,
+		Components:       components,
+	}
+
+	// Bundles keep component keys on the public ledger, so private key material is refused
+	err = s.applyPrivateRecordData(ctx, &metadata, nil)
+	if err != nil {
+		return err
+	}
+
+	// Validate every field, reporting all failures at once
+	err = s.validateEHRMetadata(ctx, &metadata, true)
+	if err != nil {
+		return err
+	}
+
+	// Retention follows the record type and the patient's jurisdiction
+	err = s.applyRetention(ctx, &metadata)
+	if err != nil {
+		return err
+	}
+
+	// The author vouches for the normalized record
+	err = s.signRecord(ctx, &metadata, authorSignature)
+	if err != nil {
+		return err
+	}
+
+	// Save to ledger
+	err = s.putEHRMetadata(ctx, &metadata)
+	if err != nil {
+		return err
+	}
+
+	err = notifyPatient(ctx, &metadata)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionCreateEHR, callerID, patientID, recordID, patientID, true,
+		fmt.Sprintf("EHR bundle created with %d components", len(components)))
+}
+
+// AmendEHRBundle creates a new version of a bundle with a new component manifest
+func (s *SmartContract) AmendEHRBundle(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	newRecordID string,
+	encryptedKey string,
+	components []EHRComponent,
+	reason string,
+	authorSignature string,
+) error {
+	if len(components) == 0 {
+		return fmt.Errorf("a bundle needs at least one component")
+	}
+
+	return s.amendRecord(ctx, recordID, newRecordID, reason, authorSignature, func(previous *EHRMetadata, amended *EHRMetadata) error {
+		if len(previous.Components) == 0 {
+			return fmt.Errorf("record %s is not a bundle, amend it with AmendEHR", recordID)
+		}
+
+		amended.EncryptedKey = encryptedKey
+		amended.Checksum = bundleChecksum(components)
+		amended.Components = components
+		return nil
+	})
+}
+
+// GetEHRComponent returns one component of the latest version of a bundle. A component without
+// its own key is returned with the bundle key.
+func (s *SmartContract) GetEHRComponent(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	componentID string,
+) (*EHRComponent, error) {
+	metadata, err := s.latestEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	view, err := s.readableRecord(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, component := range view.Components {
+		if component.ComponentID == componentID {
+			if component.EncryptedKey == "" {
+				component.EncryptedKey = metadata.EncryptedKey
+			}
+			return &component, nil
+		}
+	}
+
+	// Don't reveal whether components outside the caller's consent exist
+	return nil, fmt.Errorf("component %s of record %s does not exist or is not accessible", componentID, recordID)
+}
+
+// readableRecord returns a record as the caller may read it: whole, or for a bundle reduced to
+// the components the caller holds consent for
+func (s *SmartContract) readableRecord(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) (*EHRMetadata, error) {
+	accessErr := s.checkRecordAccess(ctx, metadata)
+	if accessErr == nil {
+		return metadata, nil
+	}
+
+	view, err := s.bundleView(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if view == nil {
+		return nil, accessErr
+	}
+
+	return view, nil
+}
+
+// bundleView reduces a bundle to the components the calling doctor has consent for, or
+// returns nil if there are none
+func (s *SmartContract) bundleView(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) (*EHRMetadata, error) {
+	if len(metadata.Components) == 0 {
+		return nil, nil
+	}
+
+	isDoctor, err := s.IsDoctor(ctx)
+	if err != nil || !isDoctor {
+		return nil, err
+	}
+
+	doctorID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get doctor ID: %v", err)
+	}
+
+	var components []EHRComponent
+	needsBundleKey := false
+	for _, component := range metadata.Components {
+		allowed, _, err := s.consentAccess(ctx, metadata.PatientID, doctorID, componentRef(metadata.RecordID, component.ComponentID))
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			components = append(components, component)
+			needsBundleKey = needsBundleKey || component.EncryptedKey == ""
+		}
+	}
+	if len(components) == 0 {
+		return nil, nil
+	}
+
+	view := *metadata
+	view.Components = components
+	if !needsBundleKey {
+		view.EncryptedKey = ""
+	}
+
+	return &view, nil
+}
+
+// componentRef addresses a bundle component in consent record IDs
+func componentRef(recordID string, componentID string) string {
+	return recordID + componentSeparator + componentID
+}
+
+// splitComponentRef splits a consent record ID into the record and component IDs
+func splitComponentRef(ref string) (string, string) {
+	if i := strings.Index(ref, componentSeparator); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// bundleChecksum is the SHA-256 of the component manifest, one "componentId:checksum" line
+// per component in manifest order, with lower-case checksums
+func bundleChecksum(components []EHRComponent) string {
+	hash := sha256.New()
+	for _, component := range components {
+		fmt.Fprintf(hash, "%s:%s\n", component.ComponentID, strings.ToLower(component.Checksum))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
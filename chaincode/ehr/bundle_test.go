@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encounterComponents is a sample manifest of one encounter
+func encounterComponents() []EHRComponent {
+	return []EHRComponent{
+		{ComponentID: "report", IPFSHash: testCID("report"), Checksum: testChecksum("c1"), MimeType: "application/pdf", Size: 52000},
+		{ComponentID: "ct-1", IPFSHash: testCID("image1"), Checksum: testChecksum("c2"), MimeType: "application/dicom", Size: 9000000, EncryptedKey: "imageKey"},
+		{ComponentID: "summary", IPFSHash: testCID("summary"), Checksum: testChecksum("c3"), MimeType: "application/fhir+json", Size: 800},
+	}
+}
+
+// TestEHRBundle tests bundle creation, manifest checksums and component-level consent
+func TestEHRBundle(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	invalid := encounterComponents()
+	invalid[2].ComponentID = "report"
+	err := inTx(stub, "tx0", func() error {
+		return s.CreateEHRBundle(ctx, "ENC-001", "patient123", "bundleKey", "Encounter", invalid, testSignature(ctx, "ENC-001", "patient123", "", bundleChecksum(invalid), "Encounter"))
+	})
+	assert.ErrorContains(t, err, "duplicate componentId report")
+
+	err = inTx(stub, "tx1", func() error {
+		return s.CreateEHRBundle(ctx, "ENC-001", "patient123", "bundleKey", "Encounter", encounterComponents(), testSignature(ctx, "ENC-001", "patient123", "", bundleChecksum(encounterComponents()), "Encounter"))
+	})
+	assert.NoError(t, err)
+
+	metadata, err := s.QueryEHR(ctx, "ENC-001")
+	assert.NoError(t, err)
+	assert.Len(t, metadata.Components, 3)
+	assert.Equal(t, bundleChecksum(encounterComponents()), metadata.Checksum)
+
+	// Without consent the doctor sees nothing
+	_, err = s.QueryEHR(doctorCtx, "ENC-001")
+	assert.Error(t, err)
+
+	// Consent on one image exposes only that component, with its own key
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-ENC-001#ct-1", "patient123", "doctor456", "ENC-001#ct-1", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	view, err := s.QueryEHR(doctorCtx, "ENC-001")
+	assert.NoError(t, err)
+	if assert.Len(t, view.Components, 1) {
+		assert.Equal(t, "ct-1", view.Components[0].ComponentID)
+	}
+	assert.Empty(t, view.EncryptedKey, "the bundle key is withheld when no visible component needs it")
+
+	component, err := s.GetEHRComponent(doctorCtx, "ENC-001", "ct-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "imageKey", component.EncryptedKey)
+
+	_, err = s.GetEHRComponent(doctorCtx, "ENC-001", "report")
+	assert.ErrorContains(t, err, "not accessible")
+
+	hasConsent, err := s.CheckConsent(ctx, "patient123", "doctor456", "ENC-001#report")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent)
+
+	// Component consent carries over to a new version of the bundle
+	amended := encounterComponents()
+	amended[0].Checksum = testChecksum("c1-corrected")
+	err = inTx(stub, "tx3", func() error {
+		return s.AmendEHRBundle(ctx, "ENC-001", "ENC-001-v2", "bundleKey", amended, "Corrected report", testSignature(ctx, "ENC-001-v2", "patient123", "", bundleChecksum(amended), "Encounter"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.AmendEHR(ctx, "ENC-001-v2", "ENC-001-v3", testCID("flat"), "key", testChecksum("checksum"), "Flatten", testSignature(ctx, "ENC-001-v3", "patient123", testCID("flat"), testChecksum("checksum"), "Encounter"))
+	})
+	assert.ErrorContains(t, err, "is a bundle")
+
+	hasConsent, err = s.CheckConsent(ctx, "patient123", "doctor456", "ENC-001-v2#ct-1")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent)
+
+	// Consent on the whole bundle covers every component, falling back to the bundle key
+	err = inTx(stub, "tx5", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-ENC-001", "patient123", "doctor456", "ENC-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	component, err = s.GetEHRComponent(doctorCtx, "ENC-001", "report")
+	assert.NoError(t, err)
+	assert.Equal(t, testChecksum("c1-corrected"), component.Checksum)
+	assert.Equal(t, "bundleKey", component.EncryptedKey)
+}
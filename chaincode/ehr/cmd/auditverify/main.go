@@ -0,0 +1,77 @@
+// Command auditverify checks the audit chain in an exported audit log, offline.
+//
+// The export is a JSON array of audit log entries, as returned by GetAllAuditLogs or the
+// QueryAuditLogsBy queries:
+//
+//	auditverify [-patient patientID] audit.json
+//
+// Without -patient the global chain is checked, otherwise the patient's. An export that does not
+// start at the first entry is checked from its first entry on. Breaks are printed one per line
+// and the command exits with status 1 if there are any.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ehr-blockchain/chaincode/auditchain"
+)
+
+func main() {
+	patientID := flag.String("patient", "", "check the chain of this patient instead of the global chain")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: auditverify [-patient patientID] audit.json\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	breaks, err := verifyFile(flag.Arg(0), *patientID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "auditverify: %v\n", err)
+		os.Exit(2)
+	}
+	if len(breaks) > 0 {
+		os.Exit(1)
+	}
+}
+
+// verifyFile checks the chain in an export and prints what it found
+func verifyFile(path string, patientID string) ([]auditchain.Break, error) {
+	exportJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*auditchain.Entry
+	err = json.Unmarshal(exportJSON, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %v", path, err)
+	}
+
+	chain := "global chain"
+	if patientID != "" {
+		chain = "chain of " + patientID
+	}
+
+	from, to, breaks := auditchain.VerifyAll(entries, patientID)
+	if from == 0 {
+		return nil, fmt.Errorf("%s has no entries of the %s", path, chain)
+	}
+
+	for _, b := range breaks {
+		if b.LogID != "" {
+			fmt.Printf("%d\t%s\t%s\n", b.Sequence, b.LogID, b.Reason)
+		} else {
+			fmt.Printf("%d\t\t%s\n", b.Sequence, b.Reason)
+		}
+	}
+	fmt.Printf("%s: entries %d to %d, %d break(s)\n", chain, from, to, len(breaks))
+
+	return breaks, nil
+}
@@ -8,7 +8,7 @@ import (
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
-// GrantConsent allows a patient to grant access to a doctor
+// GrantConsent allows a patient to grant access to a doctor and returns a consent receipt
 func (s *SmartContract) GrantConsent(
 	ctx contractapi.TransactionContextInterface,
 	consentID string,
@@ -16,24 +16,43 @@ func (s *SmartContract) GrantConsent(
 	doctorID string,
 	recordID string,
 	expiryDays int,
-) error {
+) (*ConsentReceipt, error) {
 	// Get caller identity
 	callerID, err := s.GetCallerID(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get caller ID: %v", err)
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
 	}
 
-	// Verify caller is the patient (or admin)
-	// In production, add proper authorization checks
-
-	// Check if consent already exists
-	existing, err := ctx.GetStub().GetState(consentID)
+	// Only the patient (or an admin) may grant access to the patient's records
+	err = s.RequirePatientOrAdmin(ctx, patientID)
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return nil, err
+	}
+
+	// Access checks find consents by their conventional ID, so no other ID is accepted
+	var errs ValidationErrors
+	if patientID == "" {
+		errs.add("patientId", "is required")
+	}
+	if doctorID == "" {
+		errs.add("doctorId", "is required")
+	}
+	if recordID == "" {
+		errs.add("recordId", "is required")
+	}
+	if expected := consentIDFor(patientID, doctorID, recordID); consentID != expected {
+		errs.add("consentId", "must be %s", expected)
+	}
+	if err := errs.errOrNil(); err != nil {
+		return nil, err
 	}
 
 	// Calculate expiry date
-	expiryDate := time.Now().AddDate(0, 0, expiryDays)
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expiryDate := now.AddDate(0, 0, expiryDays)
 
 	consent := ConsentRecord{
 		ConsentID:  consentID,
@@ -41,32 +60,32 @@ func (s *SmartContract) GrantConsent(
 		DoctorID:   doctorID,
 		RecordID:   recordID,
 		Granted:    true,
-		Timestamp:  time.Now(),
+		Timestamp:  now,
 		ExpiryDate: expiryDate,
 		GrantedBy:  callerID,
 	}
 
-	consentJSON, err := json.Marshal(consent)
+	receipt, replaced, err := s.grantConsent(ctx, &consent)
 	if err != nil {
-		return fmt.Errorf("failed to marshal consent: %v", err)
-	}
-
-	// Save to ledger
-	err = ctx.GetStub().PutState(consentID, consentJSON)
-	if err != nil {
-		return fmt.Errorf("failed to put to world state: %v", err)
+		return nil, err
 	}
 
 	// Create audit log
-	if existing == nil {
-		s.CreateAuditLog(ctx, ActionGrantConsent, callerID, doctorID, recordID, true, 
+	if !replaced {
+		err = s.createAuditLog(ctx, ActionGrantConsent, callerID, doctorID, recordID, patientID, true, 
 			fmt.Sprintf("Consent granted by patient %s to doctor %s", patientID, doctorID))
+		if err != nil {
+			return nil, err
+		}
 	} else {
-		s.CreateAuditLog(ctx, ActionGrantConsent, callerID, doctorID, recordID, true, 
+		err = s.createAuditLog(ctx, ActionGrantConsent, callerID, doctorID, recordID, patientID, true, 
 			fmt.Sprintf("Consent updated by patient %s for doctor %s", patientID, doctorID))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return nil
+	return receipt, nil
 }
 
 // RevokeConsent allows a patient to revoke access from a doctor
@@ -86,7 +105,7 @@ func (s *SmartContract) RevokeConsent(
 		return fmt.Errorf("failed to read from world state: %v", err)
 	}
 	if consentJSON == nil {
-		return fmt.Errorf("consent %s does not exist", consentID)
+		return fmt.Errorf("consent %s %w", consentID, errNotFound)
 	}
 
 	var consent ConsentRecord
@@ -95,29 +114,121 @@ func (s *SmartContract) RevokeConsent(
 		return fmt.Errorf("failed to unmarshal consent: %v", err)
 	}
 
-	// Verify caller is the patient who granted consent
-	// In production, add proper authorization checks
+	// Only the patient (or an admin) may revoke the patient's consent
+	err = s.RequirePatientOrAdmin(ctx, consent.PatientID)
+	if err != nil {
+		return err
+	}
 
 	// Update consent to revoked
+	consent.Timestamp, err = txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	revokedKeys, revokedReEncryption, err := s.revokeConsent(ctx, &consent)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionRevokeConsent, callerID, consent.DoctorID, consent.RecordID, consent.PatientID, true, 
+		fmt.Sprintf("Consent revoked by patient %s from doctor %s, %d wrapped key(s) deleted, re-encryption key deleted: %t",
+			consent.PatientID, consent.DoctorID, revokedKeys, revokedReEncryption))
+}
+
+// grantConsent saves a granted consent, stores the record keys wrapped for the doctor and issues
+// the patient's receipt. It reports whether the consent replaced a stored one.
+func (s *SmartContract) grantConsent(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) (*ConsentReceipt, bool, error) {
+	consent.Granted = true
+
+	replaced, err := s.putConsent(ctx, consent)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Store the record keys wrapped for the doctor
+	err = s.grantRecordKeys(ctx, consent)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Issue the patient's consent receipt
+	receipt, err := s.issueConsentReceipt(ctx, consent)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return receipt, replaced, nil
+}
+
+// revokeConsent saves a revoked consent and deletes the doctor's wrapped record keys and
+// re-encryption key. It returns how many wrapped keys were deleted, and whether the
+// re-encryption key was.
+func (s *SmartContract) revokeConsent(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) (int, bool, error) {
 	consent.Granted = false
-	consent.Timestamp = time.Now()
 
-	consentJSON, err = json.Marshal(consent)
+	_, err := s.putConsent(ctx, consent)
 	if err != nil {
-		return fmt.Errorf("failed to marshal consent: %v", err)
+		return 0, false, err
 	}
 
-	// Save to ledger
-	err = ctx.GetStub().PutState(consentID, consentJSON)
+	// The doctor's wrapped record keys go with the consent
+	revokedKeys, err := s.revokeRecordKeys(ctx, consent)
 	if err != nil {
-		return fmt.Errorf("failed to put to world state: %v", err)
+		return 0, false, err
 	}
 
-	// Create audit log
-	s.CreateAuditLog(ctx, ActionRevokeConsent, callerID, consent.DoctorID, consent.RecordID, true, 
-		fmt.Sprintf("Consent revoked by patient %s from doctor %s", consent.PatientID, consent.DoctorID))
+	// Without the re-encryption key the service can no longer share new keys
+	revokedReEncryption, err := s.revokeReEncryptionKey(ctx, consent)
+	if err != nil {
+		return 0, false, err
+	}
 
-	return nil
+	return revokedKeys, revokedReEncryption, nil
+}
+
+// putConsent saves a consent, unless its ID is taken by another grant. It reports whether the
+// consent replaced a stored one.
+func (s *SmartContract) putConsent(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) (bool, error) {
+	// Check if consent already exists
+	existing, err := ctx.GetStub().GetState(consent.ConsentID)
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		// IDs with hyphens can collide, so an existing consent must be the same patient's
+		var current ConsentRecord
+		err = json.Unmarshal(existing, &current)
+		if err != nil {
+			return false, fmt.Errorf("failed to unmarshal consent: %v", err)
+		}
+		if current.PatientID != consent.PatientID || current.DoctorID != consent.DoctorID || current.RecordID != consent.RecordID {
+			return false, fmt.Errorf("consent %s belongs to another grant", consent.ConsentID)
+		}
+	}
+
+	consentJSON, err := json.Marshal(consent)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal consent: %v", err)
+	}
+
+	// Save to ledger
+	err = ctx.GetStub().PutState(consent.ConsentID, consentJSON)
+	if err != nil {
+		return false, fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return existing != nil, nil
 }
 
 // CheckConsent verifies if a doctor has access to a patient's record
@@ -127,44 +238,140 @@ func (s *SmartContract) CheckConsent(
 	doctorID string,
 	recordID string,
 ) (bool, error) {
+	// Consents of merged patient IDs have moved to the surviving ID
+	patientID, err := s.resolvePatientID(ctx, patientID)
+	if err != nil {
+		return false, err
+	}
+
+	allowed, _, err := s.consentAccess(ctx, patientID, doctorID, recordID)
+	if err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+// consentAccess resolves the consent a doctor holds on a record. When only a broad consent
+// (on the record's encounter, its episode of care or all records) applies, restricted lists
+// the record labels it does not cover.
+func (s *SmartContract) consentAccess(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	doctorID string,
+	recordID string,
+) (bool, []string, error) {
 	// Query for consent record
-	// Try specific record consent first
-	consentID := fmt.Sprintf("%s-%s-%s", patientID, doctorID, recordID)
-	
-	consentJSON, err := ctx.GetStub().GetState(consentID)
+	// Try specific record consent first, then consent on versions it amends
+	recordID, componentID := splitComponentRef(recordID)
+	lineage, err := s.recordLineage(ctx, recordID)
 	if err != nil {
-		return false, fmt.Errorf("failed to read consent: %v", err)
+		return false, nil, err
+	}
+
+	// A bundle component is covered by consent on the component or on the whole bundle
+	candidates := lineage
+	if componentID != "" {
+		candidates = nil
+		for _, versionID := range lineage {
+			candidates = append(candidates, componentRef(versionID, componentID))
+		}
+		candidates = append(candidates, lineage...)
+	}
+
+	var consentJSON []byte
+	for _, versionID := range candidates {
+		consentJSON, err = ctx.GetStub().GetState(consentIDFor(patientID, doctorID, versionID))
+		if err != nil {
+			return false, nil, fmt.Errorf("failed to read consent: %v", err)
+		}
+		if consentJSON != nil {
+			break
+		}
 	}
 
-	// If no specific consent, check for general access (empty recordID)
+	// If no specific consent, check consent on the record's encounter or episode of care,
+	// then general access
+	broad := false
+	var metadata *EHRMetadata
 	if consentJSON == nil {
-		consentID = fmt.Sprintf("%s-%s-*", patientID, doctorID)
-		consentJSON, err = ctx.GetStub().GetState(consentID)
+		metadata, err = s.lookupEHR(ctx, recordID)
 		if err != nil {
-			return false, fmt.Errorf("failed to read general consent: %v", err)
+			return false, nil, err
 		}
+
+		scopes, err := s.recordConsentScopes(ctx, metadata)
+		if err != nil {
+			return false, nil, err
+		}
+
+		for _, scope := range scopes {
+			consentJSON, err = ctx.GetStub().GetState(consentIDFor(patientID, doctorID, scope))
+			if err != nil {
+				return false, nil, fmt.Errorf("failed to read general consent: %v", err)
+			}
+			if consentJSON != nil {
+				break
+			}
+		}
+		broad = true
 	}
 
 	if consentJSON == nil {
-		return false, nil
+		return false, nil, nil
 	}
 
 	var consent ConsentRecord
 	err = json.Unmarshal(consentJSON, &consent)
 	if err != nil {
-		return false, fmt.Errorf("failed to unmarshal consent: %v", err)
+		return false, nil, fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+
+	// IDs with hyphens can collide, so the consent must be between these two
+	if consent.PatientID != patientID || consent.DoctorID != doctorID {
+		return false, nil, nil
 	}
 
 	// Check if consent is granted and not expired
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	if !consentInEffect(&consent, now) {
+		return false, nil, nil
+	}
+
+	// Labeled records are only covered by a broad consent the patient opted in to
+	if broad && metadata != nil {
+		restricted := uncoveredLabels(&consent, metadata)
+		if len(restricted) > 0 {
+			return false, restricted, nil
+		}
+	}
+
+	return true, nil, nil
+}
+
+// consentInEffect checks that a consent is granted, started and not expired at a time
+func consentInEffect(consent *ConsentRecord, now time.Time) bool {
 	if !consent.Granted {
-		return false, nil
+		return false
+	}
+
+	if now.After(consent.ExpiryDate) {
+		return false
 	}
 
-	if time.Now().After(consent.ExpiryDate) {
-		return false, nil
+	if !consent.StartDate.IsZero() && now.Before(consent.StartDate) {
+		return false
 	}
 
-	return true, nil
+	return true
+}
+
+// consentIDFor builds the conventional consent ID (patientID-doctorID-recordID)
+func consentIDFor(patientID string, doctorID string, recordID string) string {
+	return fmt.Sprintf("%s-%s-%s", patientID, doctorID, recordID)
 }
 
 // QueryConsentsByPatient retrieves all consent records for a patient
@@ -172,7 +379,13 @@ func (s *SmartContract) QueryConsentsByPatient(
 	ctx contractapi.TransactionContextInterface,
 	patientID string,
 ) ([]*ConsentRecord, error) {
-	queryString := fmt.Sprintf(`{"selector":{"patientId":"%s"}}`, patientID)
+	// Merged patient IDs are redirected to the surviving ID
+	patientID, err := s.resolvePatientID(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	queryString := fmt.Sprintf(`{"selector":{"patientId":"%s","consentId":{"$exists":true}}}`, patientID)
 	
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
 	if err != nil {
@@ -203,6 +416,11 @@ func (s *SmartContract) QueryConsentsByDoctor(
 	ctx contractapi.TransactionContextInterface,
 	doctorID string,
 ) ([]*ConsentRecord, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	queryString := fmt.Sprintf(`{"selector":{"doctorId":"%s","granted":true}}`, doctorID)
 	
 	resultsIterator, err := ctx.GetStub().GetQueryResult(queryString)
@@ -225,7 +443,7 @@ func (s *SmartContract) QueryConsentsByDoctor(
 		}
 
 		// Filter out expired consents
-		if time.Now().Before(consent.ExpiryDate) {
+		if now.Before(consent.ExpiryDate) {
 			results = append(results, &consent)
 		}
 	}
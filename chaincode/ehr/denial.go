@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// EventAccessDenied is emitted with the AccessDecision of every denial committed, for alerting
+const EventAccessDenied = "AccessDenied"
+
+const (
+	maxDeniedOperationLength = 128
+	maxDenialReasonLength    = 1024
+)
+
+// AccessDecision is the outcome of an audited access request. Transaction responses are recorded
+// in the block, so it never carries record content.
+type AccessDecision struct {
+	RecordID  string `json:"recordId"`
+	ActorID   string `json:"actorId"`
+	Operation string `json:"operation"`
+	Granted   bool   `json:"granted"`
+	Reason    string `json:"reason,omitempty" metadata:",optional"` // Why access was denied
+	TxID      string `json:"txId"`                                  // Transaction that committed the audit entry
+}
+
+// RequestRecordAccess checks the caller's access to the latest version of a record and commits
+// the decision to the audit trail. A denial is returned as a decision rather than an error, so the
+// transaction, and with it the trace of the attempt, is committed. Clients submit it before
+// evaluating QueryEHR.
+func (s *SmartContract) RequestRecordAccess(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*AccessDecision, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	decision := &AccessDecision{
+		RecordID:  recordID,
+		ActorID:   callerID,
+		Operation: "QueryEHR",
+		TxID:      ctx.GetStub().GetTxID(),
+	}
+
+	metadata, err := s.latestEHR(ctx, recordID)
+	if err == nil {
+		_, err = s.readableRecord(ctx, metadata)
+	}
+	if err != nil && !isDenial(err) {
+		return nil, err
+	}
+
+	patientID := ""
+	if metadata != nil {
+		patientID = metadata.PatientID
+	}
+
+	if err != nil {
+		decision.Reason = err.Error()
+		return decision, s.commitDenial(ctx, decision, patientID)
+	}
+
+	decision.Granted = true
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionViewEHR, callerID, patientID, recordID, patientID, true, "Access to record granted")
+	if err != nil {
+		return nil, err
+	}
+
+	return decision, nil
+}
+
+// RecordAccessDenied records an attempt that was denied while being evaluated, which commits
+// nothing. The backend submits it with its admin identity on behalf of the user it served; users
+// may also record their own.
+func (s *SmartContract) RecordAccessDenied(
+	ctx contractapi.TransactionContextInterface,
+	actorID string,
+	operation string,
+	recordID string,
+	reason string,
+) (*AccessDecision, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if actorID != callerID {
+		err = s.RequireRole(ctx, RoleAdmin)
+		if err != nil {
+			return nil, fmt.Errorf("%w: only admin can record denials of other users", errUnauthorized)
+		}
+	}
+
+	var errs ValidationErrors
+	if actorID == "" {
+		errs.add("actorId", "is required")
+	}
+	if operation == "" {
+		errs.add("operation", "is required")
+	} else if len(operation) > maxDeniedOperationLength {
+		errs.add("operation", "must be at most %d characters", maxDeniedOperationLength)
+	}
+	if reason == "" {
+		errs.add("reason", "is required")
+	} else if len(reason) > maxDenialReasonLength {
+		errs.add("reason", "must be at most %d characters", maxDenialReasonLength)
+	}
+	if err := errs.errOrNil(); err != nil {
+		return nil, err
+	}
+
+	patientID := ""
+	if recordID != "" {
+		baseRecordID, _ := splitComponentRef(recordID)
+		metadata, err := s.lookupEHR(ctx, baseRecordID)
+		if err == nil && metadata != nil {
+			patientID = metadata.PatientID
+		}
+	}
+
+	decision := &AccessDecision{
+		RecordID:  recordID,
+		ActorID:   actorID,
+		Operation: operation,
+		Reason:    reason,
+		TxID:      ctx.GetStub().GetTxID(),
+	}
+	if actorID != callerID {
+		decision.Reason = fmt.Sprintf("%s (recorded by %s)", reason, callerID)
+	}
+
+	return decision, s.commitDenial(ctx, decision, patientID)
+}
+
+// QueryAccessDenials returns the audit entries of denied and failed attempts, of one actor or,
+// with an empty actor ID, of everyone
+func (s *SmartContract) QueryAccessDenials(
+	ctx contractapi.TransactionContextInterface,
+	actorID string,
+) ([]*AuditLog, error) {
+	err := s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	// Audit entries are the only documents with a success field
+	selector := map[string]interface{}{"success": false}
+	if actorID != "" {
+		selector["actorId"] = actorID
+	}
+	queryJSON, err := json.Marshal(map[string]interface{}{"selector": selector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	logs, err := s.getAuditQueryResult(ctx, string(queryJSON))
+	if err != nil {
+		return nil, err
+	}
+	if logs == nil {
+		logs = []*AuditLog{}
+	}
+
+	return logs, nil
+}
+
+// commitDenial audits a denial and emits it
+func (s *SmartContract) commitDenial(
+	ctx contractapi.TransactionContextInterface,
+	decision *AccessDecision,
+	patientID string,
+) error {
+	// Create audit log
+	err := s.createAuditLog(ctx, ActionAccessDenied, decision.ActorID, patientID, decision.RecordID, patientID, false,
+		fmt.Sprintf("%s denied: %s", decision.Operation, decision.Reason))
+	if err != nil {
+		return err
+	}
+
+	decisionJSON, err := json.Marshal(decision)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+	err = ctx.GetStub().SetEvent(EventAccessDenied, decisionJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
+
+// isDenial reports whether an error refuses the caller, rather than failing: authorization errors,
+// and records that do not exist, which probing also runs into
+func isDenial(err error) bool {
+	return errors.Is(err, errUnauthorized) || errors.Is(err, errNotFound)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// unreadableStub fails reads of one key, as a peer would with a broken state database
+type unreadableStub struct {
+	*shimtest.MockStub
+	key string
+}
+
+func (s *unreadableStub) GetState(key string) ([]byte, error) {
+	if key == s.key {
+		return nil, errors.New("couchdb: database does not exist")
+	}
+	return s.MockStub.GetState(key)
+}
+
+// TestAccessDenials tests that denied access requests are committed to the audit trail instead
+// of failing, so probing leaves a trace
+func TestAccessDenials(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	adminCtx := newQueryContext(stub, adminIdentity("admin1"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	// A doctor without consent is denied, and the transaction still commits
+	var decision *AccessDecision
+	err = inTx(stub, "tx2", func() error {
+		var err error
+		decision, err = s.RequestRecordAccess(doctorCtx, "EHR-001")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.False(t, decision.Granted)
+	assert.Contains(t, decision.Reason, "unauthorized")
+	assert.Equal(t, "tx2", decision.TxID)
+
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventAccessDenied, event.EventName)
+	var denied AccessDecision
+	assert.NoError(t, json.Unmarshal(event.Payload, &denied))
+	assert.Equal(t, "doctor456", denied.ActorID)
+
+	// Probing for record IDs is denied and traced too
+	for _, recordID := range []string{"EHR-002", "EHR-003", "EHR-004"} {
+		err = inTx(stub, "tx-probe-"+recordID, func() error {
+			decision, err := s.RequestRecordAccess(doctorCtx, recordID)
+			if err == nil {
+				assert.False(t, decision.Granted)
+				assert.Contains(t, decision.Reason, "does not exist")
+			}
+			return err
+		})
+		assert.NoError(t, err)
+		<-stub.ChaincodeEventsChannel
+	}
+
+	denials, err := s.QueryAccessDenials(adminCtx, "doctor456")
+	assert.NoError(t, err)
+	assert.Len(t, denials, 4)
+	for _, denial := range denials {
+		assert.Equal(t, ActionAccessDenied, denial.Action)
+		assert.False(t, denial.Success)
+	}
+
+	// The denial on the patient's record is in the patient's audit chain
+	report, err := s.VerifyAuditChain(patientCtx, "patient123", 0, 0)
+	assert.NoError(t, err)
+	assert.True(t, report.Valid)
+	assert.Equal(t, 2, report.Checked)
+
+	_, err = s.QueryAccessDenials(newQueryContext(stub, doctorIdentity("doctor456")), "")
+	assert.ErrorContains(t, err, "requires role admin")
+
+	// Granted requests are audited as views
+	err = inTx(stub, "tx3", func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor456", "*"), "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+	err = inTx(stub, "tx4", func() error {
+		var err error
+		decision, err = s.RequestRecordAccess(doctorCtx, "EHR-001")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.True(t, decision.Granted)
+	assert.Empty(t, decision.Reason)
+
+	views, err := s.QueryAuditLogsByAction(adminCtx, ActionViewEHR)
+	assert.NoError(t, err)
+	assert.Len(t, views, 1)
+
+	// The backend records denials it saw while evaluating, for the user it served
+	err = inTx(stub, "tx5", func() error {
+		decision, err = s.RecordAccessDenied(adminCtx, "doctor789", "GetMyRecordKey", "EHR-001", "unauthorized: no valid consent")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, decision.Reason, "recorded by admin1")
+	<-stub.ChaincodeEventsChannel
+
+	err = inTx(stub, "tx6", func() error {
+		_, err := s.RecordAccessDenied(doctorCtx, "doctor789", "GetMyRecordKey", "EHR-001", "unauthorized: no valid consent")
+		return err
+	})
+	assert.ErrorContains(t, err, "only admin can record denials of other users")
+
+	err = inTx(stub, "tx7", func() error {
+		_, err := s.RecordAccessDenied(adminCtx, "doctor789", "", "EHR-001", "")
+		return err
+	})
+	assert.ErrorContains(t, err, `"field":"operation"`)
+	assert.ErrorContains(t, err, `"field":"reason"`)
+
+	denials, err = s.QueryAccessDenials(adminCtx, "doctor789")
+	assert.NoError(t, err)
+	if assert.Len(t, denials, 1) {
+		assert.Equal(t, "EHR-001", denials[0].RecordID)
+		assert.Equal(t, "patient123", denials[0].PatientID)
+	}
+
+	denials, err = s.QueryAccessDenials(adminCtx, "")
+	assert.NoError(t, err)
+	assert.Len(t, denials, 5)
+}
+
+// TestDenialsAreTyped tests that only errors refusing the caller are committed as denials, and
+// that a failing read is returned as an error even when its message reads like a denial
+func TestDenialsAreTyped(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	metadata, err := s.latestEHR(doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, s.checkRecordAccess(doctorCtx, metadata), errUnauthorized)
+	_, err = s.latestEHR(doctorCtx, "EHR-404")
+	assert.ErrorIs(t, err, errNotFound)
+	assert.ErrorIs(t, s.RequireRole(doctorCtx, RoleAdmin), errUnauthorized)
+
+	doctorCtx.SetStub(&unreadableStub{stub, "EHR-001"})
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.RequestRecordAccess(doctorCtx, "EHR-001")
+		return err
+	})
+	assert.ErrorContains(t, err, "failed to read from world state")
+
+	denials, err := s.QueryAccessDenials(newQueryContext(stub, adminIdentity("admin1")), "doctor456")
+	assert.NoError(t, err)
+	assert.Empty(t, denials)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
@@ -15,40 +16,71 @@ type SmartContract struct {
 
 // EHRMetadata represents metadata for an electronic health record
 type EHRMetadata struct {
-	RecordID      string    `json:"recordId"`
-	PatientID     string    `json:"patientId"`
-	IPFSHash      string    `json:"ipfsHash"`
-	EncryptedKey  string    `json:"encryptedKey"`
-	Timestamp     time.Time `json:"timestamp"`
-	RecordType    string    `json:"recordType"`
-	Checksum      string    `json:"checksum"`
-	CreatedBy     string    `json:"createdBy"`
+	RecordID         string                 `json:"recordId"`
+	PatientID        string                 `json:"patientId"`
+	IPFSHash         string                 `json:"ipfsHash"`
+	EncryptedKey     string                 `json:"encryptedKey"`
+	Timestamp        time.Time              `json:"timestamp"`
+	RecordType       string                 `json:"recordType"`
+	Checksum         string                 `json:"checksum"`
+	CreatedBy        string                 `json:"createdBy"`
+	AuthorOrg        string                 `json:"authorOrg"` // MSP ID of the creator's organization
+	Version          int                    `json:"version"`
+	RootRecordID     string                 `json:"rootRecordId"`                                    // First version of the record
+	Supersedes       string                 `json:"supersedes"`                                      // Previous version, empty for the original
+	SupersededBy     string                 `json:"supersededBy"`                                    // Next version, empty for the latest
+	AmendReason      string                 `json:"amendReason"`                                     // Why this version was created
+	Confidentiality  string                 `json:"confidentiality"`                                 // HL7 confidentiality code, N by default
+	SensitivityTags  []string               `json:"sensitivityTags,omitempty" metadata:",optional"`  // e.g. PSY, HIV, ETH, GDIS or custom tags
+	Components       []EHRComponent         `json:"components,omitempty" metadata:",optional"`       // Manifest of a bundle record
+	Status           string                 `json:"status,omitempty" metadata:",optional"`           // ERASED for tombstones, ARCHIVED after archival
+	Erasure          *ErasureInfo           `json:"erasure,omitempty" metadata:",optional"`          // Set on tombstones
+	AuthorCredential string                 `json:"authorCredential,omitempty" metadata:",optional"` // License of a clinician author
+	Acknowledgement  *RecordAcknowledgement `json:"acknowledgement,omitempty" metadata:",optional"`  // Patient's review of a record authored for them
+	AuthorSignature  *RecordSignature       `json:"authorSignature,omitempty" metadata:",optional"`  // Author's signature over the record digest
+	EncounterID      string                 `json:"encounterId,omitempty" metadata:",optional"`      // Encounter the record belongs to
+	Retention        *RecordRetention       `json:"retention,omitempty" metadata:",optional"`        // Retention end under the applicable rule
+	Archival         *ArchivalInfo          `json:"archival,omitempty" metadata:",optional"`         // Set on archived records
+	MergedFrom       string                 `json:"mergedFrom,omitempty" metadata:",optional"`       // Patient ID the record was written for, if since merged
+	KeyVersion       int                    `json:"keyVersion,omitempty" metadata:",optional"`       // Data key version, 1 until the key is first rotated
+	KeyRotation      *KeyRotationInfo       `json:"keyRotation,omitempty" metadata:",optional"`      // Set once the data key has been rotated
+	PrivateData      *PrivateDataRef        `json:"privateData,omitempty" metadata:",optional"`      // Collection holding the key, and CID if private
 }
 
 // ConsentRecord represents consent given by patient to doctor
 type ConsentRecord struct {
-	ConsentID   string    `json:"consentId"`
-	PatientID   string    `json:"patientId"`
-	DoctorID    string    `json:"doctorId"`
-	RecordID    string    `json:"recordId"` // Empty string means all records
-	Granted     bool      `json:"granted"`
-	Timestamp   time.Time `json:"timestamp"`
-	ExpiryDate  time.Time `json:"expiryDate"`
-	GrantedBy   string    `json:"grantedBy"`
+	ConsentID         string    `json:"consentId"`
+	PatientID         string    `json:"patientId"`
+	DoctorID          string    `json:"doctorId"`
+	RecordID          string    `json:"recordId"` // Empty string means all records
+	Granted           bool      `json:"granted"`
+	Timestamp         time.Time `json:"timestamp"`
+	ExpiryDate        time.Time `json:"expiryDate"`
+	GrantedBy         string    `json:"grantedBy"`
+	StartDate         time.Time `json:"startDate"`                                        // Zero means effective immediately
+	Purposes          []string  `json:"purposes,omitempty" metadata:",optional"`          // Purpose of use codes (e.g. TREAT)
+	SensitivityOptIns []string  `json:"sensitivityOptIns,omitempty" metadata:",optional"` // Labels a broad consent also covers
+	Scopes            []string  `json:"scopes,omitempty" metadata:",optional"`            // read and/or write, read when empty
 }
 
 // AuditLog represents an audit trail entry
 type AuditLog struct {
-	LogID      string    `json:"logId"`
-	Action     string    `json:"action"`
-	ActorID    string    `json:"actorId"`
-	ActorRole  string    `json:"actorRole"`
-	TargetID   string    `json:"targetId"`
-	RecordID   string    `json:"recordId"`
-	Timestamp  time.Time `json:"timestamp"`
-	IPAddress  string    `json:"ipAddress"`
-	Success    bool      `json:"success"`
-	Message    string    `json:"message"`
+	LogID           string    `json:"logId"`
+	Action          string    `json:"action"`
+	ActorID         string    `json:"actorId"`
+	ActorRole       string    `json:"actorRole"`
+	TargetID        string    `json:"targetId"`
+	RecordID        string    `json:"recordId"`
+	Timestamp       time.Time `json:"timestamp"`
+	IPAddress       string    `json:"ipAddress"`
+	Success         bool      `json:"success"`
+	Message         string    `json:"message"`
+	Sequence        int       `json:"sequence"`                                       // Position in the global audit chain
+	PrevHash        string    `json:"prevHash"`                                       // Hash of the entry before in the global chain
+	PatientID       string    `json:"patientId,omitempty" metadata:",optional"`       // Patient whose chain the entry is also in
+	PatientSequence int       `json:"patientSequence,omitempty" metadata:",optional"` // Position in the patient's chain
+	PatientPrevHash string    `json:"patientPrevHash,omitempty" metadata:",optional"` // Hash of the entry before in the patient's chain
+	Hash            string    `json:"hash"`                                           // auditchain.Hash of the entry
 }
 
 // User roles
@@ -60,11 +92,48 @@ const (
 
 // Audit actions
 const (
-	ActionCreateEHR    = "CREATE_EHR"
-	ActionViewEHR      = "VIEW_EHR"
-	ActionGrantConsent = "GRANT_CONSENT"
-	ActionRevokeConsent = "REVOKE_CONSENT"
-	ActionCheckConsent = "CHECK_CONSENT"
+	ActionCreateEHR             = "CREATE_EHR"
+	ActionViewEHR               = "VIEW_EHR"
+	ActionGrantConsent          = "GRANT_CONSENT"
+	ActionRevokeConsent         = "REVOKE_CONSENT"
+	ActionCheckConsent          = "CHECK_CONSENT"
+	ActionImportConsent         = "IMPORT_FHIR_CONSENT"
+	ActionAmendEHR              = "AMEND_EHR"
+	ActionAmendmentRequest      = "AMENDMENT_REQUEST"
+	ActionEraseEHR              = "ERASE_EHR"
+	ActionSetRecordLabels       = "SET_RECORD_LABELS"
+	ActionSetConsentOptIns      = "SET_CONSENT_OPT_INS"
+	ActionLabelRestrictedAccess = "LABEL_RESTRICTED_ACCESS"
+	ActionSetRecordTypes        = "SET_RECORD_TYPE_VOCABULARY"
+	ActionSetConsentScopes      = "SET_CONSENT_SCOPES"
+	ActionAcknowledgeEHR        = "ACKNOWLEDGE_EHR"
+	ActionFlagEHR               = "FLAG_EHR"
+	ActionManageEncounter       = "MANAGE_ENCOUNTER"
+	ActionManageEpisode         = "MANAGE_EPISODE_OF_CARE"
+	ActionManageRetention       = "MANAGE_RETENTION"
+	ActionLegalHold             = "LEGAL_HOLD"
+	ActionArchiveEHR            = "ARCHIVE_EHR"
+	ActionMergePatients         = "MERGE_PATIENTS"
+	ActionUnmergePatients       = "UNMERGE_PATIENTS"
+	ActionCreateShareToken      = "CREATE_SHARE_TOKEN"
+	ActionRevokeShareToken      = "REVOKE_SHARE_TOKEN"
+	ActionExternalDisclosure    = "EXTERNAL_DISCLOSURE"
+	ActionSetRecordKeyPolicy    = "SET_RECORD_KEY_POLICY"
+	ActionGetRecordKey          = "GET_RECORD_KEY"
+	ActionRegisterPublicKey     = "REGISTER_PUBLIC_KEY"
+	ActionRotatePublicKey       = "ROTATE_PUBLIC_KEY"
+	ActionRevokePublicKey       = "REVOKE_PUBLIC_KEY"
+	ActionRotateRecordKey       = "ROTATE_RECORD_KEY"
+	ActionSetEscrowPolicy       = "SET_ESCROW_POLICY"
+	ActionEscrowRecordKey       = "ESCROW_RECORD_KEY"
+	ActionRequestEscrowRecovery = "REQUEST_ESCROW_RECOVERY"
+	ActionGetEscrowShare        = "GET_ESCROW_SHARE"
+	ActionSubmitEscrowShare     = "SUBMIT_ESCROW_SHARE"
+	ActionEscrowKeyReleased     = "ESCROW_KEY_RELEASED"
+	ActionIssueReEncryptionKey  = "ISSUE_REENCRYPTION_KEY"
+	ActionReEncryptRecordKey    = "REENCRYPT_RECORD_KEY"
+	ActionSealAuditBatch        = "SEAL_AUDIT_BATCH"
+	ActionAccessDenied          = "ACCESS_DENIED"
 )
 
 // Init initializes the chaincode
@@ -81,6 +150,7 @@ func (s *SmartContract) CreateEHRMetadata(
 	encryptedKey string,
 	recordType string,
 	checksum string,
+	authorSignature string,
 ) error {
 	// Get caller identity
 	callerID, err := s.GetCallerID(ctx)
@@ -88,55 +158,151 @@ func (s *SmartContract) CreateEHRMetadata(
 		return fmt.Errorf("failed to get caller ID: %v", err)
 	}
 
-	// Check if record already exists
-	existing, err := ctx.GetStub().GetState(recordID)
+	callerOrg, err := s.GetCallerMSPID(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to read from world state: %v", err)
+		return err
 	}
-	if existing != nil {
+
+	// Patients write their own records, doctors need a credential and a write-scoped consent
+	credential, err := s.requireRecordAuthor(ctx, patientID)
+	if err != nil {
+		return err
+	}
+
+	// Check if record already exists, erased records keep their ID
+	exists, err := s.ehrRecordExists(ctx, recordID)
+	if err != nil {
+		return err
+	}
+	if exists {
 		return fmt.Errorf("record %s already exists", recordID)
 	}
 
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
 	// Create metadata
 	metadata := EHRMetadata{
-		RecordID:     recordID,
-		PatientID:    patientID,
-		IPFSHash:     ipfsHash,
-		EncryptedKey: encryptedKey,
-		Timestamp:    time.Now(),
-		RecordType:   recordType,
-		Checksum:     checksum,
-		CreatedBy:    callerID,
+		RecordID:         recordID,
+		PatientID:        patientID,
+		IPFSHash:         ipfsHash,
+		EncryptedKey:     encryptedKey,
+		Timestamp:        now,
+		RecordType:       recordType,
+		Checksum:         checksum,
+		CreatedBy:        callerID,
+		AuthorOrg:        callerOrg,
+		AuthorCredential: credential,
+		Confidentiality:  ConfidentialityNormal,
+		Version:          1,
+		RootRecordID:     recordID,
 	}
 
-	metadataJSON, err := json.Marshal(metadata)
+	// Key material passed privately stays off the public ledger
+	err = s.applyPrivateRecordData(ctx, &metadata, nil)
 	if err != nil {
-		return fmt.Errorf("failed to marshal metadata: %v", err)
+		return err
+	}
+
+	// Validate every field, reporting all failures at once
+	err = s.validateEHRMetadata(ctx, &metadata, true)
+	if err != nil {
+		return err
+	}
+
+	// Retention follows the record type and the patient's jurisdiction
+	err = s.applyRetention(ctx, &metadata)
+	if err != nil {
+		return err
+	}
+
+	// The author vouches for the normalized record
+	err = s.signRecord(ctx, &metadata, authorSignature)
+	if err != nil {
+		return err
 	}
 
 	// Save to ledger
-	err = ctx.GetStub().PutState(recordID, metadataJSON)
+	err = s.putEHRMetadata(ctx, &metadata)
 	if err != nil {
-		return fmt.Errorf("failed to put to world state: %v", err)
+		return err
 	}
 
-	// Create audit log
-	s.CreateAuditLog(ctx, ActionCreateEHR, callerID, patientID, recordID, true, "EHR metadata created")
+	err = notifyPatient(ctx, &metadata)
+	if err != nil {
+		return err
+	}
 
-	return nil
+	// Create audit log
+	return s.createAuditLog(ctx, ActionCreateEHR, callerID, patientID, recordID, patientID, true, "EHR metadata created")
 }
 
-// QueryEHR retrieves an EHR metadata record
+// QueryEHR retrieves the latest version of an EHR metadata record
 func (s *SmartContract) QueryEHR(
 	ctx contractapi.TransactionContextInterface,
 	recordID string,
+) (*EHRMetadata, error) {
+	metadata, err := s.latestEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readableRecord(ctx, metadata)
+}
+
+// errNotFound is wrapped by the errors of lookups that find nothing
+var errNotFound = errors.New("does not exist")
+
+// latestEHR follows the amendment chain of a record forward to its latest version
+func (s *SmartContract) latestEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*EHRMetadata, error) {
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	for hops := 0; metadata.SupersededBy != "" && hops < maxVersionChain; hops++ {
+		metadata, err = s.readEHR(ctx, metadata.SupersededBy)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return metadata, nil
+}
+
+// readEHR loads exactly the requested version of an EHR metadata record
+func (s *SmartContract) readEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*EHRMetadata, error) {
+	metadata, err := s.lookupEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+	if metadata == nil {
+		return nil, fmt.Errorf("record %s %w", recordID, errNotFound)
+	}
+
+	return metadata, nil
+}
+
+// lookupEHR is readEHR for callers that treat unknown records as nil
+func (s *SmartContract) lookupEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
 ) (*EHRMetadata, error) {
 	metadataJSON, err := ctx.GetStub().GetState(recordID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read from world state: %v", err)
 	}
 	if metadataJSON == nil {
-		return nil, fmt.Errorf("record %s does not exist", recordID)
+		// Erased records are reported by their tombstone
+		return s.readTombstone(ctx, recordID)
 	}
 
 	var metadata EHRMetadata
@@ -145,17 +311,98 @@ func (s *SmartContract) QueryEHR(
 		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
 	}
 
+	// Records created before versioning are their own first version
+	if metadata.Version == 0 {
+		metadata.Version = 1
+		metadata.RootRecordID = metadata.RecordID
+	}
+
+	// Records created before labeling have normal confidentiality
+	if metadata.Confidentiality == "" {
+		metadata.Confidentiality = ConfidentialityNormal
+	}
+
+	err = s.loadPrivateRecordData(ctx, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
 	return &metadata, nil
 }
 
-// QueryEHRsByPatient retrieves all EHR records for a patient
+// putEHRMetadata saves one version of a record, with its key material in private data if it
+// is kept there
+func (s *SmartContract) putEHRMetadata(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) error {
+	public, err := s.publicEHRMetadata(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	metadataJSON, err := json.Marshal(public)
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(metadata.RecordID, metadataJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// QueryEHRsByPatient retrieves the EHR records of a patient that the caller may read
 func (s *SmartContract) QueryEHRsByPatient(
 	ctx contractapi.TransactionContextInterface,
 	patientID string,
 ) ([]*EHRMetadata, error) {
-	queryString := fmt.Sprintf(`{"selector":{"patientId":"%s"}}`, patientID)
+	// Merged patient IDs are redirected to the surviving ID
+	patientID, err := s.resolvePatientID(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only EHR metadata documents and tombstones carry an IPFS hash
+	queryString := fmt.Sprintf(`{"selector":{"patientId":"%s","ipfsHash":{"$exists":true}}}`, patientID)
 	
-	return s.getQueryResultForQueryString(ctx, queryString)
+	records, err := s.getQueryResultForQueryString(ctx, queryString)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readableRecords(ctx, records)
+}
+
+// readableRecords keeps the records the caller may read. Bundles are kept with the components
+// the caller has consent for.
+func (s *SmartContract) readableRecords(
+	ctx contractapi.TransactionContextInterface,
+	records []*EHRMetadata,
+) ([]*EHRMetadata, error) {
+	accessible := []*EHRMetadata{}
+	for _, metadata := range records {
+		allowed, _, err := s.recordAccess(ctx, metadata)
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			accessible = append(accessible, metadata)
+			continue
+		}
+
+		view, err := s.bundleView(ctx, metadata)
+		if err != nil {
+			return nil, err
+		}
+		if view != nil {
+			accessible = append(accessible, view)
+		}
+	}
+
+	return accessible, nil
 }
 
 // getQueryResultForQueryString executes a CouchDB query
@@ -198,6 +445,16 @@ func (s *SmartContract) GetCallerID(ctx contractapi.TransactionContextInterface)
 	return b64ID, nil
 }
 
+// GetCallerMSPID returns the MSP ID of the caller's organization
+func (s *SmartContract) GetCallerMSPID(ctx contractapi.TransactionContextInterface) (string, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to get caller MSP ID: %v", err)
+	}
+
+	return mspID, nil
+}
+
 // GetCallerRole extracts the caller's role from certificate attributes
 func (s *SmartContract) GetCallerRole(ctx contractapi.TransactionContextInterface) (string, error) {
 	// Try to get role attribute from certificate
@@ -212,3 +469,14 @@ func (s *SmartContract) GetCallerRole(ctx contractapi.TransactionContextInterfac
 
 	return role, nil
 }
+
+// txTime returns the transaction timestamp. Endorsing peers run a transaction at different
+// moments, so anything written to the ledger uses this rather than the peer's clock.
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	txTimestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	return txTimestamp.AsTime(), nil
+}
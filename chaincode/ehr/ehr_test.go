@@ -2,16 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // TestInit tests chaincode initialization
 func TestInit(t *testing.T) {
-	cc := new(EHRChaincode)
+	cc, err := contractapi.NewChaincode(NewSmartContract())
+	assert.NoError(t, err, "contract metadata is invalid")
+
 	stub := shimtest.NewMockStub("ehr", cc)
 
 	// Test Init
@@ -21,28 +27,17 @@ func TestInit(t *testing.T) {
 
 // TestCreateEHRMetadata tests EHR creation
 func TestCreateEHRMetadata(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-
-	// Initialize
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator as patient
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Create EHR
-	args := [][]byte{
-		[]byte("CreateEHRMetadata"),
-		[]byte("EHR-001"),
-		[]byte("patient123"),
-		[]byte("QmTestHash123"),
-		[]byte("encryptedKey123"),
-		[]byte("Lab Report"),
-		[]byte("abc123checksum"),
-	}
-
-	res := stub.MockInvoke("2", args)
-	assert.Equal(t, int32(shim.OK), res.Status, "CreateEHRMetadata failed: "+res.Message)
+	err := inTx(stub, "2", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(ctx, "EHR-001", "patient123", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.NoError(t, err, "CreateEHRMetadata failed")
 
 	// Verify stored data
 	state, err := stub.GetState("EHR-001")
@@ -54,143 +49,129 @@ func TestCreateEHRMetadata(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "EHR-001", metadata.RecordID)
 	assert.Equal(t, "patient123", metadata.PatientID)
-	assert.Equal(t, "QmTestHash123", metadata.IPFSHash)
+	assert.Equal(t, testCID("hash"), metadata.IPFSHash)
+	assert.Equal(t, "patient123", metadata.CreatedBy)
+	assert.Equal(t, "PatientMSP", metadata.AuthorOrg)
 }
 
 // TestQueryEHR tests querying an EHR record
 func TestQueryEHR(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator as patient
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Create EHR first
-	createArgs := [][]byte{
-		[]byte("CreateEHRMetadata"),
-		[]byte("EHR-001"),
-		[]byte("patient123"),
-		[]byte("QmTestHash123"),
-		[]byte("encryptedKey123"),
-		[]byte("Lab Report"),
-		[]byte("abc123checksum"),
-	}
-	stub.MockInvoke("2", createArgs)
+	err := inTx(stub, "2", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(ctx, "EHR-001", "patient123", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.NoError(t, err)
 
 	// Query EHR
-	queryArgs := [][]byte{
-		[]byte("QueryEHR"),
-		[]byte("EHR-001"),
-	}
-
-	res := stub.MockInvoke("3", queryArgs)
-	assert.Equal(t, int32(shim.OK), res.Status, "QueryEHR failed")
-
-	var metadata EHRMetadata
-	err := json.Unmarshal(res.Payload, &metadata)
-	assert.NoError(t, err)
+	metadata, err := s.QueryEHR(ctx, "EHR-001")
+	assert.NoError(t, err, "QueryEHR failed")
 	assert.Equal(t, "EHR-001", metadata.RecordID)
 }
 
 // TestGrantConsent tests consent granting
 func TestGrantConsent(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator as patient
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Grant consent
-	args := [][]byte{
-		[]byte("GrantConsent"),
-		[]byte("consent-001"),
-		[]byte("patient123"),
-		[]byte("doctor456"),
-		[]byte("EHR-001"),
-		[]byte("30"), // 30 days
-	}
-
-	res := stub.MockInvoke("2", args)
-	assert.Equal(t, int32(shim.OK), res.Status, "GrantConsent failed: "+res.Message)
+	err := inTx(stub, "2", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err, "GrantConsent failed")
 
 	// Verify consent stored
-	state, err := stub.GetState("consent-001")
+	state, err := stub.GetState("patient123-doctor456-EHR-001")
 	assert.NoError(t, err)
 	assert.NotNil(t, state)
 }
 
 // TestCheckConsent tests consent verification
 func TestCheckConsent(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator as patient for consent grant
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Grant consent first
-	grantArgs := [][]byte{
-		[]byte("GrantConsent"),
-		[]byte("consent-001"),
-		[]byte("patient123"),
-		[]byte("doctor456"),
-		[]byte("EHR-001"),
-		[]byte("30"),
-	}
-	stub.MockInvoke("2", grantArgs)
+	err := inTx(stub, "2", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
 
 	// Now check as doctor
-	stub.Creator = []byte(`{"mspid":"HospitalMSP","id":"doctor456"}`)
-
-	checkArgs := [][]byte{
-		[]byte("CheckConsent"),
-		[]byte("patient123"),
-		[]byte("doctor456"),
-		[]byte("EHR-001"),
-	}
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
 
-	res := stub.MockInvoke("3", checkArgs)
-	assert.Equal(t, int32(shim.OK), res.Status, "CheckConsent failed")
+	hasConsent, err := s.CheckConsent(doctorCtx, "patient123", "doctor456", "EHR-001")
+	assert.NoError(t, err, "CheckConsent failed")
+	assert.True(t, hasConsent, "Should have consent")
+}
 
-	var hasConsent bool
-	err := json.Unmarshal(res.Payload, &hasConsent)
+// TestConsentExpiresAtTxTime tests that expiry is judged against the transaction timestamp
+func TestConsentExpiresAtTxTime(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	grantedAt := time.Now().Truncate(time.Second)
+	err := inTx(stub, "2", func() error {
+		stub.TxTimestamp = timestamppb.New(grantedAt)
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
 	assert.NoError(t, err)
-	assert.True(t, hasConsent, "Should have consent")
+
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	checkAt := func(txID string, at time.Time) bool {
+		var hasConsent bool
+		err := inTx(stub, txID, func() error {
+			stub.TxTimestamp = timestamppb.New(at)
+			var err error
+			hasConsent, err = s.CheckConsent(doctorCtx, "patient123", "doctor456", "EHR-001")
+			return err
+		})
+		assert.NoError(t, err)
+		return hasConsent
+	}
+
+	assert.True(t, checkAt("3", grantedAt.AddDate(0, 0, 29)))
+	assert.False(t, checkAt("4", grantedAt.AddDate(0, 0, 31)), "Consent should have expired")
 }
 
 // TestRevokeConsent tests consent revocation
 func TestRevokeConsent(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator as patient
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Grant consent
-	grantArgs := [][]byte{
-		[]byte("GrantConsent"),
-		[]byte("consent-001"),
-		[]byte("patient123"),
-		[]byte("doctor456"),
-		[]byte("EHR-001"),
-		[]byte("30"),
-	}
-	stub.MockInvoke("2", grantArgs)
+	err := inTx(stub, "2", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
 
 	// Revoke consent
-	revokeArgs := [][]byte{
-		[]byte("RevokeConsent"),
-		[]byte("consent-001"),
-	}
-
-	res := stub.MockInvoke("3", revokeArgs)
-	assert.Equal(t, int32(shim.OK), res.Status, "RevokeConsent failed")
+	err = inTx(stub, "3", func() error {
+		return s.RevokeConsent(ctx, "patient123-doctor456-EHR-001")
+	})
+	assert.NoError(t, err, "RevokeConsent failed")
 
 	// Check consent is revoked
-	state, err := stub.GetState("consent-001")
+	state, err := stub.GetState("patient123-doctor456-EHR-001")
 	assert.NoError(t, err)
 
 	var consent ConsentRecord
@@ -199,135 +180,178 @@ func TestRevokeConsent(t *testing.T) {
 	assert.False(t, consent.Granted, "Consent should be revoked")
 }
 
+// TestConsentAuthorization tests that only the patient or an admin grants and revokes consent
+func TestConsentAuthorization(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+
+	// A doctor cannot grant themselves access
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.GrantConsent(doctorCtx, "patient123-doctor456-*", "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, "unauthorized")
+
+	// Consent IDs must follow the convention access checks look them up by
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.GrantConsent(patientCtx, "consent-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, `"field":"consentId"`)
+
+	err = inTx(stub, "tx3", func() error {
+		_, err := s.GrantConsent(patientCtx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// Only the patient or an admin revokes it
+	err = inTx(stub, "tx4", func() error {
+		return s.RevokeConsent(doctorCtx, "patient123-doctor456-EHR-001")
+	})
+	assert.ErrorContains(t, err, "unauthorized")
+
+	err = inTx(stub, "tx5", func() error {
+		return s.RevokeConsent(newTestContext(stub, patientIdentity("patient999")), "patient123-doctor456-EHR-001")
+	})
+	assert.ErrorContains(t, err, "unauthorized")
+
+	err = inTx(stub, "tx6", func() error {
+		return s.RevokeConsent(adminCtx, "patient123-doctor456-EHR-001")
+	})
+	assert.NoError(t, err)
+
+	// A patient whose ID ends like another's cannot take over that patient's consent ID
+	err = inTx(stub, "tx7", func() error {
+		_, err := s.GrantConsent(newTestContext(stub, patientIdentity("patient123-doctor456")), "patient123-doctor456-EHR-001", "patient123-doctor456", "EHR", "001", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, "belongs to another grant")
+}
+
 // TestCreateAuditLog tests audit logging
 func TestCreateAuditLog(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Any operation should create audit log
 	// Create EHR (which internally creates audit log)
-	args := [][]byte{
-		[]byte("CreateEHRMetadata"),
-		[]byte("EHR-001"),
-		[]byte("patient123"),
-		[]byte("QmTestHash123"),
-		[]byte("encryptedKey123"),
-		[]byte("Lab Report"),
-		[]byte("abc123checksum"),
-	}
-
-	res := stub.MockInvoke("2", args)
-	assert.Equal(t, int32(shim.OK), res.Status)
+	err := inTx(stub, "2", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(ctx, "EHR-001", "patient123", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.NoError(t, err)
 
-	// Note: Audit logs are created internally, we would need to query them
-	// In a real implementation, we'd query by record or actor
+	iterator, err := stub.GetStateByPartialCompositeKey("audit", []string{ActionCreateEHR})
+	assert.NoError(t, err)
+	defer iterator.Close()
+	if assert.True(t, iterator.HasNext(), "CreateEHRMetadata should be audited") {
+		entry, _ := iterator.Next()
+		var log AuditLog
+		assert.NoError(t, json.Unmarshal(entry.Value, &log))
+		assert.Equal(t, "EHR-001", log.RecordID)
+		assert.True(t, log.Success)
+	}
 }
 
 // TestRoleBasedAccess tests RBAC
 func TestRoleBasedAccess(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Test 1: Patient can create their own EHR
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
-
-	args := [][]byte{
-		[]byte("CreateEHRMetadata"),
-		[]byte("EHR-001"),
-		[]byte("patient123"),
-		[]byte("QmTestHash123"),
-		[]byte("encryptedKey123"),
-		[]byte("Lab Report"),
-		[]byte("abc123checksum"),
-	}
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
-	res := stub.MockInvoke("2", args)
-	assert.Equal(t, int32(shim.OK), res.Status, "Patient should create own EHR")
+	err := inTx(stub, "2", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(ctx, "EHR-001", "patient123", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.NoError(t, err, "Patient should create own EHR")
 
 	// Test 2: Patient cannot create EHR for another patient
-	args[2] = []byte("patient999") // Different patient ID
-
-	res = stub.MockInvoke("3", args)
-	assert.NotEqual(t, int32(shim.OK), res.Status, "Should fail - wrong patient")
-
-	// Test 3: Doctor cannot create EHR
-	stub.Creator = []byte(`{"mspid":"HospitalMSP","id":"doctor456"}`)
-
-	res = stub.MockInvoke("4", args)
-	assert.NotEqual(t, int32(shim.OK), res.Status, "Doctor should not create EHR")
+	err = inTx(stub, "3", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-002", "patient999", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(ctx, "EHR-002", "patient999", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.Error(t, err, "Should fail - wrong patient")
+
+	// Test 3: Doctor cannot create EHR without write consent
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err = inTx(stub, "4", func() error {
+		return s.CreateEHRMetadata(doctorCtx, "EHR-002", "patient123", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(doctorCtx, "EHR-002", "patient123", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.Error(t, err, "Doctor should not create EHR")
+
+	// Test 4: Admin can create EHR for any patient
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+
+	err = inTx(stub, "5", func() error {
+		return s.CreateEHRMetadata(adminCtx, "EHR-002", "patient999", testCID("hash"), "encryptedKey123", "Lab Report", testChecksum("abc123"), testSignature(adminCtx, "EHR-002", "patient999", testCID("hash"), testChecksum("abc123"), "Lab Report"))
+	})
+	assert.NoError(t, err, "Admin should create EHR")
 }
 
 // TestQueryEHRsByPatient tests querying all patient records
 func TestQueryEHRsByPatient(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Set creator as patient
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
 
 	// Create multiple EHRs
 	for i := 1; i <= 3; i++ {
-		args := [][]byte{
-			[]byte("CreateEHRMetadata"),
-			[]byte("EHR-00" + string(rune(48+i))), // EHR-001, EHR-002, EHR-003
-			[]byte("patient123"),
-			[]byte("QmTestHash" + string(rune(48+i))),
-			[]byte("encKey" + string(rune(48+i))),
-			[]byte("Lab Report " + string(rune(48+i))),
-			[]byte("checksum" + string(rune(48+i))),
-		}
-		stub.MockInvoke(string(rune(48+i)), args)
+		recordID := fmt.Sprintf("EHR-00%d", i) // EHR-001, EHR-002, EHR-003
+		ipfsHash := testCID(fmt.Sprint("hash", i))
+		recordType := fmt.Sprint("Lab Report ", i)
+		checksum := testChecksum(fmt.Sprint("checksum", i))
+
+		err := inTx(stub, fmt.Sprint(i), func() error {
+			return s.CreateEHRMetadata(ctx, recordID, "patient123", ipfsHash, fmt.Sprint("encKey", i), recordType, checksum,
+				testSignature(ctx, recordID, "patient123", ipfsHash, checksum, recordType))
+		})
+		assert.NoError(t, err)
 	}
 
-	// Query all patient records
-	queryArgs := [][]byte{
-		[]byte("QueryEHRsByPatient"),
-		[]byte("patient123"),
+	// Note: MockStub doesn't support rich queries, so records are verified in world state
+	for i := 1; i <= 3; i++ {
+		metadata, err := s.QueryEHR(ctx, fmt.Sprintf("EHR-00%d", i))
+		assert.NoError(t, err)
+		assert.Equal(t, "patient123", metadata.PatientID)
 	}
-
-	res := stub.MockInvoke("10", queryArgs)
-	assert.Equal(t, int32(shim.OK), res.Status, "QueryEHRsByPatient failed")
-
-	// Note: In real CouchDB, this would return array of records
-	// MockStub doesn't support rich queries, so we just verify it doesn't error
 }
 
 // TestAccessControl tests that doctors can only access with consent
 func TestAccessControl(t *testing.T) {
-	cc := new(EHRChaincode)
-	stub := shimtest.NewMockStub("ehr", cc)
-	stub.MockInit("1", [][]byte{})
+	s := new(SmartContract)
+	stub := newTestStub()
 
 	// Patient creates EHR
-	stub.Creator = []byte(`{"mspid":"PatientMSP","id":"patient123"}`)
-
-	createArgs := [][]byte{
-		[]byte("CreateEHRMetadata"),
-		[]byte("EHR-001"),
-		[]byte("patient123"),
-		[]byte("QmTestHash"),
-		[]byte("encKey"),
-		[]byte("Lab Report"),
-		[]byte("checksum"),
-	}
-	stub.MockInvoke("1", createArgs)
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	err := inTx(stub, "1", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("hash"), "encKey", "Lab Report", testChecksum("checksum"), testSignature(ctx, "EHR-001", "patient123", testCID("hash"), testChecksum("checksum"), "Lab Report"))
+	})
+	assert.NoError(t, err)
 
 	// Doctor tries to access without consent
-	stub.Creator = []byte(`{"mspid":"HospitalMSP","id":"doctor456"}`)
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
 
-	queryArgs := [][]byte{
-		[]byte("QueryEHR"),
-		[]byte("EHR-001"),
-	}
+	_, err = s.QueryEHR(doctorCtx, "EHR-001")
+	assert.Error(t, err, "Doctor should not read without consent")
 
-	// This should work (query is allowed), but in practice doctor would check consent first
-	res := stub.MockInvoke("2", queryArgs)
-	// Note: Our implementation allows query but access control happens in backend
-	assert.Equal(t, int32(shim.OK), res.Status)
+	// Access is granted once the patient consents
+	err = inTx(stub, "2", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	metadata, err := s.QueryEHR(doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "EHR-001", metadata.RecordID)
 }
@@ -0,0 +1,985 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Encounter statuses (FHIR R4 Encounter.status)
+const (
+	EncounterPlanned        = "planned"
+	EncounterInProgress     = "in-progress"
+	EncounterFinished       = "finished"
+	EncounterCancelled      = "cancelled"
+	EncounterEnteredInError = "entered-in-error"
+)
+
+// Episode of care statuses (FHIR R4 EpisodeOfCare.status)
+const (
+	EpisodePlanned        = "planned"
+	EpisodeWaitlist       = "waitlist"
+	EpisodeActive         = "active"
+	EpisodeOnHold         = "onhold"
+	EpisodeFinished       = "finished"
+	EpisodeCancelled      = "cancelled"
+	EpisodeEnteredInError = "entered-in-error"
+)
+
+// Consent record IDs covering every record of an encounter or episode of care
+const (
+	encounterConsentPrefix = "encounter:"
+	episodeConsentPrefix   = "episode:"
+)
+
+const (
+	encounterDocType      = "encounter"
+	episodeDocType        = "episodeOfCare"
+	encounterRecordIndex  = "encounter~record"
+	episodeEncounterIndex = "episode~encounter"
+	maxCareParticipants   = 50
+)
+
+var encounterStatuses = map[string]bool{
+	EncounterPlanned:        true,
+	EncounterInProgress:     true,
+	EncounterFinished:       true,
+	EncounterCancelled:      true,
+	EncounterEnteredInError: true,
+}
+
+var episodeStatuses = map[string]bool{
+	EpisodePlanned:        true,
+	EpisodeWaitlist:       true,
+	EpisodeActive:         true,
+	EpisodeOnHold:         true,
+	EpisodeFinished:       true,
+	EpisodeCancelled:      true,
+	EpisodeEnteredInError: true,
+}
+
+// CareParticipant is a member of the care team of an encounter or episode
+type CareParticipant struct {
+	ParticipantID string `json:"participantId"`
+	Role          string `json:"role"` // e.g. attender, consultant, nurse
+}
+
+// CarePeriod is when an encounter or episode took place
+type CarePeriod struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"` // Zero while ongoing
+}
+
+// Encounter is one interaction between a patient and providers, such as an admission or visit
+type Encounter struct {
+	DocType       string            `json:"docType"`
+	EncounterID   string            `json:"encounterId"`
+	PatientID     string            `json:"patientId"`
+	EpisodeID     string            `json:"episodeId,omitempty" metadata:",optional"`
+	EncounterType string            `json:"encounterType"` // e.g. inpatient admission, outpatient visit
+	Facility      string            `json:"facility"`
+	Participants  []CareParticipant `json:"participants"`
+	Period        CarePeriod        `json:"period"`
+	Status        string            `json:"status"`
+	CreatedBy     string            `json:"createdBy"`
+	AuthorOrg     string            `json:"authorOrg"`
+	Timestamp     time.Time         `json:"timestamp"`
+}
+
+// EpisodeOfCare groups the encounters of one condition or course of treatment, such as a
+// course of chemotherapy
+type EpisodeOfCare struct {
+	DocType      string            `json:"docType"`
+	EpisodeID    string            `json:"episodeId"`
+	PatientID    string            `json:"patientId"`
+	EpisodeType  string            `json:"episodeType"`
+	ManagingOrg  string            `json:"managingOrg"` // MSP ID of the organization responsible for the episode
+	Participants []CareParticipant `json:"participants"`
+	Period       CarePeriod        `json:"period"`
+	Status       string            `json:"status"`
+	CreatedBy    string            `json:"createdBy"`
+	Timestamp    time.Time         `json:"timestamp"`
+}
+
+// CreateEncounter records an encounter for a patient
+func (s *SmartContract) CreateEncounter(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+	patientID string,
+	encounterType string,
+	facility string,
+	participants []CareParticipant,
+	periodStart string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Same rule as writing a record for the patient
+	_, err = s.requireRecordAuthor(ctx, patientID)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	start, err := validateCareEntity("encounterId", encounterID, encounterType, participants, periodStart, now)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.readEncounter(ctx, encounterID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("encounter %s already exists", encounterID)
+	}
+
+	encounter := Encounter{
+		DocType:       encounterDocType,
+		EncounterID:   encounterID,
+		PatientID:     patientID,
+		EncounterType: encounterType,
+		Facility:      facility,
+		Participants:  participants,
+		Period:        CarePeriod{Start: start},
+		Status:        EncounterInProgress,
+		CreatedBy:     callerID,
+		AuthorOrg:     callerOrg,
+		Timestamp:     now,
+	}
+	if start.After(encounter.Timestamp) {
+		encounter.Status = EncounterPlanned
+	}
+
+	err = s.putStateEntity(ctx, encounterDocType, encounterID, &encounter)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageEncounter, callerID, patientID, "", patientID, true,
+		fmt.Sprintf("Encounter %s created at %s", encounterID, facility))
+}
+
+// UpdateEncounterStatus moves an encounter to a new status. Finishing it closes its period.
+func (s *SmartContract) UpdateEncounterStatus(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+	status string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if !encounterStatuses[status] {
+		return fmt.Errorf("invalid encounter status %q", status)
+	}
+
+	encounter, err := s.getEncounter(ctx, encounterID)
+	if err != nil {
+		return err
+	}
+
+	err = s.requireCareTeam(ctx, encounter.CreatedBy, encounter.Participants)
+	if err != nil {
+		return err
+	}
+
+	err = checkCareStatusChange(encounter.Status, status, EncounterEnteredInError,
+		EncounterFinished, EncounterCancelled, EncounterEnteredInError)
+	if err != nil {
+		return fmt.Errorf("encounter %s: %v", encounterID, err)
+	}
+
+	previous := encounter.Status
+	encounter.Status = status
+	if status == EncounterFinished && encounter.Period.End.IsZero() {
+		encounter.Period.End, err = txTime(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.putStateEntity(ctx, encounterDocType, encounterID, encounter)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageEncounter, callerID, encounter.PatientID, "", encounter.PatientID, true,
+		fmt.Sprintf("Encounter %s moved from %s to %s", encounterID, previous, status))
+}
+
+// GetEncounter returns an encounter to its patient, its care team, admins and doctors with
+// consent on it
+func (s *SmartContract) GetEncounter(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+) (*Encounter, error) {
+	encounter, err := s.getEncounter(ctx, encounterID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkCareAccess(ctx, encounter.PatientID, encounter.CreatedBy, encounter.Participants, encounterScopes(encounter))
+	if err != nil {
+		return nil, err
+	}
+
+	return encounter, nil
+}
+
+// encounterScopes lists the consent record IDs that cover an encounter
+func encounterScopes(encounter *Encounter) []string {
+	scopes := []string{encounterConsentPrefix + encounter.EncounterID}
+	if encounter.EpisodeID != "" {
+		scopes = append(scopes, episodeConsentPrefix+encounter.EpisodeID)
+	}
+	return scopes
+}
+
+// LinkEHRToEncounter attaches every version of a record to an encounter of the same patient.
+// Amendments inherit the link.
+func (s *SmartContract) LinkEHRToEncounter(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	encounterID string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	encounter, err := s.getEncounter(ctx, encounterID)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	latest := versions[len(versions)-1]
+	err = requireActive(latest)
+	if err != nil {
+		return err
+	}
+
+	// The record's author, its patient or an admin may link it
+	if callerID != latest.CreatedBy {
+		err = s.RequirePatientOrAdmin(ctx, latest.PatientID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if encounter.PatientID != latest.PatientID {
+		return fmt.Errorf("encounter %s belongs to another patient", encounterID)
+	}
+
+	// Move the record out of its previous encounter
+	if latest.EncounterID != "" && latest.EncounterID != encounterID {
+		err = s.deleteIndexEntry(ctx, encounterRecordIndex, latest.EncounterID, latest.RootRecordID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, version := range versions {
+		version.EncounterID = encounterID
+
+		err = s.putEHRMetadata(ctx, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.putIndexEntry(ctx, encounterRecordIndex, encounterID, latest.RootRecordID)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageEncounter, callerID, latest.PatientID, latest.RecordID, latest.PatientID, true,
+		fmt.Sprintf("Record linked to encounter %s", encounterID))
+}
+
+// QueryEHRsByEncounter returns the latest version of each record of an encounter that the
+// caller may read
+func (s *SmartContract) QueryEHRsByEncounter(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+) ([]*EHRMetadata, error) {
+	_, err := s.getEncounter(ctx, encounterID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.encounterRecords(ctx, []string{encounterID})
+}
+
+// CreateEpisodeOfCare records an episode of care managed by the caller's organization
+func (s *SmartContract) CreateEpisodeOfCare(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+	patientID string,
+	episodeType string,
+	participants []CareParticipant,
+	periodStart string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.requireRecordAuthor(ctx, patientID)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	start, err := validateCareEntity("episodeId", episodeID, episodeType, participants, periodStart, now)
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.readEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("episode of care %s already exists", episodeID)
+	}
+
+	episode := EpisodeOfCare{
+		DocType:      episodeDocType,
+		EpisodeID:    episodeID,
+		PatientID:    patientID,
+		EpisodeType:  episodeType,
+		ManagingOrg:  callerOrg,
+		Participants: participants,
+		Period:       CarePeriod{Start: start},
+		Status:       EpisodeActive,
+		CreatedBy:    callerID,
+		Timestamp:    now,
+	}
+	if start.After(episode.Timestamp) {
+		episode.Status = EpisodePlanned
+	}
+
+	err = s.putStateEntity(ctx, episodeDocType, episodeID, &episode)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageEpisode, callerID, patientID, "", patientID, true,
+		fmt.Sprintf("Episode of care %s created", episodeID))
+}
+
+// UpdateEpisodeOfCareStatus moves an episode of care to a new status. Finishing it closes its period.
+func (s *SmartContract) UpdateEpisodeOfCareStatus(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+	status string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if !episodeStatuses[status] {
+		return fmt.Errorf("invalid episode of care status %q", status)
+	}
+
+	episode, err := s.getEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return err
+	}
+
+	err = s.requireCareTeam(ctx, episode.CreatedBy, episode.Participants)
+	if err != nil {
+		return err
+	}
+
+	err = checkCareStatusChange(episode.Status, status, EpisodeEnteredInError,
+		EpisodeFinished, EpisodeCancelled, EpisodeEnteredInError)
+	if err != nil {
+		return fmt.Errorf("episode of care %s: %v", episodeID, err)
+	}
+
+	previous := episode.Status
+	episode.Status = status
+	if status == EpisodeFinished && episode.Period.End.IsZero() {
+		episode.Period.End, err = txTime(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.putStateEntity(ctx, episodeDocType, episodeID, episode)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageEpisode, callerID, episode.PatientID, "", episode.PatientID, true,
+		fmt.Sprintf("Episode of care %s moved from %s to %s", episodeID, previous, status))
+}
+
+// GetEpisodeOfCare returns an episode of care to its patient, its care team, admins and doctors
+// with consent on it
+func (s *SmartContract) GetEpisodeOfCare(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+) (*EpisodeOfCare, error) {
+	episode, err := s.getEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkCareAccess(ctx, episode.PatientID, episode.CreatedBy, episode.Participants,
+		[]string{episodeConsentPrefix + episodeID})
+	if err != nil {
+		return nil, err
+	}
+
+	return episode, nil
+}
+
+// LinkEncounterToEpisode adds an encounter to an episode of care of the same patient
+func (s *SmartContract) LinkEncounterToEpisode(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+	episodeID string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	encounter, err := s.getEncounter(ctx, encounterID)
+	if err != nil {
+		return err
+	}
+
+	episode, err := s.getEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return err
+	}
+
+	err = s.requireCareTeam(ctx, episode.CreatedBy, episode.Participants)
+	if err != nil {
+		return err
+	}
+
+	if encounter.PatientID != episode.PatientID {
+		return fmt.Errorf("encounter %s belongs to another patient", encounterID)
+	}
+	if encounter.EpisodeID != "" {
+		return fmt.Errorf("encounter %s is already part of episode of care %s", encounterID, encounter.EpisodeID)
+	}
+
+	encounter.EpisodeID = episodeID
+	err = s.putStateEntity(ctx, encounterDocType, encounterID, encounter)
+	if err != nil {
+		return err
+	}
+
+	err = s.putIndexEntry(ctx, episodeEncounterIndex, episodeID, encounterID)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageEpisode, callerID, episode.PatientID, "", episode.PatientID, true,
+		fmt.Sprintf("Encounter %s added to episode of care %s", encounterID, episodeID))
+}
+
+// QueryEncountersByEpisode returns the encounters of an episode of care the caller may see
+func (s *SmartContract) QueryEncountersByEpisode(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+) ([]*Encounter, error) {
+	_, err := s.getEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	encounterIDs, err := s.indexEntries(ctx, episodeEncounterIndex, episodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	encounters := []*Encounter{}
+	for _, encounterID := range encounterIDs {
+		encounter, err := s.getEncounter(ctx, encounterID)
+		if err != nil {
+			return nil, err
+		}
+
+		allowed, err := s.careAccess(ctx, encounter.PatientID, encounter.CreatedBy, encounter.Participants, encounterScopes(encounter))
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			encounters = append(encounters, encounter)
+		}
+	}
+
+	return encounters, nil
+}
+
+// QueryEHRsByEpisode returns the latest version of each record of every encounter of an
+// episode of care that the caller may read
+func (s *SmartContract) QueryEHRsByEpisode(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+) ([]*EHRMetadata, error) {
+	_, err := s.getEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	encounterIDs, err := s.indexEntries(ctx, episodeEncounterIndex, episodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.encounterRecords(ctx, encounterIDs)
+}
+
+// encounterRecords lists the readable latest versions of the records of some encounters
+func (s *SmartContract) encounterRecords(
+	ctx contractapi.TransactionContextInterface,
+	encounterIDs []string,
+) ([]*EHRMetadata, error) {
+	var records []*EHRMetadata
+	for _, encounterID := range encounterIDs {
+		rootRecordIDs, err := s.indexEntries(ctx, encounterRecordIndex, encounterID)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rootRecordID := range rootRecordIDs {
+			metadata, err := s.latestEHR(ctx, rootRecordID)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, metadata)
+		}
+	}
+
+	// Only return the records the caller may read
+	return s.readableRecords(ctx, records)
+}
+
+// recordConsentScopes lists the consent record IDs that cover a record beyond its own ID, from
+// the narrowest: its encounter, its episode of care, then all records
+func (s *SmartContract) recordConsentScopes(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) ([]string, error) {
+	if metadata == nil || metadata.EncounterID == "" {
+		return []string{"*"}, nil
+	}
+
+	encounter, err := s.readEncounter(ctx, metadata.EncounterID)
+	if err != nil {
+		return nil, err
+	}
+	if encounter == nil {
+		return []string{"*"}, nil
+	}
+
+	return append(encounterScopes(encounter), "*"), nil
+}
+
+// requireCareTeam allows admins, the creator and the participants of an encounter or episode
+func (s *SmartContract) requireCareTeam(
+	ctx contractapi.TransactionContextInterface,
+	createdBy string,
+	participants []CareParticipant,
+) error {
+	onTeam, err := s.onCareTeam(ctx, createdBy, participants)
+	if err != nil {
+		return err
+	}
+	if !onTeam {
+		return fmt.Errorf("%w: caller is not on the care team", errUnauthorized)
+	}
+
+	return nil
+}
+
+// onCareTeam checks whether the caller is an admin, the creator or a participant
+func (s *SmartContract) onCareTeam(
+	ctx contractapi.TransactionContextInterface,
+	createdBy string,
+	participants []CareParticipant,
+) (bool, error) {
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	isAdmin, err := s.IsAdmin(ctx)
+	if err != nil {
+		return false, err
+	}
+	if isAdmin || callerID == createdBy {
+		return true, nil
+	}
+
+	for _, participant := range participants {
+		if participant.ParticipantID == callerID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkCareAccess allows the patient, the care team and doctors holding an effective consent
+// on one of the scopes or on all records
+func (s *SmartContract) checkCareAccess(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	createdBy string,
+	participants []CareParticipant,
+	scopes []string,
+) error {
+	allowed, err := s.careAccess(ctx, patientID, createdBy, participants, scopes)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return fmt.Errorf("%w: no access to this encounter or episode of care", errUnauthorized)
+	}
+
+	return nil
+}
+
+// careAccess decides access to an encounter or episode of care, see checkCareAccess
+func (s *SmartContract) careAccess(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	createdBy string,
+	participants []CareParticipant,
+	scopes []string,
+) (bool, error) {
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if callerID == patientID {
+		return true, nil
+	}
+
+	onTeam, err := s.onCareTeam(ctx, createdBy, participants)
+	if err != nil || onTeam {
+		return onTeam, err
+	}
+
+	isDoctor, err := s.IsDoctor(ctx)
+	if err != nil || !isDoctor {
+		return false, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	for _, scope := range append(scopes, "*") {
+		consentJSON, err := ctx.GetStub().GetState(consentIDFor(patientID, callerID, scope))
+		if err != nil {
+			return false, fmt.Errorf("failed to read consent: %v", err)
+		}
+		if consentJSON == nil {
+			continue
+		}
+
+		var consent ConsentRecord
+		err = json.Unmarshal(consentJSON, &consent)
+		if err != nil {
+			return false, fmt.Errorf("failed to unmarshal consent: %v", err)
+		}
+		if consentInEffect(&consent, now) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkCareStatusChange rejects changes out of a closed status, except marking it entered in error
+func checkCareStatusChange(from string, to string, enteredInError string, closed ...string) error {
+	for _, status := range closed {
+		if from == status && to != enteredInError {
+			return fmt.Errorf("cannot move from %s to %s", from, to)
+		}
+	}
+	if from == enteredInError {
+		return fmt.Errorf("cannot move from %s to %s", from, to)
+	}
+
+	return nil
+}
+
+// validateCareEntity checks the fields shared by encounters and episodes and parses the start
+// of their period, defaulting to now
+func validateCareEntity(
+	idField string,
+	id string,
+	careType string,
+	participants []CareParticipant,
+	periodStart string,
+	now time.Time,
+) (time.Time, error) {
+	var errs ValidationErrors
+	validateRecordID(&errs, idField, id)
+
+	if careType == "" {
+		errs.add("type", "is required")
+	}
+
+	if len(participants) > maxCareParticipants {
+		errs.add("participants", "at most %d participants are allowed", maxCareParticipants)
+	}
+	for i, participant := range participants {
+		if participant.ParticipantID == "" {
+			errs.add(fmt.Sprintf("participants[%d].participantId", i), "is required")
+		}
+	}
+
+	start := now
+	if periodStart != "" {
+		parsed, err := time.Parse(time.RFC3339, periodStart)
+		if err != nil {
+			errs.add("periodStart", "must be an RFC 3339 timestamp")
+		}
+		start = parsed
+	}
+
+	return start, errs.errOrNil()
+}
+
+// getEncounter loads an encounter, failing if it does not exist
+func (s *SmartContract) getEncounter(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+) (*Encounter, error) {
+	encounter, err := s.readEncounter(ctx, encounterID)
+	if err != nil {
+		return nil, err
+	}
+	if encounter == nil {
+		return nil, fmt.Errorf("encounter %s %w", encounterID, errNotFound)
+	}
+
+	return encounter, nil
+}
+
+// readEncounter loads an encounter, returning nil if it does not exist
+func (s *SmartContract) readEncounter(
+	ctx contractapi.TransactionContextInterface,
+	encounterID string,
+) (*Encounter, error) {
+	var encounter Encounter
+	found, err := s.readStateEntity(ctx, encounterDocType, encounterID, &encounter)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &encounter, nil
+}
+
+// getEpisodeOfCare loads an episode of care, failing if it does not exist
+func (s *SmartContract) getEpisodeOfCare(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+) (*EpisodeOfCare, error) {
+	episode, err := s.readEpisodeOfCare(ctx, episodeID)
+	if err != nil {
+		return nil, err
+	}
+	if episode == nil {
+		return nil, fmt.Errorf("episode of care %s %w", episodeID, errNotFound)
+	}
+
+	return episode, nil
+}
+
+// readEpisodeOfCare loads an episode of care, returning nil if it does not exist
+func (s *SmartContract) readEpisodeOfCare(
+	ctx contractapi.TransactionContextInterface,
+	episodeID string,
+) (*EpisodeOfCare, error) {
+	var episode EpisodeOfCare
+	found, err := s.readStateEntity(ctx, episodeDocType, episodeID, &episode)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &episode, nil
+}
+
+// readStateEntity reads an entity stored under docType~id, reporting whether it exists
+func (s *SmartContract) readStateEntity(
+	ctx contractapi.TransactionContextInterface,
+	docType string,
+	id string,
+	entity interface{},
+) (bool, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(docType, []string{id})
+	if err != nil {
+		return false, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	entityJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if entityJSON == nil {
+		return false, nil
+	}
+
+	err = json.Unmarshal(entityJSON, entity)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal %s: %v", docType, err)
+	}
+
+	return true, nil
+}
+
+// putStateEntity stores an entity under docType~id
+func (s *SmartContract) putStateEntity(
+	ctx contractapi.TransactionContextInterface,
+	docType string,
+	id string,
+	entity interface{},
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(docType, []string{id})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	entityJSON, err := json.Marshal(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", docType, err)
+	}
+
+	err = ctx.GetStub().PutState(key, entityJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// putIndexEntry adds a parent~child entry to a composite key index
+func (s *SmartContract) putIndexEntry(
+	ctx contractapi.TransactionContextInterface,
+	index string,
+	parentID string,
+	childID string,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(index, []string{parentID, childID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	// Composite key indexes only need the key, with a non-empty value
+	err = ctx.GetStub().PutState(key, []byte{0x00})
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// deleteIndexEntry removes parentID~childID from a composite key index
+func (s *SmartContract) deleteIndexEntry(
+	ctx contractapi.TransactionContextInterface,
+	index string,
+	parentID string,
+	childID string,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(index, []string{parentID, childID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete from world state: %v", err)
+	}
+
+	return nil
+}
+
+// indexEntries lists the children of a parent in a composite key index
+func (s *SmartContract) indexEntries(
+	ctx contractapi.TransactionContextInterface,
+	index string,
+	parentID string,
+) ([]string, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(index, []string{parentID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index %s: %v", index, err)
+	}
+	defer iterator.Close()
+
+	var children []string
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read index %s: %v", index, err)
+		}
+
+		_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split composite key: %v", err)
+		}
+		children = append(children, attributes[1])
+	}
+
+	return children, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// carePathway is a chemotherapy episode with two infusion encounters, each with one record,
+// and a third record outside both
+type carePathway struct {
+	s             *SmartContract
+	stub          *shimtest.MockStub
+	patientCtx    *TransactionContext
+	oncologistCtx *TransactionContext
+	consultantCtx *TransactionContext
+}
+
+var careTeam = []CareParticipant{{ParticipantID: "doctor456", Role: "attender"}}
+
+func setupCarePathway(t *testing.T) *carePathway {
+	s := new(SmartContract)
+	stub := newTestStub()
+	p := &carePathway{
+		s:             s,
+		stub:          stub,
+		patientCtx:    newTestContext(stub, patientIdentity("patient123")),
+		oncologistCtx: newTestContext(stub, doctorIdentity("doctor456")),
+		consultantCtx: newTestContext(stub, doctorIdentity("doctor789")),
+	}
+
+	err := grantWriteConsent(s, stub, "tx-setup-1", "patient123", "doctor456")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	steps := []func() error{
+		func() error {
+			return s.CreateEpisodeOfCare(p.oncologistCtx, "EP-CHEMO", "patient123", "Chemotherapy", careTeam, "2025-01-06T08:00:00Z")
+		},
+	}
+	for _, encounterID := range []string{"ENC-1", "ENC-2"} {
+		encounterID := encounterID
+		steps = append(steps, func() error {
+			return s.CreateEncounter(p.oncologistCtx, encounterID, "patient123", "Outpatient infusion", "Oncology Day Unit", careTeam, "")
+		})
+	}
+	for _, recordID := range []string{"EHR-1", "EHR-2", "EHR-3"} {
+		recordID := recordID
+		steps = append(steps, func() error {
+			return s.CreateEHRMetadata(p.oncologistCtx, recordID, "patient123", testCID(recordID), "key", "Infusion Note", testChecksum(recordID),
+				testSignature(p.oncologistCtx, recordID, "patient123", testCID(recordID), testChecksum(recordID), "Infusion Note"))
+		})
+	}
+	steps = append(steps,
+		func() error { return s.LinkEHRToEncounter(p.oncologistCtx, "EHR-1", "ENC-1") },
+		func() error { return s.LinkEHRToEncounter(p.oncologistCtx, "EHR-2", "ENC-2") },
+	)
+	for i, step := range steps {
+		err = inTx(stub, fmt.Sprintf("tx-setup-%d", i+2), step)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+	}
+
+	return p
+}
+
+// TestCreateEncounter tests who may create encounters and the fields they need
+func TestCreateEncounter(t *testing.T) {
+	p := setupCarePathway(t)
+
+	encounter, err := p.s.GetEncounter(p.patientCtx, "ENC-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "patient123", encounter.PatientID)
+	assert.Equal(t, "HospitalMSP", encounter.AuthorOrg)
+
+	err = inTx(p.stub, "tx1", func() error {
+		return p.s.CreateEncounter(p.oncologistCtx, "ENC-3", "patient123", "", "Ward 4", careTeam, "yesterday")
+	})
+	assert.ErrorContains(t, err, "periodStart")
+	assert.ErrorContains(t, err, `"field":"type"`)
+
+	err = inTx(p.stub, "tx2", func() error {
+		return p.s.CreateEncounter(p.oncologistCtx, "ENC-1", "patient123", "Outpatient infusion", "Oncology Day Unit", careTeam, "")
+	})
+	assert.ErrorContains(t, err, "encounter ENC-1 already exists")
+
+	err = inTx(p.stub, "tx3", func() error {
+		return p.s.CreateEncounter(p.consultantCtx, "ENC-3", "patient123", "Outpatient visit", "Clinic", careTeam, "")
+	})
+	assert.ErrorContains(t, err, "unauthorized: no write consent from patient patient123")
+
+	err = inTx(p.stub, "tx4", func() error {
+		return p.s.CreateEncounter(newTestContext(p.stub, patientIdentity("patient999")), "ENC-3", "patient123", "Outpatient visit", "Clinic", nil, "")
+	})
+	assert.ErrorContains(t, err, "unauthorized: patients can only create their own records")
+
+	err = inTx(p.stub, "tx5", func() error {
+		return p.s.CreateEpisodeOfCare(p.oncologistCtx, "EP-CHEMO", "patient123", "Chemotherapy", careTeam, "")
+	})
+	assert.ErrorContains(t, err, "episode of care EP-CHEMO already exists")
+}
+
+// TestLinkEHRToEncounter tests who may link records to an encounter and which encounters they
+// may be linked to
+func TestLinkEHRToEncounter(t *testing.T) {
+	p := setupCarePathway(t)
+
+	records, err := p.s.QueryEHRsByEncounter(p.patientCtx, "ENC-1")
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "EHR-1", records[0].RecordID)
+	}
+
+	err = inTx(p.stub, "tx1", func() error {
+		return p.s.LinkEHRToEncounter(p.consultantCtx, "EHR-3", "ENC-1")
+	})
+	assert.ErrorContains(t, err, "unauthorized", "only the author, patient or admin links a record")
+
+	err = inTx(p.stub, "tx2", func() error {
+		return p.s.LinkEHRToEncounter(p.oncologistCtx, "EHR-3", "ENC-404")
+	})
+	assert.ErrorContains(t, err, "encounter ENC-404 does not exist")
+
+	// An encounter of another patient
+	err = grantWriteConsent(p.s, p.stub, "tx3", "patient999", "doctor456")
+	assert.NoError(t, err)
+
+	err = inTx(p.stub, "tx4", func() error {
+		return p.s.CreateEncounter(p.oncologistCtx, "ENC-OTHER", "patient999", "Outpatient visit", "Clinic", careTeam, "")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(p.stub, "tx5", func() error {
+		return p.s.LinkEHRToEncounter(p.oncologistCtx, "EHR-3", "ENC-OTHER")
+	})
+	assert.ErrorContains(t, err, "encounter ENC-OTHER belongs to another patient")
+
+	// Linking to another encounter moves the record
+	err = inTx(p.stub, "tx6", func() error {
+		return p.s.LinkEHRToEncounter(p.patientCtx, "EHR-2", "ENC-1")
+	})
+	assert.NoError(t, err)
+
+	records, err = p.s.QueryEHRsByEncounter(p.patientCtx, "ENC-1")
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	records, err = p.s.QueryEHRsByEncounter(p.patientCtx, "ENC-2")
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+// TestEncounterConsent tests that consent on one encounter covers its records only
+func TestEncounterConsent(t *testing.T) {
+	p := setupCarePathway(t)
+
+	_, err := p.s.GetEncounter(p.consultantCtx, "ENC-1")
+	assert.ErrorContains(t, err, "unauthorized: no access to this encounter or episode of care")
+
+	err = inTx(p.stub, "tx1", func() error {
+		_, err := p.s.GrantConsent(p.patientCtx, "patient123-doctor789-encounter:ENC-1", "patient123", "doctor789", "encounter:ENC-1", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	hasConsent, err := p.s.CheckConsent(p.patientCtx, "patient123", "doctor789", "EHR-1")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent)
+
+	hasConsent, err = p.s.CheckConsent(p.patientCtx, "patient123", "doctor789", "EHR-2")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent)
+
+	_, err = p.s.GetEncounter(p.consultantCtx, "ENC-1")
+	assert.NoError(t, err)
+
+	_, err = p.s.GetEncounter(p.consultantCtx, "ENC-2")
+	assert.ErrorContains(t, err, "unauthorized")
+
+	_, err = p.s.GetEncounter(p.patientCtx, "ENC-404")
+	assert.ErrorContains(t, err, "encounter ENC-404 does not exist")
+
+	// Amendments stay in the encounter
+	err = inTx(p.stub, "tx2", func() error {
+		return p.s.AmendEHR(p.oncologistCtx, "EHR-1", "EHR-1-v2", testCID("EHR-1-v2"), "key", testChecksum("EHR-1-v2"), "Dose corrected",
+			testSignature(p.oncologistCtx, "EHR-1-v2", "patient123", testCID("EHR-1-v2"), testChecksum("EHR-1-v2"), "Infusion Note"))
+	})
+	assert.NoError(t, err)
+
+	records, err := p.s.QueryEHRsByEncounter(p.consultantCtx, "ENC-1")
+	assert.NoError(t, err)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "EHR-1-v2", records[0].RecordID)
+	}
+}
+
+// TestEpisodeOfCareConsent tests that consent on an episode covers the records of all its
+// encounters, except labeled records without an opt-in
+func TestEpisodeOfCareConsent(t *testing.T) {
+	p := setupCarePathway(t)
+
+	for i, step := range []func() error{
+		func() error { return p.s.LinkEncounterToEpisode(p.oncologistCtx, "ENC-1", "EP-CHEMO") },
+		func() error { return p.s.LinkEncounterToEpisode(p.oncologistCtx, "ENC-2", "EP-CHEMO") },
+		func() error {
+			_, err := p.s.GrantConsent(p.patientCtx, "patient123-doctor789-episode:EP-CHEMO", "patient123", "doctor789", "episode:EP-CHEMO", 30)
+			return err
+		},
+	} {
+		assert.NoError(t, inTx(p.stub, fmt.Sprintf("tx1-%d", i), step))
+	}
+
+	err := inTx(p.stub, "tx2", func() error {
+		return p.s.LinkEncounterToEpisode(p.oncologistCtx, "ENC-404", "EP-CHEMO")
+	})
+	assert.ErrorContains(t, err, "encounter ENC-404 does not exist")
+
+	err = inTx(p.stub, "tx3", func() error {
+		return p.s.LinkEncounterToEpisode(p.oncologistCtx, "ENC-1", "EP-404")
+	})
+	assert.ErrorContains(t, err, "episode of care EP-404 does not exist")
+
+	records, err := p.s.QueryEHRsByEpisode(p.consultantCtx, "EP-CHEMO")
+	assert.NoError(t, err)
+	assert.Len(t, records, 2)
+
+	encounters, err := p.s.QueryEncountersByEpisode(p.consultantCtx, "EP-CHEMO")
+	assert.NoError(t, err)
+	assert.Len(t, encounters, 2)
+
+	hasConsent, err := p.s.CheckConsent(p.patientCtx, "patient123", "doctor789", "EHR-3")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent, "records outside the episode are not covered")
+
+	// Labeled records need an opt-in, like under a consent on all records
+	err = inTx(p.stub, "tx4", func() error {
+		return p.s.SetRecordLabels(p.patientCtx, "EHR-2", ConfidentialityNormal, []string{SensitivityPsychiatry})
+	})
+	assert.NoError(t, err)
+
+	hasConsent, err = p.s.CheckConsent(p.patientCtx, "patient123", "doctor789", "EHR-2")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent)
+}
+
+// TestCareStatusChanges tests that only the care team moves encounters and episodes along,
+// and that closed ones stay closed
+func TestCareStatusChanges(t *testing.T) {
+	p := setupCarePathway(t)
+
+	err := inTx(p.stub, "tx1", func() error {
+		return p.s.UpdateEpisodeOfCareStatus(p.consultantCtx, "EP-CHEMO", EpisodeFinished)
+	})
+	assert.ErrorContains(t, err, "unauthorized: caller is not on the care team")
+
+	err = inTx(p.stub, "tx2", func() error {
+		return p.s.UpdateEncounterStatus(p.consultantCtx, "ENC-1", EncounterFinished)
+	})
+	assert.ErrorContains(t, err, "unauthorized: caller is not on the care team")
+
+	err = inTx(p.stub, "tx3", func() error {
+		return p.s.UpdateEncounterStatus(p.oncologistCtx, "ENC-1", "discharged")
+	})
+	assert.ErrorContains(t, err, `invalid encounter status "discharged"`)
+
+	err = inTx(p.stub, "tx4", func() error {
+		return p.s.UpdateEpisodeOfCareStatus(p.oncologistCtx, "EP-CHEMO", "done")
+	})
+	assert.ErrorContains(t, err, `invalid episode of care status "done"`)
+
+	err = inTx(p.stub, "tx5", func() error {
+		return p.s.UpdateEncounterStatus(p.oncologistCtx, "ENC-404", EncounterFinished)
+	})
+	assert.ErrorContains(t, err, "encounter ENC-404 does not exist")
+
+	// Finishing closes the period
+	err = inTx(p.stub, "tx6", func() error {
+		return p.s.UpdateEpisodeOfCareStatus(p.oncologistCtx, "EP-CHEMO", EpisodeFinished)
+	})
+	assert.NoError(t, err)
+
+	err = inTx(p.stub, "tx6a", func() error {
+		return p.s.UpdateEncounterStatus(p.oncologistCtx, "ENC-1", EncounterFinished)
+	})
+	assert.NoError(t, err)
+
+	episode, err := p.s.GetEpisodeOfCare(p.patientCtx, "EP-CHEMO")
+	assert.NoError(t, err)
+	assert.Equal(t, EpisodeFinished, episode.Status)
+	assert.Equal(t, "HospitalMSP", episode.ManagingOrg)
+	assert.False(t, episode.Period.End.IsZero())
+
+	encounter, err := p.s.GetEncounter(p.patientCtx, "ENC-1")
+	assert.NoError(t, err)
+	assert.Equal(t, EncounterFinished, encounter.Status)
+	assert.False(t, encounter.Period.End.IsZero())
+
+	err = inTx(p.stub, "tx7", func() error {
+		return p.s.UpdateEpisodeOfCareStatus(p.oncologistCtx, "EP-CHEMO", EpisodeActive)
+	})
+	assert.ErrorContains(t, err, "cannot move from finished to active")
+
+	err = inTx(p.stub, "tx8", func() error {
+		return p.s.UpdateEncounterStatus(p.oncologistCtx, "ENC-1", EncounterInProgress)
+	})
+	assert.ErrorContains(t, err, "cannot move from finished to in-progress")
+
+	// A closed encounter may still be marked as entered in error
+	err = inTx(p.stub, "tx9", func() error {
+		return p.s.UpdateEncounterStatus(p.oncologistCtx, "ENC-1", EncounterEnteredInError)
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// RecordStatusErased marks the tombstone of an erased record
+const RecordStatusErased = "ERASED"
+
+// EventEHRErased is the chaincode event emitted by EraseEHR
+const EventEHRErased = "EHRErased"
+
+const tombstoneObjectType = "tombstone"
+
+// ErasureInfo records who erased a record and why
+type ErasureInfo struct {
+	Reason     string    `json:"reason"`
+	ApprovedBy string    `json:"approvedBy"`
+	ErasedAt   time.Time `json:"erasedAt"`
+	TxID       string    `json:"txId"`
+}
+
+// EHRErasedEvent is emitted so off-chain services can unpin the erased files from IPFS
+type EHRErasedEvent struct {
+	PatientID  string   `json:"patientId"`
+	RecordIDs  []string `json:"recordIds"`
+	IPFSHashes []string `json:"ipfsHashes"`
+	Reason     string   `json:"reason"`
+	ApprovedBy string   `json:"approvedBy"`
+}
+
+// EraseEHR crypto-shreds a record and all of its versions. The metadata, including the
+// encrypted key and IPFS pointer, is deleted from world state and replaced by a tombstone.
+func (s *SmartContract) EraseEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	// Erasure is approved by an admin
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return fmt.Errorf("erasure reason is required")
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	// Records in retention or under a legal hold are kept
+	err = s.requireDisposable(ctx, versions)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	event := EHRErasedEvent{
+		PatientID:  versions[0].PatientID,
+		Reason:     reason,
+		ApprovedBy: callerID,
+	}
+	erasure := &ErasureInfo{
+		Reason:     reason,
+		ApprovedBy: callerID,
+		ErasedAt:   now,
+		TxID:       ctx.GetStub().GetTxID(),
+	}
+
+	for _, version := range versions {
+		if version.Status == RecordStatusErased {
+			continue
+		}
+
+		err = s.purgeRecordKeyMaterial(ctx, version)
+		if err != nil {
+			return err
+		}
+
+		err = s.putTombstone(ctx, ehrTombstone(version, erasure))
+		if err != nil {
+			return err
+		}
+
+		event.RecordIDs = append(event.RecordIDs, version.RecordID)
+		// Private CIDs are unpinned by the organizations holding them
+		if ipfsHash := publicIPFSHash(version); ipfsHash != "" {
+			event.IPFSHashes = append(event.IPFSHashes, ipfsHash)
+		}
+		for _, component := range version.Components {
+			event.IPFSHashes = append(event.IPFSHashes, component.IPFSHash)
+		}
+	}
+
+	if len(event.RecordIDs) == 0 {
+		return fmt.Errorf("record %s has already been erased", recordID)
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(EventEHRErased, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionEraseEHR, callerID, event.PatientID, recordID, event.PatientID, true,
+		fmt.Sprintf("Erased %d version(s): %s", len(event.RecordIDs), reason))
+}
+
+// ehrTombstone keeps what is needed to prove a record existed and was erased
+func ehrTombstone(metadata *EHRMetadata, erasure *ErasureInfo) *EHRMetadata {
+	return &EHRMetadata{
+		RecordID:     metadata.RecordID,
+		PatientID:    metadata.PatientID,
+		Timestamp:    metadata.Timestamp,
+		Checksum:     metadata.Checksum,
+		CreatedBy:    metadata.CreatedBy,
+		AuthorOrg:    metadata.AuthorOrg,
+		Version:      metadata.Version,
+		RootRecordID: metadata.RootRecordID,
+		Supersedes:   metadata.Supersedes,
+		SupersededBy: metadata.SupersededBy,
+		MergedFrom:   metadata.MergedFrom,
+		Status:       RecordStatusErased,
+		Erasure:      erasure,
+	}
+}
+
+// purgeRecordKeyMaterial deletes a record's metadata, and with it the encrypted key and
+// IPFS pointer, from world state, along with the keys wrapped for grantees, the escrowed shares
+// and the shares re-wrapped for escrow recoveries. Key material held in private data collections
+// is purged from the collection's history as well.
+func (s *SmartContract) purgeRecordKeyMaterial(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) error {
+	err := ctx.GetStub().DelState(metadata.RecordID)
+	if err != nil {
+		return fmt.Errorf("failed to delete from world state: %v", err)
+	}
+
+	if metadata.PrivateData != nil {
+		err = s.purgePrivateValue(ctx, metadata.PrivateData, metadata.RecordID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.purgeRecordKeys(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	err = s.deleteEscrowDeposit(ctx, metadata.RecordID)
+	if err != nil {
+		return err
+	}
+
+	return s.purgeEscrowRecoveries(ctx, metadata.RecordID)
+}
+
+// putTombstone saves the tombstone of an erased record
+func (s *SmartContract) putTombstone(
+	ctx contractapi.TransactionContextInterface,
+	tombstone *EHRMetadata,
+) error {
+	tombstoneKey, err := ctx.GetStub().CreateCompositeKey(tombstoneObjectType, []string{tombstone.RecordID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	tombstoneJSON, err := json.Marshal(tombstone)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tombstone: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(tombstoneKey, tombstoneJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// readTombstone loads the tombstone of an erased record, or nil if the record was not erased
+func (s *SmartContract) readTombstone(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*EHRMetadata, error) {
+	tombstoneKey, err := ctx.GetStub().CreateCompositeKey(tombstoneObjectType, []string{recordID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	tombstoneJSON, err := ctx.GetStub().GetState(tombstoneKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if tombstoneJSON == nil {
+		return nil, nil
+	}
+
+	var tombstone EHRMetadata
+	err = json.Unmarshal(tombstoneJSON, &tombstone)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tombstone: %v", err)
+	}
+
+	return &tombstone, nil
+}
+
+// ehrRecordExists reports whether a record ID is in use, including by an erased record
+func (s *SmartContract) ehrRecordExists(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (bool, error) {
+	existing, err := ctx.GetStub().GetState(recordID)
+	if err != nil {
+		return false, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if existing != nil {
+		return true, nil
+	}
+
+	tombstone, err := s.readTombstone(ctx, recordID)
+	if err != nil {
+		return false, err
+	}
+
+	return tombstone != nil, nil
+}
+
+// requireNotErased rejects changes to erased records
+func requireNotErased(metadata *EHRMetadata) error {
+	if metadata.Status == RecordStatusErased {
+		return fmt.Errorf("record %s has been erased", metadata.RecordID)
+	}
+	return nil
+}
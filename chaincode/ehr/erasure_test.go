@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEraseEHR tests that erasure removes key material, leaves tombstones and emits an unpin event
+func TestEraseEHR(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("original"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(ctx, "EHR-001", "patient123", testCID("original"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.AmendEHR(ctx, "EHR-001", "EHR-001-v2", testCID("corrected"), "key2", testChecksum("checksum2"), "Corrected value", testSignature(ctx, "EHR-001-v2", "patient123", testCID("corrected"), testChecksum("checksum2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	// Patients request erasure, admins approve it
+	err = inTx(stub, "tx3", func() error {
+		return s.EraseEHR(ctx, "EHR-001", "GDPR Art. 17 request")
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.EraseEHR(adminCtx, "EHR-001-v2", "GDPR Art. 17 request")
+	})
+	assert.NoError(t, err)
+
+	// Both versions are gone from world state
+	assert.NotContains(t, stub.State, "EHR-001")
+	assert.NotContains(t, stub.State, "EHR-001-v2")
+
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventEHRErased, event.EventName)
+	var payload EHRErasedEvent
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, []string{"EHR-001", "EHR-001-v2"}, payload.RecordIDs)
+	assert.Equal(t, []string{testCID("original"), testCID("corrected")}, payload.IPFSHashes)
+
+	// Queries report the tombstone instead of a missing record
+	metadata, err := s.QueryEHR(ctx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "EHR-001-v2", metadata.RecordID)
+	assert.Equal(t, RecordStatusErased, metadata.Status)
+	assert.Empty(t, metadata.EncryptedKey)
+	assert.Empty(t, metadata.IPFSHash)
+	assert.Equal(t, testChecksum("checksum2"), metadata.Checksum)
+	assert.Equal(t, "admin1", metadata.Erasure.ApprovedBy)
+	assert.Equal(t, "tx4", metadata.Erasure.TxID)
+
+	// Erased IDs cannot be reused or amended
+	err = inTx(stub, "tx5", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("new"), "key3", "Lab Report", testChecksum("checksum3"), testSignature(ctx, "EHR-001", "patient123", testCID("new"), testChecksum("checksum3"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "already exists")
+
+	err = inTx(stub, "tx6", func() error {
+		return s.AmendEHR(ctx, "EHR-001-v2", "EHR-001-v3", testCID("new"), "key3", testChecksum("checksum3"), "Restore", testSignature(ctx, "EHR-001-v3", "patient123", testCID("new"), testChecksum("checksum3"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "has been erased")
+
+	err = inTx(stub, "tx7", func() error {
+		return s.EraseEHR(adminCtx, "EHR-001", "Duplicate request")
+	})
+	assert.ErrorContains(t, err, "already been erased")
+}
@@ -0,0 +1,1108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Escrow recovery statuses. Expired is not stored: a pending recovery past its expiry reads as
+// expired.
+const (
+	EscrowRecoveryPending  = "PENDING"
+	EscrowRecoveryReleased = "RELEASED"
+	EscrowRecoveryExpired  = "EXPIRED"
+)
+
+// Escrow events, so custodians are asked for their share and the patient learns of the release
+const (
+	EventEscrowRecoveryRequested = "EscrowRecoveryRequested"
+	EventEscrowKeyReleased       = "EscrowKeyReleased"
+)
+
+// Transient map keys of the shares deposited for a record and of a share re-wrapped by a custodian
+const (
+	escrowSharesTransientKey = "escrowShares"
+	escrowShareTransientKey  = "escrowShare"
+)
+
+// Escrow limits
+const (
+	minEscrowThreshold     = 2
+	maxEscrowCustodians    = 16
+	minEscrowOrganizations = 2
+	maxEscrowJustification = 1024
+	escrowRecoveryValidity = 24 * time.Hour
+)
+
+const (
+	configEscrowPolicyKey     = "escrowPolicy"
+	escrowDepositObjectType   = "escrowDeposit"
+	escrowRecoveryObjectType  = "escrowRecovery"
+	escrowRecoveryRecordIndex = "escrowrecovery~record"
+	escrowShareObjectType     = "escrowShare"    // Private key of a deposited share
+	escrowApprovalObjectType  = "escrowApproval" // Private key of a share re-wrapped for a recovery
+)
+
+// EscrowPolicy names the custodians record keys are escrowed with, and how many of them must
+// approve a recovery
+type EscrowPolicy struct {
+	Threshold    int       `json:"threshold"`
+	CustodianIDs []string  `json:"custodianIds"`
+	UpdatedBy    string    `json:"updatedBy"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// EscrowShare is one Shamir share of a record key, wrapped to a custodian's encryption key. The
+// wrapped share is kept in the private data collection of the custodian's organization.
+type EscrowShare struct {
+	CustodianID    string          `json:"custodianId"`
+	WrappedShare   string          `json:"wrappedShare,omitempty" metadata:",optional"` // Base64 share encrypted to the custodian; only returned to them
+	KeyFingerprint string          `json:"keyFingerprint"`                              // Key ID of the custodian's encryption key in the directory
+	PrivateData    *PrivateDataRef `json:"privateData,omitempty" metadata:",optional"`  // Collection holding the wrapped share
+}
+
+// EscrowDeposit holds the shares of a record key. Any threshold of them rebuilds the key; fewer
+// reveal nothing about it.
+type EscrowDeposit struct {
+	RecordID    string        `json:"recordId"`
+	Threshold   int           `json:"threshold"`
+	KeyVersion  int           `json:"keyVersion"` // Record key version the shares rebuild
+	Shares      []EscrowShare `json:"shares"`
+	DepositedBy string        `json:"depositedBy"`
+	Timestamp   time.Time     `json:"timestamp"`
+}
+
+// EscrowApproval is a custodian's share of a recovery, re-wrapped to the requester's key. The
+// re-wrapped share is kept in the private data collection of the requester's organization.
+type EscrowApproval struct {
+	CustodianID  string          `json:"custodianId"`
+	CustodianOrg string          `json:"custodianOrg"`
+	WrappedShare string          `json:"wrappedShare,omitempty" metadata:",optional"` // Only shown to the requester once released
+	PrivateData  *PrivateDataRef `json:"privateData,omitempty" metadata:",optional"`  // Collection holding the re-wrapped share
+	ApprovedAt   time.Time       `json:"approvedAt"`
+}
+
+// EscrowRecovery is a break-glass request for a record key held in escrow
+type EscrowRecovery struct {
+	RecoveryID    string           `json:"recoveryId"`
+	RecordID      string           `json:"recordId"`
+	PatientID     string           `json:"patientId"`
+	RequestedBy   string           `json:"requestedBy"`
+	RequesterKey  string           `json:"requesterKey"` // Key ID custodians re-wrap their share to
+	RequesterOrg  string           `json:"requesterOrg"` // Organization of the requester's key, whose collection holds the re-wrapped shares
+	Justification string           `json:"justification"`
+	Threshold     int              `json:"threshold"`
+	KeyVersion    int              `json:"keyVersion"`
+	Status        string           `json:"status"`
+	Approvals     []EscrowApproval `json:"approvals"`
+	RequestedAt   time.Time        `json:"requestedAt"`
+	ExpiresAt     time.Time        `json:"expiresAt"`
+	ReleasedAt    time.Time        `json:"releasedAt"` // Zero until released
+}
+
+// privateEscrowShareData is the private value of a deposited share, or of a share re-wrapped for
+// a recovery
+type privateEscrowShareData struct {
+	RecordID     string `json:"recordId"`
+	RecoveryID   string `json:"recoveryId,omitempty"`
+	CustodianID  string `json:"custodianId"`
+	WrappedShare string `json:"wrappedShare"`
+}
+
+// EscrowRecoveryRequestedEvent asks the custodians of a record key for their share
+type EscrowRecoveryRequestedEvent struct {
+	RecoveryID   string    `json:"recoveryId"`
+	RecordID     string    `json:"recordId"`
+	PatientID    string    `json:"patientId"`
+	RequestedBy  string    `json:"requestedBy"`
+	CustodianIDs []string  `json:"custodianIds"`
+	Threshold    int       `json:"threshold"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// EscrowKeyReleasedEvent is emitted once enough custodians approved a recovery
+type EscrowKeyReleasedEvent struct {
+	RecoveryID   string   `json:"recoveryId"`
+	RecordID     string   `json:"recordId"`
+	PatientID    string   `json:"patientId"`
+	RequestedBy  string   `json:"requestedBy"`
+	CustodianIDs []string `json:"custodianIds"`
+}
+
+// SetEscrowPolicy sets the custodians record keys are escrowed with and the number of them needed
+// to recover a key. Custodians need an active encryption key, and must come from more than one
+// organization so that no single organization holds every share. Deposits keep the custodians
+// and threshold they were made with.
+func (s *SmartContract) SetEscrowPolicy(
+	ctx contractapi.TransactionContextInterface,
+	threshold int,
+	custodianIDs []string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	if len(custodianIDs) < minEscrowThreshold || len(custodianIDs) > maxEscrowCustodians {
+		errs.add("custodianIds", "must name between %d and %d custodians", minEscrowThreshold, maxEscrowCustodians)
+	}
+	if threshold < minEscrowThreshold || threshold > len(custodianIDs) {
+		errs.add("threshold", "must be between %d and the number of custodians", minEscrowThreshold)
+	}
+	seen := make(map[string]bool, len(custodianIDs))
+	organizations := map[string]bool{}
+	for i, custodianID := range custodianIDs {
+		field := fmt.Sprintf("custodianIds[%d]", i)
+		if custodianID == "" {
+			errs.add(field, "is required")
+			continue
+		}
+		if seen[custodianID] {
+			errs.add(field, "duplicate custodian %s", custodianID)
+		}
+		seen[custodianID] = true
+
+		entry, err := s.activePublicKey(ctx, custodianID, KeyUsageEncryption)
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			errs.add(field, "%s has no active encryption key", custodianID)
+			continue
+		}
+		organizations[entry.MSPID] = true
+	}
+	if len(organizations) < minEscrowOrganizations && errs.errOrNil() == nil {
+		errs.add("custodianIds", "must come from at least %d organizations", minEscrowOrganizations)
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy := EscrowPolicy{
+		Threshold:    threshold,
+		CustodianIDs: custodianIDs,
+		UpdatedBy:    callerID,
+		Timestamp:    now,
+	}
+
+	err = s.putStateEntity(ctx, configObjectType, configEscrowPolicyKey, policy)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionSetEscrowPolicy, callerID, "", "", "", true,
+		fmt.Sprintf("Escrow policy set to %d of %d custodians: %v", threshold, len(custodianIDs), custodianIDs))
+}
+
+// GetEscrowPolicy returns the escrow policy; no custodians are set by default
+func (s *SmartContract) GetEscrowPolicy(
+	ctx contractapi.TransactionContextInterface,
+) (*EscrowPolicy, error) {
+	policy := EscrowPolicy{CustodianIDs: []string{}}
+	_, err := s.readStateEntity(ctx, configObjectType, configEscrowPolicyKey, &policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// EscrowRecordKey deposits the key of a record as Shamir shares, one per custodian of the escrow
+// policy. The patient's client splits the key and wraps each share to the custodian's key, and
+// passes them in the transient map under escrowShares as a JSON array of EscrowShare. Each
+// wrapped share is kept in the collection of its custodian's organization. A new deposit replaces
+// the previous one, for example after the record key was rotated.
+func (s *SmartContract) EscrowRecordKey(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*EscrowDeposit, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireActive(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, metadata.PatientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bundle components carry keys of their own
+	if len(metadata.Components) > 0 {
+		return nil, fmt.Errorf("record %s is a bundle; its component keys cannot be escrowed", recordID)
+	}
+
+	policy, err := s.GetEscrowPolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if policy.Threshold == 0 {
+		return nil, fmt.Errorf("no escrow policy has been set")
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	shares := []EscrowShare{}
+	if sharesJSON, found := transient[escrowSharesTransientKey]; found {
+		err = json.Unmarshal(sharesJSON, &shares)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transient %s: %v", escrowSharesTransientKey, err)
+		}
+	}
+
+	var errs ValidationErrors
+	seen := make(map[string]bool, len(shares))
+	for i, share := range shares {
+		field := fmt.Sprintf("%s[%d]", escrowSharesTransientKey, i)
+		if share.CustodianID == "" {
+			errs.add(field+".custodianId", "is required")
+		} else if seen[share.CustodianID] {
+			errs.add(field+".custodianId", "duplicate custodian %s", share.CustodianID)
+		}
+		seen[share.CustodianID] = true
+		validateWrappedShare(&errs, field+".wrappedShare", share.WrappedShare)
+		if !checksumPattern.MatchString(share.KeyFingerprint) {
+			errs.add(field+".keyFingerprint", "must be a public key ID")
+		}
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return nil, err
+	}
+
+	// Every custodian of the policy gets exactly one share
+	custodians := make(map[string]bool, len(policy.CustodianIDs))
+	for _, custodianID := range policy.CustodianIDs {
+		custodians[custodianID] = true
+		if !seen[custodianID] {
+			return nil, fmt.Errorf("a share of record %s must be wrapped for custodian %s", recordID, custodianID)
+		}
+	}
+	for i, share := range shares {
+		if !custodians[share.CustodianID] {
+			return nil, fmt.Errorf("%s is not an escrow custodian", share.CustodianID)
+		}
+		entry, err := s.requireEncryptionKey(ctx, share.CustodianID, share.KeyFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		shares[i].PrivateData = &PrivateDataRef{Collection: privateCollection(entry.MSPID)}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deposit := &EscrowDeposit{
+		RecordID:    recordID,
+		Threshold:   policy.Threshold,
+		KeyVersion:  recordKeyVersion(metadata),
+		Shares:      shares,
+		DepositedBy: callerID,
+		Timestamp:   now,
+	}
+
+	public, err := s.putEscrowDeposit(ctx, deposit)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionEscrowRecordKey, callerID, metadata.PatientID, recordID, metadata.PatientID, true,
+		fmt.Sprintf("Key version %d escrowed with %d of %d custodians", deposit.KeyVersion, deposit.Threshold, len(shares)))
+	if err != nil {
+		return nil, err
+	}
+
+	return public, nil
+}
+
+// RequestEscrowRecovery opens a break-glass request for a record key held in escrow. The
+// requesting doctor names their active encryption key, to which custodians re-wrap their shares.
+// The request expires after 24 hours.
+func (s *SmartContract) RequestEscrowRecovery(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	justification string,
+	keyFingerprint string,
+) (*EscrowRecovery, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	// Emergency access is for licensed clinicians
+	err = s.RequireRole(ctx, RoleDoctor)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.authorCredential(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if justification == "" {
+		return nil, fmt.Errorf("justification is required")
+	}
+	if len(justification) > maxEscrowJustification {
+		return nil, fmt.Errorf("justification must be at most %d characters", maxEscrowJustification)
+	}
+
+	requesterKey, err := s.requireEncryptionKey(ctx, callerID, keyFingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata, deposit, err := s.currentEscrowDeposit(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recovery := &EscrowRecovery{
+		RecoveryID:    ctx.GetStub().GetTxID(),
+		RecordID:      recordID,
+		PatientID:     metadata.PatientID,
+		RequestedBy:   callerID,
+		RequesterKey:  keyFingerprint,
+		RequesterOrg:  requesterKey.MSPID,
+		Justification: justification,
+		Threshold:     deposit.Threshold,
+		KeyVersion:    deposit.KeyVersion,
+		Status:        EscrowRecoveryPending,
+		Approvals:     []EscrowApproval{},
+		RequestedAt:   now,
+		ExpiresAt:     now.Add(escrowRecoveryValidity),
+	}
+
+	err = s.putStateEntity(ctx, escrowRecoveryObjectType, recovery.RecoveryID, recovery)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.putIndexEntry(ctx, escrowRecoveryRecordIndex, recordID, recovery.RecoveryID)
+	if err != nil {
+		return nil, err
+	}
+
+	custodianIDs := []string{}
+	for _, share := range deposit.Shares {
+		custodianIDs = append(custodianIDs, share.CustodianID)
+	}
+	sort.Strings(custodianIDs)
+
+	err = setEscrowEvent(ctx, EventEscrowRecoveryRequested, EscrowRecoveryRequestedEvent{
+		RecoveryID:   recovery.RecoveryID,
+		RecordID:     recordID,
+		PatientID:    metadata.PatientID,
+		RequestedBy:  callerID,
+		CustodianIDs: custodianIDs,
+		Threshold:    deposit.Threshold,
+		ExpiresAt:    recovery.ExpiresAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionRequestEscrowRecovery, callerID, metadata.PatientID, recordID, metadata.PatientID, true,
+		fmt.Sprintf("Escrow recovery %s requested, needs %d custodian(s): %s", recovery.RecoveryID, deposit.Threshold, justification))
+	if err != nil {
+		return nil, err
+	}
+
+	return recovery, nil
+}
+
+// GetMyEscrowShare returns the caller's escrowed share of the record key a pending recovery is
+// for, so they can decrypt it and re-wrap it to the requester's key
+func (s *SmartContract) GetMyEscrowShare(
+	ctx contractapi.TransactionContextInterface,
+	recoveryID string,
+) (*EscrowShare, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	recovery, err := s.getEscrowRecovery(ctx, recoveryID)
+	if err != nil {
+		return nil, err
+	}
+	err = requirePendingRecovery(recovery)
+	if err != nil {
+		return nil, err
+	}
+
+	_, deposit, err := s.currentEscrowDeposit(ctx, recovery.RecordID)
+	if err != nil {
+		return nil, err
+	}
+
+	share := escrowShareOf(deposit, callerID)
+	if share == nil {
+		return nil, fmt.Errorf("%w: caller holds no escrowed share of record %s", errUnauthorized, recovery.RecordID)
+	}
+
+	err = s.loadEscrowShare(ctx, deposit.RecordID, share)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionGetEscrowShare, callerID, recovery.PatientID, recovery.RecordID, recovery.PatientID, true,
+		fmt.Sprintf("Escrowed share retrieved for recovery %s", recoveryID))
+	if err != nil {
+		return nil, err
+	}
+
+	return share, nil
+}
+
+// SubmitEscrowShare approves a recovery with the caller's share, re-wrapped to the requester's
+// key and passed in the transient map under escrowShare. The recovery is released once the
+// threshold of the deposit is reached. Custodians cannot approve their own request.
+func (s *SmartContract) SubmitEscrowShare(
+	ctx contractapi.TransactionContextInterface,
+	recoveryID string,
+) (*EscrowRecovery, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recovery, err := s.getEscrowRecovery(ctx, recoveryID)
+	if err != nil {
+		return nil, err
+	}
+	err = requirePendingRecovery(recovery)
+	if err != nil {
+		return nil, err
+	}
+
+	_, deposit, err := s.currentEscrowDeposit(ctx, recovery.RecordID)
+	if err != nil {
+		return nil, err
+	}
+	if deposit.KeyVersion != recovery.KeyVersion {
+		return nil, fmt.Errorf("key of record %s was escrowed again after recovery %s was requested", recovery.RecordID, recoveryID)
+	}
+
+	if escrowShareOf(deposit, callerID) == nil {
+		return nil, fmt.Errorf("%w: caller holds no escrowed share of record %s", errUnauthorized, recovery.RecordID)
+	}
+	if callerID == recovery.RequestedBy {
+		return nil, fmt.Errorf("%w: custodians cannot approve their own recovery", errUnauthorized)
+	}
+	for _, approval := range recovery.Approvals {
+		if approval.CustodianID == callerID {
+			return nil, fmt.Errorf("%s has already approved recovery %s", callerID, recoveryID)
+		}
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	var errs ValidationErrors
+	validateWrappedShare(&errs, escrowShareTransientKey, string(transient[escrowShareTransientKey]))
+	err = errs.errOrNil()
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	recovery.Approvals = append(recovery.Approvals, EscrowApproval{
+		CustodianID:  callerID,
+		CustodianOrg: callerOrg,
+		WrappedShare: string(transient[escrowShareTransientKey]),
+		PrivateData:  &PrivateDataRef{Collection: privateCollection(recovery.RequesterOrg)},
+		ApprovedAt:   now,
+	})
+
+	released := len(recovery.Approvals) >= recovery.Threshold
+	if released {
+		recovery.Status = EscrowRecoveryReleased
+		recovery.ReleasedAt = now
+	}
+
+	recovery, err = s.putEscrowRecovery(ctx, recovery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionSubmitEscrowShare, callerID, recovery.PatientID, recovery.RecordID, recovery.PatientID, true,
+		fmt.Sprintf("Share submitted for recovery %s (%d of %d)", recoveryID, len(recovery.Approvals), recovery.Threshold))
+	if err != nil {
+		return nil, err
+	}
+
+	if released {
+		custodianIDs := []string{}
+		for _, approval := range recovery.Approvals {
+			custodianIDs = append(custodianIDs, approval.CustodianID)
+		}
+
+		err = setEscrowEvent(ctx, EventEscrowKeyReleased, EscrowKeyReleasedEvent{
+			RecoveryID:   recoveryID,
+			RecordID:     recovery.RecordID,
+			PatientID:    recovery.PatientID,
+			RequestedBy:  recovery.RequestedBy,
+			CustodianIDs: custodianIDs,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.createAuditLog(ctx, ActionEscrowKeyReleased, callerID, recovery.PatientID, recovery.RecordID, recovery.PatientID, true,
+			fmt.Sprintf("Escrowed key released to %s by recovery %s, approved by %v", recovery.RequestedBy, recoveryID, custodianIDs))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return redactEscrowRecovery(recovery, callerID), nil
+}
+
+// GetEscrowRecovery returns a recovery. The re-wrapped shares are only included for the requester,
+// once the recovery has been released, read from the collection of the requester's organization.
+func (s *SmartContract) GetEscrowRecovery(
+	ctx contractapi.TransactionContextInterface,
+	recoveryID string,
+) (*EscrowRecovery, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	recovery, err := s.getEscrowRecovery(ctx, recoveryID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.requireEscrowRecoveryReader(ctx, recovery)
+	if err != nil {
+		return nil, err
+	}
+
+	if callerID == recovery.RequestedBy && recovery.Status == EscrowRecoveryReleased {
+		err = s.loadEscrowApprovals(ctx, recovery)
+		if err != nil {
+			return nil, err
+		}
+
+		// Create audit log
+		err = s.createAuditLog(ctx, ActionEscrowKeyReleased, callerID, recovery.PatientID, recovery.RecordID, recovery.PatientID, true,
+			fmt.Sprintf("Released shares of recovery %s retrieved", recoveryID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return redactEscrowRecovery(recovery, callerID), nil
+}
+
+// QueryEscrowRecoveriesByRecord lists the recoveries requested for a record, so patients can
+// review break-glass access to their records
+func (s *SmartContract) QueryEscrowRecoveriesByRecord(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) ([]*EscrowRecovery, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, metadata.PatientID)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryIDs, err := s.indexEntries(ctx, escrowRecoveryRecordIndex, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveries := []*EscrowRecovery{}
+	for _, recoveryID := range recoveryIDs {
+		recovery, err := s.getEscrowRecovery(ctx, recoveryID)
+		if err != nil {
+			return nil, err
+		}
+		recoveries = append(recoveries, redactEscrowRecovery(recovery, callerID))
+	}
+
+	return recoveries, nil
+}
+
+// currentEscrowDeposit loads a record and its escrow deposit, which must hold the record's
+// current key
+func (s *SmartContract) currentEscrowDeposit(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*EHRMetadata, *EscrowDeposit, error) {
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = requireNotErased(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var deposit EscrowDeposit
+	found, err := s.readStateEntity(ctx, escrowDepositObjectType, recordID, &deposit)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, fmt.Errorf("key of record %s is not in escrow", recordID)
+	}
+	if deposit.KeyVersion != recordKeyVersion(metadata) {
+		return nil, nil, fmt.Errorf("escrowed key of record %s is version %d, record is at key version %d",
+			recordID, deposit.KeyVersion, recordKeyVersion(metadata))
+	}
+
+	return metadata, &deposit, nil
+}
+
+// putEscrowDeposit saves a deposit with each wrapped share in its collection, purges the shares
+// of a previous deposit that the new one does not overwrite, and returns the deposit as it goes
+// on the public ledger
+func (s *SmartContract) putEscrowDeposit(
+	ctx contractapi.TransactionContextInterface,
+	deposit *EscrowDeposit,
+) (*EscrowDeposit, error) {
+	var previous EscrowDeposit
+	found, err := s.readStateEntity(ctx, escrowDepositObjectType, deposit.RecordID, &previous)
+	if err != nil {
+		return nil, err
+	}
+
+	public := *deposit
+	public.Shares = make([]EscrowShare, len(deposit.Shares))
+	for i, share := range deposit.Shares {
+		key, err := ctx.GetStub().CreateCompositeKey(escrowShareObjectType, []string{deposit.RecordID, share.CustodianID})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create composite key: %v", err)
+		}
+
+		ref := *share.PrivateData
+		ref.Hash, err = s.putPrivateValue(ctx, &ref, key, privateEscrowShareData{
+			RecordID:     deposit.RecordID,
+			CustodianID:  share.CustodianID,
+			WrappedShare: share.WrappedShare,
+		})
+		if err != nil {
+			return nil, err
+		}
+		share.PrivateData = &ref
+		share.WrappedShare = ""
+		public.Shares[i] = share
+	}
+
+	if found {
+		for _, share := range previous.Shares {
+			current := escrowShareOf(&public, share.CustodianID)
+			if current != nil && current.PrivateData.Collection == collectionOf(share.PrivateData) {
+				continue
+			}
+			err = s.purgeEscrowShare(ctx, deposit.RecordID, &share)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err = s.putStateEntity(ctx, escrowDepositObjectType, deposit.RecordID, &public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &public, nil
+}
+
+// loadEscrowShare fills in a deposited share from the collection of the custodian's organization,
+// failing where the collection is not readable
+func (s *SmartContract) loadEscrowShare(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	share *EscrowShare,
+) error {
+	if share.PrivateData == nil {
+		return nil
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(escrowShareObjectType, []string{recordID, share.CustodianID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	var data privateEscrowShareData
+	found, err := s.readPrivateValue(ctx, share.PrivateData, key, &data)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("escrowed share of record %s is not readable by the caller's organization in %s",
+			recordID, share.PrivateData.Collection)
+	}
+
+	share.WrappedShare = data.WrappedShare
+	return nil
+}
+
+// purgeEscrowShare purges a deposited share from its collection. Shares deposited before they
+// were kept privately have nothing to purge.
+func (s *SmartContract) purgeEscrowShare(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	share *EscrowShare,
+) error {
+	if share.PrivateData == nil {
+		return nil
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(escrowShareObjectType, []string{recordID, share.CustodianID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	return s.purgePrivateValue(ctx, share.PrivateData, key)
+}
+
+// deleteEscrowDeposit deletes the escrowed shares of a record's key, if any, purging them from
+// their collections
+func (s *SmartContract) deleteEscrowDeposit(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) error {
+	var deposit EscrowDeposit
+	found, err := s.readStateEntity(ctx, escrowDepositObjectType, recordID, &deposit)
+	if err != nil || !found {
+		return err
+	}
+
+	for i := range deposit.Shares {
+		err = s.purgeEscrowShare(ctx, recordID, &deposit.Shares[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(escrowDepositObjectType, []string{recordID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete from world state: %v", err)
+	}
+
+	return nil
+}
+
+// putEscrowRecovery saves a recovery with new re-wrapped shares in the collection of the
+// requester's organization, and returns the recovery as it goes on the public ledger
+func (s *SmartContract) putEscrowRecovery(
+	ctx contractapi.TransactionContextInterface,
+	recovery *EscrowRecovery,
+) (*EscrowRecovery, error) {
+	public := *recovery
+	public.Approvals = make([]EscrowApproval, len(recovery.Approvals))
+	for i, approval := range recovery.Approvals {
+		if approval.WrappedShare != "" && approval.PrivateData != nil {
+			key, err := ctx.GetStub().CreateCompositeKey(escrowApprovalObjectType, []string{recovery.RecoveryID, approval.CustodianID})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create composite key: %v", err)
+			}
+
+			ref := *approval.PrivateData
+			ref.Hash, err = s.putPrivateValue(ctx, &ref, key, privateEscrowShareData{
+				RecordID:     recovery.RecordID,
+				RecoveryID:   recovery.RecoveryID,
+				CustodianID:  approval.CustodianID,
+				WrappedShare: approval.WrappedShare,
+			})
+			if err != nil {
+				return nil, err
+			}
+			approval.PrivateData = &ref
+			approval.WrappedShare = ""
+		}
+		public.Approvals[i] = approval
+	}
+
+	err := s.putStateEntity(ctx, escrowRecoveryObjectType, recovery.RecoveryID, &public)
+	if err != nil {
+		return nil, err
+	}
+
+	return &public, nil
+}
+
+// loadEscrowApprovals fills in the re-wrapped shares of a recovery from the collection of the
+// requester's organization, failing where the collection is not readable
+func (s *SmartContract) loadEscrowApprovals(
+	ctx contractapi.TransactionContextInterface,
+	recovery *EscrowRecovery,
+) error {
+	for i := range recovery.Approvals {
+		approval := &recovery.Approvals[i]
+		if approval.PrivateData == nil {
+			continue
+		}
+
+		key, err := ctx.GetStub().CreateCompositeKey(escrowApprovalObjectType, []string{recovery.RecoveryID, approval.CustodianID})
+		if err != nil {
+			return fmt.Errorf("failed to create composite key: %v", err)
+		}
+
+		var data privateEscrowShareData
+		found, err := s.readPrivateValue(ctx, approval.PrivateData, key, &data)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("shares of recovery %s are not readable by the caller's organization in %s",
+				recovery.RecoveryID, approval.PrivateData.Collection)
+		}
+		approval.WrappedShare = data.WrappedShare
+	}
+
+	return nil
+}
+
+// purgeEscrowRecoveries purges the re-wrapped shares of every recovery of a record from their
+// collections. The recoveries themselves stay, without shares, as a record of break-glass access.
+func (s *SmartContract) purgeEscrowRecoveries(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) error {
+	recoveryIDs, err := s.indexEntries(ctx, escrowRecoveryRecordIndex, recordID)
+	if err != nil {
+		return err
+	}
+
+	for _, recoveryID := range recoveryIDs {
+		// Read as stored, without marking expiry
+		var recovery EscrowRecovery
+		found, err := s.readStateEntity(ctx, escrowRecoveryObjectType, recoveryID, &recovery)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+
+		for i := range recovery.Approvals {
+			approval := &recovery.Approvals[i]
+			if approval.PrivateData != nil {
+				key, err := ctx.GetStub().CreateCompositeKey(escrowApprovalObjectType, []string{recoveryID, approval.CustodianID})
+				if err != nil {
+					return fmt.Errorf("failed to create composite key: %v", err)
+				}
+				err = s.purgePrivateValue(ctx, approval.PrivateData, key)
+				if err != nil {
+					return err
+				}
+			}
+			// Shares submitted before they were kept privately are blanked
+			approval.WrappedShare = ""
+			approval.PrivateData = nil
+		}
+
+		err = s.putStateEntity(ctx, escrowRecoveryObjectType, recoveryID, &recovery)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getEscrowRecovery loads a recovery, failing if it does not exist. Pending recoveries past
+// their expiry read as expired.
+func (s *SmartContract) getEscrowRecovery(
+	ctx contractapi.TransactionContextInterface,
+	recoveryID string,
+) (*EscrowRecovery, error) {
+	var recovery EscrowRecovery
+	found, err := s.readStateEntity(ctx, escrowRecoveryObjectType, recoveryID, &recovery)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("escrow recovery %s %w", recoveryID, errNotFound)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if recovery.Status == EscrowRecoveryPending && !now.Before(recovery.ExpiresAt) {
+		recovery.Status = EscrowRecoveryExpired
+	}
+
+	return &recovery, nil
+}
+
+// requireEscrowRecoveryReader lets the requester, the custodians of the record key, the patient
+// and admins read a recovery
+func (s *SmartContract) requireEscrowRecoveryReader(
+	ctx contractapi.TransactionContextInterface,
+	recovery *EscrowRecovery,
+) error {
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+	if callerID == recovery.RequestedBy {
+		return nil
+	}
+
+	var deposit EscrowDeposit
+	found, err := s.readStateEntity(ctx, escrowDepositObjectType, recovery.RecordID, &deposit)
+	if err != nil {
+		return err
+	}
+	if found && escrowShareOf(&deposit, callerID) != nil {
+		return nil
+	}
+
+	return s.RequirePatientOrAdmin(ctx, recovery.PatientID)
+}
+
+// requirePendingRecovery rejects recoveries that were released or expired
+func requirePendingRecovery(recovery *EscrowRecovery) error {
+	switch recovery.Status {
+	case EscrowRecoveryReleased:
+		return fmt.Errorf("escrow recovery %s has already been released", recovery.RecoveryID)
+	case EscrowRecoveryExpired:
+		return fmt.Errorf("escrow recovery %s expired at %s", recovery.RecoveryID, recovery.ExpiresAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// setEscrowEvent emits an escrow recovery event
+func setEscrowEvent(
+	ctx contractapi.TransactionContextInterface,
+	name string,
+	event interface{},
+) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(name, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
+
+// escrowShareOf returns a custodian's share in a deposit, or nil
+func escrowShareOf(deposit *EscrowDeposit, custodianID string) *EscrowShare {
+	for i := range deposit.Shares {
+		if deposit.Shares[i].CustodianID == custodianID {
+			return &deposit.Shares[i]
+		}
+	}
+	return nil
+}
+
+// collectionOf is the collection a private data reference points at, or empty for public data
+func collectionOf(ref *PrivateDataRef) string {
+	if ref == nil {
+		return ""
+	}
+	return ref.Collection
+}
+
+// redactEscrowRecovery leaves the re-wrapped shares out of a recovery unless it was released and
+// the caller requested it
+func redactEscrowRecovery(recovery *EscrowRecovery, callerID string) *EscrowRecovery {
+	if callerID == recovery.RequestedBy && recovery.Status == EscrowRecoveryReleased {
+		return recovery
+	}
+
+	redacted := *recovery
+	redacted.Approvals = make([]EscrowApproval, len(recovery.Approvals))
+	for i, approval := range recovery.Approvals {
+		approval.WrappedShare = ""
+		redacted.Approvals[i] = approval
+	}
+	return &redacted
+}
+
+// validateWrappedShare checks a base64 share wrapped to a custodian or requester key
+func validateWrappedShare(errs *ValidationErrors, field string, wrappedShare string) {
+	if wrappedShare == "" {
+		errs.add(field, "is required")
+	} else if len(wrappedShare) > maxEncryptedKeyLength {
+		errs.add(field, "must be at most %d characters", maxEncryptedKeyLength)
+	} else if _, err := base64.StdEncoding.DecodeString(wrappedShare); err != nil {
+		errs.add(field, "must be base64")
+	}
+}
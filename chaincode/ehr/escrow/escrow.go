@@ -0,0 +1,227 @@
+// Package escrow splits a record key into Shamir shares for the custodians of the escrow policy,
+// and puts it back together from the shares released by a recovery.
+//
+// Shares are computed byte by byte over GF(2^8) with the AES polynomial. A share is its
+// x-coordinate, 1 to 255, followed by one byte per byte of the key. Shares are wrapped with
+// RSA-OAEP (SHA-256) like record keys, to keys in the public key directory.
+package escrow
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ehr-blockchain/chaincode/keyrotation"
+)
+
+// Transient map keys EscrowRecordKey and SubmitEscrowShare read the shares from
+const (
+	TransientKey      = "escrowShares"
+	ShareTransientKey = "escrowShare"
+)
+
+const maxShares = 255
+
+// Custodian is a custodian of the escrow policy, with the encryption key registered for them in
+// the public key directory (GetActivePublicKey)
+type Custodian struct {
+	CustodianID string
+	PublicKey   string // PEM encoded RSA PUBLIC KEY
+}
+
+// WrappedShare is one share wrapped for a custodian, in the shape EscrowRecordKey expects
+type WrappedShare struct {
+	CustodianID    string `json:"custodianId"`
+	WrappedShare   string `json:"wrappedShare"`
+	KeyFingerprint string `json:"keyFingerprint"`
+}
+
+// Deposit splits a record key into one share per custodian, any threshold of which rebuild it,
+// and returns the transient map for EscrowRecordKey
+func Deposit(key []byte, threshold int, custodians []Custodian) (map[string][]byte, error) {
+	shares, err := Split(key, threshold, len(custodians))
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := make([]WrappedShare, len(custodians))
+	for i, custodian := range custodians {
+		publicKey, keyID, err := keyrotation.ParsePublicKey(custodian.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for custodian %s: %v", custodian.CustodianID, err)
+		}
+		wrap, err := keyrotation.WrapKey(publicKey, shares[i])
+		if err != nil {
+			return nil, err
+		}
+		wrapped[i] = WrappedShare{
+			CustodianID:    custodian.CustodianID,
+			WrappedShare:   base64.StdEncoding.EncodeToString(wrap),
+			KeyFingerprint: keyID,
+		}
+	}
+
+	sharesJSON, err := json.Marshal(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal shares: %v", err)
+	}
+	return map[string][]byte{TransientKey: sharesJSON}, nil
+}
+
+// Rewrap decrypts a custodian's share, as returned by GetMyEscrowShare, and wraps it to the key
+// of the recovery's requester. It returns the transient map for SubmitEscrowShare.
+func Rewrap(custodianKey *rsa.PrivateKey, wrappedShare string, requesterKey string) (map[string][]byte, error) {
+	share, err := unwrapShare(custodianKey, wrappedShare)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, err := keyrotation.ParsePublicKey(requesterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid requester key: %v", err)
+	}
+	wrap, err := keyrotation.WrapKey(publicKey, share)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string][]byte{ShareTransientKey: []byte(base64.StdEncoding.EncodeToString(wrap))}, nil
+}
+
+// Recover rebuilds a record key from the shares of a released recovery, wrapped to the
+// requester. Fewer shares than the threshold rebuild a wrong key, which fails to decrypt the file.
+func Recover(requesterKey *rsa.PrivateKey, wrappedShares []string) ([]byte, error) {
+	shares := make([][]byte, len(wrappedShares))
+	for i, wrappedShare := range wrappedShares {
+		share, err := unwrapShare(requesterKey, wrappedShare)
+		if err != nil {
+			return nil, err
+		}
+		shares[i] = share
+	}
+
+	return Combine(shares)
+}
+
+// Split splits a secret into count shares, any threshold of which rebuild it
+func Split(secret []byte, threshold int, count int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret is required")
+	}
+	if threshold < 2 || threshold > count {
+		return nil, fmt.Errorf("threshold must be between 2 and the number of shares, got %d of %d", threshold, count)
+	}
+	if count > maxShares {
+		return nil, fmt.Errorf("at most %d shares are supported", maxShares)
+	}
+
+	shares := make([][]byte, count)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	// One random polynomial per byte, with the secret byte as its constant term
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		_, err := rand.Read(coefficients[1:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate coefficients: %v", err)
+		}
+		coefficients[0] = b
+
+		for _, share := range shares {
+			share[j+1] = evaluate(coefficients, share[0])
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine rebuilds a secret from shares made by Split
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least 2 shares are required")
+	}
+
+	size := len(shares[0])
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if len(share) != size || size < 2 {
+			return nil, fmt.Errorf("shares must have the same length")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("shares must have distinct non-zero x-coordinates")
+		}
+		seen[share[0]] = true
+	}
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		basis := byte(1)
+		for k, other := range shares {
+			if k != i {
+				basis = mul(basis, div(other[0], other[0]^share[0]))
+			}
+		}
+		for j := range secret {
+			secret[j] ^= mul(basis, share[j+1])
+		}
+	}
+
+	return secret, nil
+}
+
+// unwrapShare decrypts a base64 share wrapped with RSA-OAEP (SHA-256)
+func unwrapShare(privateKey *rsa.PrivateKey, wrappedShare string) ([]byte, error) {
+	wrap, err := base64.StdEncoding.DecodeString(wrappedShare)
+	if err != nil {
+		return nil, fmt.Errorf("wrapped share is not valid base64: %v", err)
+	}
+
+	share, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrap, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap share: %v", err)
+	}
+	return share, nil
+}
+
+// evaluate evaluates a polynomial at x with Horner's method
+func evaluate(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// mul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x + 1
+func mul(a byte, b byte) byte {
+	var product byte
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// div divides in GF(2^8); b must not be zero
+func div(a byte, b byte) byte {
+	// b^254 is the inverse of b
+	inverse := byte(1)
+	for i := 0; i < 254; i++ {
+		inverse = mul(inverse, b)
+	}
+	return mul(a, inverse)
+}
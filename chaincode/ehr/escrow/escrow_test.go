@@ -0,0 +1,97 @@
+package escrow
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testKey returns an RSA key and its PEM public key
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// TestSplitCombine tests that any threshold of shares rebuild the secret
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	assert.NoError(t, err)
+
+	shares, err := Split(secret, 3, 5)
+	assert.NoError(t, err)
+	assert.Len(t, shares, 5)
+
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		picked := [][]byte{}
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		combined, err := Combine(picked)
+		assert.NoError(t, err)
+		assert.Equal(t, secret, combined, "shares %v", subset)
+	}
+
+	// Below the threshold the result is unrelated to the secret
+	combined, err := Combine(shares[:2])
+	assert.NoError(t, err)
+	assert.NotEqual(t, secret, combined)
+
+	_, err = Split(secret, 1, 5)
+	assert.ErrorContains(t, err, "threshold must be between 2")
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	assert.ErrorContains(t, err, "distinct")
+}
+
+// TestRecover tests depositing a key, re-wrapping shares to a requester and recovering it
+func TestRecover(t *testing.T) {
+	requesterKey, requesterPEM := testKey(t)
+	custodianKeys := map[string]*rsa.PrivateKey{}
+	custodians := []Custodian{}
+	for _, custodianID := range []string{"custodian-a", "custodian-b", "custodian-c"} {
+		key, publicKey := testKey(t)
+		custodianKeys[custodianID] = key
+		custodians = append(custodians, Custodian{CustodianID: custodianID, PublicKey: publicKey})
+	}
+
+	recordKey := make([]byte, 32)
+	_, err := rand.Read(recordKey)
+	assert.NoError(t, err)
+
+	transient, err := Deposit(recordKey, 2, custodians)
+	assert.NoError(t, err)
+	var deposited []WrappedShare
+	assert.NoError(t, json.Unmarshal(transient[TransientKey], &deposited))
+	assert.Len(t, deposited, 3)
+
+	// A wrapped share alone does not hold the key
+	for _, share := range deposited {
+		wrap, err := base64.StdEncoding.DecodeString(share.WrappedShare)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(wrap), string(recordKey))
+	}
+
+	released := []string{}
+	for _, share := range deposited[1:] {
+		rewrapped, err := Rewrap(custodianKeys[share.CustodianID], share.WrappedShare, requesterPEM)
+		assert.NoError(t, err)
+		released = append(released, string(rewrapped[ShareTransientKey]))
+	}
+
+	recovered, err := Recover(requesterKey, released)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, recovered)
+
+	// Custodians cannot open each other's shares
+	_, err = Rewrap(custodianKeys["custodian-a"], deposited[1].WrappedShare, requesterPEM)
+	assert.ErrorContains(t, err, "failed to unwrap share")
+}
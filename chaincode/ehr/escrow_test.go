@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/ehr-blockchain/chaincode/escrow"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestEscrowRecovery tests that an escrowed record key is only released to a doctor once the
+// threshold of custodians re-wrapped their shares for them
+func TestEscrowRecovery(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newPrivateDataContext(stub, patientIdentity("patient123"))
+	doctorCtx := newPrivateDataContext(stub, doctorIdentity("doctor456"))
+	adminCtx := newPrivateDataContext(stub, adminIdentity("admin1"))
+	patientCollection := privateCollection("PatientMSP")
+	hospitalCollection := privateCollection("HospitalMSP")
+	custodians := map[string]*testIdentity{
+		"admin1":   adminIdentity("admin1"),
+		"admin2":   adminIdentity("admin2"),
+		"steward1": patientIdentity("steward1"),
+	}
+
+	for i, custodianID := range []string{"admin1", "admin2"} {
+		_, err := registerEncryptionKey(s, stub, "tx-key-"+string(rune('a'+i)), custodians[custodianID])
+		assert.NoError(t, err)
+	}
+
+	// Custodians must hold an encryption key and span more than one organization
+	err := inTx(stub, "tx1", func() error {
+		return s.SetEscrowPolicy(adminCtx, 2, []string{"admin1", "admin2", "steward1"})
+	})
+	assert.ErrorContains(t, err, "steward1 has no active encryption key")
+
+	err = inTx(stub, "tx2", func() error {
+		return s.SetEscrowPolicy(adminCtx, 2, []string{"admin1", "admin2"})
+	})
+	assert.ErrorContains(t, err, "at least 2 organizations")
+
+	_, err = registerEncryptionKey(s, stub, "tx3", custodians["steward1"])
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.SetEscrowPolicy(adminCtx, 1, []string{"admin1", "admin2", "steward1"})
+	})
+	assert.ErrorContains(t, err, `"field":"threshold"`)
+
+	err = inTx(stub, "tx5", func() error {
+		return s.SetEscrowPolicy(adminCtx, 2, []string{"admin1", "admin2", "steward1"})
+	})
+	assert.NoError(t, err)
+
+	// The patient escrows the key, with one share per custodian
+	err = inTx(stub, "tx6", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	recordKey := make([]byte, 32)
+	_, err = rand.Read(recordKey)
+	assert.NoError(t, err)
+	escrowCustodians := []escrow.Custodian{}
+	for _, custodianID := range []string{"admin1", "admin2"} {
+		escrowCustodians = append(escrowCustodians, escrow.Custodian{CustodianID: custodianID, PublicKey: testRSAPublicKey(custodianID)})
+	}
+
+	partial, err := escrow.Deposit(recordKey, 2, escrowCustodians)
+	assert.NoError(t, err)
+	err = inTxWithTransient(stub, "tx7", partial, func() error {
+		_, err := s.EscrowRecordKey(patientCtx, "EHR-001")
+		return err
+	})
+	assert.ErrorContains(t, err, "must be wrapped for custodian steward1")
+
+	escrowCustodians = append(escrowCustodians, escrow.Custodian{CustodianID: "steward1", PublicKey: testRSAPublicKey("steward1")})
+	deposit, err := escrow.Deposit(recordKey, 2, escrowCustodians)
+	assert.NoError(t, err)
+	var deposited *EscrowDeposit
+	err = inTxWithTransient(stub, "tx8", deposit, func() error {
+		var err error
+		deposited, err = s.EscrowRecordKey(patientCtx, "EHR-001")
+		return err
+	})
+	assert.NoError(t, err)
+
+	// Each share is kept in the collection of its custodian's organization, with only hashes public
+	depositKey, err := stub.CreateCompositeKey(escrowDepositObjectType, []string{"EHR-001"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stub.State[depositKey]), "wrappedShare")
+	for _, share := range deposited.Shares {
+		assert.Empty(t, share.WrappedShare)
+		assert.NotEmpty(t, share.PrivateData.Hash)
+	}
+	assert.Len(t, stub.PvtState[hospitalCollection], 2)
+	assert.Len(t, stub.PvtState[patientCollection], 1)
+
+	// A licensed doctor asks for the key, to be re-wrapped to their own key
+	doctorKeyID, err := registerEncryptionKey(s, stub, "tx9", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx10", func() error {
+		_, err := s.RequestEscrowRecovery(adminCtx, "EHR-001", "Unconscious patient in ER", doctorKeyID)
+		return err
+	})
+	assert.Error(t, err)
+
+	var recovery *EscrowRecovery
+	err = inTx(stub, "tx11", func() error {
+		var err error
+		recovery, err = s.RequestEscrowRecovery(doctorCtx, "EHR-001", "Unconscious patient in ER", doctorKeyID)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, EscrowRecoveryPending, recovery.Status)
+	assert.Equal(t, 2, recovery.Threshold)
+
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventEscrowRecoveryRequested, event.EventName)
+	var requested EscrowRecoveryRequestedEvent
+	assert.NoError(t, json.Unmarshal(event.Payload, &requested))
+	assert.Equal(t, []string{"admin1", "admin2", "steward1"}, requested.CustodianIDs)
+
+	// Custodians approve one at a time
+	submitShare := func(txID string, custodianID string) (*EscrowRecovery, error) {
+		ctx := newPrivateDataContext(stub, custodians[custodianID])
+		var share *EscrowShare
+		err := inTx(stub, txID+"-share", func() error {
+			var err error
+			share, err = s.GetMyEscrowShare(ctx, recovery.RecoveryID)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		transient, err := escrow.Rewrap(testRSAKeys[custodianID], share.WrappedShare, testRSAPublicKey("doctor456"))
+		if err != nil {
+			return nil, err
+		}
+		var updated *EscrowRecovery
+		err = inTxWithTransient(stub, txID, transient, func() error {
+			var err error
+			updated, err = s.SubmitEscrowShare(ctx, recovery.RecoveryID)
+			return err
+		})
+		return updated, err
+	}
+
+	_, err = s.GetMyEscrowShare(doctorCtx, recovery.RecoveryID)
+	assert.ErrorContains(t, err, "holds no escrowed share")
+
+	// A custodian's share is only readable through a peer of their organization
+	stewardOnHospitalPeer := newTestContext(stub, custodians["steward1"])
+	stewardOnHospitalPeer.SetStub(&privateDataStub{stub, hospitalCollection})
+	_, err = s.GetMyEscrowShare(stewardOnHospitalPeer, recovery.RecoveryID)
+	assert.ErrorContains(t, err, "not readable by the caller's organization in PatientMSPPrivateCollection")
+
+	updated, err := submitShare("tx12", "admin1")
+	assert.NoError(t, err)
+	assert.Equal(t, EscrowRecoveryPending, updated.Status)
+
+	_, err = submitShare("tx13", "admin1")
+	assert.ErrorContains(t, err, "has already approved")
+
+	pending, err := s.GetEscrowRecovery(doctorCtx, recovery.RecoveryID)
+	assert.NoError(t, err)
+	if assert.Len(t, pending.Approvals, 1) {
+		assert.Empty(t, pending.Approvals[0].WrappedShare, "shares stay hidden below the threshold")
+	}
+
+	updated, err = submitShare("tx14", "steward1")
+	assert.NoError(t, err)
+	assert.Equal(t, EscrowRecoveryReleased, updated.Status)
+
+	// Re-wrapped shares go to the collection of the requester's organization
+	recoveryKey, err := stub.CreateCompositeKey(escrowRecoveryObjectType, []string{recovery.RecoveryID})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stub.State[recoveryKey]), "wrappedShare")
+	assert.Len(t, stub.PvtState[hospitalCollection], 4)
+
+	event = <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventEscrowKeyReleased, event.EventName)
+
+	_, err = submitShare("tx15", "admin2")
+	assert.ErrorContains(t, err, "has already been released")
+
+	// The requester rebuilds the key; others see the approvals without shares
+	var released *EscrowRecovery
+	err = inTx(stub, "tx16", func() error {
+		var err error
+		released, err = s.GetEscrowRecovery(doctorCtx, recovery.RecoveryID)
+		return err
+	})
+	assert.NoError(t, err)
+	wrappedShares := []string{}
+	for _, approval := range released.Approvals {
+		wrappedShares = append(wrappedShares, approval.WrappedShare)
+	}
+	recovered, err := escrow.Recover(testRSAKeys["doctor456"], wrappedShares)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, recovered)
+
+	recoveries, err := s.QueryEscrowRecoveriesByRecord(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	if assert.Len(t, recoveries, 1) {
+		assert.Equal(t, "PatientMSP", recoveries[0].Approvals[1].CustodianOrg)
+		assert.Empty(t, recoveries[0].Approvals[0].WrappedShare)
+	}
+
+	_, err = s.GetEscrowRecovery(newTestContext(stub, doctorIdentity("doctor789")), recovery.RecoveryID)
+	assert.Error(t, err)
+
+	// Every step of the recovery is audited
+	queryCtx := newQueryContext(stub, adminIdentity("admin1"))
+	logs, err := s.QueryAuditLogsByAction(queryCtx, ActionRequestEscrowRecovery)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 1)
+	logs, err = s.QueryAuditLogsByAction(queryCtx, ActionGetEscrowShare)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 3, "three shares retrieved")
+	logs, err = s.QueryAuditLogsByAction(queryCtx, ActionSubmitEscrowShare)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 2, "two shares submitted")
+	logs, err = s.QueryAuditLogsByAction(queryCtx, ActionEscrowKeyReleased)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 2, "the release and the requester reading the shares")
+
+	// Once the key is rotated the escrowed shares are stale
+	err = inTx(stub, "tx17", func() error {
+		_, err := s.RotateRecordKey(patientCtx, "EHR-001", testCID("rotated"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx18", func() error {
+		_, err := s.RequestEscrowRecovery(doctorCtx, "EHR-001", "Unconscious patient in ER", doctorKeyID)
+		return err
+	})
+	assert.ErrorContains(t, err, "escrowed key of record EHR-001 is version 1")
+
+	// Erasure purges the deposit and the shares re-wrapped for recoveries
+	err = inTx(stub, "tx19", func() error {
+		return s.EraseEHR(adminCtx, "EHR-001", "GDPR Art. 17 request")
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, stub.PvtState[hospitalCollection])
+	assert.Empty(t, stub.PvtState[patientCollection])
+	assert.Nil(t, stub.State[depositKey])
+
+	var erased *EscrowRecovery
+	err = inTx(stub, "tx20", func() error {
+		var err error
+		erased, err = s.GetEscrowRecovery(doctorCtx, recovery.RecoveryID)
+		return err
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, approval := range erased.Approvals {
+		assert.Empty(t, approval.WrappedShare)
+		assert.Nil(t, approval.PrivateData)
+	}
+}
@@ -0,0 +1,650 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// FHIR R4 code systems used when mapping consents
+const (
+	fhirConsentScopeSystem    = "http://terminology.hl7.org/CodeSystem/consentscope"
+	fhirLOINCSystem           = "http://loinc.org"
+	fhirActCodeSystem         = "http://terminology.hl7.org/CodeSystem/v3-ActCode"
+	fhirActReasonSystem       = "http://terminology.hl7.org/CodeSystem/v3-ActReason"
+	fhirConfidentialitySystem = "http://terminology.hl7.org/CodeSystem/v3-Confidentiality"
+	fhirParticipationSystem   = "http://terminology.hl7.org/CodeSystem/v3-ParticipationType"
+	fhirIdentifierSystemBase  = "urn:ehr-blockchain:"
+	fhirPatientConsentLOINC   = "59284-0"
+	fhirPrivacyScope          = "patient-privacy"
+	fhirProvisionPermit       = "permit"
+	fhirProvisionDeny         = "deny"
+	fhirDataMeaningInstance   = "instance"
+	fhirResourcePatient       = "Patient"
+	fhirResourcePractitioner  = "Practitioner"
+	fhirResourceDocumentRef   = "DocumentReference"
+	fhirResourceConsent       = "Consent"
+	fhirConsentStatusActive   = "active"
+	fhirConsentStatusInactive = "inactive"
+	fhirConsentStatusRejected = "rejected"
+)
+
+// fhirIDPattern is the R4 id datatype; ledger IDs that don't fit are exported as identifiers
+var fhirIDPattern = regexp.MustCompile(`^[A-Za-z0-9\-.]{1,64}$`)
+
+// FHIRCoding is an R4 Coding
+type FHIRCoding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+// FHIRCodeableConcept is an R4 CodeableConcept
+type FHIRCodeableConcept struct {
+	Coding []FHIRCoding `json:"coding,omitempty"`
+	Text   string       `json:"text,omitempty"`
+}
+
+// FHIRIdentifier is an R4 Identifier
+type FHIRIdentifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+// FHIRReference is an R4 Reference (literal or logical)
+type FHIRReference struct {
+	Reference  string          `json:"reference,omitempty"`
+	Identifier *FHIRIdentifier `json:"identifier,omitempty"`
+	Display    string          `json:"display,omitempty"`
+}
+
+// FHIRPeriod is an R4 Period
+type FHIRPeriod struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+// FHIRConsentActor is Consent.provision.actor
+type FHIRConsentActor struct {
+	Role      FHIRCodeableConcept `json:"role"`
+	Reference FHIRReference       `json:"reference"`
+}
+
+// FHIRConsentData is Consent.provision.data
+type FHIRConsentData struct {
+	Meaning   string        `json:"meaning"`
+	Reference FHIRReference `json:"reference"`
+}
+
+// FHIRConsentProvision is Consent.provision, including nested exceptions
+type FHIRConsentProvision struct {
+	Type          string                 `json:"type,omitempty"`
+	Period        *FHIRPeriod            `json:"period,omitempty"`
+	Actor         []FHIRConsentActor     `json:"actor,omitempty"`
+	Purpose       []FHIRCoding           `json:"purpose,omitempty"`
+	SecurityLabel []FHIRCoding           `json:"securityLabel,omitempty"`
+	Data          []FHIRConsentData      `json:"data,omitempty"`
+	Provision     []FHIRConsentProvision `json:"provision,omitempty"`
+}
+
+// FHIRConsent is the subset of the R4 Consent resource understood by the contract
+type FHIRConsent struct {
+	ResourceType string                `json:"resourceType"`
+	ID           string                `json:"id,omitempty"`
+	Identifier   []FHIRIdentifier      `json:"identifier,omitempty"`
+	Status       string                `json:"status"`
+	Scope        FHIRCodeableConcept   `json:"scope"`
+	Category     []FHIRCodeableConcept `json:"category"`
+	Patient      *FHIRReference        `json:"patient,omitempty"`
+	DateTime     string                `json:"dateTime,omitempty"`
+	Performer    []FHIRReference       `json:"performer,omitempty"`
+	PolicyRule   *FHIRCodeableConcept  `json:"policyRule,omitempty"`
+	Provision    *FHIRConsentProvision `json:"provision,omitempty"`
+}
+
+// FHIRBundleEntry is Bundle.entry
+type FHIRBundleEntry struct {
+	Resource *FHIRConsent `json:"resource"`
+}
+
+// FHIRBundle is an R4 Bundle of Consent resources
+type FHIRBundle struct {
+	ResourceType string            `json:"resourceType"`
+	Type         string            `json:"type"`
+	Timestamp    string            `json:"timestamp,omitempty"`
+	Entry        []FHIRBundleEntry `json:"entry,omitempty"`
+}
+
+// ImportFHIRConsent validates a FHIR R4 Consent and stores it as consent records
+func (s *SmartContract) ImportFHIRConsent(
+	ctx contractapi.TransactionContextInterface,
+	consentJSON string,
+) ([]*ConsentRecord, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	var resource FHIRConsent
+	err = json.Unmarshal([]byte(consentJSON), &resource)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIR Consent: %v", err)
+	}
+
+	consents, err := fhirConsentToRecords(&resource)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the patient (or an admin) may record their consent
+	err = s.RequirePatientOrAdmin(ctx, consents[0].PatientID)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Imported consents take the same path as granted and revoked ones, so keys follow them
+	for _, consent := range consents {
+		consent.GrantedBy = callerID
+		consent.Timestamp = now
+
+		message := fmt.Sprintf("Consent %s imported from FHIR Consent %s", consent.ConsentID, resource.ID)
+		if consent.Granted {
+			_, _, err = s.grantConsent(ctx, consent)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			revokedKeys, revokedReEncryption, err := s.revokeConsent(ctx, consent)
+			if err != nil {
+				return nil, err
+			}
+			message = fmt.Sprintf("%s as revoked, %d wrapped key(s) deleted, re-encryption key deleted: %t",
+				message, revokedKeys, revokedReEncryption)
+		}
+
+		// Create audit log
+		err = s.createAuditLog(ctx, ActionImportConsent, callerID, consent.DoctorID, consent.RecordID, consent.PatientID, true, message)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return consents, nil
+}
+
+// ExportConsentAsFHIR returns a consent record as a FHIR R4 Consent resource
+func (s *SmartContract) ExportConsentAsFHIR(
+	ctx contractapi.TransactionContextInterface,
+	consentID string,
+) (string, error) {
+	consentJSON, err := ctx.GetStub().GetState(consentID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if consentJSON == nil {
+		return "", fmt.Errorf("consent %s %w", consentID, errNotFound)
+	}
+
+	var consent ConsentRecord
+	err = json.Unmarshal(consentJSON, &consent)
+	if err != nil {
+		return "", fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+
+	// Only the patient (or an admin) may read the patient's consent directive
+	err = s.RequirePatientOrAdmin(ctx, consent.PatientID)
+	if err != nil {
+		return "", err
+	}
+
+	resourceJSON, err := json.Marshal(consentRecordToFHIR(&consent))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal FHIR Consent: %v", err)
+	}
+
+	return string(resourceJSON), nil
+}
+
+// ExportPatientConsentsBundle returns all of a patient's consents as a FHIR R4 Bundle
+func (s *SmartContract) ExportPatientConsentsBundle(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) (string, error) {
+	// Only the patient (or an admin) may read the patient's consent directives
+	err := s.RequirePatientOrAdmin(ctx, patientID)
+	if err != nil {
+		return "", err
+	}
+
+	consents, err := s.QueryConsentsByPatient(ctx, patientID)
+	if err != nil {
+		return "", err
+	}
+
+	// Every endorsing peer must produce the same bundle
+	now, err := txTime(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	bundleJSON, err := json.Marshal(fhirConsentBundle(consents, now))
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal FHIR Bundle: %v", err)
+	}
+
+	return string(bundleJSON), nil
+}
+
+// fhirConsentToRecords maps a FHIR Consent onto one consent record per (actor, data) pair.
+// Nested provisions are applied after their parent so exceptions override the base rule.
+func fhirConsentToRecords(resource *FHIRConsent) ([]*ConsentRecord, error) {
+	if resource.ResourceType != fhirResourceConsent {
+		return nil, fmt.Errorf("invalid FHIR Consent: resourceType must be %s, got %q", fhirResourceConsent, resource.ResourceType)
+	}
+
+	var active bool
+	switch resource.Status {
+	case fhirConsentStatusActive:
+		active = true
+	case fhirConsentStatusInactive, fhirConsentStatusRejected:
+		active = false
+	default:
+		return nil, fmt.Errorf("invalid FHIR Consent: status %q cannot be imported", resource.Status)
+	}
+
+	if !hasCoding(resource.Scope, fhirConsentScopeSystem, fhirPrivacyScope) {
+		return nil, fmt.Errorf("invalid FHIR Consent: scope must be %s", fhirPrivacyScope)
+	}
+	if len(resource.Category) == 0 {
+		return nil, fmt.Errorf("invalid FHIR Consent: category is required")
+	}
+	if resource.Patient == nil {
+		return nil, fmt.Errorf("invalid FHIR Consent: patient is required")
+	}
+	patientID, err := parseFHIRReference(*resource.Patient, fhirResourcePatient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FHIR Consent: patient: %v", err)
+	}
+	if resource.Provision == nil {
+		return nil, fmt.Errorf("invalid FHIR Consent: provision is required")
+	}
+
+	mapper := fhirProvisionMapper{
+		patientID: patientID,
+		active:    active,
+		byID:      make(map[string]*ConsentRecord),
+	}
+	err = mapper.walk(resource.Provision, "provision", fhirProvisionScope{provisionType: fhirProvisionPermit})
+	if err != nil {
+		return nil, err
+	}
+	if len(mapper.order) == 0 {
+		return nil, fmt.Errorf("invalid FHIR Consent: provision grants nothing to any actor")
+	}
+
+	consents := make([]*ConsentRecord, 0, len(mapper.order))
+	for _, consentID := range mapper.order {
+		consents = append(consents, mapper.byID[consentID])
+	}
+
+	return consents, nil
+}
+
+// fhirProvisionScope carries the values a nested provision inherits from its parent
+type fhirProvisionScope struct {
+	provisionType string
+	period        *FHIRPeriod
+	doctorIDs     []string
+	purposes      []string
+	labels        []string
+}
+
+// fhirProvisionMapper accumulates consent records while walking a provision tree
+type fhirProvisionMapper struct {
+	patientID string
+	active    bool
+	byID      map[string]*ConsentRecord
+	order     []string
+}
+
+func (m *fhirProvisionMapper) walk(provision *FHIRConsentProvision, path string, inherited fhirProvisionScope) error {
+	scope := inherited
+
+	switch provision.Type {
+	case "":
+		// Inherit the parent's rule
+	case fhirProvisionPermit, fhirProvisionDeny:
+		scope.provisionType = provision.Type
+	default:
+		return fmt.Errorf("invalid FHIR Consent: %s.type %q must be permit or deny", path, provision.Type)
+	}
+
+	if provision.Period != nil {
+		scope.period = provision.Period
+	}
+
+	if len(provision.Actor) > 0 {
+		scope.doctorIDs = nil
+		for i, actor := range provision.Actor {
+			doctorID, err := parseFHIRReference(actor.Reference, fhirResourcePractitioner)
+			if err != nil {
+				return fmt.Errorf("invalid FHIR Consent: %s.actor[%d]: %v", path, i, err)
+			}
+			scope.doctorIDs = append(scope.doctorIDs, doctorID)
+		}
+	}
+
+	if len(provision.Purpose) > 0 {
+		scope.purposes = nil
+		for _, purpose := range provision.Purpose {
+			scope.purposes = append(scope.purposes, purposeFromCoding(purpose))
+		}
+	}
+
+	// Security labels on a permit opt the consent in to records carrying them
+	if len(provision.SecurityLabel) > 0 {
+		var codes []string
+		for _, label := range provision.SecurityLabel {
+			codes = append(codes, label.Code)
+		}
+		labels, err := normalizeLabels(codes)
+		if err != nil {
+			return fmt.Errorf("invalid FHIR Consent: %s.securityLabel: %v", path, err)
+		}
+		scope.labels = labels
+	}
+
+	recordIDs := []string{"*"}
+	if len(provision.Data) > 0 {
+		recordIDs = nil
+		for i, data := range provision.Data {
+			if data.Meaning != fhirDataMeaningInstance {
+				return fmt.Errorf("invalid FHIR Consent: %s.data[%d].meaning %q is not supported", path, i, data.Meaning)
+			}
+			recordID, err := parseFHIRReference(data.Reference, fhirResourceDocumentRef)
+			if err != nil {
+				return fmt.Errorf("invalid FHIR Consent: %s.data[%d]: %v", path, i, err)
+			}
+			recordIDs = append(recordIDs, recordID)
+		}
+	}
+
+	if len(scope.doctorIDs) == 0 {
+		return fmt.Errorf("invalid FHIR Consent: %s has no actor", path)
+	}
+
+	startDate, expiryDate, err := parseFHIRPeriod(scope.period)
+	if err != nil {
+		return fmt.Errorf("invalid FHIR Consent: %s.period: %v", path, err)
+	}
+
+	for _, doctorID := range scope.doctorIDs {
+		for _, recordID := range recordIDs {
+			consent := &ConsentRecord{
+				ConsentID:         consentIDFor(m.patientID, doctorID, recordID),
+				PatientID:         m.patientID,
+				DoctorID:          doctorID,
+				RecordID:          recordID,
+				Granted:           m.active && scope.provisionType == fhirProvisionPermit,
+				ExpiryDate:        expiryDate,
+				StartDate:         startDate,
+				Purposes:          scope.purposes,
+				SensitivityOptIns: scope.labels,
+			}
+			if _, seen := m.byID[consent.ConsentID]; !seen {
+				m.order = append(m.order, consent.ConsentID)
+			}
+			m.byID[consent.ConsentID] = consent
+		}
+	}
+
+	for i := range provision.Provision {
+		err := m.walk(&provision.Provision[i], fmt.Sprintf("%s.provision[%d]", path, i), scope)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// consentRecordToFHIR maps a consent record onto a FHIR Consent resource
+func consentRecordToFHIR(consent *ConsentRecord) *FHIRConsent {
+	status := fhirConsentStatusActive
+	if !consent.Granted {
+		status = fhirConsentStatusInactive
+	}
+
+	patient := fhirReferenceFor(fhirResourcePatient, consent.PatientID)
+
+	period := &FHIRPeriod{End: consent.ExpiryDate.UTC().Format(time.RFC3339Nano)}
+	if !consent.StartDate.IsZero() {
+		period.Start = consent.StartDate.UTC().Format(time.RFC3339Nano)
+	}
+
+	provision := &FHIRConsentProvision{
+		Type:   fhirProvisionPermit,
+		Period: period,
+		Actor: []FHIRConsentActor{{
+			Role: FHIRCodeableConcept{Coding: []FHIRCoding{{
+				System: fhirParticipationSystem,
+				Code:   "PRCP",
+			}}},
+			Reference: fhirReferenceFor(fhirResourcePractitioner, consent.DoctorID),
+		}},
+	}
+
+	for _, purpose := range consent.Purposes {
+		provision.Purpose = append(provision.Purpose, codingFromPurpose(purpose))
+	}
+
+	for _, label := range consent.SensitivityOptIns {
+		provision.SecurityLabel = append(provision.SecurityLabel, codingFromLabel(label))
+	}
+
+	// A consent on all records carries no data restriction
+	if consent.RecordID != "" && consent.RecordID != "*" {
+		provision.Data = []FHIRConsentData{{
+			Meaning:   fhirDataMeaningInstance,
+			Reference: fhirReferenceFor(fhirResourceDocumentRef, consent.RecordID),
+		}}
+	}
+
+	return &FHIRConsent{
+		ResourceType: fhirResourceConsent,
+		ID:           fhirIDFor(consent.ConsentID),
+		Identifier: []FHIRIdentifier{{
+			System: fhirIdentifierSystemFor(fhirResourceConsent),
+			Value:  consent.ConsentID,
+		}},
+		Status: status,
+		Scope: FHIRCodeableConcept{Coding: []FHIRCoding{{
+			System: fhirConsentScopeSystem,
+			Code:   fhirPrivacyScope,
+		}}},
+		Category: []FHIRCodeableConcept{{Coding: []FHIRCoding{{
+			System: fhirLOINCSystem,
+			Code:   fhirPatientConsentLOINC,
+		}}}},
+		Patient:   &patient,
+		DateTime:  consent.Timestamp.UTC().Format(time.RFC3339Nano),
+		Performer: []FHIRReference{patient},
+		PolicyRule: &FHIRCodeableConcept{Coding: []FHIRCoding{{
+			System: fhirActCodeSystem,
+			Code:   "OPTIN",
+		}}},
+		Provision: provision,
+	}
+}
+
+// fhirConsentBundle wraps consent records in a FHIR collection Bundle
+func fhirConsentBundle(consents []*ConsentRecord, timestamp time.Time) *FHIRBundle {
+	bundle := &FHIRBundle{
+		ResourceType: "Bundle",
+		Type:         "collection",
+		Timestamp:    timestamp.UTC().Format(time.RFC3339Nano),
+	}
+
+	sorted := make([]*ConsentRecord, 0, len(consents))
+	for _, consent := range consents {
+		// Patient queries also match EHR metadata documents
+		if consent.ConsentID != "" {
+			sorted = append(sorted, consent)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ConsentID < sorted[j].ConsentID
+	})
+
+	for _, consent := range sorted {
+		bundle.Entry = append(bundle.Entry, FHIRBundleEntry{Resource: consentRecordToFHIR(consent)})
+	}
+
+	return bundle
+}
+
+// parseFHIRReference extracts a ledger ID from a literal or identifier reference
+func parseFHIRReference(ref FHIRReference, resourceType string) (string, error) {
+	if ref.Reference != "" {
+		// Accept relative ("Patient/123") and absolute (".../Patient/123") references
+		parts := strings.Split(strings.TrimSuffix(ref.Reference, "/"), "/")
+		if len(parts) < 2 || parts[len(parts)-2] != resourceType || parts[len(parts)-1] == "" {
+			return "", fmt.Errorf("reference %q must point to a %s", ref.Reference, resourceType)
+		}
+		return parts[len(parts)-1], nil
+	}
+
+	if ref.Identifier != nil {
+		if ref.Identifier.System != fhirIdentifierSystemFor(resourceType) || ref.Identifier.Value == "" {
+			return "", fmt.Errorf("identifier must use system %s", fhirIdentifierSystemFor(resourceType))
+		}
+		return ref.Identifier.Value, nil
+	}
+
+	return "", fmt.Errorf("reference to a %s is required", resourceType)
+}
+
+// fhirReferenceFor builds a literal reference, or a logical one when the ID isn't a valid FHIR id
+func fhirReferenceFor(resourceType string, id string) FHIRReference {
+	if fhirIDPattern.MatchString(id) {
+		return FHIRReference{Reference: resourceType + "/" + id}
+	}
+
+	return FHIRReference{Identifier: &FHIRIdentifier{
+		System: fhirIdentifierSystemFor(resourceType),
+		Value:  id,
+	}}
+}
+
+// fhirIdentifierSystemFor returns the identifier system for ledger IDs of a resource type
+func fhirIdentifierSystemFor(resourceType string) string {
+	return fhirIdentifierSystemBase + strings.ToLower(resourceType) + "-id"
+}
+
+// fhirIDFor converts a ledger ID into a valid FHIR id
+func fhirIDFor(id string) string {
+	id = strings.ReplaceAll(id, "*", "all")
+
+	var b strings.Builder
+	for _, r := range id {
+		if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '.' {
+			b.WriteRune(r)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+
+	result := b.String()
+	if len(result) > 64 {
+		result = result[:64]
+	}
+	return result
+}
+
+// parseFHIRPeriod returns the start (zero if open) and the required end of a period
+func parseFHIRPeriod(period *FHIRPeriod) (time.Time, time.Time, error) {
+	if period == nil || period.End == "" {
+		return time.Time{}, time.Time{}, fmt.Errorf("end is required, consents must expire")
+	}
+
+	var start time.Time
+	var err error
+	if period.Start != "" {
+		start, err = parseFHIRDateTime(period.Start, false)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("start: %v", err)
+		}
+	}
+
+	end, err := parseFHIRDateTime(period.End, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("end: %v", err)
+	}
+
+	if !start.IsZero() && !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end must be after start")
+	}
+
+	return start, end, nil
+}
+
+// parseFHIRDateTime parses a dateTime or date; a date used as a period end covers the whole day
+func parseFHIRDateTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a FHIR date or dateTime", value)
+	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
+
+// purposeFromCoding stores v3-ActReason codes bare and any other system as system|code
+func purposeFromCoding(coding FHIRCoding) string {
+	if coding.System == "" || coding.System == fhirActReasonSystem {
+		return coding.Code
+	}
+	return coding.System + "|" + coding.Code
+}
+
+// codingFromPurpose is the inverse of purposeFromCoding
+func codingFromPurpose(purpose string) FHIRCoding {
+	if i := strings.LastIndex(purpose, "|"); i >= 0 {
+		return FHIRCoding{System: purpose[:i], Code: purpose[i+1:]}
+	}
+	return FHIRCoding{System: fhirActReasonSystem, Code: purpose}
+}
+
+// codingFromLabel codes confidentiality levels in v3-Confidentiality and other labels in v3-ActCode
+func codingFromLabel(label string) FHIRCoding {
+	if confidentialityCodes[label] {
+		return FHIRCoding{System: fhirConfidentialitySystem, Code: label}
+	}
+	return FHIRCoding{System: fhirActCodeSystem, Code: label}
+}
+
+// hasCoding reports whether a concept carries the given system and code
+func hasCoding(concept FHIRCodeableConcept, system string, code string) bool {
+	for _, coding := range concept.Coding {
+		if coding.System == system && coding.Code == code {
+			return true
+		}
+	}
+	return false
+}
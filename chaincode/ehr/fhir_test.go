@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ehr-blockchain/chaincode/pre"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// loadFHIRFixture reads a sample resource from testdata/fhir
+func loadFHIRFixture(t *testing.T, name string) string {
+	data, err := os.ReadFile(filepath.Join("testdata", "fhir", name))
+	assert.NoError(t, err)
+	return string(data)
+}
+
+// fhirBlanketConsent builds a FHIR Consent permitting or denying a practitioner all of a
+// patient's records
+func fhirBlanketConsent(t *testing.T, patientID string, doctorID string, provisionType string) string {
+	resource := FHIRConsent{
+		ResourceType: fhirResourceConsent,
+		Status:       fhirConsentStatusActive,
+		Scope:        FHIRCodeableConcept{Coding: []FHIRCoding{{System: fhirConsentScopeSystem, Code: fhirPrivacyScope}}},
+		Category:     []FHIRCodeableConcept{{Coding: []FHIRCoding{{System: fhirLOINCSystem, Code: fhirPatientConsentLOINC}}}},
+		Patient:      &FHIRReference{Reference: fhirResourcePatient + "/" + patientID},
+		Provision: &FHIRConsentProvision{
+			Type:   provisionType,
+			Period: &FHIRPeriod{End: "2030-12-31T23:59:59Z"},
+			Actor: []FHIRConsentActor{{
+				Role:      FHIRCodeableConcept{Coding: []FHIRCoding{{System: fhirParticipationSystem, Code: "PRCP"}}},
+				Reference: FHIRReference{Reference: fhirResourcePractitioner + "/" + doctorID},
+			}},
+		},
+	}
+	resourceJSON, err := json.Marshal(resource)
+	assert.NoError(t, err)
+	return string(resourceJSON)
+}
+
+// TestImportFHIRConsent tests mapping actors, data, purposes and period into consent records
+func TestImportFHIRConsent(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	var consents []*ConsentRecord
+	err := inTx(stub, "tx1", func() error {
+		var err error
+		consents, err = s.ImportFHIRConsent(ctx, loadFHIRFixture(t, "consent-permit.json"))
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Len(t, consents, 4, "one consent per actor and document")
+
+	state, err := stub.GetState("patient123-doctor 789-EHR-002")
+	assert.NoError(t, err)
+	assert.NotNil(t, state)
+
+	var consent ConsentRecord
+	err = json.Unmarshal(state, &consent)
+	assert.NoError(t, err)
+	assert.True(t, consent.Granted)
+	assert.Equal(t, "doctor 789", consent.DoctorID)
+	assert.Equal(t, "EHR-002", consent.RecordID)
+	assert.Equal(t, []string{"TREAT"}, consent.Purposes)
+	assert.Equal(t, []string{"PSY"}, consent.SensitivityOptIns)
+	assert.Equal(t, "patient123", consent.GrantedBy)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), consent.StartDate.UTC())
+	assert.Equal(t, time.Date(2030, 12, 31, 23, 59, 59, 999999999, time.UTC), consent.ExpiryDate.UTC())
+}
+
+// TestImportFHIRConsentNestedDeny tests that nested deny provisions carve exceptions out of a blanket permit
+func TestImportFHIRConsentNestedDeny(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.ImportFHIRConsent(ctx, loadFHIRFixture(t, "consent-nested-deny.json"))
+		return err
+	})
+	assert.NoError(t, err)
+
+	hasConsent, err := s.CheckConsent(ctx, "patient123", "doctor456", "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent, "blanket permit should cover other records")
+
+	hasConsent, err = s.CheckConsent(ctx, "patient123", "doctor456", "EHR-009")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent, "nested deny should exclude EHR-009")
+}
+
+// TestImportFHIRConsentValidation tests rejection of invalid resources and foreign patients
+func TestImportFHIRConsentValidation(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.ImportFHIRConsent(ctx, loadFHIRFixture(t, "consent-missing-end.json"))
+		return err
+	})
+	assert.ErrorContains(t, err, "consents must expire")
+
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.ImportFHIRConsent(ctx, `{"resourceType":"Patient","id":"patient123"}`)
+		return err
+	})
+	assert.ErrorContains(t, err, "resourceType must be Consent")
+
+	// Another patient cannot record consent on patient123's behalf
+	ctx = newTestContext(stub, patientIdentity("patient999"))
+	err = inTx(stub, "tx3", func() error {
+		_, err := s.ImportFHIRConsent(ctx, loadFHIRFixture(t, "consent-permit.json"))
+		return err
+	})
+	assert.Error(t, err)
+	assert.Empty(t, stub.State)
+}
+
+// TestExportConsentAsFHIRRoundTrip tests that exported resources import back to the same consents
+func TestExportConsentAsFHIRRoundTrip(t *testing.T) {
+	for _, fixture := range []string{"consent-permit.json", "consent-nested-deny.json"} {
+		t.Run(fixture, func(t *testing.T) {
+			s := new(SmartContract)
+			stub := newTestStub()
+			ctx := newTestContext(stub, patientIdentity("patient123"))
+
+			var imported []*ConsentRecord
+			err := inTx(stub, "tx1", func() error {
+				var err error
+				imported, err = s.ImportFHIRConsent(ctx, loadFHIRFixture(t, fixture))
+				return err
+			})
+			assert.NoError(t, err)
+
+			for _, original := range imported {
+				exported, err := s.ExportConsentAsFHIR(ctx, original.ConsentID)
+				assert.NoError(t, err)
+
+				var resource FHIRConsent
+				err = json.Unmarshal([]byte(exported), &resource)
+				assert.NoError(t, err)
+				assert.Equal(t, "Consent", resource.ResourceType)
+				assert.Regexp(t, fhirIDPattern, resource.ID)
+
+				roundTrip, err := fhirConsentToRecords(&resource)
+				assert.NoError(t, err)
+				if assert.Len(t, roundTrip, 1) {
+					assert.Equal(t, original.ConsentID, roundTrip[0].ConsentID)
+					assert.Equal(t, original.Granted, roundTrip[0].Granted)
+					assert.Equal(t, original.Purposes, roundTrip[0].Purposes)
+					assert.Equal(t, original.SensitivityOptIns, roundTrip[0].SensitivityOptIns)
+					assert.True(t, original.StartDate.Equal(roundTrip[0].StartDate))
+					assert.True(t, original.ExpiryDate.Equal(roundTrip[0].ExpiryDate))
+				}
+			}
+		})
+	}
+}
+
+// TestFHIRConsentBundle tests bundle assembly from patient query results
+func TestFHIRConsentBundle(t *testing.T) {
+	expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	consents := []*ConsentRecord{
+		{ConsentID: "patient123-doctor456-*", PatientID: "patient123", DoctorID: "doctor456", RecordID: "*", Granted: true, ExpiryDate: expiry},
+		{PatientID: "patient123"}, // EHR metadata matched by the patientId selector
+		{ConsentID: "patient123-doctor456-EHR-001", PatientID: "patient123", DoctorID: "doctor456", RecordID: "EHR-001", ExpiryDate: expiry},
+	}
+
+	bundle := fhirConsentBundle(consents, expiry)
+	assert.Equal(t, "Bundle", bundle.ResourceType)
+	assert.Equal(t, "collection", bundle.Type)
+	if assert.Len(t, bundle.Entry, 2) {
+		assert.Equal(t, "patient123-doctor456-all", bundle.Entry[0].Resource.ID)
+		assert.Nil(t, bundle.Entry[0].Resource.Provision.Data, "blanket consent has no data restriction")
+		assert.Equal(t, "inactive", bundle.Entry[1].Resource.Status)
+	}
+}
+
+// TestImportFHIRConsentKeys tests that an imported permit grants like GrantConsent, and an
+// imported deny revokes like RevokeConsent, taking the doctor's key material with it
+func TestImportFHIRConsentKeys(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newPrivateDataContext(stub, patientIdentity("patient123"))
+	doctorCtx := newPrivateDataContext(stub, doctorIdentity("doctor456"))
+	consentID := consentIDFor("patient123", "doctor456", "*")
+
+	patientKey, err := pre.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	doctorKey, err := pre.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	var patientKeyID, doctorKeyID string
+	err = inTx(stub, "tx1", func() error {
+		entry, err := s.RegisterPublicKey(patientCtx, patientKey.PublicKey.MarshalPEM(), KeyUsageReEncryption, 365)
+		if err == nil {
+			patientKeyID = entry.KeyID
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	err = inTx(stub, "tx2", func() error {
+		entry, err := s.RegisterPublicKey(doctorCtx, doctorKey.PublicKey.MarshalPEM(), KeyUsageReEncryption, 365)
+		if err == nil {
+			doctorKeyID = entry.KeyID
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	encryptionKeyID, err := registerEncryptionKey(s, stub, "tx3", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	// An imported permit stores the wrapped keys and issues a receipt
+	err = inTxWithTransient(stub, "tx5", recordKeysTransient(t, encryptionKeyID, "EHR-001"), func() error {
+		_, err := s.ImportFHIRConsent(patientCtx, fhirBlanketConsent(t, "patient123", "doctor456", fhirProvisionPermit))
+		return err
+	})
+	assert.NoError(t, err)
+
+	grants, err := s.granteeRecordKeys(doctorCtx, "doctor456")
+	assert.NoError(t, err)
+	assert.Len(t, grants, 1)
+	receipt, err := s.GetConsentReceipt(patientCtx, "tx5")
+	if assert.NoError(t, err) {
+		assert.Equal(t, consentID, receipt.ConsentID)
+	}
+
+	reKey, err := pre.GenerateReEncryptionKey(rand.Reader, patientKey, &doctorKey.PublicKey)
+	assert.NoError(t, err)
+	reKeyJSON, err := json.Marshal(reKey)
+	assert.NoError(t, err)
+	err = inTxWithTransient(stub, "tx6", map[string][]byte{reEncryptionKeyTransientKey: reKeyJSON}, func() error {
+		_, err := s.IssueReEncryptionKey(patientCtx, consentID, patientKeyID, doctorKeyID)
+		return err
+	})
+	assert.NoError(t, err)
+	reKeyKey, err := stub.CreateCompositeKey(reEncryptionKeyObjectType, []string{"patient123", "doctor456"})
+	assert.NoError(t, err)
+	assert.Contains(t, stub.PvtState[privateCollection("PatientMSP")], reKeyKey)
+
+	// An imported deny over the active grant revokes it
+	err = inTx(stub, "tx7", func() error {
+		_, err := s.ImportFHIRConsent(patientCtx, fhirBlanketConsent(t, "patient123", "doctor456", fhirProvisionDeny))
+		return err
+	})
+	assert.NoError(t, err)
+
+	hasConsent, err := s.CheckConsent(doctorCtx, "patient123", "doctor456", "EHR-001")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent)
+	grants, err = s.granteeRecordKeys(doctorCtx, "doctor456")
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+	assert.NotContains(t, stub.PvtState[privateCollection("PatientMSP")], reKeyKey)
+	_, err = getMyRecordKey(s, stub, "tx8", doctorCtx, "EHR-001")
+	assert.Error(t, err)
+}
+
+// TestImportFHIRConsentCollision tests that an import cannot overwrite a consent of another grant
+// whose ID reads the same
+func TestImportFHIRConsentCollision(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.GrantConsent(newTestContext(stub, patientIdentity("p-1")), consentIDFor("p-1", "d", "*"), "p-1", "d", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// p-1-d-* is also the ID of p's consent for 1-d
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.ImportFHIRConsent(newTestContext(stub, patientIdentity("p")), fhirBlanketConsent(t, "p", "1-d", fhirProvisionDeny))
+		return err
+	})
+	assert.ErrorContains(t, err, "belongs to another grant")
+
+	hasConsent, err := s.CheckConsent(newTestContext(stub, patientIdentity("p-1")), "p-1", "d", "*")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent)
+}
+
+// TestExportFHIRConsentAuthorization tests that only the patient or an admin exports the
+// patient's consent directives
+func TestExportFHIRConsentAuthorization(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	consentID := consentIDFor("patient123", "doctor456", "*")
+
+	err := inTx(stub, "tx1", func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	_, err = s.ExportConsentAsFHIR(newTestContext(stub, patientIdentity("patient999")), consentID)
+	assert.ErrorIs(t, err, errUnauthorized)
+	_, err = s.ExportConsentAsFHIR(newTestContext(stub, doctorIdentity("doctor456")), consentID)
+	assert.ErrorIs(t, err, errUnauthorized)
+	_, err = s.ExportConsentAsFHIR(newTestContext(stub, adminIdentity("admin1")), consentID)
+	assert.NoError(t, err)
+
+	_, err = s.ExportPatientConsentsBundle(newQueryContext(stub, patientIdentity("patient999")), "patient123")
+	assert.ErrorIs(t, err, errUnauthorized)
+	_, err = s.ExportPatientConsentsBundle(newQueryContext(stub, doctorIdentity("doctor456")), "patient123")
+	assert.ErrorIs(t, err, errUnauthorized)
+
+	// Every peer stamps the bundle with the transaction's time
+	var bundleJSON string
+	err = inTx(stub, "tx2", func() error {
+		stub.TxTimestamp = timestamppb.New(time.Date(2026, 3, 1, 9, 30, 0, 0, time.UTC))
+		var err error
+		bundleJSON, err = s.ExportPatientConsentsBundle(newQueryContext(stub, patientIdentity("patient123")), "patient123")
+		return err
+	})
+	assert.NoError(t, err)
+	var bundle FHIRBundle
+	assert.NoError(t, json.Unmarshal([]byte(bundleJSON), &bundle))
+	assert.Equal(t, "2026-03-01T09:30:00Z", bundle.Timestamp)
+	assert.Len(t, bundle.Entry, 1)
+}
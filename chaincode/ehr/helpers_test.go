@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// testIdentity is a minimal client identity used to call contract functions directly
+type testIdentity struct {
+	id    string
+	mspID string
+	attrs map[string]string
+	cert  *x509.Certificate
+	key   *ecdsa.PrivateKey
+}
+
+// testEnrollment is the key pair and certificate of one test user
+type testEnrollment struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// testEnrollments caches enrollments so every identity with the same ID signs with the same key
+var testEnrollments = map[string]*testEnrollment{}
+
+// newTestIdentity returns an identity enrolled with a self-signed ECDSA certificate
+func newTestIdentity(id string, mspID string, attrs map[string]string) *testIdentity {
+	enrollment, found := testEnrollments[id]
+	if !found {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(len(testEnrollments) + 1)),
+			Subject:      pkix.Name{CommonName: id},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			panic(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			panic(err)
+		}
+		enrollment = &testEnrollment{key: key, cert: cert}
+		testEnrollments[id] = enrollment
+	}
+
+	return &testIdentity{id: id, mspID: mspID, attrs: attrs, cert: enrollment.cert, key: enrollment.key}
+}
+
+func (i *testIdentity) GetID() (string, error) {
+	return i.id, nil
+}
+
+func (i *testIdentity) GetMSPID() (string, error) {
+	return i.mspID, nil
+}
+
+func (i *testIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := i.attrs[attrName]
+	return value, found, nil
+}
+
+func (i *testIdentity) AssertAttributeValue(attrName, attrValue string) error {
+	if value, found := i.attrs[attrName]; !found || value != attrValue {
+		return fmt.Errorf("attribute %s does not have value %s", attrName, attrValue)
+	}
+	return nil
+}
+
+func (i *testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return i.cert, nil
+}
+
+// patientIdentity returns an identity without a role attribute (defaults to patient)
+func patientIdentity(id string) *testIdentity {
+	return newTestIdentity(id, "PatientMSP", map[string]string{})
+}
+
+// doctorIdentity returns an identity carrying the doctor role and a license
+func doctorIdentity(id string) *testIdentity {
+	return newTestIdentity(id, "HospitalMSP", map[string]string{"role": RoleDoctor, credentialAttribute: "MD-" + id})
+}
+
+// grantWriteConsent lets a doctor create records for a patient, granting the consent in txID and
+// widening its scopes in a second transaction
+func grantWriteConsent(s *SmartContract, stub *shimtest.MockStub, txID string, patientID string, doctorID string) error {
+	ctx := newTestContext(stub, patientIdentity(patientID))
+	consentID := consentIDFor(patientID, doctorID, "*")
+	err := inTx(stub, txID, func() error {
+		_, err := s.GrantConsent(ctx, consentID, patientID, doctorID, "*", 30)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return inTx(stub, txID+"-scopes", func() error {
+		return s.SetConsentScopes(ctx, consentID, []string{ConsentScopeRead, ConsentScopeWrite})
+	})
+}
+
+// testRSAKeys caches RSA keys, which are slow to generate, by seed
+var testRSAKeys = map[string]*rsa.PrivateKey{}
+
+// testRSAPublicKey returns the PEM public key of an RSA key derived from seed
+func testRSAPublicKey(seed string) string {
+	key, found := testRSAKeys[seed]
+	if !found {
+		var err error
+		key, err = rsa.GenerateKey(rand.Reader, minRSAKeyBits)
+		if err != nil {
+			panic(err)
+		}
+		testRSAKeys[seed] = key
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// registerEncryptionKey registers an RSA encryption key for a user and returns its key ID
+func registerEncryptionKey(s *SmartContract, stub *shimtest.MockStub, txID string, identity *testIdentity) (string, error) {
+	var keyID string
+	err := inTx(stub, txID, func() error {
+		entry, err := s.RegisterPublicKey(newTestContext(stub, identity), testRSAPublicKey(identity.id), KeyUsageEncryption, 365)
+		if err != nil {
+			return err
+		}
+		keyID = entry.KeyID
+		return nil
+	})
+	return keyID, err
+}
+
+// getMyRecordKey retrieves the caller's wrapped record key in a transaction of its own, since
+// every retrieval is audited
+func getMyRecordKey(s *SmartContract, stub *shimtest.MockStub, txID string, ctx contractapi.TransactionContextInterface, recordID string) (*RecordKeyGrant, error) {
+	var grant *RecordKeyGrant
+	err := inTx(stub, txID, func() error {
+		var err error
+		grant, err = s.GetMyRecordKey(ctx, recordID)
+		return err
+	})
+	return grant, err
+}
+
+// adminIdentity returns an identity carrying the admin role
+func adminIdentity(id string) *testIdentity {
+	return newTestIdentity(id, "HospitalMSP", map[string]string{"role": RoleAdmin})
+}
+
+// newTestStub creates an empty mock ledger
+func newTestStub() *shimtest.MockStub {
+	return shimtest.NewMockStub("ehr", nil)
+}
+
+// testContexts are the contexts bound to each mock stub, whose transactions inTx checks as the
+// contract's AfterTransaction does
+var testContexts = map[*shimtest.MockStub][]*TransactionContext{}
+
+// newTestContext binds a mock stub and identity into the contract's transaction context
+func newTestContext(stub *shimtest.MockStub, identity *testIdentity) *TransactionContext {
+	ctx := new(TransactionContext)
+	ctx.SetStub(stub)
+	ctx.SetClientIdentity(identity)
+	testContexts[stub] = append(testContexts[stub], ctx)
+	return ctx
+}
+
+// newQueryContext is newTestContext with rich queries, for functions that query CouchDB
+func newQueryContext(stub *shimtest.MockStub, identity *testIdentity) *TransactionContext {
+	ctx := newTestContext(stub, identity)
+	ctx.SetStub(&richQueryStub{stub})
+	return ctx
+}
+
+// newPrivateDataContext is newTestContext on a peer of the identity's organization, which can read
+// that organization's private data collection only
+func newPrivateDataContext(stub *shimtest.MockStub, identity *testIdentity) *TransactionContext {
+	ctx := newTestContext(stub, identity)
+	ctx.SetStub(&privateDataStub{stub, privateCollection(identity.mspID)})
+	return ctx
+}
+
+// privateDataStub adds private data hashes, purging and collection membership to MockStub
+type privateDataStub struct {
+	*shimtest.MockStub
+	member string
+}
+
+func (s *privateDataStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	if collection != s.member {
+		return nil, fmt.Errorf("tx creator does not have read access permission on privatedata in collection %s", collection)
+	}
+	return s.MockStub.GetPrivateData(collection, key)
+}
+
+func (s *privateDataStub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	value := s.PvtState[collection][key]
+	if value == nil {
+		return nil, nil
+	}
+	digest := sha256.Sum256(value)
+	return digest[:], nil
+}
+
+func (s *privateDataStub) DelPrivateData(collection string, key string) error {
+	delete(s.PvtState[collection], key)
+	return nil
+}
+
+func (s *privateDataStub) PurgePrivateData(collection string, key string) error {
+	return s.DelPrivateData(collection, key)
+}
+
+// richQueryStub adds CouchDB rich queries to MockStub. Selectors may use equality and $exists
+// conditions; other operators match everything. Documents are returned in key order.
+type richQueryStub struct {
+	*shimtest.MockStub
+}
+
+func (s *richQueryStub) GetQueryResult(query string) (shim.StateQueryIteratorInterface, error) {
+	iterator, _, err := s.GetQueryResultWithPagination(query, 0, "")
+	return iterator, err
+}
+
+func (s *richQueryStub) GetQueryResultWithPagination(
+	query string,
+	pageSize int32,
+	bookmark string,
+) (shim.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+	}
+	err := json.Unmarshal([]byte(query), &parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var keys []string
+	for key, value := range s.State {
+		var document map[string]interface{}
+		if key > bookmark && json.Unmarshal(value, &document) == nil && selectorMatches(parsed.Selector, document) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if pageSize > 0 && len(keys) > int(pageSize) {
+		keys = keys[:pageSize]
+	}
+
+	iterator := &sliceQueryIterator{}
+	metadata := &peer.QueryResponseMetadata{FetchedRecordsCount: int32(len(keys))}
+	for _, key := range keys {
+		iterator.results = append(iterator.results, &queryresult.KV{Key: key, Value: s.State[key]})
+		metadata.Bookmark = key
+	}
+	return iterator, metadata, nil
+}
+
+// selectorMatches checks the equality and $exists conditions of a selector
+func selectorMatches(selector map[string]interface{}, document map[string]interface{}) bool {
+	for field, condition := range selector {
+		value, present := document[field]
+		operators, isOperator := condition.(map[string]interface{})
+		if !isOperator {
+			if !present || value != condition {
+				return false
+			}
+			continue
+		}
+		if exists, ok := operators["$exists"].(bool); ok && exists != present {
+			return false
+		}
+	}
+	return true
+}
+
+// sliceQueryIterator iterates over fixed query results
+type sliceQueryIterator struct {
+	results []*queryresult.KV
+}
+
+func (i *sliceQueryIterator) HasNext() bool {
+	return len(i.results) > 0
+}
+
+func (i *sliceQueryIterator) Next() (*queryresult.KV, error) {
+	next := i.results[0]
+	i.results = i.results[1:]
+	return next, nil
+}
+
+func (i *sliceQueryIterator) Close() error {
+	return nil
+}
+
+// inTx runs fn as a single mock transaction so that state writes are accepted
+func inTx(stub *shimtest.MockStub, txID string, fn func() error) error {
+	stub.MockTransactionStart(txID)
+	defer stub.MockTransactionEnd(txID)
+
+	err := fn()
+	if err != nil {
+		return err
+	}
+
+	// A transaction that writes without an audit entry fails, as it does on a peer
+	for _, ctx := range testContexts[stub] {
+		err = requireAuditEntry(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inTxWithTransient runs fn as a mock transaction with private data in the transient map
+func inTxWithTransient(stub *shimtest.MockStub, txID string, transient map[string][]byte, fn func() error) error {
+	return inTx(stub, txID, func() error {
+		stub.TransientMap = transient
+		defer func() { stub.TransientMap = nil }()
+		return fn()
+	})
+}
+
+// testChecksum returns a valid hex SHA-256 checksum derived from seed
+func testChecksum(seed string) string {
+	digest := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(digest[:])
+}
+
+// testCID returns a valid CIDv0 derived from seed
+func testCID(seed string) string {
+	digest := sha256.Sum256([]byte(seed))
+	multihash := append([]byte{multihashSHA256, multihashSHA256Len}, digest[:]...)
+
+	value := new(big.Int).SetBytes(multihash)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var encoded []byte
+	for value.Sign() > 0 {
+		value.DivMod(value, radix, mod)
+		encoded = append([]byte{base58BitcoinAlphabet[mod.Int64()]}, encoded...)
+	}
+	return string(encoded)
+}
+
+// testSignature signs a record digest with the key of the context's identity
+func testSignature(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	patientID string,
+	ipfsHash string,
+	checksum string,
+	recordType string,
+) string {
+	identity := ctx.GetClientIdentity().(*testIdentity)
+	digest := recordDigest(&EHRMetadata{
+		RecordID:   recordID,
+		PatientID:  patientID,
+		IPFSHash:   ipfsHash,
+		Checksum:   checksum,
+		RecordType: recordType,
+	})
+
+	signature, err := ecdsa.SignASN1(rand.Reader, identity.key, digest)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(signature)
+}
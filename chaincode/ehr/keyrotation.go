@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// EventRecordKeyRotated is emitted so off-chain services can unpin the file encrypted under the old key
+const EventRecordKeyRotated = "RecordKeyRotated"
+
+const maxKeyRotationReason = 1024
+
+// KeyRotationInfo records the latest rotation of a record's data key. The author signature keeps
+// covering the file as it was signed, before any rotation.
+type KeyRotationInfo struct {
+	SignedIPFSHash   string    `json:"signedIpfsHash"`
+	SignedChecksum   string    `json:"signedChecksum"`
+	PreviousIPFSHash string    `json:"previousIpfsHash"`
+	PreviousChecksum string    `json:"previousChecksum"`
+	Reason           string    `json:"reason"`
+	RotatedBy        string    `json:"rotatedBy"`
+	RotatedAt        time.Time `json:"rotatedAt"`
+	TxID             string    `json:"txId"`
+}
+
+// RecordKeyRotatedEvent is emitted after a record has been re-encrypted under a new key
+type RecordKeyRotatedEvent struct {
+	RecordID         string   `json:"recordId"`
+	PatientID        string   `json:"patientId"`
+	KeyVersion       int      `json:"keyVersion"`
+	IPFSHash         string   `json:"ipfsHash"`
+	PreviousIPFSHash string   `json:"previousIpfsHash"`
+	GranteeIDs       []string `json:"granteeIds"`
+}
+
+// RotateRecordKey swaps a record to a file re-encrypted under a new data key. The new key
+// wrapped for every current grantee is passed in the transient map under recordKeys, one
+// entry per grantee with granteeId, wrappedKey and keyFingerprint. Wraps of the old key are
+// deleted and the record's key version is bumped, all in one transaction. Records keeping their
+// key in private data take the new key, and CID if private, in transient ehrPrivate instead.
+func (s *SmartContract) RotateRecordKey(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	ipfsHash string,
+	encryptedKey string,
+	checksum string,
+	reason string,
+) (*EHRMetadata, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireActive(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, metadata.PatientID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bundle components carry keys of their own
+	if len(metadata.Components) > 0 {
+		return nil, fmt.Errorf("record %s is a bundle; its component keys cannot be rotated", recordID)
+	}
+
+	// The signed file is carried over from the private data
+	err = requirePrivateDataLoaded(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	rotated := *metadata
+	rotated.IPFSHash = ipfsHash
+	rotated.EncryptedKey = encryptedKey
+	err = s.applyPrivateRecordData(ctx, &rotated, metadata.PrivateData)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs ValidationErrors
+	validateCIDField(&errs, "ipfsHash", rotated.IPFSHash)
+	validateChecksumField(&errs, "checksum", checksum)
+	if rotated.EncryptedKey == "" {
+		errs.add("encryptedKey", "is required")
+	} else if len(rotated.EncryptedKey) > maxEncryptedKeyLength {
+		errs.add("encryptedKey", "must be at most %d characters", maxEncryptedKeyLength)
+	}
+	if reason == "" {
+		errs.add("reason", "is required")
+	} else if len(reason) > maxKeyRotationReason {
+		errs.add("reason", "must be at most %d characters", maxKeyRotationReason)
+	}
+
+	grants, err := readTransientRecordKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	validateRecordKeyGrants(&errs, grants)
+	seen := make(map[string]bool, len(grants))
+	for i, grant := range grants {
+		field := fmt.Sprintf("%s[%d]", recordKeysTransientKey, i)
+		if grant.GranteeID == "" {
+			errs.add(field+".granteeId", "is required")
+		} else if seen[grant.GranteeID] {
+			errs.add(field+".granteeId", "duplicate grantee %s", grant.GranteeID)
+		}
+		seen[grant.GranteeID] = true
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return nil, err
+	}
+
+	if rotated.IPFSHash == metadata.IPFSHash {
+		return nil, fmt.Errorf("record %s must be re-encrypted to a new file", recordID)
+	}
+
+	current, err := s.currentRecordKeyGrants(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The new key must reach exactly the grantees still holding the old one
+	for _, grant := range grants {
+		if current[grant.GranteeID] == nil {
+			return nil, fmt.Errorf("%s holds no current key for record %s", grant.GranteeID, recordID)
+		}
+	}
+	for granteeID := range current {
+		if !seen[granteeID] {
+			return nil, fmt.Errorf("new key for record %s must also be wrapped for %s", recordID, granteeID)
+		}
+	}
+
+	err = s.purgeRecordKeys(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	keyVersion := recordKeyVersion(metadata) + 1
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	granteeIDs := []string{}
+	for _, grant := range grants {
+		entry, err := s.requireEncryptionKey(ctx, grant.GranteeID, grant.KeyFingerprint)
+		if err != nil {
+			return nil, err
+		}
+
+		grant.RecordID = recordID
+		grant.ConsentID = current[grant.GranteeID].ConsentID
+		grant.KeyVersion = keyVersion
+		grant.PrivateData = grantPrivateDataRef(&rotated, entry)
+		grant.GrantedBy = callerID
+		grant.Timestamp = now
+
+		err = s.putRecordKeyGrant(ctx, &grant)
+		if err != nil {
+			return nil, err
+		}
+		granteeIDs = append(granteeIDs, grant.GranteeID)
+	}
+	sort.Strings(granteeIDs)
+
+	rotation := &KeyRotationInfo{
+		SignedIPFSHash:   metadata.IPFSHash,
+		SignedChecksum:   metadata.Checksum,
+		PreviousIPFSHash: metadata.IPFSHash,
+		PreviousChecksum: metadata.Checksum,
+		Reason:           reason,
+		RotatedBy:        callerID,
+		RotatedAt:        now,
+		TxID:             ctx.GetStub().GetTxID(),
+	}
+	if metadata.KeyRotation != nil {
+		rotation.SignedIPFSHash = metadata.KeyRotation.SignedIPFSHash
+		rotation.SignedChecksum = metadata.KeyRotation.SignedChecksum
+	}
+
+	event := RecordKeyRotatedEvent{
+		RecordID:         recordID,
+		PatientID:        metadata.PatientID,
+		KeyVersion:       keyVersion,
+		IPFSHash:         publicIPFSHash(&rotated),
+		PreviousIPFSHash: publicIPFSHash(metadata),
+		GranteeIDs:       granteeIDs,
+	}
+
+	rotated.Checksum = strings.ToLower(checksum)
+	rotated.KeyVersion = keyVersion
+	rotated.KeyRotation = rotation
+
+	err = s.putEHRMetadata(ctx, &rotated)
+	if err != nil {
+		return nil, err
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(EventRecordKeyRotated, eventJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionRotateRecordKey, callerID, metadata.PatientID, recordID, metadata.PatientID, true,
+		fmt.Sprintf("Record key rotated to version %d for %d grantee(s): %s", keyVersion, len(granteeIDs), reason))
+	if err != nil {
+		return nil, err
+	}
+
+	// The response is recorded in the block, so private fields are left out
+	return s.publicEHRMetadata(ctx, &rotated)
+}
+
+// currentRecordKeyGrants maps the grantees of a record's key whose consent is still in effect to
+// their grant. Keys of lapsed consents are not carried over to a new key.
+func (s *SmartContract) currentRecordKeyGrants(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (map[string]*RecordKeyGrant, error) {
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(recordKeyObjectType, []string{recordID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record keys: %v", err)
+	}
+	defer iterator.Close()
+
+	grants := map[string]*RecordKeyGrant{}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record keys: %v", err)
+		}
+
+		var grant RecordKeyGrant
+		err = json.Unmarshal(entry.Value, &grant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal record key: %v", err)
+		}
+
+		consentJSON, err := ctx.GetStub().GetState(grant.ConsentID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read consent: %v", err)
+		}
+		if consentJSON == nil {
+			continue
+		}
+
+		var consent ConsentRecord
+		err = json.Unmarshal(consentJSON, &consent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal consent: %v", err)
+		}
+		if consentInEffect(&consent, now) {
+			grants[grant.GranteeID] = &grant
+		}
+	}
+
+	return grants, nil
+}
+
+// recordKeyVersion is the version of a record's data key; records start at version 1
+func recordKeyVersion(metadata *EHRMetadata) int {
+	if metadata.KeyVersion == 0 {
+		return 1
+	}
+	return metadata.KeyVersion
+}
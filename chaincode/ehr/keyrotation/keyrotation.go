@@ -0,0 +1,286 @@
+// Package keyrotation re-encrypts an EHR file under a new data key and prepares the
+// RotateRecordKey transaction that swaps the record over to it.
+//
+// Files use the backend's format: AES-256-GCM with a 12-byte IV and a 16-byte tag kept next to
+// the ciphertext, and a data key wrapped with RSA-OAEP (SHA-256). The record checksum is the
+// SHA-256 of the plaintext, so it is checked before re-encrypting and stays the same after.
+package keyrotation
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+// TransientKey is the transient map key RotateRecordKey reads the re-wrapped keys from
+const TransientKey = "recordKeys"
+
+const (
+	dataKeySize = 32
+	ivSize      = 12
+	tagSize     = 16
+)
+
+// ContentStore reads and writes files by content ID, usually an IPFS client
+type ContentStore interface {
+	Get(ctx context.Context, cid string) ([]byte, error)
+	Add(ctx context.Context, data []byte) (string, error)
+}
+
+// Grantee is a current holder of the record key, with the encryption key registered for them in
+// the public key directory (GetActivePublicKey)
+type Grantee struct {
+	GranteeID string
+	PublicKey string // PEM encoded RSA PUBLIC KEY
+}
+
+// Request describes the record to rotate, as stored on the ledger and off-chain
+type Request struct {
+	RecordID     string
+	IPFSHash     string
+	Checksum     string
+	EncryptedKey string // Base64 data key wrapped for the owner
+	IV           []byte
+	AuthTag      []byte
+	OwnerKey     *rsa.PrivateKey // Unwraps EncryptedKey and receives the new key
+	Grantees     []Grantee
+	Reason       string
+}
+
+// WrappedKey is the new data key wrapped for one grantee, in the shape RotateRecordKey expects
+type WrappedKey struct {
+	GranteeID      string `json:"granteeId"`
+	WrappedKey     string `json:"wrappedKey"`
+	KeyFingerprint string `json:"keyFingerprint"`
+}
+
+// Result is the re-encrypted file and the arguments to submit with RotateRecordKey. IV and
+// AuthTag replace the ones stored for the record off-chain.
+type Result struct {
+	RecordID     string
+	IPFSHash     string
+	Checksum     string
+	EncryptedKey string
+	IV           []byte
+	AuthTag      []byte
+	WrappedKeys  []WrappedKey
+	Reason       string
+}
+
+// Args are the RotateRecordKey arguments: recordId, ipfsHash, encryptedKey, checksum and reason
+func (r *Result) Args() []string {
+	return []string{r.RecordID, r.IPFSHash, r.EncryptedKey, r.Checksum, r.Reason}
+}
+
+// Transient is the transient map carrying the re-wrapped keys
+func (r *Result) Transient() (map[string][]byte, error) {
+	keysJSON, err := json.Marshal(r.WrappedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal wrapped keys: %v", err)
+	}
+	return map[string][]byte{TransientKey: keysJSON}, nil
+}
+
+// RotateRecordKey decrypts a record's file, checks it against the checksum, encrypts it under a
+// fresh data key, stores it and wraps the new key for the owner and every grantee. The old file
+// is left in the store; unpin it once the transaction has committed.
+func RotateRecordKey(ctx context.Context, store ContentStore, req *Request) (*Result, error) {
+	if req.OwnerKey == nil {
+		return nil, fmt.Errorf("owner key is required")
+	}
+	if req.Reason == "" {
+		return nil, fmt.Errorf("rotation reason is required")
+	}
+
+	// Parse grantee keys first so a bad key fails before anything is uploaded
+	granteeKeys := make([]*rsa.PublicKey, len(req.Grantees))
+	keyIDs := make([]string, len(req.Grantees))
+	for i, grantee := range req.Grantees {
+		publicKey, keyID, err := ParsePublicKey(grantee.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key for grantee %s: %v", grantee.GranteeID, err)
+		}
+		granteeKeys[i] = publicKey
+		keyIDs[i] = keyID
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(req.EncryptedKey)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted key is not valid base64: %v", err)
+	}
+	oldKey, err := UnwrapKey(req.OwnerKey, wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := store.Get(ctx, req.IPFSHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %v", req.IPFSHash, err)
+	}
+	plaintext, err := Decrypt(oldKey, req.IV, ciphertext, req.AuthTag)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(plaintext)
+	checksum := hex.EncodeToString(digest[:])
+	if checksum != strings.ToLower(req.Checksum) {
+		return nil, fmt.Errorf("record %s does not match its checksum", req.RecordID)
+	}
+
+	newKey := make([]byte, dataKeySize)
+	_, err = rand.Read(newKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	iv, newCiphertext, tag, err := Encrypt(newKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	ipfsHash, err := store.Add(ctx, newCiphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add re-encrypted file: %v", err)
+	}
+
+	ownerWrap, err := WrapKey(&req.OwnerKey.PublicKey, newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		RecordID:     req.RecordID,
+		IPFSHash:     ipfsHash,
+		Checksum:     checksum,
+		EncryptedKey: base64.StdEncoding.EncodeToString(ownerWrap),
+		IV:           iv,
+		AuthTag:      tag,
+		WrappedKeys:  []WrappedKey{},
+		Reason:       req.Reason,
+	}
+	for i, grantee := range req.Grantees {
+		wrap, err := WrapKey(granteeKeys[i], newKey)
+		if err != nil {
+			return nil, err
+		}
+		result.WrappedKeys = append(result.WrappedKeys, WrappedKey{
+			GranteeID:      grantee.GranteeID,
+			WrappedKey:     base64.StdEncoding.EncodeToString(wrap),
+			KeyFingerprint: keyIDs[i],
+		})
+	}
+
+	return result, nil
+}
+
+// ParsePublicKey parses a PEM RSA public key and returns it with its key ID in the directory,
+// the hex SHA-256 of its DER encoding
+func ParsePublicKey(publicKeyPEM string) (*rsa.PublicKey, string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, "", fmt.Errorf("must be a PEM encoded PUBLIC KEY")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	rsaKey, ok := publicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", fmt.Errorf("encryption keys must be RSA, got %T", publicKey)
+	}
+
+	digest := sha256.Sum256(block.Bytes)
+	return rsaKey, hex.EncodeToString(digest[:]), nil
+}
+
+// WrapKey encrypts a data key to an RSA public key with OAEP and SHA-256
+func WrapKey(publicKey *rsa.PublicKey, key []byte) ([]byte, error) {
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %v", err)
+	}
+	return wrapped, nil
+}
+
+// UnwrapKey decrypts a data key wrapped with WrapKey
+func UnwrapKey(privateKey *rsa.PrivateKey, wrapped []byte) ([]byte, error) {
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap key: %v", err)
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", dataKeySize, len(key))
+	}
+	return key, nil
+}
+
+// Encrypt encrypts a file with AES-256-GCM under a random IV
+func Encrypt(key []byte, plaintext []byte) (iv []byte, ciphertext []byte, tag []byte, err error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	iv = make([]byte, ivSize)
+	_, err = rand.Read(iv)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to generate IV: %v", err)
+	}
+
+	sealed := aead.Seal(nil, iv, plaintext, nil)
+	split := len(sealed) - tagSize
+	return iv, sealed[:split], sealed[split:], nil
+}
+
+// Decrypt decrypts and authenticates a file encrypted with AES-256-GCM
+func Decrypt(key []byte, iv []byte, ciphertext []byte, tag []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != ivSize {
+		return nil, fmt.Errorf("IV must be %d bytes, got %d", ivSize, len(iv))
+	}
+	if len(tag) != tagSize {
+		return nil, fmt.Errorf("auth tag must be %d bytes, got %d", tagSize, len(tag))
+	}
+
+	sealed := make([]byte, 0, len(ciphertext)+len(tag))
+	sealed = append(append(sealed, ciphertext...), tag...)
+	plaintext, err := aead.Open(nil, iv, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt file: %v", err)
+	}
+	return plaintext, nil
+}
+
+// newGCM returns AES-256-GCM for a data key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", dataKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return aead, nil
+}
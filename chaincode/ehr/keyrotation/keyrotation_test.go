@@ -0,0 +1,153 @@
+package keyrotation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStore is a content store keyed by the SHA-256 of each file
+type memoryStore map[string][]byte
+
+func (m memoryStore) Get(ctx context.Context, cid string) ([]byte, error) {
+	data, found := m[cid]
+	if !found {
+		return nil, fmt.Errorf("%s not found", cid)
+	}
+	return data, nil
+}
+
+func (m memoryStore) Add(ctx context.Context, data []byte) (string, error) {
+	digest := sha256.Sum256(data)
+	cid := hex.EncodeToString(digest[:])
+	m[cid] = data
+	return cid, nil
+}
+
+// testKey returns an RSA key and its PEM public key
+func testKey(t *testing.T) (*rsa.PrivateKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// TestRotateRecordKey tests that a file is re-encrypted and its new key wrapped for every holder
+func TestRotateRecordKey(t *testing.T) {
+	ctx := context.Background()
+	store := memoryStore{}
+	ownerKey, _ := testKey(t)
+	doctorKey, doctorPEM := testKey(t)
+
+	// Encrypt a file the way the backend does on upload
+	plaintext := []byte("Hemoglobin A1c: 5.4%")
+	dataKey := make([]byte, dataKeySize)
+	_, err := rand.Read(dataKey)
+	assert.NoError(t, err)
+	iv, ciphertext, tag, err := Encrypt(dataKey, plaintext)
+	assert.NoError(t, err)
+	cid, err := store.Add(ctx, ciphertext)
+	assert.NoError(t, err)
+	ownerWrap, err := WrapKey(&ownerKey.PublicKey, dataKey)
+	assert.NoError(t, err)
+	digest := sha256.Sum256(plaintext)
+
+	req := &Request{
+		RecordID:     "EHR-001",
+		IPFSHash:     cid,
+		Checksum:     hex.EncodeToString(digest[:]),
+		EncryptedKey: base64.StdEncoding.EncodeToString(ownerWrap),
+		IV:           iv,
+		AuthTag:      tag,
+		OwnerKey:     ownerKey,
+		Grantees:     []Grantee{{GranteeID: "doctor456", PublicKey: doctorPEM}},
+		Reason:       "Key compromise",
+	}
+
+	result, err := RotateRecordKey(ctx, store, req)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cid, result.IPFSHash)
+	assert.Equal(t, req.Checksum, result.Checksum)
+	assert.Equal(t, []string{"EHR-001", result.IPFSHash, result.EncryptedKey, req.Checksum, "Key compromise"}, result.Args())
+
+	// The grantee opens the new file with their wrapped key
+	_, keyID, err := ParsePublicKey(doctorPEM)
+	assert.NoError(t, err)
+	transient, err := result.Transient()
+	assert.NoError(t, err)
+	var wrapped []WrappedKey
+	assert.NoError(t, json.Unmarshal(transient[TransientKey], &wrapped))
+	if assert.Len(t, wrapped, 1) {
+		assert.Equal(t, "doctor456", wrapped[0].GranteeID)
+		assert.Equal(t, keyID, wrapped[0].KeyFingerprint)
+
+		wrap, err := base64.StdEncoding.DecodeString(wrapped[0].WrappedKey)
+		assert.NoError(t, err)
+		newKey, err := UnwrapKey(doctorKey, wrap)
+		assert.NoError(t, err)
+		assert.NotEqual(t, dataKey, newKey)
+
+		decrypted, err := Decrypt(newKey, result.IV, store[result.IPFSHash], result.AuthTag)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintext, decrypted)
+	}
+
+	// So does the owner
+	wrap, err := base64.StdEncoding.DecodeString(result.EncryptedKey)
+	assert.NoError(t, err)
+	newKey, err := UnwrapKey(ownerKey, wrap)
+	assert.NoError(t, err)
+	_, err = Decrypt(newKey, result.IV, store[result.IPFSHash], result.AuthTag)
+	assert.NoError(t, err)
+
+	// The old key does not open the new file
+	_, err = Decrypt(dataKey, result.IV, store[result.IPFSHash], result.AuthTag)
+	assert.Error(t, err)
+}
+
+// TestRotateRecordKeyChecksFile tests that a file not matching its checksum is not re-encrypted
+func TestRotateRecordKeyChecksFile(t *testing.T) {
+	ctx := context.Background()
+	store := memoryStore{}
+	ownerKey, _ := testKey(t)
+
+	dataKey := make([]byte, dataKeySize)
+	iv, ciphertext, tag, err := Encrypt(dataKey, []byte("original"))
+	assert.NoError(t, err)
+	cid, err := store.Add(ctx, ciphertext)
+	assert.NoError(t, err)
+	ownerWrap, err := WrapKey(&ownerKey.PublicKey, dataKey)
+	assert.NoError(t, err)
+	digest := sha256.Sum256([]byte("something else"))
+
+	req := &Request{
+		RecordID:     "EHR-001",
+		IPFSHash:     cid,
+		Checksum:     hex.EncodeToString(digest[:]),
+		EncryptedKey: base64.StdEncoding.EncodeToString(ownerWrap),
+		IV:           iv,
+		AuthTag:      tag,
+		OwnerKey:     ownerKey,
+		Grantees:     []Grantee{{GranteeID: "doctor456", PublicKey: "not a key"}},
+		Reason:       "Key compromise",
+	}
+
+	_, err = RotateRecordKey(ctx, store, req)
+	assert.ErrorContains(t, err, "invalid key for grantee doctor456")
+
+	req.Grantees = nil
+	_, err = RotateRecordKey(ctx, store, req)
+	assert.ErrorContains(t, err, "does not match its checksum")
+	assert.Len(t, store, 1, "nothing is uploaded")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rotatedKeysTransient returns the transient map re-wrapping a rotated key for grantees, by key ID
+func rotatedKeysTransient(t *testing.T, keyIDs map[string]string) map[string][]byte {
+	grants := []RecordKeyGrant{}
+	for granteeID, keyID := range keyIDs {
+		grants = append(grants, RecordKeyGrant{
+			GranteeID:      granteeID,
+			WrappedKey:     base64.StdEncoding.EncodeToString([]byte("new key for " + granteeID)),
+			KeyFingerprint: keyID,
+		})
+	}
+	grantsJSON, err := json.Marshal(grants)
+	assert.NoError(t, err)
+	return map[string][]byte{recordKeysTransientKey: grantsJSON}
+}
+
+// TestRotateRecordKey tests that rotation swaps the file and re-wraps the key for current grantees
+func TestRotateRecordKey(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	keyID, err := registerEncryptionKey(s, stub, "tx1a", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+	otherKeyID, err := registerEncryptionKey(s, stub, "tx1b", doctorIdentity("doctor789"))
+	assert.NoError(t, err)
+
+	consentID := consentIDFor("patient123", "doctor456", "EHR-001")
+	err = inTxWithTransient(stub, "tx2", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	grant, err := getMyRecordKey(s, stub, "tx-get-key1", doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, grant.KeyVersion)
+
+	// Only the patient or an admin rotates the key
+	err = inTxWithTransient(stub, "tx3", rotatedKeysTransient(t, map[string]string{"doctor456": keyID}), func() error {
+		_, err := s.RotateRecordKey(doctorCtx, "EHR-001", testCID("rotated"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.Error(t, err)
+
+	// Every current grantee gets the new key, and no one else
+	err = inTx(stub, "tx4", func() error {
+		_, err := s.RotateRecordKey(patientCtx, "EHR-001", testCID("rotated"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.ErrorContains(t, err, "must also be wrapped for doctor456")
+
+	err = inTxWithTransient(stub, "tx5", rotatedKeysTransient(t, map[string]string{"doctor456": keyID, "doctor789": otherKeyID}), func() error {
+		_, err := s.RotateRecordKey(patientCtx, "EHR-001", testCID("rotated"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.ErrorContains(t, err, "doctor789 holds no current key")
+
+	err = inTxWithTransient(stub, "tx6", rotatedKeysTransient(t, map[string]string{"doctor456": keyID}), func() error {
+		_, err := s.RotateRecordKey(patientCtx, "EHR-001", testCID("EHR-001"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.ErrorContains(t, err, "re-encrypted to a new file")
+
+	var rotated *EHRMetadata
+	err = inTxWithTransient(stub, "tx7", rotatedKeysTransient(t, map[string]string{"doctor456": keyID}), func() error {
+		var err error
+		rotated, err = s.RotateRecordKey(patientCtx, "EHR-001", testCID("rotated"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rotated.KeyVersion)
+	assert.Equal(t, testCID("rotated"), rotated.IPFSHash)
+	assert.Equal(t, testCID("EHR-001"), rotated.KeyRotation.PreviousIPFSHash)
+	assert.Equal(t, "tx7", rotated.KeyRotation.TxID)
+
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventRecordKeyRotated, event.EventName)
+	var payload RecordKeyRotatedEvent
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Equal(t, testCID("EHR-001"), payload.PreviousIPFSHash)
+	assert.Equal(t, []string{"doctor456"}, payload.GranteeIDs)
+
+	grant, err = getMyRecordKey(s, stub, "tx-get-key2", doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, grant.KeyVersion)
+	assert.Equal(t, consentID, grant.ConsentID)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("new key for doctor456")), grant.WrappedKey)
+
+	grant, err = getMyRecordKey(s, stub, "tx-get-key3", patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "new patient key", grant.WrappedKey)
+
+	// The author signature still verifies against the file as signed
+	provenance, err := s.VerifyRecordProvenance(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+
+	// Keys of revoked consents are not carried over
+	err = inTx(stub, "tx8", func() error {
+		return s.RevokeConsent(patientCtx, consentID)
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx9", func() error {
+		var err error
+		rotated, err = s.RotateRecordKey(patientCtx, "EHR-001", testCID("rotated again"), "newer patient key", testChecksum("EHR-001"), "Consent revoked")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, rotated.KeyVersion)
+	assert.Equal(t, testCID("EHR-001"), rotated.KeyRotation.SignedIPFSHash)
+	assert.Equal(t, testCID("rotated"), rotated.KeyRotation.PreviousIPFSHash)
+
+	provenance, err = s.VerifyRecordProvenance(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+}
+
+// TestGetMyRecordKeyRejectsStaleWraps tests that a wrap of an earlier key version is not released
+func TestGetMyRecordKeyRejectsStaleWraps(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	keyID, err := registerEncryptionKey(s, stub, "tx1a", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTxWithTransient(stub, "tx2", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor456", "*"), "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// Bump the key version without re-wrapping, which no contract transaction does
+	metadata, err := s.readEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	metadata.KeyVersion = 2
+	metadataJSON, err := json.Marshal(metadata)
+	assert.NoError(t, err)
+	err = inTx(stub, "tx3", func() error {
+		return stub.PutState("EHR-001", metadataJSON)
+	})
+	assert.NoError(t, err)
+
+	_, err = getMyRecordKey(s, stub, "tx-get-key4", doctorCtx, "EHR-001")
+	assert.ErrorContains(t, err, "key wrapped for the caller is version 1")
+}
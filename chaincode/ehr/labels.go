@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// HL7 v3 Confidentiality codes
+const (
+	ConfidentialityUnrestricted   = "U"
+	ConfidentialityLow            = "L"
+	ConfidentialityModerate       = "M"
+	ConfidentialityNormal         = "N"
+	ConfidentialityRestricted     = "R"
+	ConfidentialityVeryRestricted = "V"
+)
+
+// Common HL7 v3 ActCode sensitivity tags. Other tags may be used as custom labels.
+const (
+	SensitivityPsychiatry   = "PSY"  // Psychiatry / psychotherapy notes
+	SensitivityHIV          = "HIV"  // HIV / AIDS status
+	SensitivitySubstanceUse = "ETH"  // Substance use treatment (42 CFR Part 2)
+	SensitivityGenetic      = "GDIS" // Genetic disease and genetic tests
+	SensitivitySexual       = "SEX"  // Sexuality and reproductive health
+)
+
+// maxSensitivityTags bounds the labels on a record or consent
+const maxSensitivityTags = 20
+
+var confidentialityCodes = map[string]bool{
+	ConfidentialityUnrestricted:   true,
+	ConfidentialityLow:            true,
+	ConfidentialityModerate:       true,
+	ConfidentialityNormal:         true,
+	ConfidentialityRestricted:     true,
+	ConfidentialityVeryRestricted: true,
+}
+
+// SetRecordLabels sets the confidentiality code and sensitivity tags of every version of a record
+func (s *SmartContract) SetRecordLabels(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	confidentiality string,
+	sensitivityTags []string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if !confidentialityCodes[confidentiality] {
+		return fmt.Errorf("invalid confidentiality code %q, must be one of U, L, M, N, R, V", confidentiality)
+	}
+
+	tags, err := normalizeLabels(sensitivityTags)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	latest := versions[len(versions)-1]
+	err = requireActive(latest)
+	if err != nil {
+		return err
+	}
+
+	// The record's author, its patient or an admin may label it
+	if callerID != latest.CreatedBy {
+		err = s.RequirePatientOrAdmin(ctx, latest.PatientID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, version := range versions {
+		version.Confidentiality = confidentiality
+		version.SensitivityTags = tags
+
+		err = s.putEHRMetadata(ctx, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionSetRecordLabels, callerID, latest.PatientID, latest.RecordID, latest.PatientID, true,
+		fmt.Sprintf("Labels set to %s %v on %d version(s)", confidentiality, tags, len(versions)))
+}
+
+// SetConsentSensitivityOptIns lists the labels a patient explicitly allows under a broad consent
+func (s *SmartContract) SetConsentSensitivityOptIns(
+	ctx contractapi.TransactionContextInterface,
+	consentID string,
+	optIns []string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	labels, err := normalizeLabels(optIns)
+	if err != nil {
+		return err
+	}
+
+	consentJSON, err := ctx.GetStub().GetState(consentID)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if consentJSON == nil {
+		return fmt.Errorf("consent %s %w", consentID, errNotFound)
+	}
+
+	var consent ConsentRecord
+	err = json.Unmarshal(consentJSON, &consent)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+
+	// Only the patient can widen their own consent
+	err = s.RequirePatientOrAdmin(ctx, consent.PatientID)
+	if err != nil {
+		return err
+	}
+
+	consent.SensitivityOptIns = labels
+	consent.Timestamp, err = txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	consentJSON, err = json.Marshal(consent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal consent: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(consentID, consentJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionSetConsentOptIns, callerID, consent.DoctorID, consent.RecordID, consent.PatientID, true,
+		fmt.Sprintf("Sensitivity opt-ins of consent %s set to %v", consentID, labels))
+}
+
+// checkRecordAccess allows the patient, the record's author, admins and doctors whose consent
+// covers the record and its labels. Granted reads of labeled records are audited. A denial is
+// returned as an error, which rolls back the transaction and anything it wrote, so denials are
+// committed by RequestRecordAccess instead.
+func (s *SmartContract) checkRecordAccess(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) error {
+	allowed, restricted, err := s.recordAccess(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	if len(restricted) > 0 {
+		return fmt.Errorf("%w: record %s is labeled %v, which consent does not cover", errUnauthorized, metadata.RecordID, restricted)
+	}
+	if !allowed {
+		return fmt.Errorf("%w: no valid consent for record %s", errUnauthorized, metadata.RecordID)
+	}
+
+	labels := recordLabels(metadata)
+	if len(labels) > 0 {
+		callerID, err := s.GetCallerID(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get caller ID: %v", err)
+		}
+
+		// Create audit log
+		return s.createAuditLog(ctx, ActionLabelRestrictedAccess, callerID, metadata.PatientID, metadata.RecordID, metadata.PatientID, true,
+			fmt.Sprintf("Access to record labeled %v granted", labels))
+	}
+
+	return nil
+}
+
+// recordAccess decides whether the caller may read a record. restricted lists the labels that
+// kept a broad consent from covering it.
+func (s *SmartContract) recordAccess(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) (bool, []string, error) {
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	role, err := s.GetCallerRole(ctx)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to get caller role: %v", err)
+	}
+
+	if role == RoleAdmin || callerID == metadata.PatientID || callerID == metadata.CreatedBy {
+		return true, nil, nil
+	}
+	if role != RoleDoctor {
+		return false, nil, nil
+	}
+
+	return s.consentAccess(ctx, metadata.PatientID, callerID, metadata.RecordID)
+}
+
+// recordLabels returns the labels that keep a record out of broad consents: its sensitivity
+// tags and an R or V confidentiality code
+func recordLabels(metadata *EHRMetadata) []string {
+	labels := append([]string{}, metadata.SensitivityTags...)
+	if metadata.Confidentiality == ConfidentialityRestricted || metadata.Confidentiality == ConfidentialityVeryRestricted {
+		labels = append(labels, metadata.Confidentiality)
+	}
+	return labels
+}
+
+// uncoveredLabels returns the record labels a consent has not opted in to
+func uncoveredLabels(consent *ConsentRecord, metadata *EHRMetadata) []string {
+	optedIn := make(map[string]bool, len(consent.SensitivityOptIns))
+	for _, label := range consent.SensitivityOptIns {
+		optedIn[label] = true
+	}
+
+	var uncovered []string
+	for _, label := range recordLabels(metadata) {
+		if !optedIn[label] {
+			uncovered = append(uncovered, label)
+		}
+	}
+	return uncovered
+}
+
+// normalizeLabels upper-cases, de-duplicates and sorts labels
+func normalizeLabels(labels []string) ([]string, error) {
+	if len(labels) > maxSensitivityTags {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxSensitivityTags)
+	}
+
+	seen := make(map[string]bool, len(labels))
+	var normalized []string
+	for _, label := range labels {
+		label = strings.ToUpper(strings.TrimSpace(label))
+		if label == "" {
+			return nil, fmt.Errorf("labels must not be empty")
+		}
+		if !seen[label] {
+			seen[label] = true
+			normalized = append(normalized, label)
+		}
+	}
+	sort.Strings(normalized)
+
+	return normalized, nil
+}
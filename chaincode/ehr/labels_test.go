@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSensitivityLabels tests that labeled records fall outside broad consents until the patient opts in
+func TestSensitivityLabels(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("lab"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(ctx, "EHR-001", "patient123", testCID("lab"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx1a", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-002", "patient123", testCID("psych"), "key2", "Psychiatric Note", testChecksum("checksum2"), testSignature(ctx, "EHR-002", "patient123", testCID("psych"), testChecksum("checksum2"), "Psychiatric Note"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.SetRecordLabels(ctx, "EHR-002", ConfidentialityRestricted, []string{"psy", "PSY"})
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx3", func() error {
+		return s.SetRecordLabels(ctx, "EHR-002", "X", nil)
+	})
+	assert.ErrorContains(t, err, "invalid confidentiality code")
+
+	err = inTx(stub, "tx4", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-*", "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	hasConsent, err := s.CheckConsent(ctx, "patient123", "doctor456", "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent)
+
+	// A broad consent does not reach the labeled note
+	hasConsent, err = s.CheckConsent(ctx, "patient123", "doctor456", "EHR-002")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent)
+
+	err = inTx(stub, "tx5", func() error {
+		_, err := s.QueryEHR(doctorCtx, "EHR-002")
+		return err
+	})
+	assert.ErrorContains(t, err, "[PSY R]")
+
+	// The denial is committed by requesting access, once, with the labels in the reason
+	err = inTx(stub, "tx5a", func() error {
+		decision, err := s.RequestRecordAccess(doctorCtx, "EHR-002")
+		if err == nil {
+			assert.False(t, decision.Granted)
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	<-stub.ChaincodeEventsChannel
+
+	iterator, err := stub.GetStateByPartialCompositeKey("audit", []string{ActionAccessDenied})
+	assert.NoError(t, err)
+	if assert.True(t, iterator.HasNext()) {
+		entry, _ := iterator.Next()
+		var log AuditLog
+		assert.NoError(t, json.Unmarshal(entry.Value, &log))
+		assert.False(t, log.Success)
+		assert.Equal(t, "EHR-002", log.RecordID)
+		assert.Contains(t, log.Message, "[PSY R]")
+	}
+	assert.False(t, iterator.HasNext())
+	iterator.Close()
+
+	iterator, err = stub.GetStateByPartialCompositeKey("audit", []string{ActionLabelRestrictedAccess})
+	assert.NoError(t, err)
+	assert.False(t, iterator.HasNext(), "denials are not audited twice")
+	iterator.Close()
+
+	// Opting in to only one of the labels is not enough
+	err = inTx(stub, "tx6", func() error {
+		return s.SetConsentSensitivityOptIns(ctx, "patient123-doctor456-*", []string{SensitivityPsychiatry})
+	})
+	assert.NoError(t, err)
+
+	hasConsent, err = s.CheckConsent(ctx, "patient123", "doctor456", "EHR-002")
+	assert.NoError(t, err)
+	assert.False(t, hasConsent)
+
+	// The doctor cannot widen the consent
+	err = inTx(stub, "tx7", func() error {
+		return s.SetConsentSensitivityOptIns(doctorCtx, "patient123-doctor456-*", []string{SensitivityPsychiatry, ConfidentialityRestricted})
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx8", func() error {
+		return s.SetConsentSensitivityOptIns(ctx, "patient123-doctor456-*", []string{SensitivityPsychiatry, ConfidentialityRestricted})
+	})
+	assert.NoError(t, err)
+
+	var metadata *EHRMetadata
+	err = inTx(stub, "tx9", func() error {
+		var err error
+		metadata, err = s.QueryEHR(doctorCtx, "EHR-002")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"PSY"}, metadata.SensitivityTags)
+
+	// The granted read is audited under its own action
+	iterator, err = stub.GetStateByPartialCompositeKey("audit", []string{ActionLabelRestrictedAccess})
+	assert.NoError(t, err)
+	if assert.True(t, iterator.HasNext()) {
+		entry, _ := iterator.Next()
+		var log AuditLog
+		assert.NoError(t, json.Unmarshal(entry.Value, &log))
+		assert.True(t, log.Success)
+		assert.Equal(t, "EHR-002", log.RecordID)
+	}
+	iterator.Close()
+
+	// Labels carry over to amendments
+	err = inTx(stub, "tx10", func() error {
+		return s.AmendEHR(ctx, "EHR-002", "EHR-002-v2", testCID("psych2"), "key3", testChecksum("checksum3"), "Addendum", testSignature(ctx, "EHR-002-v2", "patient123", testCID("psych2"), testChecksum("checksum3"), "Psychiatric Note"))
+	})
+	assert.NoError(t, err)
+
+	amended, err := s.readEHR(ctx, "EHR-002-v2")
+	assert.NoError(t, err)
+	assert.Equal(t, ConfidentialityRestricted, amended.Confidentiality)
+	assert.Equal(t, []string{"PSY"}, amended.SensitivityTags)
+}
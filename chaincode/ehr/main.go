@@ -7,7 +7,7 @@ import (
 )
 
 func main() {
-	chaincode, err := contractapi.NewChaincode(new(SmartContract))
+	chaincode, err := contractapi.NewChaincode(NewSmartContract())
 	if err != nil {
 		log.Panicf("Error creating ehr chaincode: %v", err)
 	}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Chaincode events emitted when patient IDs are merged and unmerged
+const (
+	EventPatientsMerged   = "PatientsMerged"
+	EventPatientsUnmerged = "PatientsUnmerged"
+)
+
+const (
+	patientMergeObjectType = "patientMerge"
+	mergeSurvivorIndex     = "merge~survivor"
+	maxMergeChain          = 10 // Merged IDs followed when resolving a patient ID
+)
+
+// mergeableObjectTypes are the composite-key documents, besides tombstones, that follow a
+// patient's records to the surviving ID. Retention profiles stay with each ID and consent
+// receipts are issued documents, so they are left as they are.
+var mergeableObjectTypes = map[string]bool{
+	encounterDocType:        true,
+	episodeDocType:          true,
+	amendmentRequestDocType: true,
+	legalHoldObjectType:     true,
+	shareTokenObjectType:    true,
+}
+
+// patientIndexes are the composite key indexes that list mergeable documents by patient
+var patientIndexes = map[string]string{
+	legalHoldObjectType:  legalHoldPatientIndex,
+	shareTokenObjectType: shareTokenPatientIndex,
+}
+
+// PatientMerge links a duplicate patient ID to the ID that survives it. The link is kept after
+// an unmerge, and lists what was re-pointed so the merge can be undone exactly.
+type PatientMerge struct {
+	MergeID       string         `json:"mergeId"` // Transaction that merged the IDs
+	SurvivorID    string         `json:"survivorId"`
+	MergedID      string         `json:"mergedId"`
+	Reason        string         `json:"reason"`
+	Active        bool           `json:"active"`
+	MergedBy      string         `json:"mergedBy"`
+	MergedAt      time.Time      `json:"mergedAt"`
+	RecordIDs     []string       `json:"recordIds"`  // First versions of the re-pointed records
+	Consents      []MovedConsent `json:"consents"`   // Consents moved to the survivor
+	EntityKeys    []string       `json:"entityKeys"` // Encounters, episodes, amendment requests, legal holds and share tokens
+	UnmergedBy    string         `json:"unmergedBy,omitempty" metadata:",optional"`
+	UnmergedAt    time.Time      `json:"unmergedAt"` // Zero while merged
+	UnmergeReason string         `json:"unmergeReason,omitempty" metadata:",optional"`
+}
+
+// MovedConsent is a consent re-pointed by a merge. Consents with conventional IDs get the
+// survivor's ID so consent lookups find them.
+type MovedConsent struct {
+	FromID string `json:"fromId"`
+	ToID   string `json:"toId"`
+}
+
+// PatientMergeEvent is emitted so off-chain services can merge or split their patient accounts
+type PatientMergeEvent struct {
+	MergeID    string `json:"mergeId"`
+	SurvivorID string `json:"survivorId"`
+	MergedID   string `json:"mergedId"`
+}
+
+// MergePatients merges a duplicate patient ID into the surviving one. The merged patient's
+// records, consents, encounters, episodes, amendment requests, legal holds and share tokens are
+// re-pointed to the survivor, and queries on the merged ID are redirected.
+func (s *SmartContract) MergePatients(
+	ctx contractapi.TransactionContextInterface,
+	survivorID string,
+	mergedID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	if survivorID == "" {
+		errs.add("survivorId", "is required")
+	}
+	if mergedID == "" {
+		errs.add("mergedId", "is required")
+	} else if mergedID == survivorID {
+		errs.add("mergedId", "must differ from survivorId")
+	}
+	if reason == "" {
+		errs.add("reason", "is required")
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	for _, patientID := range []string{mergedID, survivorID} {
+		err = s.requireUnmergedPatient(ctx, patientID)
+		if err != nil {
+			return err
+		}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	merge := &PatientMerge{
+		MergeID:    ctx.GetStub().GetTxID(),
+		SurvivorID: survivorID,
+		MergedID:   mergedID,
+		Reason:     reason,
+		Active:     true,
+		MergedBy:   callerID,
+		MergedAt:   now,
+		RecordIDs:  []string{},
+		Consents:   []MovedConsent{},
+		EntityKeys: []string{},
+	}
+
+	err = s.collectPatientState(ctx, merge)
+	if err != nil {
+		return err
+	}
+
+	// Every version moves, including tombstones of erased ones
+	for _, rootRecordID := range merge.RecordIDs {
+		err = s.repointRecord(ctx, rootRecordID, mergedID, survivorID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Consents move to the survivor's conventional ID unless the survivor already has that consent
+	var moved []MovedConsent
+	for _, consent := range merge.Consents {
+		toID := consent.ToID
+		existing, err := ctx.GetStub().GetState(toID)
+		if err != nil {
+			return fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if existing != nil && toID != consent.FromID {
+			continue
+		}
+
+		err = s.moveConsent(ctx, consent.FromID, toID, mergedID, survivorID)
+		if err != nil {
+			return err
+		}
+		moved = append(moved, consent)
+	}
+	merge.Consents = append([]MovedConsent{}, moved...)
+
+	for _, key := range merge.EntityKeys {
+		err = s.repointEntity(ctx, key, mergedID, survivorID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = s.putPatientMerge(ctx, merge)
+	if err != nil {
+		return err
+	}
+
+	err = s.putIndexEntry(ctx, mergeSurvivorIndex, survivorID, mergedID)
+	if err != nil {
+		return err
+	}
+
+	err = setPatientMergeEvent(ctx, EventPatientsMerged, merge)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionMergePatients, callerID, survivorID, "", survivorID, true,
+		fmt.Sprintf("Patient %s merged into %s: %d record(s), %d consent(s), %d other document(s): %s",
+			mergedID, survivorID, len(merge.RecordIDs), len(merge.Consents), len(merge.EntityKeys), reason))
+}
+
+// UnmergePatients undoes the active merge of a patient ID, moving back what the merge moved.
+// Records the survivor added after the merge stay with the survivor.
+func (s *SmartContract) UnmergePatients(
+	ctx contractapi.TransactionContextInterface,
+	mergedID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return fmt.Errorf("unmerge reason is required")
+	}
+
+	merge, err := s.activePatientMerge(ctx, mergedID)
+	if err != nil {
+		return err
+	}
+	if merge == nil {
+		return fmt.Errorf("patient %s is not merged", mergedID)
+	}
+
+	// Later merges of the survivor are undone first, so records are where this merge left them
+	later, err := s.activePatientMerge(ctx, merge.SurvivorID)
+	if err != nil {
+		return err
+	}
+	if later != nil {
+		return fmt.Errorf("patient %s has since been merged into %s, unmerge it first", merge.SurvivorID, later.SurvivorID)
+	}
+
+	for _, rootRecordID := range merge.RecordIDs {
+		err = s.repointRecord(ctx, rootRecordID, merge.SurvivorID, mergedID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, consent := range merge.Consents {
+		err = s.moveConsent(ctx, consent.ToID, consent.FromID, merge.SurvivorID, mergedID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range merge.EntityKeys {
+		err = s.repointEntity(ctx, key, merge.SurvivorID, mergedID)
+		if err != nil {
+			return err
+		}
+	}
+
+	merge.Active = false
+	merge.UnmergedBy = callerID
+	merge.UnmergedAt, err = txTime(ctx)
+	if err != nil {
+		return err
+	}
+	merge.UnmergeReason = reason
+
+	err = s.putPatientMerge(ctx, merge)
+	if err != nil {
+		return err
+	}
+
+	err = setPatientMergeEvent(ctx, EventPatientsUnmerged, merge)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionUnmergePatients, callerID, mergedID, "", mergedID, true,
+		fmt.Sprintf("Patient %s unmerged from %s: %s", mergedID, merge.SurvivorID, reason))
+}
+
+// GetPatientMerges returns the merges a patient ID took part in, as merged or surviving ID,
+// including undone ones
+func (s *SmartContract) GetPatientMerges(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) ([]*PatientMerge, error) {
+	err := s.RequirePatientOrAdmin(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	merges, err := s.patientMerges(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	mergedIDs, err := s.indexEntries(ctx, mergeSurvivorIndex, patientID)
+	if err != nil {
+		return nil, err
+	}
+	for _, mergedID := range mergedIDs {
+		survived, err := s.patientMerges(ctx, mergedID)
+		if err != nil {
+			return nil, err
+		}
+		for _, merge := range survived {
+			if merge.SurvivorID == patientID {
+				merges = append(merges, merge)
+			}
+		}
+	}
+
+	return merges, nil
+}
+
+// resolvePatientID follows merge links from a patient ID to the ID that currently holds its records
+func (s *SmartContract) resolvePatientID(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) (string, error) {
+	for hops := 0; hops < maxMergeChain; hops++ {
+		merge, err := s.activePatientMerge(ctx, patientID)
+		if err != nil {
+			return "", err
+		}
+		if merge == nil {
+			return patientID, nil
+		}
+		patientID = merge.SurvivorID
+	}
+
+	return "", fmt.Errorf("patient ID %s is merged more than %d times", patientID, maxMergeChain)
+}
+
+// requireUnmergedPatient rejects patient IDs that have been merged into another
+func (s *SmartContract) requireUnmergedPatient(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) error {
+	merge, err := s.activePatientMerge(ctx, patientID)
+	if err != nil {
+		return err
+	}
+	if merge != nil {
+		return fmt.Errorf("patient %s has been merged into %s", patientID, merge.SurvivorID)
+	}
+
+	return nil
+}
+
+// collectPatientState finds what belongs to the merged patient: records by their first version,
+// consents, and the keys of other documents that follow records
+func (s *SmartContract) collectPatientState(
+	ctx contractapi.TransactionContextInterface,
+	merge *PatientMerge,
+) error {
+	queryJSON, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"patientId": merge.MergedID},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal query: %v", err)
+	}
+
+	resultsIterator, err := ctx.GetStub().GetQueryResult(string(queryJSON))
+	if err != nil {
+		return fmt.Errorf("failed to execute query: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	roots := make(map[string]bool)
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return err
+		}
+
+		objectType := ""
+		if strings.HasPrefix(queryResponse.Key, "\x00") {
+			objectType, _, err = ctx.GetStub().SplitCompositeKey(queryResponse.Key)
+			if err != nil {
+				return fmt.Errorf("failed to split composite key: %v", err)
+			}
+		}
+
+		var document struct {
+			ConsentID    *string `json:"consentId"`
+			DoctorID     string  `json:"doctorId"`
+			RecordID     string  `json:"recordId"`
+			IPFSHash     *string `json:"ipfsHash"`
+			RootRecordID string  `json:"rootRecordId"`
+		}
+		err = json.Unmarshal(queryResponse.Value, &document)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal %s: %v", queryResponse.Key, err)
+		}
+
+		switch {
+		case objectType == "" && document.ConsentID != nil:
+			toID := queryResponse.Key
+			if toID == consentIDFor(merge.MergedID, document.DoctorID, document.RecordID) {
+				toID = consentIDFor(merge.SurvivorID, document.DoctorID, document.RecordID)
+			}
+			merge.Consents = append(merge.Consents, MovedConsent{FromID: queryResponse.Key, ToID: toID})
+		case objectType == "" && document.IPFSHash != nil, objectType == tombstoneObjectType:
+			roots[document.RootRecordID] = true
+		case mergeableObjectTypes[objectType]:
+			merge.EntityKeys = append(merge.EntityKeys, queryResponse.Key)
+		}
+	}
+
+	// Sorted so every endorser writes in the same order
+	for rootRecordID := range roots {
+		merge.RecordIDs = append(merge.RecordIDs, rootRecordID)
+	}
+	sort.Strings(merge.RecordIDs)
+
+	return nil
+}
+
+// repointRecord moves every version of a record that belongs to one patient ID to another. The
+// patient a record was written for is kept, as its author signature covers that ID.
+func (s *SmartContract) repointRecord(
+	ctx contractapi.TransactionContextInterface,
+	rootRecordID string,
+	fromID string,
+	toID string,
+) error {
+	metadata, err := s.readEHR(ctx, rootRecordID)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		if version.PatientID != fromID {
+			continue
+		}
+
+		if version.MergedFrom == "" {
+			version.MergedFrom = fromID
+		}
+		version.PatientID = toID
+		if version.MergedFrom == toID {
+			version.MergedFrom = ""
+		}
+
+		if version.Status == RecordStatusErased {
+			err = s.putTombstone(ctx, version)
+		} else {
+			err = s.putEHRMetadata(ctx, version)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// moveConsent re-points a consent to another patient ID, moving it to a new key if needed
+func (s *SmartContract) moveConsent(
+	ctx contractapi.TransactionContextInterface,
+	fromKey string,
+	toKey string,
+	fromID string,
+	toID string,
+) error {
+	consentJSON, err := ctx.GetStub().GetState(fromKey)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if consentJSON == nil {
+		return nil
+	}
+
+	var consent ConsentRecord
+	err = json.Unmarshal(consentJSON, &consent)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+	if consent.PatientID != fromID {
+		return nil
+	}
+
+	consent.ConsentID = toKey
+	consent.PatientID = toID
+
+	consentJSON, err = json.Marshal(consent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal consent: %v", err)
+	}
+
+	if fromKey != toKey {
+		err = ctx.GetStub().DelState(fromKey)
+		if err != nil {
+			return fmt.Errorf("failed to delete from world state: %v", err)
+		}
+	}
+
+	err = ctx.GetStub().PutState(toKey, consentJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// Wrapped keys stay revocable with the consent
+	if fromKey != toKey {
+		return s.renameRecordKeyConsent(ctx, consent.DoctorID, fromKey, toKey)
+	}
+
+	return nil
+}
+
+// repointEntity changes the patient of an encounter, episode, amendment request, legal hold or
+// share token, leaving the rest of the document as stored
+func (s *SmartContract) repointEntity(
+	ctx contractapi.TransactionContextInterface,
+	key string,
+	fromID string,
+	toID string,
+) error {
+	entityJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if entityJSON == nil {
+		return nil
+	}
+
+	var entity map[string]json.RawMessage
+	err = json.Unmarshal(entityJSON, &entity)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal %s: %v", key, err)
+	}
+
+	var patientID string
+	err = json.Unmarshal(entity["patientId"], &patientID)
+	if err != nil || patientID != fromID {
+		return nil
+	}
+
+	entity["patientId"], err = json.Marshal(toID)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patient ID: %v", err)
+	}
+
+	entityJSON, err = json.Marshal(entity)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", key, err)
+	}
+
+	err = ctx.GetStub().PutState(key, entityJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// Legal holds and share tokens are also listed by patient
+	objectType, attributes, err := ctx.GetStub().SplitCompositeKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to split composite key: %v", err)
+	}
+	if index, found := patientIndexes[objectType]; found {
+		err = s.putIndexEntry(ctx, index, toID, attributes[0])
+		if err != nil {
+			return err
+		}
+		err = s.deleteIndexEntry(ctx, index, fromID, attributes[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// activePatientMerge returns the merge of a patient ID that is in effect, or nil
+func (s *SmartContract) activePatientMerge(
+	ctx contractapi.TransactionContextInterface,
+	mergedID string,
+) (*PatientMerge, error) {
+	merges, err := s.patientMerges(ctx, mergedID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, merge := range merges {
+		if merge.Active {
+			return merge, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// patientMerges lists every merge of a patient ID into another
+func (s *SmartContract) patientMerges(
+	ctx contractapi.TransactionContextInterface,
+	mergedID string,
+) ([]*PatientMerge, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(patientMergeObjectType, []string{mergedID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read patient merges: %v", err)
+	}
+	defer iterator.Close()
+
+	merges := []*PatientMerge{}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read patient merges: %v", err)
+		}
+
+		var merge PatientMerge
+		err = json.Unmarshal(entry.Value, &merge)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal patient merge: %v", err)
+		}
+		merges = append(merges, &merge)
+	}
+
+	return merges, nil
+}
+
+// putPatientMerge saves a merge link under patientMerge~mergedID~mergeID
+func (s *SmartContract) putPatientMerge(
+	ctx contractapi.TransactionContextInterface,
+	merge *PatientMerge,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(patientMergeObjectType, []string{merge.MergedID, merge.MergeID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	mergeJSON, err := json.Marshal(merge)
+	if err != nil {
+		return fmt.Errorf("failed to marshal patient merge: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, mergeJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// setPatientMergeEvent emits a merge or unmerge event
+func setPatientMergeEvent(
+	ctx contractapi.TransactionContextInterface,
+	name string,
+	merge *PatientMerge,
+) error {
+	eventJSON, err := json.Marshal(PatientMergeEvent{
+		MergeID:    merge.MergeID,
+		SurvivorID: merge.SurvivorID,
+		MergedID:   merge.MergedID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(name, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	return nil
+}
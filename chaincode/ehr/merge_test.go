@@ -0,0 +1,195 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMergePatients tests merging a duplicate patient ID into the surviving one and undoing it
+func TestMergePatients(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	adminCtx := newQueryContext(stub, adminIdentity("admin1"))
+	survivorCtx := newQueryContext(stub, patientIdentity("patientA"))
+	duplicateCtx := newQueryContext(stub, patientIdentity("patientB"))
+	doctorCtx := newQueryContext(stub, doctorIdentity("doctor456"))
+
+	// The duplicate ID has an amended record, an erased record, a consent with a wrapped key, an
+	// encounter and a hold
+	keyID, err := registerEncryptionKey(s, stub, "tx0", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(survivorCtx, "EHR-A1", "patientA", testCID("EHR-A1"), "key", "Lab Report", testChecksum("EHR-A1"),
+			testSignature(survivorCtx, "EHR-A1", "patientA", testCID("EHR-A1"), testChecksum("EHR-A1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	for _, recordID := range []string{"EHR-B1", "EHR-B2"} {
+		recordID := recordID
+		err = inTx(stub, "tx1-"+recordID, func() error {
+			return s.CreateEHRMetadata(duplicateCtx, recordID, "patientB", testCID(recordID), "key", "Lab Report", testChecksum(recordID),
+				testSignature(duplicateCtx, recordID, "patientB", testCID(recordID), testChecksum(recordID), "Lab Report"))
+		})
+		assert.NoError(t, err)
+	}
+
+	err = inTx(stub, "tx1a", func() error {
+		return s.AmendEHR(duplicateCtx, "EHR-B1", "EHR-B1-v2", testCID("EHR-B1-v2"), "key", testChecksum("EHR-B1-v2"), "Corrected",
+			testSignature(duplicateCtx, "EHR-B1-v2", "patientB", testCID("EHR-B1-v2"), testChecksum("EHR-B1-v2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTxWithTransient(stub, "tx1b", recordKeysTransient(t, keyID, "EHR-B1"), func() error {
+		_, err := s.GrantConsent(duplicateCtx, "patientB-doctor456-EHR-B1", "patientB", "doctor456", "EHR-B1", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx1c", func() error {
+		return s.CreateEncounter(duplicateCtx, "ENC-B", "patientB", "Outpatient visit", "Clinic 2", []CareParticipant{}, "")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.EraseEHR(adminCtx, "EHR-B2", "Duplicate upload")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2a", func() error {
+		return s.PlaceLegalHold(adminCtx, "HOLD-1", "patientB", "EHR-B1", "Smith v. Hospital")
+	})
+	assert.NoError(t, err)
+
+	// Only admins merge, and never an ID into itself
+	err = inTx(stub, "tx3", func() error {
+		return s.MergePatients(survivorCtx, "patientA", "patientB", "Duplicate registration")
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.MergePatients(adminCtx, "patientA", "patientA", "Duplicate registration")
+	})
+	assert.ErrorContains(t, err, "must differ")
+
+	err = inTx(stub, "tx5", func() error {
+		return s.MergePatients(adminCtx, "patientA", "patientB", "Duplicate registration")
+	})
+	assert.NoError(t, err)
+
+	// Records move with their versions and keep a valid author signature
+	record, err := s.QueryEHR(adminCtx, "EHR-B1-v2")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientA", record.PatientID)
+	assert.Equal(t, "patientB", record.MergedFrom)
+
+	original, err := s.readEHR(adminCtx, "EHR-B1")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientA", original.PatientID)
+
+	tombstone, err := s.readEHR(adminCtx, "EHR-B2")
+	assert.NoError(t, err)
+	assert.Equal(t, RecordStatusErased, tombstone.Status)
+	assert.Equal(t, "patientA", tombstone.PatientID)
+
+	provenance, err := s.VerifyRecordProvenance(adminCtx, "EHR-B1-v2")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+
+	// Consents move to the survivor's consent ID and still grant access
+	assert.Nil(t, stub.State["patientB-doctor456-EHR-B1"])
+	assert.NotNil(t, stub.State["patientA-doctor456-EHR-B1"])
+
+	grant, err := getMyRecordKey(s, stub, "tx-get-key1", doctorCtx, "EHR-B1")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientA-doctor456-EHR-B1", grant.ConsentID)
+
+	hasConsent, err := s.CheckConsent(doctorCtx, "patientB", "doctor456", "EHR-B1-v2")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent)
+
+	_, err = s.QueryEHR(doctorCtx, "EHR-B1-v2")
+	assert.NoError(t, err)
+
+	encounter, err := s.GetEncounter(adminCtx, "ENC-B")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientA", encounter.PatientID)
+
+	holds, err := s.QueryLegalHoldsByPatient(adminCtx, "patientA")
+	assert.NoError(t, err)
+	assert.Len(t, holds, 1)
+
+	// Queries on the merged ID are redirected
+	records, err := s.QueryEHRsByPatient(adminCtx, "patientB")
+	assert.NoError(t, err)
+	ids := []string{}
+	for _, record := range records {
+		ids = append(ids, record.RecordID)
+	}
+	assert.Contains(t, ids, "EHR-A1")
+	assert.Contains(t, ids, "EHR-B1-v2")
+
+	// The merged ID takes no new records and cannot be merged again
+	err = inTx(stub, "tx6", func() error {
+		return s.CreateEHRMetadata(adminCtx, "EHR-B3", "patientB", testCID("EHR-B3"), "key", "Lab Report", testChecksum("EHR-B3"),
+			testSignature(adminCtx, "EHR-B3", "patientB", testCID("EHR-B3"), testChecksum("EHR-B3"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "has been merged into patientA")
+
+	err = inTx(stub, "tx7", func() error {
+		return s.MergePatients(adminCtx, "patientB", "patientC", "Duplicate registration")
+	})
+	assert.ErrorContains(t, err, "has been merged into patientA")
+
+	// Versions added by the survivor move back on unmerge and stay verifiable
+	err = inTx(stub, "tx8", func() error {
+		return s.AmendEHR(survivorCtx, "EHR-B1-v2", "EHR-B1-v3", testCID("EHR-B1-v3"), "key", testChecksum("EHR-B1-v3"), "Addendum",
+			testSignature(survivorCtx, "EHR-B1-v3", "patientA", testCID("EHR-B1-v3"), testChecksum("EHR-B1-v3"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx9", func() error {
+		return s.UnmergePatients(adminCtx, "patientB", "Different people with the same name")
+	})
+	assert.NoError(t, err)
+
+	record, err = s.readEHR(adminCtx, "EHR-B1-v2")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientB", record.PatientID)
+	assert.Empty(t, record.MergedFrom)
+
+	provenance, err = s.VerifyRecordProvenance(adminCtx, "EHR-B1-v3")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+
+	record, err = s.readEHR(adminCtx, "EHR-A1")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientA", record.PatientID)
+
+	assert.NotNil(t, stub.State["patientB-doctor456-EHR-B1"])
+	assert.Nil(t, stub.State["patientA-doctor456-EHR-B1"])
+
+	grant, err = getMyRecordKey(s, stub, "tx-get-key2", doctorCtx, "EHR-B1")
+	assert.NoError(t, err)
+	assert.Equal(t, "patientB-doctor456-EHR-B1", grant.ConsentID)
+
+	holds, err = s.QueryLegalHoldsByPatient(adminCtx, "patientB")
+	assert.NoError(t, err)
+	assert.Len(t, holds, 1)
+
+	// The merge link is kept
+	merges, err := s.GetPatientMerges(adminCtx, "patientA")
+	assert.NoError(t, err)
+	if assert.Len(t, merges, 1) {
+		assert.False(t, merges[0].Active)
+		assert.Equal(t, "patientB", merges[0].MergedID)
+		assert.Equal(t, "tx5", merges[0].MergeID)
+		assert.Equal(t, "Different people with the same name", merges[0].UnmergeReason)
+	}
+
+	err = inTx(stub, "tx10", func() error {
+		return s.UnmergePatients(adminCtx, "patientB", "Again")
+	})
+	assert.ErrorContains(t, err, "is not merged")
+}
@@ -0,0 +1,386 @@
+// Package pre is a reference implementation of proxy re-encryption for record keys. A patient
+// encrypts a record key to their own PRE key and issues a re-encryption key per grantee. A proxy
+// holding that key turns the ciphertext into one only the grantee can decrypt, without learning
+// the record key or being able to decrypt anything itself.
+//
+// The scheme is unidirectional and non-interactive, after Umbral: the patient only needs the
+// grantee's public key. It works in the subgroup of prime order q = (p-1)/2 generated by 2 in
+// the 2048-bit MODP group of RFC 3526. The capsule key is derived with SHA-256 and seals the
+// record key with AES-256-GCM.
+//
+// Threat model: the proxy is honest but curious. Holding re-encryption keys and ciphertexts, it
+// learns nothing about record keys, and a grantee learns only the record keys re-encrypted for
+// them. In the contract the proxy is the peer of the patient's organization, which keeps the
+// re-encryption keys in that organization's private data collection.
+//
+// Collusion is not resisted: the fragment is the patient's secret key divided by a scalar the
+// grantee can compute, so a proxy and a grantee together recover the patient's secret key and
+// with it every record key encrypted to the patient. Re-encryption keys must therefore never
+// leave the proxy. Ciphertexts are not authenticated to their sender, revocation only stops
+// future re-encryptions, and the group gives about 112-bit security. This is a reference
+// implementation that has not been independently reviewed.
+package pre
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// PEMType is the PEM block type of a PRE public key, holding the group element big-endian
+const PEMType = "PRE PUBLIC KEY"
+
+// KeySize is the size of the group in bits
+const KeySize = 2048
+
+const elementSize = KeySize / 8
+
+// Hash domains, so a hash for one purpose is never valid for another
+const (
+	capsuleDomain = "medledger-pre-v1 capsule"
+	delegDomain   = "medledger-pre-v1 delegation"
+	kdfDomain     = "medledger-pre-v1 key"
+)
+
+// RFC 3526 group 14
+var (
+	p, _ = new(big.Int).SetString(
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+			"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+			"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+			"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+			"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+			"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+			"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+			"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF", 16)
+	q = new(big.Int).Rsh(p, 1)
+	g = big.NewInt(2)
+)
+
+// PublicKey is a PRE public key, g^x
+type PublicKey struct {
+	Y *big.Int
+}
+
+// PrivateKey is a PRE key pair
+type PrivateKey struct {
+	PublicKey
+	X *big.Int
+}
+
+// Ciphertext is a record key encrypted to a PRE key. E and V form the capsule the key is
+// derived from; S proves the capsule is well formed and is dropped on re-encryption, which sets
+// the ephemeral key R instead.
+type Ciphertext struct {
+	E      []byte `json:"e"`
+	V      []byte `json:"v"`
+	S      []byte `json:"s,omitempty"`
+	R      []byte `json:"r,omitempty"`
+	Nonce  []byte `json:"nonce"`
+	Sealed []byte `json:"sealed"`
+}
+
+// ReEncryptionKey turns ciphertexts for the patient into ciphertexts for one grantee
+type ReEncryptionKey struct {
+	Fragment  []byte `json:"fragment"`  // a / d mod q
+	Ephemeral []byte `json:"ephemeral"` // g^r, from which the grantee derives d
+}
+
+// GenerateKey generates a PRE key pair
+func GenerateKey(random io.Reader) (*PrivateKey, error) {
+	x, err := randomScalar(random)
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{PublicKey: PublicKey{Y: new(big.Int).Exp(g, x, p)}, X: x}, nil
+}
+
+// MarshalPEM encodes a public key for the public key directory
+func (k *PublicKey) MarshalPEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: PEMType, Bytes: elementBytes(k.Y)}))
+}
+
+// ParsePublicKey decodes the contents of a PRE PUBLIC KEY block, checking it is in the group
+func ParsePublicKey(der []byte) (*PublicKey, error) {
+	y, err := parseElement(der)
+	if err != nil {
+		return nil, err
+	}
+	return &PublicKey{Y: y}, nil
+}
+
+// ParsePublicKeyPEM decodes a PEM PRE PUBLIC KEY
+func ParsePublicKeyPEM(publicKeyPEM string) (*PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil || block.Type != PEMType {
+		return nil, fmt.Errorf("must be a PEM encoded %s", PEMType)
+	}
+	return ParsePublicKey(block.Bytes)
+}
+
+// Encrypt encrypts a record key to a PRE public key
+func Encrypt(random io.Reader, publicKey *PublicKey, plaintext []byte) (*Ciphertext, error) {
+	r, err := randomScalar(random)
+	if err != nil {
+		return nil, err
+	}
+	u, err := randomScalar(random)
+	if err != nil {
+		return nil, err
+	}
+
+	e := new(big.Int).Exp(g, r, p)
+	v := new(big.Int).Exp(g, u, p)
+	h := hashScalar(capsuleDomain, e, v)
+	s := new(big.Int).Mul(r, h)
+	s.Add(s, u).Mod(s, q)
+
+	// The capsule key is A^(r+u), which the patient gets back as (E V)^a
+	exponent := new(big.Int).Add(r, u)
+	shared := new(big.Int).Exp(publicKey.Y, exponent, p)
+
+	nonce, sealed, err := seal(random, shared, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ciphertext{
+		E:      elementBytes(e),
+		V:      elementBytes(v),
+		S:      elementBytes(s),
+		Nonce:  nonce,
+		Sealed: sealed,
+	}, nil
+}
+
+// Decrypt decrypts a ciphertext encrypted to the key, or re-encrypted for it
+func Decrypt(privateKey *PrivateKey, ciphertext *Ciphertext) ([]byte, error) {
+	e, err := parseElement(ciphertext.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capsule: %v", err)
+	}
+	v, err := parseElement(ciphertext.V)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capsule: %v", err)
+	}
+
+	exponent := privateKey.X
+	if len(ciphertext.R) > 0 {
+		ephemeral, err := parseElement(ciphertext.R)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ephemeral key: %v", err)
+		}
+		exponent = delegationScalar(ephemeral, privateKey.Y, new(big.Int).Exp(ephemeral, privateKey.X, p))
+	}
+
+	product := new(big.Int).Mul(e, v)
+	shared := product.Mod(product, p).Exp(product, exponent, p)
+
+	return open(shared, ciphertext.Nonce, ciphertext.Sealed)
+}
+
+// GenerateReEncryptionKey issues a re-encryption key from the patient's key to a grantee's
+// public key
+func GenerateReEncryptionKey(random io.Reader, delegator *PrivateKey, delegatee *PublicKey) (*ReEncryptionKey, error) {
+	r, err := randomScalar(random)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeral := new(big.Int).Exp(g, r, p)
+	d := delegationScalar(ephemeral, delegatee.Y, new(big.Int).Exp(delegatee.Y, r, p))
+	inverse := new(big.Int).ModInverse(d, q)
+	if inverse == nil {
+		return nil, fmt.Errorf("failed to invert delegation scalar")
+	}
+	fragment := inverse.Mul(inverse, delegator.X)
+	fragment.Mod(fragment, q)
+
+	return &ReEncryptionKey{Fragment: elementBytes(fragment), Ephemeral: elementBytes(ephemeral)}, nil
+}
+
+// Validate checks that a re-encryption key is well formed
+func (k *ReEncryptionKey) Validate() error {
+	if len(k.Fragment) != elementSize {
+		return fmt.Errorf("fragment must be %d bytes", elementSize)
+	}
+	fragment := new(big.Int).SetBytes(k.Fragment)
+	if fragment.Sign() == 0 || fragment.Cmp(q) >= 0 {
+		return fmt.Errorf("fragment is out of range")
+	}
+	_, err := parseElement(k.Ephemeral)
+	if err != nil {
+		return fmt.Errorf("invalid ephemeral key: %v", err)
+	}
+	return nil
+}
+
+// ReEncrypt turns a ciphertext for the patient into one for the grantee of a re-encryption key.
+// Capsules that are not well formed are refused, so the proxy cannot be used as an oracle.
+func ReEncrypt(key *ReEncryptionKey, ciphertext *Ciphertext) (*Ciphertext, error) {
+	err := key.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext.R) > 0 {
+		return nil, fmt.Errorf("ciphertext has already been re-encrypted")
+	}
+
+	e, err := parseElement(ciphertext.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capsule: %v", err)
+	}
+	v, err := parseElement(ciphertext.V)
+	if err != nil {
+		return nil, fmt.Errorf("invalid capsule: %v", err)
+	}
+
+	// g^s = V E^h
+	s := new(big.Int).SetBytes(ciphertext.S)
+	expected := new(big.Int).Exp(e, hashScalar(capsuleDomain, e, v), p)
+	expected.Mul(expected, v).Mod(expected, p)
+	if s.Cmp(q) >= 0 || new(big.Int).Exp(g, s, p).Cmp(expected) != 0 {
+		return nil, fmt.Errorf("capsule is not well formed")
+	}
+
+	fragment := new(big.Int).SetBytes(key.Fragment)
+	return &Ciphertext{
+		E:      elementBytes(new(big.Int).Exp(e, fragment, p)),
+		V:      elementBytes(new(big.Int).Exp(v, fragment, p)),
+		R:      key.Ephemeral,
+		Nonce:  ciphertext.Nonce,
+		Sealed: ciphertext.Sealed,
+	}, nil
+}
+
+// Marshal encodes a ciphertext as base64 JSON, the form stored as a record's encryptedKey
+func (c *Ciphertext) Marshal() (string, error) {
+	ciphertextJSON, err := json.Marshal(c)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ciphertext: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(ciphertextJSON), nil
+}
+
+// ParseCiphertext decodes a ciphertext encoded with Marshal
+func ParseCiphertext(encoded string) (*Ciphertext, error) {
+	ciphertextJSON, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("ciphertext is not valid base64: %v", err)
+	}
+
+	var ciphertext Ciphertext
+	err = json.Unmarshal(ciphertextJSON, &ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ciphertext: %v", err)
+	}
+	return &ciphertext, nil
+}
+
+// delegationScalar binds a re-encryption key to its grantee: only the holder of the grantee's
+// secret key, or of the ephemeral secret, can compute it
+func delegationScalar(ephemeral *big.Int, delegatee *big.Int, shared *big.Int) *big.Int {
+	return hashScalar(delegDomain, ephemeral, delegatee, shared)
+}
+
+// hashScalar hashes group elements to a non-zero scalar
+func hashScalar(domain string, elements ...*big.Int) *big.Int {
+	digest := sha256.New()
+	digest.Write([]byte(domain))
+	for _, element := range elements {
+		digest.Write(elementBytes(element))
+	}
+
+	scalar := new(big.Int).SetBytes(digest.Sum(nil))
+	scalar.Mod(scalar, q)
+	if scalar.Sign() == 0 {
+		scalar.SetInt64(1)
+	}
+	return scalar
+}
+
+// seal encrypts with AES-256-GCM under the key derived from a shared group element
+func seal(random io.Reader, shared *big.Int, plaintext []byte) ([]byte, []byte, error) {
+	aead, err := newGCM(shared)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(random, nonce)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	return nonce, aead.Seal(nil, nonce, plaintext, nil), nil
+}
+
+// open decrypts what seal encrypted
+func open(shared *big.Int, nonce []byte, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(shared)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("nonce must be %d bytes", aead.NonceSize())
+	}
+
+	plaintext, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
+
+// newGCM returns AES-256-GCM keyed with the SHA-256 of a shared group element
+func newGCM(shared *big.Int) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte(kdfDomain), elementBytes(shared)...))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return aead, nil
+}
+
+// randomScalar returns a scalar in [1, q)
+func randomScalar(random io.Reader) (*big.Int, error) {
+	scalar, err := rand.Int(random, new(big.Int).Sub(q, big.NewInt(1)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate scalar: %v", err)
+	}
+	return scalar.Add(scalar, big.NewInt(1)), nil
+}
+
+// parseElement decodes a big-endian element of the order q subgroup, other than the identity
+func parseElement(data []byte) (*big.Int, error) {
+	if len(data) != elementSize {
+		return nil, fmt.Errorf("must be %d bytes", elementSize)
+	}
+
+	element := new(big.Int).SetBytes(data)
+	if element.Cmp(big.NewInt(1)) <= 0 || element.Cmp(p) >= 0 {
+		return nil, fmt.Errorf("is out of range")
+	}
+	if new(big.Int).Exp(element, q, p).Cmp(big.NewInt(1)) != 0 {
+		return nil, fmt.Errorf("is not in the group")
+	}
+	return element, nil
+}
+
+// elementBytes encodes an element or scalar big-endian in elementSize bytes
+func elementBytes(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, elementSize))
+}
@@ -0,0 +1,222 @@
+package pre
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGroup tests that the generator has prime order q
+func TestGroup(t *testing.T) {
+	assert.True(t, q.ProbablyPrime(20))
+	assert.Equal(t, 0, new(big.Int).Exp(g, q, p).Cmp(big.NewInt(1)))
+}
+
+// TestReEncrypt tests that a grantee decrypts a re-encrypted record key, and that the proxy and
+// other users cannot
+func TestReEncrypt(t *testing.T) {
+	patient, err := GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	grantee, err := GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	other, err := GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	recordKey := make([]byte, 32)
+	_, err = rand.Read(recordKey)
+	assert.NoError(t, err)
+
+	ciphertext, err := Encrypt(rand.Reader, &patient.PublicKey, recordKey)
+	assert.NoError(t, err)
+	decrypted, err := Decrypt(patient, ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, decrypted)
+
+	// The public key is all the patient needs of the grantee
+	parsed, err := ParsePublicKeyPEM(grantee.PublicKey.MarshalPEM())
+	assert.NoError(t, err)
+	reKey, err := GenerateReEncryptionKey(rand.Reader, patient, parsed)
+	assert.NoError(t, err)
+	assert.NoError(t, reKey.Validate())
+
+	reEncrypted, err := ReEncrypt(reKey, ciphertext)
+	assert.NoError(t, err)
+	decrypted, err = Decrypt(grantee, reEncrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, decrypted)
+
+	_, err = Decrypt(other, reEncrypted)
+	assert.ErrorContains(t, err, "failed to decrypt")
+	_, err = Decrypt(grantee, ciphertext)
+	assert.ErrorContains(t, err, "failed to decrypt")
+
+	// Tampered capsules and double re-encryption are refused
+	tampered := *ciphertext
+	tampered.V = elementBytes(new(big.Int).Exp(g, big.NewInt(7), p))
+	_, err = ReEncrypt(reKey, &tampered)
+	assert.ErrorContains(t, err, "not well formed")
+	_, err = ReEncrypt(reKey, reEncrypted)
+	assert.ErrorContains(t, err, "already been re-encrypted")
+
+	encoded, err := reEncrypted.Marshal()
+	assert.NoError(t, err)
+	roundTrip, err := ParseCiphertext(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, reEncrypted, roundTrip)
+}
+
+// seededReader is a deterministic source of bytes for known-answer tests, the SHA-256 of a
+// seed and a counter
+type seededReader struct {
+	seed    string
+	counter uint64
+	buffer  []byte
+}
+
+func (r *seededReader) Read(b []byte) (int, error) {
+	for len(r.buffer) < len(b) {
+		block := sha256.New()
+		block.Write([]byte(r.seed))
+		binary.Write(block, binary.BigEndian, r.counter)
+		r.counter++
+		r.buffer = block.Sum(r.buffer)
+	}
+	n := copy(b, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+// TestKnownAnswers tests the scheme against fixed vectors, so that a change to the group,
+// hashes, key derivation or encoding, which would strand stored keys and ciphertexts, fails
+func TestKnownAnswers(t *testing.T) {
+	random := &seededReader{seed: "medledger-pre-v1 known answers"}
+	recordKey := []byte("0123456789abcdef0123456789abcdef")
+
+	patient, err := GenerateKey(random)
+	assert.NoError(t, err)
+	grantee, err := GenerateKey(random)
+	assert.NoError(t, err)
+	ciphertext, err := Encrypt(random, &patient.PublicKey, recordKey)
+	assert.NoError(t, err)
+	reKey, err := GenerateReEncryptionKey(random, patient, &grantee.PublicKey)
+	assert.NoError(t, err)
+	reEncrypted, err := ReEncrypt(reKey, ciphertext)
+	assert.NoError(t, err)
+
+	for _, vector := range []struct {
+		name   string
+		value  interface{}
+		digest string
+	}{
+		{"patient public key", patient.PublicKey.MarshalPEM(), "85a68970c3b71627ce8bc5ba56937fd335d7a642a47ae5e0bd2753c2d6575abf"},
+		{"grantee public key", grantee.PublicKey.MarshalPEM(), "abaf055f9d7d1942982edf8cd8cb8081b63196181cb00120700ee92ed0dae44b"},
+		{"ciphertext", ciphertext, "377f3e463f95f070e8da6f291820bbf6d038c3ef34b2be0db319cf558ecb717d"},
+		{"re-encryption key", reKey, "bc505c9acfb30b418bc839abbd3d79110b7ee6d75b44eb2a5b3fc4d0684e9d1c"},
+		{"re-encrypted ciphertext", reEncrypted, "ed37b1de5e29dc159f852f569b65d49781941d837887a7179951db487dad0958"},
+	} {
+		valueJSON, err := json.Marshal(vector.value)
+		assert.NoError(t, err)
+		digest := sha256.Sum256(valueJSON)
+		assert.Equal(t, vector.digest, hex.EncodeToString(digest[:]), vector.name)
+	}
+
+	decrypted, err := Decrypt(patient, ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, decrypted)
+	decrypted, err = Decrypt(grantee, reEncrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, decrypted)
+}
+
+// TestParsePublicKey tests that keys outside the group are rejected
+func TestParsePublicKey(t *testing.T) {
+	_, err := ParsePublicKey(elementBytes(big.NewInt(1)))
+	assert.ErrorContains(t, err, "out of range")
+
+	// p - 1 has order 2
+	_, err = ParsePublicKey(elementBytes(new(big.Int).Sub(p, big.NewInt(1))))
+	assert.ErrorContains(t, err, "not in the group")
+
+	_, err = ParsePublicKeyPEM("not a key")
+	assert.ErrorContains(t, err, PEMType)
+}
+
+// memoryLedger stands in for the contract, with one authorized grantee per record
+type memoryLedger struct {
+	authorized map[string]string
+	keyVersion int
+	keys       map[string]*ReEncryptedKey
+}
+
+func (l *memoryLedger) AuthorizeReEncryption(ctx context.Context, recordID string, granteeID string) (*Authorization, error) {
+	if l.authorized[recordID] != granteeID {
+		return nil, fmt.Errorf("unauthorized: no valid consent for record %s", recordID)
+	}
+	return &Authorization{RecordID: recordID, GranteeID: granteeID, KeyVersion: l.keyVersion}, nil
+}
+
+func (l *memoryLedger) ReEncryptRecordKey(ctx context.Context, recordID string, granteeID string) (*ReEncryptedKey, error) {
+	return l.keys[recordID], nil
+}
+
+// TestService tests that the service only re-encrypts for grantees the contract authorized
+func TestService(t *testing.T) {
+	patient, err := GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	grantee, err := GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	recordKey := []byte("0123456789abcdef0123456789abcdef")
+	ciphertext, err := Encrypt(rand.Reader, &patient.PublicKey, recordKey)
+	assert.NoError(t, err)
+	encryptedKey, err := ciphertext.Marshal()
+	assert.NoError(t, err)
+	reKey, err := GenerateReEncryptionKey(rand.Reader, patient, &grantee.PublicKey)
+	assert.NoError(t, err)
+	reEncrypted, err := ReEncrypt(reKey, ciphertext)
+	assert.NoError(t, err)
+	reEncryptedKey, err := reEncrypted.Marshal()
+	assert.NoError(t, err)
+
+	ledger := &memoryLedger{
+		authorized: map[string]string{"EHR-001": "doctor456"},
+		keyVersion: 1,
+		keys: map[string]*ReEncryptedKey{"EHR-001": {
+			RecordID:     "EHR-001",
+			GranteeID:    "doctor456",
+			KeyVersion:   1,
+			EncryptedKey: reEncryptedKey,
+		}},
+	}
+	service := &Service{Ledger: ledger}
+
+	encoded, err := service.ReEncrypt(context.Background(), "EHR-001", "doctor456")
+	assert.NoError(t, err)
+	parsed, err := ParseCiphertext(encoded)
+	assert.NoError(t, err)
+	decrypted, err := Decrypt(grantee, parsed)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, decrypted)
+
+	_, err = service.ReEncrypt(context.Background(), "EHR-001", "doctor789")
+	assert.ErrorContains(t, err, "not authorized")
+
+	// Keys rotated between the two calls are not used
+	ledger.keys["EHR-001"].KeyVersion = 2
+	_, err = service.ReEncrypt(context.Background(), "EHR-001", "doctor456")
+	assert.ErrorContains(t, err, "changed since it was authorized")
+
+	// A key the proxy did not transform is not handed on
+	ledger.keys["EHR-001"].KeyVersion = 1
+	ledger.keys["EHR-001"].EncryptedKey = encryptedKey
+	_, err = service.ReEncrypt(context.Background(), "EHR-001", "doctor456")
+	assert.ErrorContains(t, err, "was not re-encrypted")
+}
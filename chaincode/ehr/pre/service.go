@@ -0,0 +1,70 @@
+package pre
+
+import (
+	"context"
+	"fmt"
+)
+
+// Authorization is what the contract's AuthorizeReEncryption returns once it has confirmed the
+// grantee's consent
+type Authorization struct {
+	RecordID     string `json:"recordId"`
+	PatientID    string `json:"patientId"`
+	GranteeID    string `json:"granteeId"`
+	ConsentID    string `json:"consentId"`
+	KeyVersion   int    `json:"keyVersion"`
+	GranteeKeyID string `json:"granteeKeyId"`
+}
+
+// ReEncryptedKey is what the contract's ReEncryptRecordKey returns: the record key re-encrypted
+// for the grantee. The peer of the patient's organization that holds the re-encryption key acts
+// as the proxy, so the key never reaches the service.
+type ReEncryptedKey struct {
+	RecordID     string `json:"recordId"`
+	GranteeID    string `json:"granteeId"`
+	KeyVersion   int    `json:"keyVersion"`
+	EncryptedKey string `json:"encryptedKey"` // A marshalled Ciphertext for the grantee
+}
+
+// Ledger is the part of the contract the service relies on, usually a Fabric gateway client
+// with the backend's admin identity on a peer of the patient's organization
+type Ledger interface {
+	// AuthorizeReEncryption submits the transaction that checks consent and audits the request
+	AuthorizeReEncryption(ctx context.Context, recordID string, granteeID string) (*Authorization, error)
+	// ReEncryptRecordKey evaluates the query re-encrypting the record key for the grantee
+	ReEncryptRecordKey(ctx context.Context, recordID string, granteeID string) (*ReEncryptedKey, error)
+}
+
+// Service shares patient-wrapped record keys with grantees, so patients need not be online to
+// share a record. It holds no keys and never sees a re-encryption key.
+type Service struct {
+	Ledger Ledger
+}
+
+// ReEncrypt returns a record's key re-encrypted for a grantee, as a marshalled Ciphertext the
+// grantee decrypts with their PRE key. The contract must first confirm the grantee's consent.
+func (s *Service) ReEncrypt(ctx context.Context, recordID string, granteeID string) (string, error) {
+	authorization, err := s.Ledger.AuthorizeReEncryption(ctx, recordID, granteeID)
+	if err != nil {
+		return "", fmt.Errorf("re-encryption of %s for %s not authorized: %v", recordID, granteeID, err)
+	}
+
+	reEncrypted, err := s.Ledger.ReEncryptRecordKey(ctx, recordID, granteeID)
+	if err != nil {
+		return "", fmt.Errorf("failed to re-encrypt key of %s for %s: %v", recordID, granteeID, err)
+	}
+	if reEncrypted.RecordID != authorization.RecordID || reEncrypted.GranteeID != authorization.GranteeID ||
+		reEncrypted.KeyVersion != authorization.KeyVersion {
+		return "", fmt.Errorf("record key of %s changed since it was authorized", recordID)
+	}
+
+	ciphertext, err := ParseCiphertext(reEncrypted.EncryptedKey)
+	if err != nil {
+		return "", fmt.Errorf("record key of %s is not a PRE ciphertext: %v", recordID, err)
+	}
+	if len(ciphertext.R) == 0 {
+		return "", fmt.Errorf("record key of %s was not re-encrypted", recordID)
+	}
+
+	return reEncrypted.EncryptedKey, nil
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// privateRecordTransientKey is the transient map key of a record's key material when it is kept in
+// a private data collection, a JSON object with encryptedKey and optionally ipfsHash and mspId
+const privateRecordTransientKey = "ehrPrivate"
+
+// privateCollectionSuffix names the collection of each organization, e.g. HospitalMSPPrivateCollection,
+// as defined in collections_config.json
+const privateCollectionSuffix = "PrivateCollection"
+
+// PrivateDataRef points at key material held in a private data collection. Only the hash of the
+// private value is on the public ledger.
+type PrivateDataRef struct {
+	Collection string `json:"collection"`
+	Hash       string `json:"hash"`                                    // Hex SHA-256 of the private value, as GetPrivateDataHash reports it
+	IPFSHash   bool   `json:"ipfsHash,omitempty" metadata:",optional"` // The CID is private as well
+}
+
+// PrivateDataCheck compares a private value with the hash kept on the public ledger
+type PrivateDataCheck struct {
+	RecordID     string `json:"recordId"`
+	GranteeID    string `json:"granteeId,omitempty" metadata:",optional"` // Set for a wrapped key
+	Collection   string `json:"collection"`
+	ExpectedHash string `json:"expectedHash"`
+	ActualHash   string `json:"actualHash"` // Empty if the collection has no value
+	Valid        bool   `json:"valid"`
+}
+
+// privateRecordInput is the transient ehrPrivate value
+type privateRecordInput struct {
+	EncryptedKey string `json:"encryptedKey"`
+	IPFSHash     string `json:"ipfsHash,omitempty"`
+	MSPID        string `json:"mspId,omitempty"` // Organization whose collection holds the data, which must be the caller's
+}
+
+// privateRecordData is the private value of a record, keyed by record ID
+type privateRecordData struct {
+	RecordID         string `json:"recordId"`
+	EncryptedKey     string `json:"encryptedKey"`
+	IPFSHash         string `json:"ipfsHash,omitempty"`
+	SignedIPFSHash   string `json:"signedIpfsHash,omitempty"`
+	PreviousIPFSHash string `json:"previousIpfsHash,omitempty"`
+}
+
+// privateKeyGrantData is the private value of a record key wrapped for a grantee
+type privateKeyGrantData struct {
+	RecordID   string `json:"recordId"`
+	GranteeID  string `json:"granteeId"`
+	WrappedKey string `json:"wrappedKey"`
+}
+
+// VerifyPrivateData checks the private data of a record and of the keys wrapped for its grantees
+// against the hashes on the public ledger. Hashes are available on every peer, so the check
+// works without membership in the collections.
+func (s *SmartContract) VerifyPrivateData(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) ([]*PrivateDataCheck, error) {
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireNotErased(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkRecordAccess(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := []*PrivateDataCheck{}
+	if metadata.PrivateData != nil {
+		check, err := s.checkPrivateValue(ctx, metadata.PrivateData, metadata.RecordID)
+		if err != nil {
+			return nil, err
+		}
+		check.RecordID = metadata.RecordID
+		checks = append(checks, check)
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(recordKeyObjectType, []string{recordID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read record keys: %v", err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record keys: %v", err)
+		}
+
+		var grant RecordKeyGrant
+		err = json.Unmarshal(entry.Value, &grant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal record key: %v", err)
+		}
+		if grant.PrivateData == nil {
+			continue
+		}
+
+		check, err := s.checkPrivateValue(ctx, grant.PrivateData, entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		check.RecordID = grant.RecordID
+		check.GranteeID = grant.GranteeID
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// checkPrivateValue compares the hash of a private value with its reference
+func (s *SmartContract) checkPrivateValue(
+	ctx contractapi.TransactionContextInterface,
+	ref *PrivateDataRef,
+	key string,
+) (*PrivateDataCheck, error) {
+	hash, err := ctx.GetStub().GetPrivateDataHash(ref.Collection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private data hash: %v", err)
+	}
+
+	check := &PrivateDataCheck{
+		Collection:   ref.Collection,
+		ExpectedHash: ref.Hash,
+		ActualHash:   hex.EncodeToString(hash),
+	}
+	check.Valid = len(hash) > 0 && check.ActualHash == ref.Hash
+	return check, nil
+}
+
+// applyPrivateRecordData takes a record's key, and optionally its CID, from the transient map
+// and marks them for a private data collection. Versions of a private record must stay private,
+// in the previous collection unless the input names the caller's organization.
+func (s *SmartContract) applyPrivateRecordData(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+	previous *PrivateDataRef,
+) error {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to get transient data: %v", err)
+	}
+
+	inputJSON, found := transient[privateRecordTransientKey]
+	if !found {
+		if previous != nil {
+			return fmt.Errorf("record %s keeps its key in private data, pass the new key in transient %s",
+				metadata.RecordID, privateRecordTransientKey)
+		}
+		return nil
+	}
+
+	var input privateRecordInput
+	err = json.Unmarshal(inputJSON, &input)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal transient %s: %v", privateRecordTransientKey, err)
+	}
+
+	var errs ValidationErrors
+	if len(metadata.Components) > 0 {
+		errs.add(privateRecordTransientKey, "bundles cannot keep their keys in private data")
+	}
+	if metadata.EncryptedKey != "" {
+		errs.add("encryptedKey", "must be empty when the key is passed in transient %s", privateRecordTransientKey)
+	}
+	if input.EncryptedKey == "" {
+		errs.add(privateRecordTransientKey+".encryptedKey", "is required")
+	}
+	if input.IPFSHash != "" && metadata.IPFSHash != "" {
+		errs.add("ipfsHash", "must be empty when the CID is passed in transient %s", privateRecordTransientKey)
+	}
+	if input.MSPID != "" && !recordIDPattern.MatchString(input.MSPID) {
+		errs.add(privateRecordTransientKey+".mspId", "must be an MSP ID")
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return err
+	}
+
+	// The collections allow writes from any organization, so that keys can be granted across
+	// organizations. A record's own key material is only placed in the caller's collection.
+	if input.MSPID != "" && input.MSPID != callerOrg {
+		return fmt.Errorf("%w: %s cannot place record %s in the collection of %s", errUnauthorized,
+			callerOrg, metadata.RecordID, input.MSPID)
+	}
+
+	collection := privateCollection(callerOrg)
+	if previous != nil && input.MSPID == "" {
+		collection = previous.Collection
+	}
+
+	metadata.EncryptedKey = input.EncryptedKey
+	if input.IPFSHash != "" {
+		metadata.IPFSHash = input.IPFSHash
+	}
+	metadata.PrivateData = &PrivateDataRef{
+		Collection: collection,
+		IPFSHash:   input.IPFSHash != "",
+	}
+
+	return nil
+}
+
+// loadPrivateRecordData fills in a record's private fields when the collection is readable here.
+// Peers and clients outside the collection see the public record only.
+func (s *SmartContract) loadPrivateRecordData(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) error {
+	if metadata.PrivateData == nil {
+		return nil
+	}
+
+	var data privateRecordData
+	found, err := s.readPrivateValue(ctx, metadata.PrivateData, metadata.RecordID, &data)
+	if err != nil || !found {
+		return err
+	}
+
+	metadata.EncryptedKey = data.EncryptedKey
+	if metadata.PrivateData.IPFSHash {
+		metadata.IPFSHash = data.IPFSHash
+		if metadata.KeyRotation != nil {
+			rotation := *metadata.KeyRotation
+			rotation.SignedIPFSHash = data.SignedIPFSHash
+			rotation.PreviousIPFSHash = data.PreviousIPFSHash
+			metadata.KeyRotation = &rotation
+		}
+	}
+
+	return nil
+}
+
+// publicEHRMetadata saves the private fields of a loaded or new record to its collection and
+// returns the record as it goes on the public ledger
+func (s *SmartContract) publicEHRMetadata(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) (*EHRMetadata, error) {
+	if metadata.PrivateData == nil {
+		return metadata, nil
+	}
+
+	// Records read where the collection is not readable keep their private value as it is
+	if metadata.EncryptedKey != "" {
+		data := privateRecordData{
+			RecordID:     metadata.RecordID,
+			EncryptedKey: metadata.EncryptedKey,
+		}
+		if metadata.PrivateData.IPFSHash {
+			data.IPFSHash = metadata.IPFSHash
+			if metadata.KeyRotation != nil {
+				data.SignedIPFSHash = metadata.KeyRotation.SignedIPFSHash
+				data.PreviousIPFSHash = metadata.KeyRotation.PreviousIPFSHash
+			}
+		}
+
+		hash, err := s.putPrivateValue(ctx, metadata.PrivateData, metadata.RecordID, data)
+		if err != nil {
+			return nil, err
+		}
+		metadata.PrivateData.Hash = hash
+	}
+
+	public := *metadata
+	ref := *metadata.PrivateData
+	public.PrivateData = &ref
+	public.EncryptedKey = ""
+	if ref.IPFSHash {
+		public.IPFSHash = ""
+		if public.KeyRotation != nil {
+			rotation := *public.KeyRotation
+			rotation.SignedIPFSHash = ""
+			rotation.PreviousIPFSHash = ""
+			public.KeyRotation = &rotation
+		}
+	}
+
+	return &public, nil
+}
+
+// requirePrivateDataLoaded rejects changes that need a record's private fields where they cannot be read
+func requirePrivateDataLoaded(metadata *EHRMetadata) error {
+	if metadata.PrivateData != nil && metadata.EncryptedKey == "" {
+		return fmt.Errorf("private data of record %s is not readable by the caller's organization in %s",
+			metadata.RecordID, metadata.PrivateData.Collection)
+	}
+	return nil
+}
+
+// grantPrivateDataRef decides where a key wrapped for a grantee is kept: keys of private records go
+// to the collection of the organization that registered the grantee's key
+func grantPrivateDataRef(metadata *EHRMetadata, entry *PublicKeyEntry) *PrivateDataRef {
+	if metadata.PrivateData == nil {
+		return nil
+	}
+	if entry.MSPID == "" {
+		return &PrivateDataRef{Collection: metadata.PrivateData.Collection}
+	}
+	return &PrivateDataRef{Collection: privateCollection(entry.MSPID)}
+}
+
+// readPrivateValue loads a private value and checks it against its hash. Values that cannot be
+// read, because the caller's organization is not a member of the collection, are not found.
+func (s *SmartContract) readPrivateValue(
+	ctx contractapi.TransactionContextInterface,
+	ref *PrivateDataRef,
+	key string,
+	value interface{},
+) (bool, error) {
+	valueJSON, err := ctx.GetStub().GetPrivateData(ref.Collection, key)
+	if err != nil || valueJSON == nil {
+		return false, nil
+	}
+
+	if privateDataHash(valueJSON) != ref.Hash {
+		return false, fmt.Errorf("private data %s in %s does not match its hash on the ledger", key, ref.Collection)
+	}
+
+	err = json.Unmarshal(valueJSON, value)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal private data: %v", err)
+	}
+
+	return true, nil
+}
+
+// putPrivateValue saves a private value unless it is unchanged, and returns its hash
+func (s *SmartContract) putPrivateValue(
+	ctx contractapi.TransactionContextInterface,
+	ref *PrivateDataRef,
+	key string,
+	value interface{},
+) (string, error) {
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal private data: %v", err)
+	}
+
+	hash := privateDataHash(valueJSON)
+	if hash == ref.Hash {
+		return hash, nil
+	}
+
+	err = ctx.GetStub().PutPrivateData(ref.Collection, key, valueJSON)
+	if err != nil {
+		return "", fmt.Errorf("failed to put private data: %v", err)
+	}
+
+	return hash, nil
+}
+
+// purgePrivateValue deletes a private value along with its history on the collection's peers
+func (s *SmartContract) purgePrivateValue(
+	ctx contractapi.TransactionContextInterface,
+	ref *PrivateDataRef,
+	key string,
+) error {
+	err := ctx.GetStub().PurgePrivateData(ref.Collection, key)
+	if err != nil {
+		return fmt.Errorf("failed to purge private data: %v", err)
+	}
+	return nil
+}
+
+// publicIPFSHash is a record's CID where it may appear in events and transaction responses,
+// which are recorded in the block: empty when the CID is private
+func publicIPFSHash(metadata *EHRMetadata) string {
+	if metadata.PrivateData != nil && metadata.PrivateData.IPFSHash {
+		return ""
+	}
+	return metadata.IPFSHash
+}
+
+// privateCollection names the private data collection of an organization
+func privateCollection(mspID string) string {
+	return mspID + privateCollectionSuffix
+}
+
+// privateDataHash is the hex SHA-256 of a private value
+func privateDataHash(value []byte) string {
+	digest := sha256.Sum256(value)
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// privateRecordTransient returns the transient map passing a record's key and CID privately
+func privateRecordTransient(t *testing.T, encryptedKey string, ipfsHash string) map[string][]byte {
+	inputJSON, err := json.Marshal(privateRecordInput{EncryptedKey: encryptedKey, IPFSHash: ipfsHash})
+	assert.NoError(t, err)
+	return map[string][]byte{privateRecordTransientKey: inputJSON}
+}
+
+// TestPrivateRecordData tests that key material passed privately is kept in the collections of
+// the organizations that use it, with only hashes on the public ledger
+func TestPrivateRecordData(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newPrivateDataContext(stub, patientIdentity("patient123"))
+	doctorCtx := newPrivateDataContext(stub, doctorIdentity("doctor456"))
+	adminCtx := newPrivateDataContext(stub, adminIdentity("admin1"))
+	patientCollection := privateCollection("PatientMSP")
+	hospitalCollection := privateCollection("HospitalMSP")
+
+	// The key cannot be passed both ways
+	transient := privateRecordTransient(t, "patient key", testCID("EHR-001"))
+	err := inTxWithTransient(stub, "tx1", transient, func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", "", "public key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, `"field":"encryptedKey"`)
+
+	// Key material only goes to the caller's own collection
+	inputJSON, err := json.Marshal(privateRecordInput{EncryptedKey: "patient key", MSPID: "HospitalMSP"})
+	assert.NoError(t, err)
+	err = inTxWithTransient(stub, "tx1a", map[string][]byte{privateRecordTransientKey: inputJSON}, func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "unauthorized: PatientMSP cannot place record EHR-001 in the collection of HospitalMSP")
+	assert.Empty(t, stub.PvtState[hospitalCollection])
+
+	err = inTxWithTransient(stub, "tx2", transient, func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", "", "", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	// Only the hash is public
+	assert.NotContains(t, string(stub.State["EHR-001"]), "patient key")
+	assert.NotContains(t, string(stub.State["EHR-001"]), testCID("EHR-001"))
+	assert.Contains(t, stub.PvtState[patientCollection], "EHR-001")
+
+	// Members of the collection read the record in full, others see the public record
+	metadata, err := s.QueryEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "patient key", metadata.EncryptedKey)
+	assert.Equal(t, testCID("EHR-001"), metadata.IPFSHash)
+	assert.Equal(t, patientCollection, metadata.PrivateData.Collection)
+
+	provenance, err := s.VerifyRecordProvenance(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+
+	metadata, err = s.QueryEHR(adminCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Empty(t, metadata.EncryptedKey)
+	assert.Empty(t, metadata.IPFSHash)
+
+	// Keys wrapped for a doctor go to the collection of the doctor's organization
+	keyID, err := registerEncryptionKey(s, stub, "tx3", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTxWithTransient(stub, "tx4", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor456", "*"), "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Len(t, stub.PvtState[hospitalCollection], 1)
+
+	grant, err := getMyRecordKey(s, stub, "tx-get-key1", doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, hospitalCollection, grant.PrivateData.Collection)
+	assert.NotEmpty(t, grant.WrappedKey)
+
+	grants, err := s.granteeRecordKeys(patientCtx, "doctor456")
+	assert.NoError(t, err)
+	if assert.Len(t, grants, 1) {
+		assert.Empty(t, grants[0].WrappedKey, "the patient's organization cannot read the doctor's collection")
+	}
+
+	// Hashes check the collections from any organization
+	checks, err := s.VerifyPrivateData(adminCtx, "EHR-001")
+	assert.NoError(t, err)
+	if assert.Len(t, checks, 2) {
+		assert.True(t, checks[0].Valid)
+		assert.Equal(t, "doctor456", checks[1].GranteeID)
+		assert.True(t, checks[1].Valid)
+	}
+
+	original := stub.PvtState[patientCollection]["EHR-001"]
+	stub.PvtState[patientCollection]["EHR-001"] = []byte(`{"recordId":"EHR-001","encryptedKey":"forged"}`)
+
+	checks, err = s.VerifyPrivateData(adminCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.False(t, checks[0].Valid)
+
+	_, err = s.QueryEHR(patientCtx, "EHR-001")
+	assert.ErrorContains(t, err, "does not match its hash")
+	stub.PvtState[patientCollection]["EHR-001"] = original
+
+	// New versions of a private record stay private
+	err = inTx(stub, "tx5", func() error {
+		return s.AmendEHR(patientCtx, "EHR-001", "EHR-001-v2", testCID("EHR-001-v2"), "public key", testChecksum("EHR-001-v2"), "Corrected value",
+			testSignature(patientCtx, "EHR-001-v2", "patient123", testCID("EHR-001-v2"), testChecksum("EHR-001-v2"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "keeps its key in private data")
+
+	err = inTxWithTransient(stub, "tx6", privateRecordTransient(t, "patient key v2", testCID("EHR-001-v2")), func() error {
+		return s.AmendEHR(patientCtx, "EHR-001", "EHR-001-v2", "", "", testChecksum("EHR-001-v2"), "Corrected value",
+			testSignature(patientCtx, "EHR-001-v2", "patient123", testCID("EHR-001-v2"), testChecksum("EHR-001-v2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stub.State["EHR-001-v2"]), testCID("EHR-001-v2"))
+
+	// Marking the old version superseded leaves its private data as it was
+	metadata, err = s.readEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "EHR-001-v2", metadata.SupersededBy)
+	assert.Equal(t, "patient key", metadata.EncryptedKey)
+
+	// Erasure purges the collections and keeps private CIDs out of the event
+	err = inTx(stub, "tx7", func() error {
+		return s.EraseEHR(adminCtx, "EHR-001", "GDPR Art. 17 request")
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, stub.PvtState[patientCollection])
+	assert.Empty(t, stub.PvtState[hospitalCollection])
+
+	event := <-stub.ChaincodeEventsChannel
+	assert.Equal(t, EventEHRErased, event.EventName)
+	var payload EHRErasedEvent
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Empty(t, payload.IPFSHashes)
+}
+
+// TestRotatePrivateRecordKey tests that rotating the key of a private record keeps the new key
+// and CID private
+func TestRotatePrivateRecordKey(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newPrivateDataContext(stub, patientIdentity("patient123"))
+	doctorCtx := newPrivateDataContext(stub, doctorIdentity("doctor456"))
+	patientCollection := privateCollection("PatientMSP")
+
+	err := inTxWithTransient(stub, "tx1", privateRecordTransient(t, "patient key", testCID("EHR-001")), func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", "", "", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	keyID, err := registerEncryptionKey(s, stub, "tx2", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTxWithTransient(stub, "tx3", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor456", "EHR-001"), "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// The new key of a private record comes privately as well
+	err = inTxWithTransient(stub, "tx4", rotatedKeysTransient(t, map[string]string{"doctor456": keyID}), func() error {
+		_, err := s.RotateRecordKey(patientCtx, "EHR-001", testCID("rotated"), "new patient key", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.ErrorContains(t, err, "keeps its key in private data")
+
+	transient := rotatedKeysTransient(t, map[string]string{"doctor456": keyID})
+	transient[privateRecordTransientKey] = privateRecordTransient(t, "new patient key", testCID("rotated"))[privateRecordTransientKey]
+	var rotated *EHRMetadata
+	err = inTxWithTransient(stub, "tx5", transient, func() error {
+		var err error
+		rotated, err = s.RotateRecordKey(patientCtx, "EHR-001", "", "", testChecksum("EHR-001"), "Key compromise")
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, rotated.EncryptedKey, "responses are recorded in the block")
+	assert.Empty(t, rotated.IPFSHash)
+	assert.Empty(t, rotated.KeyRotation.SignedIPFSHash)
+	assert.NotContains(t, string(stub.State["EHR-001"]), testCID("EHR-001"))
+	assert.NotContains(t, string(stub.State["EHR-001"]), testCID("rotated"))
+
+	event := <-stub.ChaincodeEventsChannel
+	var payload RecordKeyRotatedEvent
+	assert.NoError(t, json.Unmarshal(event.Payload, &payload))
+	assert.Empty(t, payload.IPFSHash)
+	assert.Empty(t, payload.PreviousIPFSHash)
+
+	metadata, err := s.QueryEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "new patient key", metadata.EncryptedKey)
+	assert.Equal(t, testCID("rotated"), metadata.IPFSHash)
+	assert.Equal(t, testCID("EHR-001"), metadata.KeyRotation.SignedIPFSHash)
+	assert.Equal(t, patientCollection, metadata.PrivateData.Collection)
+
+	provenance, err := s.VerifyRecordProvenance(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+
+	grant, err := getMyRecordKey(s, stub, "tx-get-key2", doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, grant.KeyVersion)
+	assert.NotEmpty(t, grant.WrappedKey)
+}
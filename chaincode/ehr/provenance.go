@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Certificate statuses at signing time
+const (
+	CertificateValid       = "VALID"
+	CertificateExpired     = "EXPIRED"
+	CertificateNotYetValid = "NOT_YET_VALID"
+	CertificateUnsigned    = "UNSIGNED" // Records created before author signatures
+)
+
+// recordSignatureDomain prefixes the signed message so record signatures cannot be replayed elsewhere
+const recordSignatureDomain = "medledger-record-signature-v1"
+
+// RecordSignature is the author's signature over a record digest and the certificate that made it
+type RecordSignature struct {
+	Signature   string    `json:"signature"`   // Base64 signature over the record digest
+	Certificate string    `json:"certificate"` // PEM certificate of the author at signing time
+	SignedAt    time.Time `json:"signedAt"`
+}
+
+// RecordProvenance is the result of verifying a record's author signature
+type RecordProvenance struct {
+	RecordID               string    `json:"recordId"`
+	Version                int       `json:"version"`
+	Digest                 string    `json:"digest"` // Hex SHA-256 of the signed message
+	SignatureValid         bool      `json:"signatureValid"`
+	SignerID               string    `json:"signerId"`
+	SignerMSPID            string    `json:"signerMspId"`
+	CertificateSubject     string    `json:"certificateSubject"`
+	CertificateIssuer      string    `json:"certificateIssuer"`
+	CertificateSerial      string    `json:"certificateSerial"`
+	CertificateFingerprint string    `json:"certificateFingerprint"` // Hex SHA-256 of the DER certificate
+	NotBefore              time.Time `json:"notBefore"`
+	NotAfter               time.Time `json:"notAfter"`
+	SignedAt               time.Time `json:"signedAt"`
+	CertificateStatus      string    `json:"certificateStatus"` // At signing time
+}
+
+// VerifyRecordProvenance checks the author signature of one version of a record and reports who
+// signed it and whether their certificate was valid when they did
+func (s *SmartContract) VerifyRecordProvenance(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*RecordProvenance, error) {
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireNotErased(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkRecordAccess(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := recordDigest(metadata)
+	provenance := &RecordProvenance{
+		RecordID:          metadata.RecordID,
+		Version:           metadata.Version,
+		Digest:            hex.EncodeToString(digest),
+		SignerID:          metadata.CreatedBy,
+		SignerMSPID:       metadata.AuthorOrg,
+		CertificateStatus: CertificateUnsigned,
+	}
+	if metadata.AuthorSignature == nil {
+		return provenance, nil
+	}
+
+	cert, err := parseCertificatePEM(metadata.AuthorSignature.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	provenance.CertificateSubject = cert.Subject.String()
+	provenance.CertificateIssuer = cert.Issuer.String()
+	provenance.CertificateSerial = cert.SerialNumber.String()
+	provenance.CertificateFingerprint = hex.EncodeToString(fingerprint[:])
+	provenance.NotBefore = cert.NotBefore
+	provenance.NotAfter = cert.NotAfter
+	provenance.SignedAt = metadata.AuthorSignature.SignedAt
+	provenance.CertificateStatus = certificateStatus(cert, metadata.AuthorSignature.SignedAt)
+	provenance.SignatureValid = verifyDigestSignature(cert, digest, metadata.AuthorSignature.Signature) == nil
+
+	return provenance, nil
+}
+
+// signRecord verifies the caller's signature over a record and attaches it with their certificate
+func (s *SmartContract) signRecord(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+	signature string,
+) error {
+	if signature == "" {
+		return fmt.Errorf("author signature is required")
+	}
+
+	cert, err := ctx.GetClientIdentity().GetX509Certificate()
+	if err != nil {
+		return fmt.Errorf("failed to get caller certificate: %v", err)
+	}
+	if cert == nil {
+		return fmt.Errorf("caller has no X.509 certificate to verify the author signature")
+	}
+
+	status := certificateStatus(cert, metadata.Timestamp)
+	if status != CertificateValid {
+		return fmt.Errorf("author certificate is %s at signing time", strings.ToLower(status))
+	}
+
+	err = verifyDigestSignature(cert, recordDigest(metadata), signature)
+	if err != nil {
+		return fmt.Errorf("invalid author signature for record %s: %v", metadata.RecordID, err)
+	}
+
+	metadata.AuthorSignature = &RecordSignature{
+		Signature:   signature,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		SignedAt:    metadata.Timestamp,
+	}
+
+	return nil
+}
+
+// recordDigest hashes the canonical form of the fields an author vouches for: one per line,
+// after the domain prefix. Validation guarantees none of them contain a newline. Records of
+// merged patients are verified against the patient ID they were signed for.
+func recordDigest(metadata *EHRMetadata) []byte {
+	patientID := metadata.PatientID
+	if metadata.MergedFrom != "" {
+		patientID = metadata.MergedFrom
+	}
+
+	// After a key rotation the signature still covers the file the author signed
+	ipfsHash, checksum := metadata.IPFSHash, metadata.Checksum
+	if metadata.KeyRotation != nil {
+		ipfsHash, checksum = metadata.KeyRotation.SignedIPFSHash, metadata.KeyRotation.SignedChecksum
+	}
+
+	message := strings.Join([]string{
+		recordSignatureDomain,
+		metadata.RecordID,
+		patientID,
+		ipfsHash,
+		checksum,
+		metadata.RecordType,
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(message))
+	return digest[:]
+}
+
+// verifyDigestSignature checks a base64 signature over a SHA-256 digest with a certificate's key
+func verifyDigestSignature(cert *x509.Certificate, digest []byte, signature string) error {
+	return verifyPublicKeySignature(cert.PublicKey, digest, signature)
+}
+
+// verifyPublicKeySignature checks a base64 signature over a SHA-256 digest: ASN.1 ECDSA (Fabric's
+// default), PKCS #1 v1.5 RSA, or Ed25519 over the digest bytes
+func verifyPublicKeySignature(key crypto.PublicKey, digest []byte, signature string) error {
+	signatureBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not valid base64: %v", err)
+	}
+
+	switch publicKey := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(publicKey, digest, signatureBytes) {
+			return fmt.Errorf("signature does not match")
+		}
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest, signatureBytes)
+		if err != nil {
+			return fmt.Errorf("signature does not match")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, digest, signatureBytes) {
+			return fmt.Errorf("signature does not match")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+
+	return nil
+}
+
+// certificateStatus reports whether a certificate was within its validity period at a given time
+func certificateStatus(cert *x509.Certificate, at time.Time) string {
+	if at.Before(cert.NotBefore) {
+		return CertificateNotYetValid
+	}
+	if at.After(cert.NotAfter) {
+		return CertificateExpired
+	}
+	return CertificateValid
+}
+
+// parseCertificatePEM decodes a stored PEM certificate
+func parseCertificatePEM(certificatePEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certificatePEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode author certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse author certificate: %v", err)
+	}
+
+	return cert, nil
+}
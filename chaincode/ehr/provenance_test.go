@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRecordProvenance tests that records carry a verified author signature
+func TestRecordProvenance(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	otherCtx := newTestContext(stub, patientIdentity("patient999"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	ipfsHash := testCID("lab")
+	checksum := testChecksum("lab")
+
+	// Signatures from another key or over other content are rejected
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", ipfsHash, "key1", "Lab Report", checksum,
+			testSignature(otherCtx, "EHR-001", "patient123", ipfsHash, checksum, "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "invalid author signature")
+
+	err = inTx(stub, "tx2", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", ipfsHash, "key1", "Lab Report", checksum,
+			testSignature(ctx, "EHR-001", "patient123", ipfsHash, testChecksum("other"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "invalid author signature")
+
+	err = inTx(stub, "tx3", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", ipfsHash, "key1", "Lab Report", checksum, "")
+	})
+	assert.ErrorContains(t, err, "author signature is required")
+
+	err = inTx(stub, "tx4", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", ipfsHash, "key1", "Lab Report", checksum,
+			testSignature(ctx, "EHR-001", "patient123", ipfsHash, checksum, "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	provenance, err := s.VerifyRecordProvenance(ctx, "EHR-001")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+	assert.Equal(t, "patient123", provenance.SignerID)
+	assert.Equal(t, "PatientMSP", provenance.SignerMSPID)
+	assert.Equal(t, "CN=patient123", provenance.CertificateSubject)
+	assert.Equal(t, CertificateValid, provenance.CertificateStatus)
+	assert.Len(t, provenance.CertificateFingerprint, 64)
+
+	// Doctors need consent to inspect provenance
+	_, err = s.VerifyRecordProvenance(doctorCtx, "EHR-001")
+	assert.Error(t, err)
+
+	// Tampering with a signed field breaks the signature
+	state, _ := stub.GetState("EHR-001")
+	var metadata EHRMetadata
+	assert.NoError(t, json.Unmarshal(state, &metadata))
+	metadata.Checksum = testChecksum("tampered")
+	tampered, _ := json.Marshal(metadata)
+	stub.State["EHR-001"] = tampered
+
+	provenance, err = s.VerifyRecordProvenance(ctx, "EHR-001")
+	assert.NoError(t, err)
+	assert.False(t, provenance.SignatureValid)
+
+	// Records written before signatures are reported as unsigned
+	metadata.RecordID = "EHR-000"
+	metadata.AuthorSignature = nil
+	legacy, _ := json.Marshal(metadata)
+	stub.State["EHR-000"] = legacy
+
+	provenance, err = s.VerifyRecordProvenance(ctx, "EHR-000")
+	assert.NoError(t, err)
+	assert.False(t, provenance.SignatureValid)
+	assert.Equal(t, CertificateUnsigned, provenance.CertificateStatus)
+
+	// Amendments are signed by their own author
+	err = grantWriteConsent(s, stub, "tx5", "patient123", "doctor456")
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx6", func() error {
+		return s.CreateEHRMetadata(doctorCtx, "EHR-002", "patient123", ipfsHash, "key2", "Lab Report", checksum,
+			testSignature(doctorCtx, "EHR-002", "patient123", ipfsHash, checksum, "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx7", func() error {
+		return s.AmendEHR(doctorCtx, "EHR-002", "EHR-002-v2", testCID("lab2"), "key3", testChecksum("lab2"), "Corrected",
+			testSignature(ctx, "EHR-002-v2", "patient123", testCID("lab2"), testChecksum("lab2"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "invalid author signature")
+
+	err = inTx(stub, "tx8", func() error {
+		return s.AmendEHR(doctorCtx, "EHR-002", "EHR-002-v2", testCID("lab2"), "key3", testChecksum("lab2"), "Corrected",
+			testSignature(doctorCtx, "EHR-002-v2", "patient123", testCID("lab2"), testChecksum("lab2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	provenance, err = s.VerifyRecordProvenance(ctx, "EHR-002-v2")
+	assert.NoError(t, err)
+	assert.True(t, provenance.SignatureValid)
+	assert.Equal(t, "doctor456", provenance.SignerID)
+	assert.Equal(t, "CN=doctor456", provenance.CertificateSubject)
+}
+
+// TestCertificateStatus tests validity at signing time
+func TestCertificateStatus(t *testing.T) {
+	cert := patientIdentity("patient123").cert
+
+	assert.Equal(t, CertificateValid, certificateStatus(cert, time.Now()))
+	assert.Equal(t, CertificateNotYetValid, certificateStatus(cert, cert.NotBefore.Add(-time.Second)))
+	assert.Equal(t, CertificateExpired, certificateStatus(cert, cert.NotAfter.Add(time.Second)))
+}
@@ -0,0 +1,580 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"time"
+
+	"github.com/ehr-blockchain/chaincode/pre"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Public key usages. Encryption keys wrap record keys and must be RSA for RSA-OAEP.
+// Re-encryption keys receive re-encrypted record keys and must be PRE keys.
+const (
+	KeyUsageEncryption   = "encryption"
+	KeyUsageSigning      = "signing"
+	KeyUsageReEncryption = "reencryption"
+)
+
+// Public key statuses
+const (
+	PublicKeyActive  = "ACTIVE"
+	PublicKeyRotated = "ROTATED" // Replaced by a newer key, kept to attribute old wraps
+	PublicKeyRevoked = "REVOKED"
+)
+
+// Public key algorithms
+const (
+	KeyAlgorithmRSA     = "RSA"
+	KeyAlgorithmECDSA   = "ECDSA"
+	KeyAlgorithmEd25519 = "Ed25519"
+	KeyAlgorithmPRE     = "PRE"
+)
+
+// Public key limits
+const (
+	maxPublicKeyLength = 4096
+	maxKeyValidityDays = 3650
+	minRSAKeyBits      = 2048
+	maxKeyRevokeReason = 1024
+)
+
+const (
+	publicKeyObjectType       = "publicKey"
+	publicKeyFingerprintIndex = "publickey~fingerprint"
+)
+
+// PublicKeyEntry is a user's public key in the directory. Entries are never deleted, so a key
+// fingerprint found on an old wrap can always be attributed to its owner.
+type PublicKeyEntry struct {
+	KeyID        string    `json:"keyId"` // Hex SHA-256 of the DER SubjectPublicKeyInfo
+	UserID       string    `json:"userId"`
+	MSPID        string    `json:"mspId"`     // Organization of the user, whose collection holds keys wrapped to this key
+	PublicKey    string    `json:"publicKey"` // PEM PUBLIC KEY, or PRE PUBLIC KEY
+	Algorithm    string    `json:"algorithm"` // RSA, ECDSA, Ed25519 or PRE
+	KeySize      int       `json:"keySize"`   // Bits of the modulus or curve
+	Curve        string    `json:"curve,omitempty" metadata:",optional"`
+	Usage        string    `json:"usage"` // encryption, signing or reencryption
+	Status       string    `json:"status"`
+	NotBefore    time.Time `json:"notBefore"`
+	NotAfter     time.Time `json:"notAfter"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	Replaces     string    `json:"replaces,omitempty" metadata:",optional"`   // Key ID this key rotated out
+	ReplacedBy   string    `json:"replacedBy,omitempty" metadata:",optional"` // Key ID that rotated this key out
+	RevokedAt    time.Time `json:"revokedAt"`                                 // Zero unless revoked
+	RevokedBy    string    `json:"revokedBy,omitempty" metadata:",optional"`
+	RevokeReason string    `json:"revokeReason,omitempty" metadata:",optional"`
+}
+
+// RegisterPublicKey adds a public key for the caller. A user has at most one active key per usage;
+// use RotatePublicKey to replace it.
+func (s *SmartContract) RegisterPublicKey(
+	ctx contractapi.TransactionContextInterface,
+	publicKey string,
+	usage string,
+	validDays int,
+) (*PublicKeyEntry, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := newPublicKeyEntry(callerID, publicKey, usage, validDays, now)
+	if err != nil {
+		return nil, err
+	}
+	entry.MSPID = callerOrg
+
+	active, err := s.activePublicKey(ctx, callerID, usage)
+	if err != nil {
+		return nil, err
+	}
+	if active != nil {
+		return nil, fmt.Errorf("caller already has active %s key %s, rotate it instead", usage, active.KeyID)
+	}
+
+	err = s.addPublicKey(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionRegisterPublicKey, callerID, callerID, "", "", true,
+		fmt.Sprintf("Registered %s %s key %s", entry.Algorithm, usage, entry.KeyID))
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// RotatePublicKey replaces one of the caller's active keys with a new key of the same usage. The
+// old key stays in the directory as rotated.
+func (s *SmartContract) RotatePublicKey(
+	ctx contractapi.TransactionContextInterface,
+	keyID string,
+	newPublicKey string,
+	validDays int,
+) (*PublicKeyEntry, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	old, err := s.getPublicKey(ctx, callerID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if old.Status != PublicKeyActive {
+		return nil, fmt.Errorf("public key %s is %s", keyID, old.Status)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := newPublicKeyEntry(callerID, newPublicKey, old.Usage, validDays, now)
+	if err != nil {
+		return nil, err
+	}
+	entry.MSPID = callerOrg
+	entry.Replaces = old.KeyID
+
+	old.Status = PublicKeyRotated
+	old.ReplacedBy = entry.KeyID
+
+	err = s.putPublicKey(ctx, old)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.addPublicKey(ctx, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionRotatePublicKey, callerID, callerID, "", "", true,
+		fmt.Sprintf("Rotated %s key %s to %s", old.Usage, old.KeyID, entry.KeyID))
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// RevokePublicKey marks a key as no longer to be used, for example after it was compromised.
+// Users revoke their own keys; admins revoke anyone's.
+func (s *SmartContract) RevokePublicKey(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	keyID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return fmt.Errorf("revocation reason is required")
+	}
+	if len(reason) > maxKeyRevokeReason {
+		return fmt.Errorf("revocation reason must be at most %d characters", maxKeyRevokeReason)
+	}
+
+	entry, err := s.getPublicKey(ctx, userID, keyID)
+	if err != nil {
+		return err
+	}
+	if entry.Status == PublicKeyRevoked {
+		return fmt.Errorf("public key %s has already been revoked", keyID)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	entry.Status = PublicKeyRevoked
+	entry.RevokedAt = now
+	entry.RevokedBy = callerID
+	entry.RevokeReason = reason
+
+	err = s.putPublicKey(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionRevokePublicKey, callerID, userID, "", "", true,
+		fmt.Sprintf("Revoked %s key %s: %s", entry.Usage, keyID, reason))
+}
+
+// GetPublicKeys returns every key a user registered, including rotated and revoked ones
+func (s *SmartContract) GetPublicKeys(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+) ([]*PublicKeyEntry, error) {
+	return s.userPublicKeys(ctx, userID)
+}
+
+// GetActivePublicKey returns a user's current key for a usage
+func (s *SmartContract) GetActivePublicKey(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	usage string,
+) (*PublicKeyEntry, error) {
+	entry, err := s.activePublicKey(ctx, userID, usage)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("user %s has no active %s key", userID, usage)
+	}
+
+	return entry, nil
+}
+
+// GetPublicKeyByID returns the key with a fingerprint, whatever its status, to attribute a wrap
+func (s *SmartContract) GetPublicKeyByID(
+	ctx contractapi.TransactionContextInterface,
+	keyID string,
+) (*PublicKeyEntry, error) {
+	userIDs, err := s.indexEntries(ctx, publicKeyFingerprintIndex, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(userIDs) == 0 {
+		return nil, fmt.Errorf("public key %s is not registered", keyID)
+	}
+
+	return s.getPublicKey(ctx, userIDs[0], keyID)
+}
+
+// requireEncryptionKey checks that a key ID is a user's active encryption key and in its validity
+// period, and returns its entry
+func (s *SmartContract) requireEncryptionKey(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	keyID string,
+) (*PublicKeyEntry, error) {
+	return s.requireKeyInEffect(ctx, userID, keyID, KeyUsageEncryption)
+}
+
+// requireKeyInEffect checks that a key ID is one of a user's keys for a usage, active and in its
+// validity period, and returns its entry
+func (s *SmartContract) requireKeyInEffect(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	keyID string,
+	usage string,
+) (*PublicKeyEntry, error) {
+	entry, err := s.readPublicKey(ctx, userID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil || entry.Usage != usage {
+		return nil, fmt.Errorf("key %s is not a registered %s key of %s", keyID, usage, userID)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !publicKeyInEffect(entry, now) {
+		return nil, fmt.Errorf("key %s of %s is %s", keyID, userID, publicKeyState(entry, now))
+	}
+
+	return entry, nil
+}
+
+// activePublicKey returns a user's key in effect for a usage, or nil
+func (s *SmartContract) activePublicKey(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	usage string,
+) (*PublicKeyEntry, error) {
+	entries, err := s.userPublicKeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Usage == usage && publicKeyInEffect(entry, now) {
+			return entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// userPublicKeys lists every key a user registered
+func (s *SmartContract) userPublicKeys(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+) ([]*PublicKeyEntry, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(publicKeyObjectType, []string{userID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public keys: %v", err)
+	}
+	defer iterator.Close()
+
+	entries := []*PublicKeyEntry{}
+	for iterator.HasNext() {
+		result, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public keys: %v", err)
+		}
+
+		var entry PublicKeyEntry
+		err = json.Unmarshal(result.Value, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal public key: %v", err)
+		}
+		entries = append(entries, &entry)
+	}
+
+	return entries, nil
+}
+
+// getPublicKey loads a user's key, failing if it does not exist
+func (s *SmartContract) getPublicKey(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	keyID string,
+) (*PublicKeyEntry, error) {
+	entry, err := s.readPublicKey(ctx, userID, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("public key %s of %s %w", keyID, userID, errNotFound)
+	}
+
+	return entry, nil
+}
+
+// readPublicKey loads a user's key, or nil if it does not exist
+func (s *SmartContract) readPublicKey(
+	ctx contractapi.TransactionContextInterface,
+	userID string,
+	keyID string,
+) (*PublicKeyEntry, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(publicKeyObjectType, []string{userID, keyID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	entryJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if entryJSON == nil {
+		return nil, nil
+	}
+
+	var entry PublicKeyEntry
+	err = json.Unmarshal(entryJSON, &entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal public key: %v", err)
+	}
+
+	return &entry, nil
+}
+
+// addPublicKey saves a new key, which no user may have registered before
+func (s *SmartContract) addPublicKey(
+	ctx contractapi.TransactionContextInterface,
+	entry *PublicKeyEntry,
+) error {
+	owners, err := s.indexEntries(ctx, publicKeyFingerprintIndex, entry.KeyID)
+	if err != nil {
+		return err
+	}
+	if len(owners) > 0 {
+		return fmt.Errorf("public key %s is already registered", entry.KeyID)
+	}
+
+	err = s.putPublicKey(ctx, entry)
+	if err != nil {
+		return err
+	}
+
+	return s.putIndexEntry(ctx, publicKeyFingerprintIndex, entry.KeyID, entry.UserID)
+}
+
+// putPublicKey saves a user's key
+func (s *SmartContract) putPublicKey(
+	ctx contractapi.TransactionContextInterface,
+	entry *PublicKeyEntry,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(publicKeyObjectType, []string{entry.UserID, entry.KeyID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal public key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, entryJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return nil
+}
+
+// newPublicKeyEntry validates a key for a usage and describes it, valid from now
+func newPublicKeyEntry(userID string, publicKeyPEM string, usage string, validDays int, now time.Time) (*PublicKeyEntry, error) {
+	var errs ValidationErrors
+	publicKey, keyID, err := parsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		errs.add("publicKey", "%v", err)
+	}
+	if usage != KeyUsageEncryption && usage != KeyUsageSigning && usage != KeyUsageReEncryption {
+		errs.add("usage", "must be %s, %s or %s", KeyUsageEncryption, KeyUsageSigning, KeyUsageReEncryption)
+	}
+	if validDays <= 0 || validDays > maxKeyValidityDays {
+		errs.add("validDays", "must be between 1 and %d", maxKeyValidityDays)
+	}
+
+	entry := &PublicKeyEntry{
+		KeyID:     keyID,
+		UserID:    userID,
+		PublicKey: publicKeyPEM,
+		Usage:     usage,
+		Status:    PublicKeyActive,
+	}
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		entry.Algorithm = KeyAlgorithmRSA
+		entry.KeySize = key.N.BitLen()
+		if entry.KeySize < minRSAKeyBits {
+			errs.add("publicKey", "RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+	case *ecdsa.PublicKey:
+		entry.Algorithm = KeyAlgorithmECDSA
+		entry.KeySize = key.Curve.Params().BitSize
+		entry.Curve = key.Curve.Params().Name
+	case ed25519.PublicKey:
+		entry.Algorithm = KeyAlgorithmEd25519
+		entry.KeySize = 256
+	case *pre.PublicKey:
+		entry.Algorithm = KeyAlgorithmPRE
+		entry.KeySize = pre.KeySize
+	}
+	if usage == KeyUsageEncryption && publicKey != nil && entry.Algorithm != KeyAlgorithmRSA {
+		errs.add("publicKey", "encryption keys must be RSA")
+	}
+	if publicKey != nil && (usage == KeyUsageReEncryption) != (entry.Algorithm == KeyAlgorithmPRE) {
+		errs.add("publicKey", "%s keys must be PRE keys, and PRE keys only serve %s", KeyUsageReEncryption, KeyUsageReEncryption)
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return nil, err
+	}
+
+	entry.NotBefore = now
+	entry.NotAfter = now.AddDate(0, 0, validDays)
+	entry.RegisteredAt = now
+
+	return entry, nil
+}
+
+// publicKeyInEffect checks that a key is active and in its validity period
+func publicKeyInEffect(entry *PublicKeyEntry, now time.Time) bool {
+	return publicKeyState(entry, now) == PublicKeyActive
+}
+
+// publicKeyState is the status of a key, or expired or not yet valid outside its validity period
+func publicKeyState(entry *PublicKeyEntry, now time.Time) string {
+	if entry.Status != PublicKeyActive {
+		return entry.Status
+	}
+	if now.Before(entry.NotBefore) {
+		return CertificateNotYetValid
+	}
+	if now.After(entry.NotAfter) {
+		return CertificateExpired
+	}
+	return PublicKeyActive
+}
+
+// parsePublicKeyPEM decodes a PEM PKIX public key of a supported type, or a PRE public key, and
+// returns it with its fingerprint, the hex SHA-256 of the DER SubjectPublicKeyInfo or PRE key
+func parsePublicKeyPEM(publicKeyPEM string) (crypto.PublicKey, string, error) {
+	if publicKeyPEM == "" {
+		return nil, "", fmt.Errorf("is required")
+	}
+	if len(publicKeyPEM) > maxPublicKeyLength {
+		return nil, "", fmt.Errorf("must be at most %d characters", maxPublicKeyLength)
+	}
+
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block != nil && block.Type == pre.PEMType {
+		publicKey, err := pre.ParsePublicKey(block.Bytes)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid PRE public key: %v", err)
+		}
+		digest := sha256.Sum256(block.Bytes)
+		return publicKey, hex.EncodeToString(digest[:]), nil
+	}
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, "", fmt.Errorf("must be a PEM encoded PUBLIC KEY")
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse public key: %v", err)
+	}
+
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, "", fmt.Errorf("unsupported public key type %T", publicKey)
+	}
+
+	digest := sha256.Sum256(block.Bytes)
+	return publicKey, hex.EncodeToString(digest[:]), nil
+}
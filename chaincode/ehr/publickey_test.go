@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestPublicKeyDirectory tests registering, rotating and revoking keys in the directory
+func TestPublicKeyDirectory(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	assert.NoError(t, err)
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	// Encryption keys must be RSA; EC keys can sign
+	err = inTx(stub, "tx1", func() error {
+		_, err := s.RegisterPublicKey(doctorCtx, ecPEM, KeyUsageEncryption, 365)
+		return err
+	})
+	assert.ErrorContains(t, err, "encryption keys must be RSA")
+
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.RegisterPublicKey(doctorCtx, "not a key", "wrapping", 0)
+		return err
+	})
+	assert.ErrorContains(t, err, `"field":"publicKey"`)
+	assert.ErrorContains(t, err, `"field":"usage"`)
+	assert.ErrorContains(t, err, `"field":"validDays"`)
+
+	var signing *PublicKeyEntry
+	err = inTx(stub, "tx3", func() error {
+		var err error
+		signing, err = s.RegisterPublicKey(doctorCtx, ecPEM, KeyUsageSigning, 365)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, KeyAlgorithmECDSA, signing.Algorithm)
+	assert.Equal(t, "P-256", signing.Curve)
+
+	oldKeyID, err := registerEncryptionKey(s, stub, "tx4", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	// One active key per usage, and no key registered twice
+	err = inTx(stub, "tx5", func() error {
+		_, err := s.RegisterPublicKey(doctorCtx, testRSAPublicKey("doctor456-next"), KeyUsageEncryption, 365)
+		return err
+	})
+	assert.ErrorContains(t, err, "rotate it instead")
+
+	err = inTx(stub, "tx6", func() error {
+		_, err := s.RegisterPublicKey(patientCtx, testRSAPublicKey("doctor456"), KeyUsageEncryption, 365)
+		return err
+	})
+	assert.ErrorContains(t, err, "already registered")
+
+	// Rotation keeps the old key for attribution
+	var rotated *PublicKeyEntry
+	err = inTx(stub, "tx7", func() error {
+		var err error
+		rotated, err = s.RotatePublicKey(doctorCtx, oldKeyID, testRSAPublicKey("doctor456-next"), 365)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, oldKeyID, rotated.Replaces)
+	assert.Equal(t, KeyAlgorithmRSA, rotated.Algorithm)
+	assert.Equal(t, minRSAKeyBits, rotated.KeySize)
+
+	active, err := s.GetActivePublicKey(patientCtx, "doctor456", KeyUsageEncryption)
+	assert.NoError(t, err)
+	assert.Equal(t, rotated.KeyID, active.KeyID)
+
+	old, err := s.GetPublicKeyByID(patientCtx, oldKeyID)
+	assert.NoError(t, err)
+	assert.Equal(t, "doctor456", old.UserID)
+	assert.Equal(t, PublicKeyRotated, old.Status)
+	assert.Equal(t, rotated.KeyID, old.ReplacedBy)
+
+	_, err = s.requireEncryptionKey(patientCtx, "doctor456", oldKeyID)
+	assert.ErrorContains(t, err, PublicKeyRotated)
+
+	keys, err := s.GetPublicKeys(patientCtx, "doctor456")
+	assert.NoError(t, err)
+	assert.Len(t, keys, 3)
+
+	// Users revoke their own keys, admins anyone's
+	err = inTx(stub, "tx8", func() error {
+		return s.RevokePublicKey(patientCtx, "doctor456", rotated.KeyID, "Not mine")
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx9", func() error {
+		return s.RevokePublicKey(adminCtx, "doctor456", rotated.KeyID, "Laptop stolen")
+	})
+	assert.NoError(t, err)
+
+	_, err = s.GetActivePublicKey(patientCtx, "doctor456", KeyUsageEncryption)
+	assert.ErrorContains(t, err, "no active encryption key")
+
+	_, err = s.requireEncryptionKey(patientCtx, "doctor456", rotated.KeyID)
+	assert.ErrorContains(t, err, PublicKeyRevoked)
+
+	err = inTx(stub, "tx10", func() error {
+		_, err := s.RotatePublicKey(doctorCtx, rotated.KeyID, testRSAPublicKey("doctor456-third"), 365)
+		return err
+	})
+	assert.ErrorContains(t, err, "is REVOKED")
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
+// errUnauthorized is wrapped by the errors that refuse the caller
+var errUnauthorized = errors.New("unauthorized")
+
 // RequireRole checks if the caller has the required role
 func (s *SmartContract) RequireRole(
 	ctx contractapi.TransactionContextInterface,
@@ -17,7 +21,7 @@ func (s *SmartContract) RequireRole(
 	}
 
 	if role != requiredRole {
-		return fmt.Errorf("unauthorized: requires role %s, got %s", requiredRole, role)
+		return fmt.Errorf("%w: requires role %s, got %s", errUnauthorized, requiredRole, role)
 	}
 
 	return nil
@@ -39,7 +43,7 @@ func (s *SmartContract) RequireAnyRole(
 		}
 	}
 
-	return fmt.Errorf("unauthorized: requires one of roles %v, got %s", requiredRoles, role)
+	return fmt.Errorf("%w: requires one of roles %v, got %s", errUnauthorized, requiredRoles, role)
 }
 
 // IsPatient checks if the caller is a patient
@@ -94,7 +98,7 @@ func (s *SmartContract) RequirePatientOrAdmin(
 		return nil
 	}
 
-	return fmt.Errorf("unauthorized: must be patient or admin")
+	return fmt.Errorf("%w: must be patient or admin", errUnauthorized)
 }
 
 // RequireDoctorWithConsent ensures caller is a doctor with valid consent
@@ -110,7 +114,7 @@ func (s *SmartContract) RequireDoctorWithConsent(
 	}
 
 	if !isDoctor {
-		return fmt.Errorf("unauthorized: must be a doctor")
+		return fmt.Errorf("%w: must be a doctor", errUnauthorized)
 	}
 
 	// Get doctor ID
@@ -126,7 +130,7 @@ func (s *SmartContract) RequireDoctorWithConsent(
 	}
 
 	if !hasConsent {
-		return fmt.Errorf("unauthorized: no valid consent for this record")
+		return fmt.Errorf("%w: no valid consent for this record", errUnauthorized)
 	}
 
 	return nil
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Kantara Consent Receipt v1.1 constants
+const (
+	ReceiptVersion          = "KI-CR-v1.1.0"
+	ReceiptJurisdiction     = "US"
+	ReceiptLanguage         = "en"
+	ReceiptControllerName   = "EHR Blockchain Network"
+	ReceiptPolicyURL        = "urn:ehr-blockchain:policy:patient-consent"
+	ReceiptCollectionMethod = "GrantConsent chaincode transaction"
+	ReceiptIntegrityType    = "SHA-256"
+)
+
+// ConsentReceipt is a consent receipt structured per the Kantara Consent Receipt
+// Specification v1.1, extended with the grant details and its ledger anchor
+type ConsentReceipt struct {
+	Version          string              `json:"version"`
+	Jurisdiction     string              `json:"jurisdiction"`
+	ConsentTimestamp int64               `json:"consentTimestamp"`
+	CollectionMethod string              `json:"collectionMethod"`
+	ConsentReceiptID string              `json:"consentReceiptID"`
+	Language         string              `json:"language"`
+	PiiPrincipalID   string              `json:"piiPrincipalId"`
+	PiiControllers   []ReceiptController `json:"piiControllers"`
+	PolicyURL        string              `json:"policyUrl"`
+	Services         []ReceiptService    `json:"services"`
+	Sensitive        bool                `json:"sensitive"`
+	SpiCat           []string            `json:"spiCat"`
+	ConsentID        string              `json:"consentId"`
+	Grantee          string              `json:"grantee"`
+	Scope            string              `json:"scope"` // Record ID or "*"
+	ExpiryDate       time.Time           `json:"expiryDate"`
+	Anchor           ReceiptAnchor       `json:"anchor"`
+	Integrity        ReceiptIntegrity    `json:"integrity"`
+}
+
+// ReceiptController identifies the PII controller
+type ReceiptController struct {
+	PiiController string `json:"piiController"`
+	OnBehalf      bool   `json:"onBehalf"`
+	Contact       string `json:"contact"`
+}
+
+// ReceiptService lists the purposes consented to for a service
+type ReceiptService struct {
+	Service  string           `json:"service"`
+	Purposes []ReceiptPurpose `json:"purposes"`
+}
+
+// ReceiptPurpose describes a single consented purpose
+type ReceiptPurpose struct {
+	Purpose              string   `json:"purpose"`
+	PurposeCategory      []string `json:"purposeCategory"`
+	ConsentType          string   `json:"consentType"`
+	PiiCategory          []string `json:"piiCategory"`
+	PrimaryPurpose       bool     `json:"primaryPurpose"`
+	Termination          string   `json:"termination"`
+	ThirdPartyDisclosure bool     `json:"thirdPartyDisclosure"`
+	ThirdPartyName       string   `json:"thirdPartyName"`
+}
+
+// ReceiptAnchor records where the grant was committed and by which organization's
+// member. The block number is not known at endorsement time; clients resolve it
+// from the transaction ID.
+type ReceiptAnchor struct {
+	ChannelID    string    `json:"channelId"`
+	TxID         string    `json:"txId"`
+	TxTimestamp  time.Time `json:"txTimestamp"`
+	ReceiptKey   string    `json:"receiptKey"`
+	CreatorMSPID string    `json:"creatorMspId"`
+}
+
+// ReceiptIntegrity identifies the receipt's content. Receipts are not signed: the
+// chaincode holds no signing key, and the creator's proposal signature covers the
+// transient map, whose wrapped record keys must stay off the ledger. The digest is
+// a plain SHA-256 of the receipt with an empty digest, which anyone can recompute
+// after editing a receipt. A receipt is authentic only when its digest matches the
+// copy written by the granting transaction, which VerifyConsentReceipt checks
+// against the ledger.
+type ReceiptIntegrity struct {
+	Type   string `json:"type"`
+	Digest string `json:"digest"`
+}
+
+// ReceiptVerification is the result of checking a receipt against the ledger
+type ReceiptVerification struct {
+	ReceiptID     string    `json:"receiptId"`
+	ConsentID     string    `json:"consentId"`
+	Valid         bool      `json:"valid"`         // Receipt matches the ledger copy and is anchored
+	DigestMatches bool      `json:"digestMatches"` // Content matches the ledger copy
+	Anchored      bool      `json:"anchored"`      // Issuing transaction is in the consent's history
+	ConsentActive bool      `json:"consentActive"` // Consent is currently granted and unexpired
+	Revoked       bool      `json:"revoked"`
+	Expired       bool      `json:"expired"`
+	Superseded    bool      `json:"superseded"` // Consent changed after the receipt was issued
+	CheckedAt     time.Time `json:"checkedAt"`
+	Reasons       []string  `json:"reasons,omitempty" metadata:",optional"`
+}
+
+// consentHistoryEntry is a modification of a consent key
+type consentHistoryEntry struct {
+	TxID      string
+	Timestamp time.Time
+}
+
+// GetConsentReceipt retrieves a previously issued consent receipt
+func (s *SmartContract) GetConsentReceipt(
+	ctx contractapi.TransactionContextInterface,
+	receiptID string,
+) (*ConsentReceipt, error) {
+	receipt, err := s.readConsentReceipt(ctx, receiptID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, receipt.PiiPrincipalID)
+	if err != nil {
+		return nil, err
+	}
+
+	return receipt, nil
+}
+
+// VerifyConsentReceipt checks a receipt against current ledger state and history
+func (s *SmartContract) VerifyConsentReceipt(
+	ctx contractapi.TransactionContextInterface,
+	receiptJSON string,
+) (*ReceiptVerification, error) {
+	var receipt ConsentReceipt
+	err := json.Unmarshal([]byte(receiptJSON), &receipt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid consent receipt: %v", err)
+	}
+
+	stored, err := s.readConsentReceipt(ctx, receipt.ConsentReceiptID)
+	if err != nil {
+		return nil, err
+	}
+
+	var current *ConsentRecord
+	consentJSON, err := ctx.GetStub().GetState(stored.ConsentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if consentJSON != nil {
+		current = new(ConsentRecord)
+		err = json.Unmarshal(consentJSON, current)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal consent: %v", err)
+		}
+	}
+
+	historyIterator, err := ctx.GetStub().GetHistoryForKey(stored.ConsentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consent history: %v", err)
+	}
+	defer historyIterator.Close()
+
+	var history []consentHistoryEntry
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, consentHistoryEntry{
+			TxID:      modification.TxId,
+			Timestamp: modification.Timestamp.AsTime(),
+		})
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyConsentReceipt(&receipt, stored, current, history, now)
+}
+
+// issueConsentReceipt builds, stores and returns the receipt for a consent grant
+func (s *SmartContract) issueConsentReceipt(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) (*ConsentReceipt, error) {
+	stub := ctx.GetStub()
+
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+
+	mspID, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptID := stub.GetTxID()
+	receiptKey, err := stub.CreateCompositeKey("receipt", []string{receiptID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	purposeCategory := consent.Purposes
+	if len(purposeCategory) == 0 {
+		purposeCategory = []string{"TREAT"}
+	}
+
+	scopeDescription := "all health records"
+	if consent.RecordID != "*" && consent.RecordID != "" {
+		scopeDescription = "health record " + consent.RecordID
+	}
+
+	receipt := &ConsentReceipt{
+		Version:          ReceiptVersion,
+		Jurisdiction:     ReceiptJurisdiction,
+		ConsentTimestamp: txTimestamp.AsTime().Unix(),
+		CollectionMethod: ReceiptCollectionMethod,
+		ConsentReceiptID: receiptID,
+		Language:         ReceiptLanguage,
+		PiiPrincipalID:   consent.PatientID,
+		PiiControllers: []ReceiptController{{
+			PiiController: ReceiptControllerName,
+			OnBehalf:      false,
+			Contact:       mspID,
+		}},
+		PolicyURL: ReceiptPolicyURL,
+		Services: []ReceiptService{{
+			Service: "Electronic health record sharing",
+			Purposes: []ReceiptPurpose{{
+				Purpose:              fmt.Sprintf("Access to %s by %s", scopeDescription, consent.DoctorID),
+				PurposeCategory:      purposeCategory,
+				ConsentType:          "EXPLICIT",
+				PiiCategory:          []string{"Health"},
+				PrimaryPurpose:       true,
+				Termination:          fmt.Sprintf("On revocation or at %s", consent.ExpiryDate.UTC().Format(time.RFC3339)),
+				ThirdPartyDisclosure: true,
+				ThirdPartyName:       consent.DoctorID,
+			}},
+		}},
+		Sensitive:  true,
+		SpiCat:     []string{"Health"},
+		ConsentID:  consent.ConsentID,
+		Grantee:    consent.DoctorID,
+		Scope:      consent.RecordID,
+		ExpiryDate: consent.ExpiryDate,
+		Anchor: ReceiptAnchor{
+			ChannelID:    stub.GetChannelID(),
+			TxID:         receiptID,
+			TxTimestamp:  txTimestamp.AsTime(),
+			ReceiptKey:   receiptKey,
+			CreatorMSPID: mspID,
+		},
+		Integrity: ReceiptIntegrity{
+			Type: ReceiptIntegrityType,
+		},
+	}
+
+	receipt.Integrity.Digest, err = consentReceiptDigest(receipt)
+	if err != nil {
+		return nil, err
+	}
+
+	receiptJSON, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal consent receipt: %v", err)
+	}
+
+	err = stub.PutState(receiptKey, receiptJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put consent receipt: %v", err)
+	}
+
+	return receipt, nil
+}
+
+// readConsentReceipt loads a stored receipt by ID
+func (s *SmartContract) readConsentReceipt(
+	ctx contractapi.TransactionContextInterface,
+	receiptID string,
+) (*ConsentReceipt, error) {
+	receiptKey, err := ctx.GetStub().CreateCompositeKey("receipt", []string{receiptID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	receiptJSON, err := ctx.GetStub().GetState(receiptKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if receiptJSON == nil {
+		return nil, fmt.Errorf("consent receipt %s %w", receiptID, errNotFound)
+	}
+
+	var receipt ConsentReceipt
+	err = json.Unmarshal(receiptJSON, &receipt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal consent receipt: %v", err)
+	}
+
+	return &receipt, nil
+}
+
+// consentReceiptDigest hashes the receipt with its proof digest cleared
+func consentReceiptDigest(receipt *ConsentReceipt) (string, error) {
+	undigested := *receipt
+	undigested.Integrity.Digest = ""
+
+	undigestedJSON, err := json.Marshal(undigested)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal consent receipt: %v", err)
+	}
+
+	digest := sha256.Sum256(undigestedJSON)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// verifyConsentReceipt compares a presented receipt with the stored copy, the
+// current consent and the consent's modification history
+func verifyConsentReceipt(
+	presented *ConsentReceipt,
+	stored *ConsentReceipt,
+	current *ConsentRecord,
+	history []consentHistoryEntry,
+	now time.Time,
+) (*ReceiptVerification, error) {
+	result := &ReceiptVerification{
+		ReceiptID: presented.ConsentReceiptID,
+		ConsentID: stored.ConsentID,
+		CheckedAt: now,
+	}
+
+	digest, err := consentReceiptDigest(presented)
+	if err != nil {
+		return nil, err
+	}
+	result.DigestMatches = digest == presented.Integrity.Digest && digest == stored.Integrity.Digest
+	if !result.DigestMatches {
+		result.Reasons = append(result.Reasons, "receipt content does not match the ledger copy")
+	}
+
+	var anchoredAt time.Time
+	for _, entry := range history {
+		if entry.TxID == stored.Anchor.TxID {
+			result.Anchored = true
+			anchoredAt = entry.Timestamp
+		}
+	}
+	if result.Anchored {
+		for _, entry := range history {
+			if entry.TxID != stored.Anchor.TxID && entry.Timestamp.After(anchoredAt) {
+				result.Superseded = true
+			}
+		}
+	} else {
+		result.Reasons = append(result.Reasons, "issuing transaction not found in consent history")
+	}
+	if result.Superseded {
+		result.Reasons = append(result.Reasons, "consent was modified after this receipt was issued")
+	}
+
+	if current == nil {
+		result.Reasons = append(result.Reasons, "consent no longer exists")
+	} else {
+		result.Revoked = !current.Granted
+		result.Expired = now.After(current.ExpiryDate)
+		result.ConsentActive = !result.Revoked && !result.Expired
+		if result.Revoked {
+			result.Reasons = append(result.Reasons, "consent has been revoked")
+		}
+		if result.Expired {
+			result.Reasons = append(result.Reasons, "consent has expired")
+		}
+	}
+
+	result.Valid = result.DigestMatches && result.Anchored
+
+	return result, nil
+}
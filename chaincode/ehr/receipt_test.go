@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestGrantConsentIssuesReceipt tests that a grant returns and stores a Kantara receipt
+func TestGrantConsentIssuesReceipt(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	var receipt *ConsentReceipt
+	err := inTx(stub, "tx-grant", func() error {
+		var err error
+		receipt, err = s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ReceiptVersion, receipt.Version)
+	assert.Equal(t, "tx-grant", receipt.ConsentReceiptID)
+	assert.Equal(t, "patient123", receipt.PiiPrincipalID)
+	assert.Equal(t, "doctor456", receipt.Grantee)
+	assert.Equal(t, "EHR-001", receipt.Scope)
+	assert.Equal(t, "tx-grant", receipt.Anchor.TxID)
+	assert.Equal(t, "PatientMSP", receipt.Anchor.CreatorMSPID)
+	assert.Len(t, receipt.Integrity.Digest, 64)
+
+	// The expiry is counted from the transaction timestamp, which every endorser agrees on
+	txTimestamp, err := stub.GetTxTimestamp()
+	assert.NoError(t, err)
+	assert.Equal(t, txTimestamp.AsTime().AddDate(0, 0, 30), receipt.ExpiryDate)
+	assert.Equal(t, receipt.Anchor.TxTimestamp.AddDate(0, 0, 30), receipt.ExpiryDate)
+
+	stored, err := s.GetConsentReceipt(ctx, "tx-grant")
+	assert.NoError(t, err)
+	assert.Equal(t, receipt.Integrity.Digest, stored.Integrity.Digest)
+
+	// Other patients cannot fetch the receipt
+	_, err = s.GetConsentReceipt(newTestContext(stub, patientIdentity("patient999")), "tx-grant")
+	assert.Error(t, err)
+}
+
+// TestVerifyConsentReceipt tests tamper, history and revocation checks
+func TestVerifyConsentReceipt(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	var receipt *ConsentReceipt
+	err := inTx(stub, "tx-grant", func() error {
+		var err error
+		receipt, err = s.GrantConsent(ctx, "patient123-doctor456-*", "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	stored, err := s.readConsentReceipt(ctx, receipt.ConsentReceiptID)
+	assert.NoError(t, err)
+
+	var current ConsentRecord
+	state, _ := stub.GetState("patient123-doctor456-*")
+	assert.NoError(t, json.Unmarshal(state, &current))
+
+	grantedAt := receipt.Anchor.TxTimestamp
+	history := []consentHistoryEntry{{TxID: "tx-grant", Timestamp: grantedAt}}
+
+	result, err := verifyConsentReceipt(receipt, stored, &current, history, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.True(t, result.ConsentActive)
+	assert.Empty(t, result.Reasons)
+
+	// A receipt with an altered expiry no longer matches
+	tampered := *receipt
+	tampered.ExpiryDate = tampered.ExpiryDate.AddDate(1, 0, 0)
+	result, err = verifyConsentReceipt(&tampered, stored, &current, history, time.Now())
+	assert.NoError(t, err)
+	assert.False(t, result.Valid)
+	assert.False(t, result.DigestMatches)
+
+	// A later revocation keeps the receipt authentic but reports the consent inactive
+	current.Granted = false
+	history = append(history, consentHistoryEntry{TxID: "tx-revoke", Timestamp: grantedAt.Add(time.Hour)})
+	result, err = verifyConsentReceipt(receipt, stored, &current, history, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, result.Valid)
+	assert.True(t, result.Revoked)
+	assert.True(t, result.Superseded)
+	assert.False(t, result.ConsentActive)
+
+	// A receipt whose transaction never touched the consent is not anchored
+	result, err = verifyConsentReceipt(receipt, stored, &current, history[1:], time.Now())
+	assert.NoError(t, err)
+	assert.False(t, result.Anchored)
+	assert.False(t, result.Valid)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// recordKeysTransientKey is the transient map key of the record keys wrapped for a grantee, a JSON
+// array of RecordKeyGrant with recordId, wrappedKey and keyFingerprint
+const recordKeysTransientKey = "recordKeys"
+
+const (
+	recordKeyObjectType      = "recordKey"
+	recordKeyGranteeIndex    = "recordkey~grantee"
+	configRecordKeyPolicyKey = "recordKeyPolicy"
+	maxRecordKeysPerConsent  = 100
+)
+
+// RecordKeyGrant is a record key wrapped to one grantee's public key, stored per record and
+// grantee. Record IDs may name a bundle component whose key differs from the bundle key.
+type RecordKeyGrant struct {
+	RecordID       string          `json:"recordId"`
+	GranteeID      string          `json:"granteeId"`
+	WrappedKey     string          `json:"wrappedKey"`                                 // Base64 record key encrypted to the grantee
+	KeyFingerprint string          `json:"keyFingerprint"`                             // Key ID of the grantee's encryption key in the directory
+	ConsentID      string          `json:"consentId"`                                  // Consent the key was granted with
+	KeyVersion     int             `json:"keyVersion"`                                 // Record key version the wrap belongs to
+	PrivateData    *PrivateDataRef `json:"privateData,omitempty" metadata:",optional"` // Collection holding the wrapped key of a private record
+	GrantedBy      string          `json:"grantedBy"`
+	Timestamp      time.Time       `json:"timestamp"`
+}
+
+// RecordKeyPolicy decides whether consents on a record must come with its wrapped key
+type RecordKeyPolicy struct {
+	RequireWrappedKeys bool      `json:"requireWrappedKeys"`
+	UpdatedBy          string    `json:"updatedBy"`
+	Timestamp          time.Time `json:"timestamp"`
+}
+
+// SetRecordKeyPolicy sets whether GrantConsent requires the record key wrapped for the grantee
+// when the consent is on a single record. Broad consents never require keys.
+func (s *SmartContract) SetRecordKeyPolicy(
+	ctx contractapi.TransactionContextInterface,
+	requireWrappedKeys bool,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy := RecordKeyPolicy{
+		RequireWrappedKeys: requireWrappedKeys,
+		UpdatedBy:          callerID,
+		Timestamp:          now,
+	}
+
+	err = s.putStateEntity(ctx, configObjectType, configRecordKeyPolicyKey, policy)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionSetRecordKeyPolicy, callerID, "", "", "", true,
+		fmt.Sprintf("Wrapped keys required on record consents: %t", requireWrappedKeys))
+}
+
+// GetRecordKeyPolicy returns the record key policy, which by default does not require keys
+func (s *SmartContract) GetRecordKeyPolicy(
+	ctx contractapi.TransactionContextInterface,
+) (*RecordKeyPolicy, error) {
+	var policy RecordKeyPolicy
+	_, err := s.readStateEntity(ctx, configObjectType, configRecordKeyPolicyKey, &policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return &policy, nil
+}
+
+// GetMyRecordKey returns the record key wrapped for the caller, after checking they may read the
+// record. Patients without a key of their own get the record's encryptedKey.
+func (s *SmartContract) GetMyRecordKey(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*RecordKeyGrant, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	baseRecordID, componentID := splitComponentRef(recordID)
+	metadata, err := s.readEHR(ctx, baseRecordID)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNotErased(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkRecordAccess(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	grant, err := s.readRecordKeyGrant(ctx, recordID, callerID)
+	if err != nil {
+		return nil, err
+	}
+	if grant == nil && callerID == metadata.PatientID {
+		grant = &RecordKeyGrant{
+			RecordID:   recordID,
+			GranteeID:  callerID,
+			WrappedKey: recordEncryptedKey(metadata, componentID),
+			KeyVersion: recordKeyVersion(metadata),
+			GrantedBy:  metadata.CreatedBy,
+			Timestamp:  metadata.Timestamp,
+		}
+	}
+	if grant == nil || grant.WrappedKey == "" {
+		return nil, fmt.Errorf("no key for record %s is wrapped for the caller", recordID)
+	}
+
+	// Wraps of a rotated key no longer open the record
+	if componentID == "" && grant.KeyVersion != recordKeyVersion(metadata) {
+		return nil, fmt.Errorf("key wrapped for the caller is version %d, record %s is at key version %d",
+			grant.KeyVersion, recordID, recordKeyVersion(metadata))
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionGetRecordKey, callerID, metadata.PatientID, recordID, metadata.PatientID, true,
+		"Wrapped record key retrieved")
+	if err != nil {
+		return nil, err
+	}
+
+	return grant, nil
+}
+
+// grantRecordKeys stores the record keys passed with a consent, wrapped for its grantee. When the
+// policy requires it, a consent on a single record must include that record's key.
+func (s *SmartContract) grantRecordKeys(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) error {
+	transientGrants, err := readTransientRecordKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// A FHIR import grants several doctors at once, so keys naming another grantee are theirs
+	var grants []RecordKeyGrant
+	for _, grant := range transientGrants {
+		if grant.GranteeID == "" || grant.GranteeID == consent.DoctorID {
+			grants = append(grants, grant)
+		}
+	}
+
+	// Consents on one record cover its versions; broad consents cover any of the patient's records
+	var target *EHRMetadata
+	targetID, _ := splitComponentRef(consent.RecordID)
+	if targetID != "" && targetID != "*" {
+		target, err = s.lookupEHR(ctx, targetID)
+		if err != nil {
+			return err
+		}
+	}
+
+	var errs ValidationErrors
+	seen := make(map[string]bool, len(grants))
+	for i, grant := range grants {
+		field := fmt.Sprintf("%s[%d]", recordKeysTransientKey, i)
+		if grant.RecordID == "" {
+			errs.add(field+".recordId", "is required")
+		} else if seen[grant.RecordID] {
+			errs.add(field+".recordId", "duplicate record %s", grant.RecordID)
+		}
+		seen[grant.RecordID] = true
+	}
+	validateRecordKeyGrants(&errs, grants)
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	if target != nil && !seen[consent.RecordID] {
+		policy, err := s.GetRecordKeyPolicy(ctx)
+		if err != nil {
+			return err
+		}
+		if policy.RequireWrappedKeys {
+			return fmt.Errorf("consent on record %s requires its key wrapped for %s in transient %s",
+				consent.RecordID, consent.DoctorID, recordKeysTransientKey)
+		}
+	}
+
+	for _, grant := range grants {
+		recordID, _ := splitComponentRef(grant.RecordID)
+		metadata, err := s.readEHR(ctx, recordID)
+		if err != nil {
+			return err
+		}
+		err = requireNotErased(metadata)
+		if err != nil {
+			return err
+		}
+		if metadata.PatientID != consent.PatientID {
+			return fmt.Errorf("record %s does not belong to patient %s", recordID, consent.PatientID)
+		}
+		if target != nil && metadata.RootRecordID != target.RootRecordID {
+			return fmt.Errorf("record %s is not covered by consent on %s", recordID, consent.RecordID)
+		}
+
+		// Keys are wrapped to the grantee's registered encryption key
+		entry, err := s.requireEncryptionKey(ctx, consent.DoctorID, grant.KeyFingerprint)
+		if err != nil {
+			return err
+		}
+
+		grant.GranteeID = consent.DoctorID
+		grant.ConsentID = consent.ConsentID
+		grant.KeyVersion = recordKeyVersion(metadata)
+		grant.PrivateData = grantPrivateDataRef(metadata, entry)
+		grant.GrantedBy = consent.GrantedBy
+		grant.Timestamp = consent.Timestamp
+
+		err = s.putRecordKeyGrant(ctx, &grant)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeRecordKeys deletes the keys granted to a grantee with a consent
+func (s *SmartContract) revokeRecordKeys(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) (int, error) {
+	grants, err := s.granteeRecordKeys(ctx, consent.DoctorID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for _, grant := range grants {
+		if grant.ConsentID != consent.ConsentID {
+			continue
+		}
+		err = s.deleteRecordKeyGrant(ctx, grant.RecordID, grant.GranteeID)
+		if err != nil {
+			return 0, err
+		}
+		revoked++
+	}
+
+	return revoked, nil
+}
+
+// purgeRecordKeys deletes every grantee's key of a record and of its bundle components
+func (s *SmartContract) purgeRecordKeys(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) error {
+	recordIDs := []string{metadata.RecordID}
+	for _, component := range metadata.Components {
+		recordIDs = append(recordIDs, componentRef(metadata.RecordID, component.ComponentID))
+	}
+
+	for _, recordID := range recordIDs {
+		iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(recordKeyObjectType, []string{recordID})
+		if err != nil {
+			return fmt.Errorf("failed to read record keys: %v", err)
+		}
+
+		var granteeIDs []string
+		for iterator.HasNext() {
+			entry, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return fmt.Errorf("failed to read record keys: %v", err)
+			}
+			_, attributes, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+			if err != nil {
+				iterator.Close()
+				return fmt.Errorf("failed to split composite key: %v", err)
+			}
+			granteeIDs = append(granteeIDs, attributes[1])
+		}
+		iterator.Close()
+
+		for _, granteeID := range granteeIDs {
+			err = s.deleteRecordKeyGrant(ctx, recordID, granteeID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// renameRecordKeyConsent points the keys granted with a consent at its new ID after a merge
+func (s *SmartContract) renameRecordKeyConsent(
+	ctx contractapi.TransactionContextInterface,
+	granteeID string,
+	fromConsentID string,
+	toConsentID string,
+) error {
+	grants, err := s.granteeRecordKeys(ctx, granteeID)
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range grants {
+		if grant.ConsentID != fromConsentID {
+			continue
+		}
+		grant.ConsentID = toConsentID
+		err = s.putRecordKeyGrant(ctx, grant)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// granteeRecordKeys lists every record key wrapped for a grantee
+func (s *SmartContract) granteeRecordKeys(
+	ctx contractapi.TransactionContextInterface,
+	granteeID string,
+) ([]*RecordKeyGrant, error) {
+	recordIDs, err := s.indexEntries(ctx, recordKeyGranteeIndex, granteeID)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := []*RecordKeyGrant{}
+	for _, recordID := range recordIDs {
+		grant, err := s.readRecordKeyGrant(ctx, recordID, granteeID)
+		if err != nil {
+			return nil, err
+		}
+		if grant != nil {
+			grants = append(grants, grant)
+		}
+	}
+
+	return grants, nil
+}
+
+// readRecordKeyGrant loads the key of a record wrapped for a grantee, or nil if there is none
+func (s *SmartContract) readRecordKeyGrant(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	granteeID string,
+) (*RecordKeyGrant, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(recordKeyObjectType, []string{recordID, granteeID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	grantJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if grantJSON == nil {
+		return nil, nil
+	}
+
+	var grant RecordKeyGrant
+	err = json.Unmarshal(grantJSON, &grant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal record key: %v", err)
+	}
+
+	// Wrapped keys of private records are only readable in the grantee's collection
+	if grant.PrivateData != nil {
+		var data privateKeyGrantData
+		found, err := s.readPrivateValue(ctx, grant.PrivateData, key, &data)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			grant.WrappedKey = data.WrappedKey
+		}
+	}
+
+	return &grant, nil
+}
+
+// putRecordKeyGrant saves the key of a record wrapped for a grantee and lists it by grantee
+func (s *SmartContract) putRecordKeyGrant(
+	ctx contractapi.TransactionContextInterface,
+	grant *RecordKeyGrant,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(recordKeyObjectType, []string{grant.RecordID, grant.GranteeID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	public := *grant
+	if grant.PrivateData != nil {
+		ref := *grant.PrivateData
+		if grant.WrappedKey != "" {
+			ref.Hash, err = s.putPrivateValue(ctx, &ref, key, privateKeyGrantData{
+				RecordID:   grant.RecordID,
+				GranteeID:  grant.GranteeID,
+				WrappedKey: grant.WrappedKey,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		public.PrivateData = &ref
+		public.WrappedKey = ""
+	}
+
+	grantJSON, err := json.Marshal(public)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, grantJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	return s.putIndexEntry(ctx, recordKeyGranteeIndex, grant.GranteeID, grant.RecordID)
+}
+
+// deleteRecordKeyGrant deletes the key of a record wrapped for a grantee
+func (s *SmartContract) deleteRecordKeyGrant(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	granteeID string,
+) error {
+	key, err := ctx.GetStub().CreateCompositeKey(recordKeyObjectType, []string{recordID, granteeID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	grantJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if grantJSON != nil {
+		var grant RecordKeyGrant
+		err = json.Unmarshal(grantJSON, &grant)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal record key: %v", err)
+		}
+		if grant.PrivateData != nil {
+			err = s.purgePrivateValue(ctx, grant.PrivateData, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete from world state: %v", err)
+	}
+
+	return s.deleteIndexEntry(ctx, recordKeyGranteeIndex, granteeID, recordID)
+}
+
+// readTransientRecordKeys decodes the wrapped keys passed in the transient map, if any
+func readTransientRecordKeys(ctx contractapi.TransactionContextInterface) ([]RecordKeyGrant, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+
+	grants := []RecordKeyGrant{}
+	if grantsJSON, found := transient[recordKeysTransientKey]; found {
+		err = json.Unmarshal(grantsJSON, &grants)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transient %s: %v", recordKeysTransientKey, err)
+		}
+	}
+
+	return grants, nil
+}
+
+// validateRecordKeyGrants checks the wrapped keys and key IDs of record key grants
+func validateRecordKeyGrants(errs *ValidationErrors, grants []RecordKeyGrant) {
+	if len(grants) > maxRecordKeysPerConsent {
+		errs.add(recordKeysTransientKey, "at most %d keys can be granted at once", maxRecordKeysPerConsent)
+	}
+
+	for i, grant := range grants {
+		field := fmt.Sprintf("%s[%d]", recordKeysTransientKey, i)
+		if grant.WrappedKey == "" {
+			errs.add(field+".wrappedKey", "is required")
+		} else if len(grant.WrappedKey) > maxEncryptedKeyLength {
+			errs.add(field+".wrappedKey", "must be at most %d characters", maxEncryptedKeyLength)
+		} else if _, err := base64.StdEncoding.DecodeString(grant.WrappedKey); err != nil {
+			errs.add(field+".wrappedKey", "must be base64")
+		}
+		if !checksumPattern.MatchString(grant.KeyFingerprint) {
+			errs.add(field+".keyFingerprint", "must be a public key ID")
+		}
+	}
+}
+
+// recordEncryptedKey is the stored key of a record, or of one of its bundle components
+func recordEncryptedKey(metadata *EHRMetadata, componentID string) string {
+	for _, component := range metadata.Components {
+		if component.ComponentID == componentID && component.EncryptedKey != "" {
+			return component.EncryptedKey
+		}
+	}
+	return metadata.EncryptedKey
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordKeysTransient returns the transient map granting record keys wrapped to a doctor's key
+func recordKeysTransient(t *testing.T, keyID string, recordIDs ...string) map[string][]byte {
+	grants := []RecordKeyGrant{}
+	for _, recordID := range recordIDs {
+		grants = append(grants, RecordKeyGrant{
+			RecordID:       recordID,
+			WrappedKey:     base64.StdEncoding.EncodeToString([]byte(recordID + " key")),
+			KeyFingerprint: keyID,
+		})
+	}
+	grantsJSON, err := json.Marshal(grants)
+	assert.NoError(t, err)
+	return map[string][]byte{recordKeysTransientKey: grantsJSON}
+}
+
+// TestRecordKeyGrants tests that record keys wrapped for a doctor are stored with consent and
+// released only to that doctor
+func TestRecordKeyGrants(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	otherDoctorCtx := newTestContext(stub, doctorIdentity("doctor789"))
+
+	for _, recordID := range []string{"EHR-001", "EHR-002"} {
+		recordID := recordID
+		err := inTx(stub, "tx1-"+recordID, func() error {
+			return s.CreateEHRMetadata(patientCtx, recordID, "patient123", testCID(recordID), "patient key", "Lab Report", testChecksum(recordID),
+				testSignature(patientCtx, recordID, "patient123", testCID(recordID), testChecksum(recordID), "Lab Report"))
+		})
+		assert.NoError(t, err)
+	}
+
+	err := inTx(stub, "tx1", func() error {
+		return s.SetRecordKeyPolicy(adminCtx, true)
+	})
+	assert.NoError(t, err)
+
+	keyID, err := registerEncryptionKey(s, stub, "tx1a", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	consentID := consentIDFor("patient123", "doctor456", "EHR-001")
+
+	// The policy requires the key of the consented record
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, "requires its key wrapped for doctor456")
+
+	// Keys are only accepted for records the consent covers
+	err = inTxWithTransient(stub, "tx3", recordKeysTransient(t, keyID, "EHR-001", "EHR-002"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, "not covered by consent")
+
+	// Keys are wrapped to the doctor's registered encryption key
+	err = inTxWithTransient(stub, "tx3a", recordKeysTransient(t, testChecksum("unregistered"), "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, "not a registered encryption key of doctor456")
+
+	err = inTxWithTransient(stub, "tx4", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	grant, err := getMyRecordKey(s, stub, "tx-get-key1", doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "doctor456", grant.GranteeID)
+	assert.Equal(t, consentID, grant.ConsentID)
+	assert.Equal(t, base64.StdEncoding.EncodeToString([]byte("EHR-001 key")), grant.WrappedKey)
+
+	// Other doctors get nothing, even with consent but no key of their own
+	_, err = getMyRecordKey(s, stub, "tx-get-key2", otherDoctorCtx, "EHR-001")
+	assert.ErrorContains(t, err, "no valid consent")
+
+	err = inTx(stub, "tx5", func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor789", "*"), "patient123", "doctor789", "*", 30)
+		return err
+	})
+	assert.NoError(t, err, "broad consents do not require keys")
+
+	_, err = getMyRecordKey(s, stub, "tx-get-key3", otherDoctorCtx, "EHR-001")
+	assert.ErrorContains(t, err, "no key for record EHR-001")
+
+	// The patient gets the record's own key
+	grant, err = getMyRecordKey(s, stub, "tx-get-key4", patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "patient key", grant.WrappedKey)
+
+	// Revoking the consent deletes the doctor's key
+	err = inTx(stub, "tx6", func() error {
+		return s.RevokeConsent(patientCtx, consentID)
+	})
+	assert.NoError(t, err)
+
+	stored, err := s.readRecordKeyGrant(doctorCtx, "EHR-001", "doctor456")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	_, err = getMyRecordKey(s, stub, "tx-get-key5", doctorCtx, "EHR-001")
+	assert.Error(t, err)
+}
+
+// TestRecordKeyGrantAuthorization tests that only the patient or an admin stores and deletes the
+// record keys wrapped for a doctor
+func TestRecordKeyGrantAuthorization(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+	otherDoctorCtx := newTestContext(stub, doctorIdentity("doctor789"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "patient key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx1a", func() error {
+		return s.SetRecordKeyPolicy(adminCtx, true)
+	})
+	assert.NoError(t, err)
+
+	keyID, err := registerEncryptionKey(s, stub, "tx2", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	consentID := consentIDFor("patient123", "doctor456", "EHR-001")
+
+	// A doctor cannot grant themselves consent, and so cannot store keys for themselves
+	err = inTxWithTransient(stub, "tx3", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(doctorCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.ErrorContains(t, err, "unauthorized")
+
+	stored, err := s.readRecordKeyGrant(doctorCtx, "EHR-001", "doctor456")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	err = inTxWithTransient(stub, "tx4", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// Neither another doctor nor the grantee can revoke the consent and delete the key
+	for i, ctx := range []*TransactionContext{otherDoctorCtx, doctorCtx} {
+		err = inTx(stub, fmt.Sprintf("tx5-%d", i), func() error {
+			return s.RevokeConsent(ctx, consentID)
+		})
+		assert.ErrorContains(t, err, "unauthorized")
+	}
+
+	grant, err := getMyRecordKey(s, stub, "tx-get-key1", doctorCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, consentID, grant.ConsentID)
+
+	// An admin can
+	err = inTx(stub, "tx6", func() error {
+		return s.RevokeConsent(adminCtx, consentID)
+	})
+	assert.NoError(t, err)
+
+	stored, err = s.readRecordKeyGrant(doctorCtx, "EHR-001", "doctor456")
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+// TestEraseEHRPurgesRecordKeys tests that erasing a record deletes the keys wrapped for grantees
+func TestEraseEHRPurgesRecordKeys(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	keyID, err := registerEncryptionKey(s, stub, "tx1a", doctorIdentity("doctor456"))
+	assert.NoError(t, err)
+
+	err = inTxWithTransient(stub, "tx2", recordKeysTransient(t, keyID, "EHR-001"), func() error {
+		_, err := s.GrantConsent(patientCtx, consentIDFor("patient123", "doctor456", "*"), "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	grants, err := s.granteeRecordKeys(patientCtx, "doctor456")
+	assert.NoError(t, err)
+	assert.Len(t, grants, 1)
+
+	err = inTx(stub, "tx3", func() error {
+		return s.EraseEHR(adminCtx, "EHR-001", "Patient request")
+	})
+	assert.NoError(t, err)
+
+	grants, err = s.granteeRecordKeys(patientCtx, "doctor456")
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ehr-blockchain/chaincode/pre"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// reEncryptionKeyTransientKey is the transient map key of a re-encryption key, a JSON object with
+// the base64 fragment and ephemeral key made by pre.GenerateReEncryptionKey
+const reEncryptionKeyTransientKey = "reEncryptionKey"
+
+const reEncryptionKeyObjectType = "reEncryptionKey"
+
+// ReEncryptionKey lets the re-encryption service turn a patient's record keys into keys for one
+// grantee. The key itself is kept in the private data collection of the patient's organization:
+// together with the grantee's secret key it would reveal the patient's.
+type ReEncryptionKey struct {
+	PatientID    string          `json:"patientId"`
+	GranteeID    string          `json:"granteeId"`
+	ConsentID    string          `json:"consentId"`    // Consent the key was issued with, whose revocation deletes it
+	PatientKeyID string          `json:"patientKeyId"` // Patient's re-encryption key in the directory
+	GranteeKeyID string          `json:"granteeKeyId"` // Grantee's re-encryption key in the directory
+	PrivateData  *PrivateDataRef `json:"privateData"`
+	IssuedAt     time.Time       `json:"issuedAt"`
+}
+
+// ReEncryptionAuthorization confirms that a grantee may have a record's key re-encrypted for them
+type ReEncryptionAuthorization struct {
+	RecordID     string `json:"recordId"`
+	PatientID    string `json:"patientId"`
+	GranteeID    string `json:"granteeId"`
+	ConsentID    string `json:"consentId"`
+	KeyVersion   int    `json:"keyVersion"`
+	GranteeKeyID string `json:"granteeKeyId"`
+}
+
+// ReEncryptedRecordKey is a record key re-encrypted for a grantee, which only the grantee can
+// decrypt. The re-encryption key it was made with never leaves the peer.
+type ReEncryptedRecordKey struct {
+	RecordID     string `json:"recordId"`
+	GranteeID    string `json:"granteeId"`
+	KeyVersion   int    `json:"keyVersion"`
+	EncryptedKey string `json:"encryptedKey"` // Marshalled pre.Ciphertext for the grantee's PRE key
+}
+
+// ReEncryptionKeyValue is a re-encryption key as made by pre.GenerateReEncryptionKey
+type ReEncryptionKeyValue struct {
+	Fragment  []byte `json:"fragment"`
+	Ephemeral []byte `json:"ephemeral"`
+}
+
+// reEncryptionKeyData is the private value of a re-encryption key, keyed like its public entry
+type reEncryptionKeyData struct {
+	PatientID string `json:"patientId"`
+	GranteeID string `json:"granteeId"`
+	ReEncryptionKeyValue
+}
+
+// IssueReEncryptionKey stores the caller's re-encryption key for the grantee of one of their
+// consents, passed in the transient map under reEncryptionKey. Both keys named must be active
+// re-encryption keys in the directory. A new key replaces the grantee's previous one.
+func (s *SmartContract) IssueReEncryptionKey(
+	ctx contractapi.TransactionContextInterface,
+	consentID string,
+	patientKeyID string,
+	granteeKeyID string,
+) (*ReEncryptionKey, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	consentJSON, err := ctx.GetStub().GetState(consentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if consentJSON == nil {
+		return nil, fmt.Errorf("consent %s %w", consentID, errNotFound)
+	}
+
+	var consent ConsentRecord
+	err = json.Unmarshal(consentJSON, &consent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal consent: %v", err)
+	}
+
+	// Patients delegate for their own consents
+	if consent.PatientID != callerID {
+		return nil, fmt.Errorf("%w: consent %s was not given by the caller", errUnauthorized, consentID)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !consentInEffect(&consent, now) {
+		return nil, fmt.Errorf("consent %s is not in effect", consentID)
+	}
+
+	_, err = s.requireKeyInEffect(ctx, callerID, patientKeyID, KeyUsageReEncryption)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.requireKeyInEffect(ctx, consent.DoctorID, granteeKeyID, KeyUsageReEncryption)
+	if err != nil {
+		return nil, err
+	}
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transient data: %v", err)
+	}
+	keyJSON, found := transient[reEncryptionKeyTransientKey]
+	if !found {
+		return nil, fmt.Errorf("re-encryption key is required in transient %s", reEncryptionKeyTransientKey)
+	}
+
+	var value ReEncryptionKeyValue
+	err = json.Unmarshal(keyJSON, &value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal transient %s: %v", reEncryptionKeyTransientKey, err)
+	}
+	err = (&pre.ReEncryptionKey{Fragment: value.Fragment, Ephemeral: value.Ephemeral}).Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid re-encryption key: %v", err)
+	}
+
+	// Replacing a key purges the previous one from its collection
+	err = s.deleteReEncryptionKey(ctx, callerID, consent.DoctorID)
+	if err != nil {
+		return nil, err
+	}
+
+	reEncryptionKey := &ReEncryptionKey{
+		PatientID:    callerID,
+		GranteeID:    consent.DoctorID,
+		ConsentID:    consentID,
+		PatientKeyID: patientKeyID,
+		GranteeKeyID: granteeKeyID,
+		PrivateData:  &PrivateDataRef{Collection: privateCollection(callerOrg)},
+		IssuedAt:     now,
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(reEncryptionKeyObjectType, []string{callerID, consent.DoctorID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	reEncryptionKey.PrivateData.Hash, err = s.putPrivateValue(ctx, reEncryptionKey.PrivateData, key, reEncryptionKeyData{
+		PatientID:            callerID,
+		GranteeID:            consent.DoctorID,
+		ReEncryptionKeyValue: value,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keyEntryJSON, err := json.Marshal(reEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal re-encryption key: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(key, keyEntryJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionIssueReEncryptionKey, callerID, consent.DoctorID, "", consent.PatientID, true,
+		fmt.Sprintf("Re-encryption key issued to %s (key %s) with consent %s", consent.DoctorID, granteeKeyID, consentID))
+	if err != nil {
+		return nil, err
+	}
+
+	return reEncryptionKey, nil
+}
+
+// AuthorizeReEncryption is submitted by the re-encryption service before it has a record key
+// re-encrypted. It confirms that the grantee's consent covers the record and that the patient issued
+// them a re-encryption key, and audits the request.
+func (s *SmartContract) AuthorizeReEncryption(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	granteeID string,
+) (*ReEncryptionAuthorization, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	metadata, reEncryptionKey, err := s.reEncryptionTarget(ctx, recordID, granteeID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionReEncryptRecordKey, callerID, metadata.PatientID, recordID, metadata.PatientID, true,
+		fmt.Sprintf("Record key re-encryption for %s (key %s) authorized by consent %s",
+			granteeID, reEncryptionKey.GranteeKeyID, reEncryptionKey.ConsentID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReEncryptionAuthorization{
+		RecordID:     recordID,
+		PatientID:    metadata.PatientID,
+		GranteeID:    granteeID,
+		ConsentID:    reEncryptionKey.ConsentID,
+		KeyVersion:   recordKeyVersion(metadata),
+		GranteeKeyID: reEncryptionKey.GranteeKeyID,
+	}, nil
+}
+
+// ReEncryptRecordKey re-encrypts a record's key for a grantee, after the same checks as
+// AuthorizeReEncryption. The peer reads the patient's re-encryption key from its organization's
+// collection and returns only the result, so the response is safe to record in a block.
+func (s *SmartContract) ReEncryptRecordKey(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	granteeID string,
+) (*ReEncryptedRecordKey, error) {
+	metadata, reEncryptionKey, err := s.reEncryptionTarget(ctx, recordID, granteeID)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(reEncryptionKeyObjectType, []string{reEncryptionKey.PatientID, granteeID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	var data reEncryptionKeyData
+	found, err := s.readPrivateValue(ctx, reEncryptionKey.PrivateData, key, &data)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("re-encryption key for %s is not readable in %s", granteeID, reEncryptionKey.PrivateData.Collection)
+	}
+
+	_, componentID := splitComponentRef(recordID)
+	ciphertext, err := pre.ParseCiphertext(recordEncryptedKey(metadata, componentID))
+	if err != nil {
+		return nil, fmt.Errorf("key of record %s is not encrypted for re-encryption: %v", recordID, err)
+	}
+
+	// Re-encryption is deterministic, so every endorsing peer returns the same key
+	reEncrypted, err := pre.ReEncrypt(&pre.ReEncryptionKey{
+		Fragment:  data.Fragment,
+		Ephemeral: data.Ephemeral,
+	}, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-encrypt key of record %s: %v", recordID, err)
+	}
+
+	encryptedKey, err := reEncrypted.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReEncryptedRecordKey{
+		RecordID:     recordID,
+		GranteeID:    granteeID,
+		KeyVersion:   recordKeyVersion(metadata),
+		EncryptedKey: encryptedKey,
+	}, nil
+}
+
+// GetReEncryptionKeys lists the re-encryption keys a patient has issued, without the keys
+func (s *SmartContract) GetReEncryptionKeys(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) ([]*ReEncryptionKey, error) {
+	err := s.RequirePatientOrAdmin(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(reEncryptionKeyObjectType, []string{patientID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read re-encryption keys: %v", err)
+	}
+	defer iterator.Close()
+
+	reEncryptionKeys := []*ReEncryptionKey{}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read re-encryption keys: %v", err)
+		}
+
+		var reEncryptionKey ReEncryptionKey
+		err = json.Unmarshal(entry.Value, &reEncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal re-encryption key: %v", err)
+		}
+		reEncryptionKeys = append(reEncryptionKeys, &reEncryptionKey)
+	}
+
+	return reEncryptionKeys, nil
+}
+
+// reEncryptionTarget checks that the re-encryption service may transform a record's key for a
+// grantee, and returns the record and the patient's re-encryption key for the grantee
+func (s *SmartContract) reEncryptionTarget(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	granteeID string,
+) (*EHRMetadata, *ReEncryptionKey, error) {
+	// The service runs with the backend's admin identity
+	err := s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	baseRecordID, componentID := splitComponentRef(recordID)
+	metadata, err := s.readEHR(ctx, baseRecordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = requireNotErased(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = requirePrivateDataLoaded(metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowed, restricted, err := s.consentAccess(ctx, metadata.PatientID, granteeID, recordID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(restricted) > 0 {
+		return nil, nil, fmt.Errorf("%w: record %s is labeled %v, which consent does not cover", errUnauthorized, recordID, restricted)
+	}
+	if !allowed {
+		return nil, nil, fmt.Errorf("%w: %s has no valid consent for record %s", errUnauthorized, granteeID, recordID)
+	}
+
+	reEncryptionKey, err := s.readReEncryptionKey(ctx, metadata.PatientID, granteeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reEncryptionKey == nil {
+		return nil, nil, fmt.Errorf("patient %s has issued no re-encryption key for %s", metadata.PatientID, granteeID)
+	}
+
+	// A grantee who rotated or revoked their key can no longer decrypt with it
+	_, err = s.requireKeyInEffect(ctx, granteeID, reEncryptionKey.GranteeKeyID, KeyUsageReEncryption)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = pre.ParseCiphertext(recordEncryptedKey(metadata, componentID))
+	if err != nil {
+		return nil, nil, fmt.Errorf("key of record %s is not encrypted for re-encryption: %v", recordID, err)
+	}
+
+	return metadata, reEncryptionKey, nil
+}
+
+// revokeReEncryptionKey deletes the re-encryption key issued with a consent, reporting whether
+// there was one
+func (s *SmartContract) revokeReEncryptionKey(
+	ctx contractapi.TransactionContextInterface,
+	consent *ConsentRecord,
+) (bool, error) {
+	reEncryptionKey, err := s.readReEncryptionKey(ctx, consent.PatientID, consent.DoctorID)
+	if err != nil {
+		return false, err
+	}
+	if reEncryptionKey == nil || reEncryptionKey.ConsentID != consent.ConsentID {
+		return false, nil
+	}
+
+	err = s.deleteReEncryptionKey(ctx, consent.PatientID, consent.DoctorID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// readReEncryptionKey loads a patient's re-encryption key for a grantee, or nil if there is none
+func (s *SmartContract) readReEncryptionKey(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	granteeID string,
+) (*ReEncryptionKey, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(reEncryptionKeyObjectType, []string{patientID, granteeID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	keyJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if keyJSON == nil {
+		return nil, nil
+	}
+
+	var reEncryptionKey ReEncryptionKey
+	err = json.Unmarshal(keyJSON, &reEncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal re-encryption key: %v", err)
+	}
+
+	return &reEncryptionKey, nil
+}
+
+// deleteReEncryptionKey deletes a patient's re-encryption key for a grantee and purges it from its
+// collection
+func (s *SmartContract) deleteReEncryptionKey(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	granteeID string,
+) error {
+	reEncryptionKey, err := s.readReEncryptionKey(ctx, patientID, granteeID)
+	if err != nil || reEncryptionKey == nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(reEncryptionKeyObjectType, []string{patientID, granteeID})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	err = s.purgePrivateValue(ctx, reEncryptionKey.PrivateData, key)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.GetStub().DelState(key)
+	if err != nil {
+		return fmt.Errorf("failed to delete from world state: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/ehr-blockchain/chaincode/pre"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// contractLedger runs the re-encryption service against the contract, submitting authorizations
+// in their own transactions
+type contractLedger struct {
+	s    *SmartContract
+	stub *shimtest.MockStub
+	ctx  contractapi.TransactionContextInterface
+	txID string
+}
+
+func (l *contractLedger) AuthorizeReEncryption(ctx context.Context, recordID string, granteeID string) (*pre.Authorization, error) {
+	var authorization *ReEncryptionAuthorization
+	err := inTx(l.stub, l.txID, func() error {
+		var err error
+		authorization, err = l.s.AuthorizeReEncryption(l.ctx, recordID, granteeID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var converted pre.Authorization
+	return &converted, convertJSON(authorization, &converted)
+}
+
+func (l *contractLedger) ReEncryptRecordKey(ctx context.Context, recordID string, granteeID string) (*pre.ReEncryptedKey, error) {
+	reEncrypted, err := l.s.ReEncryptRecordKey(l.ctx, recordID, granteeID)
+	if err != nil {
+		return nil, err
+	}
+
+	var converted pre.ReEncryptedKey
+	return &converted, convertJSON(reEncrypted, &converted)
+}
+
+// convertJSON copies a contract response into the client's type, as a gateway client would
+func convertJSON(from interface{}, to interface{}) error {
+	fromJSON, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(fromJSON, to)
+}
+
+// TestProxyReEncryption tests that the re-encryption service shares a patient's record key with a
+// doctor holding consent, and no longer once the consent is revoked
+func TestProxyReEncryption(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newPrivateDataContext(stub, patientIdentity("patient123"))
+	doctorCtx := newPrivateDataContext(stub, doctorIdentity("doctor456"))
+	// The service's peer is a member of the patient organization's collection
+	serviceCtx := newPrivateDataContext(stub, newTestIdentity("service1", "PatientMSP", map[string]string{"role": RoleAdmin}))
+
+	patientKey, err := pre.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	doctorKey, err := pre.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	// Re-encryption keys must be PRE keys
+	err = inTx(stub, "tx1", func() error {
+		_, err := s.RegisterPublicKey(patientCtx, testRSAPublicKey("patient123"), KeyUsageReEncryption, 365)
+		return err
+	})
+	assert.ErrorContains(t, err, "reencryption keys must be PRE keys")
+
+	var patientKeyID, doctorKeyID string
+	err = inTx(stub, "tx2", func() error {
+		entry, err := s.RegisterPublicKey(patientCtx, patientKey.PublicKey.MarshalPEM(), KeyUsageReEncryption, 365)
+		if err == nil {
+			patientKeyID = entry.KeyID
+			assert.Equal(t, KeyAlgorithmPRE, entry.Algorithm)
+		}
+		return err
+	})
+	assert.NoError(t, err)
+	err = inTx(stub, "tx3", func() error {
+		entry, err := s.RegisterPublicKey(doctorCtx, doctorKey.PublicKey.MarshalPEM(), KeyUsageReEncryption, 365)
+		if err == nil {
+			doctorKeyID = entry.KeyID
+		}
+		return err
+	})
+	assert.NoError(t, err)
+
+	// The patient keeps the record key encrypted to their own PRE key
+	recordKey := make([]byte, 32)
+	_, err = rand.Read(recordKey)
+	assert.NoError(t, err)
+	ciphertext, err := pre.Encrypt(rand.Reader, &patientKey.PublicKey, recordKey)
+	assert.NoError(t, err)
+	encryptedKey, err := ciphertext.Marshal()
+	assert.NoError(t, err)
+
+	err = inTxWithTransient(stub, "tx4", privateRecordTransient(t, encryptedKey, testCID("EHR-001")), func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", "", "", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	consentID := consentIDFor("patient123", "doctor456", "*")
+	err = inTx(stub, "tx5", func() error {
+		_, err := s.GrantConsent(patientCtx, consentID, "patient123", "doctor456", "*", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	reKey, err := pre.GenerateReEncryptionKey(rand.Reader, patientKey, &doctorKey.PublicKey)
+	assert.NoError(t, err)
+	reKeyJSON, err := json.Marshal(reKey)
+	assert.NoError(t, err)
+	transient := map[string][]byte{reEncryptionKeyTransientKey: reKeyJSON}
+
+	// Only the patient who gave the consent delegates, with registered PRE keys
+	err = inTxWithTransient(stub, "tx6", transient, func() error {
+		_, err := s.IssueReEncryptionKey(doctorCtx, consentID, patientKeyID, doctorKeyID)
+		return err
+	})
+	assert.ErrorContains(t, err, "was not given by the caller")
+
+	err = inTxWithTransient(stub, "tx7", transient, func() error {
+		_, err := s.IssueReEncryptionKey(patientCtx, consentID, doctorKeyID, doctorKeyID)
+		return err
+	})
+	assert.ErrorContains(t, err, "is not a registered reencryption key of patient123")
+
+	err = inTxWithTransient(stub, "tx8", transient, func() error {
+		_, err := s.IssueReEncryptionKey(patientCtx, consentID, patientKeyID, doctorKeyID)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// The key itself stays in the patient organization's collection
+	reKeyKey, err := stub.CreateCompositeKey(reEncryptionKeyObjectType, []string{"patient123", "doctor456"})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stub.State[reKeyKey]), "fragment")
+	assert.Contains(t, string(stub.PvtState[privateCollection("PatientMSP")][reKeyKey]), "fragment")
+
+	issued, err := s.GetReEncryptionKeys(patientCtx, "patient123")
+	assert.NoError(t, err)
+	if assert.Len(t, issued, 1) {
+		assert.Equal(t, "doctor456", issued[0].GranteeID)
+		assert.Equal(t, privateCollection("PatientMSP"), issued[0].PrivateData.Collection)
+	}
+
+	// The service transforms the key without the patient, and the doctor decrypts it
+	ledger := &contractLedger{s: s, stub: stub, ctx: serviceCtx, txID: "tx9"}
+	service := &pre.Service{Ledger: ledger}
+	encoded, err := service.ReEncrypt(context.Background(), "EHR-001", "doctor456")
+	assert.NoError(t, err)
+	reEncrypted, err := pre.ParseCiphertext(encoded)
+	assert.NoError(t, err)
+	decrypted, err := pre.Decrypt(doctorKey, reEncrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, recordKey, decrypted)
+
+	// The response carries nothing of the re-encryption key, so submitting it leaks nothing
+	response, err := s.ReEncryptRecordKey(serviceCtx, "EHR-001", "doctor456")
+	assert.NoError(t, err)
+	responseJSON, err := json.Marshal(response)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(responseJSON), "fragment")
+	assert.NotContains(t, string(responseJSON), base64.StdEncoding.EncodeToString(reKey.Fragment))
+
+	_, err = s.AuthorizeReEncryption(doctorCtx, "EHR-001", "doctor456")
+	assert.ErrorContains(t, err, "requires role admin")
+
+	_, err = s.AuthorizeReEncryption(serviceCtx, "EHR-001", "doctor789")
+	assert.ErrorContains(t, err, "no valid consent")
+
+	logs, err := s.QueryAuditLogsByAction(newQueryContext(stub, adminIdentity("admin1")), ActionReEncryptRecordKey)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 1)
+
+	// Only the patient or an admin revokes the consent and with it the re-encryption key
+	err = inTx(stub, "tx9a", func() error {
+		return s.RevokeConsent(doctorCtx, consentID)
+	})
+	assert.ErrorContains(t, err, "unauthorized")
+
+	err = inTx(stub, "tx9b", func() error {
+		return s.RevokeConsent(newPrivateDataContext(stub, patientIdentity("patient999")), consentID)
+	})
+	assert.ErrorContains(t, err, "unauthorized")
+	assert.Contains(t, stub.PvtState[privateCollection("PatientMSP")], reKeyKey)
+
+	issued, err = s.GetReEncryptionKeys(patientCtx, "patient123")
+	assert.NoError(t, err)
+	assert.Len(t, issued, 1)
+
+	// Revoking consent deletes the re-encryption key along with its private value
+	err = inTx(stub, "tx10", func() error {
+		return s.RevokeConsent(patientCtx, consentID)
+	})
+	assert.NoError(t, err)
+	assert.NotContains(t, stub.PvtState[privateCollection("PatientMSP")], reKeyKey)
+
+	issued, err = s.GetReEncryptionKeys(patientCtx, "patient123")
+	assert.NoError(t, err)
+	assert.Empty(t, issued)
+
+	ledger.txID = "tx11"
+	_, err = service.ReEncrypt(context.Background(), "EHR-001", "doctor456")
+	assert.ErrorContains(t, err, "not authorized")
+
+	_, err = s.ReEncryptRecordKey(serviceCtx, "EHR-001", "doctor456")
+	assert.Error(t, err)
+}
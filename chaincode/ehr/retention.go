@@ -0,0 +1,840 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// RecordStatusArchived marks records moved to archive storage at the end of their retention
+const RecordStatusArchived = "ARCHIVED"
+
+// EventEHRArchived is the chaincode event emitted by ArchiveEHR
+const EventEHRArchived = "EHRArchived"
+
+// retentionAny matches every jurisdiction or record type in a retention rule, and every record of
+// a patient in a legal hold
+const retentionAny = "*"
+
+// Retention limits
+const (
+	maxRetentionYears    = 200
+	maxJurisdictionCode  = 32
+	defaultAgeOfMajority = 18
+	dateLayout           = "2006-01-02"
+)
+
+const (
+	retentionRuleObjectType    = "retentionRule"
+	retentionProfileObjectType = "retentionProfile"
+	legalHoldObjectType        = "legalHold"
+	legalHoldPatientIndex      = "legalhold~patient"
+)
+
+// RetentionRule is how long records of a type must be kept in a jurisdiction. Records made while
+// the patient was a minor are kept until the later of the adult period and majority plus
+// MinorYearsAfterMajority.
+type RetentionRule struct {
+	Jurisdiction            string    `json:"jurisdiction"` // e.g. US-CA, or * for any
+	RecordType              string    `json:"recordType"`   // * for any
+	AdultYears              int       `json:"adultYears"`   // Years after the record date
+	MinorYearsAfterMajority int       `json:"minorYearsAfterMajority"`
+	AgeOfMajority           int       `json:"ageOfMajority"`
+	UpdatedBy               string    `json:"updatedBy"`
+	Timestamp               time.Time `json:"timestamp"`
+}
+
+// RetentionProfile holds what retention depends on about a patient
+type RetentionProfile struct {
+	PatientID    string    `json:"patientId"`
+	Jurisdiction string    `json:"jurisdiction"`
+	BirthDate    string    `json:"birthDate"` // YYYY-MM-DD
+	UpdatedBy    string    `json:"updatedBy"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// RecordRetention is the retention computed for one record version
+type RecordRetention struct {
+	Jurisdiction   string    `json:"jurisdiction"`
+	RuleRecordType string    `json:"ruleRecordType"` // Record type of the rule applied, * for a default rule
+	RetainUntil    time.Time `json:"retainUntil"`
+	Pediatric      bool      `json:"pediatric"` // The patient was a minor at the record date
+}
+
+// LegalHold keeps records from being erased or archived while litigation is pending
+type LegalHold struct {
+	HoldID        string    `json:"holdId"`
+	PatientID     string    `json:"patientId"`
+	RecordID      string    `json:"recordId"` // First version of the record, * for all of the patient's records
+	Matter        string    `json:"matter"`   // Case or matter the hold is for
+	Active        bool      `json:"active"`
+	PlacedBy      string    `json:"placedBy"`
+	PlacedAt      time.Time `json:"placedAt"`
+	ReleasedBy    string    `json:"releasedBy,omitempty" metadata:",optional"`
+	ReleasedAt    time.Time `json:"releasedAt"` // Zero while active
+	ReleaseReason string    `json:"releaseReason,omitempty" metadata:",optional"`
+}
+
+// RetentionStatus tells whether a record may be erased or archived
+type RetentionStatus struct {
+	RecordID    string       `json:"recordId"`
+	RetainUntil time.Time    `json:"retainUntil"` // Latest retention end of all versions, zero if no rule applies
+	InRetention bool         `json:"inRetention"`
+	LegalHolds  []*LegalHold `json:"legalHolds"` // Active holds covering the record
+	Disposable  bool         `json:"disposable"` // Neither in retention nor held
+}
+
+// ArchivalInfo records who archived a record and why
+type ArchivalInfo struct {
+	Reason     string    `json:"reason"`
+	ArchivedBy string    `json:"archivedBy"`
+	ArchivedAt time.Time `json:"archivedAt"`
+	TxID       string    `json:"txId"`
+}
+
+// EHRArchivedEvent is emitted so off-chain services can move the archived files to archive storage
+type EHRArchivedEvent struct {
+	PatientID  string   `json:"patientId"`
+	RecordIDs  []string `json:"recordIds"`
+	IPFSHashes []string `json:"ipfsHashes"`
+	Reason     string   `json:"reason"`
+	ArchivedBy string   `json:"archivedBy"`
+}
+
+// SetRetentionRule sets how long records of a type are kept in a jurisdiction. Use * for the
+// jurisdiction or record type to set a default; the most specific rule applies. New records get
+// their retention end when written; RecomputeRecordRetention updates existing ones.
+func (s *SmartContract) SetRetentionRule(
+	ctx contractapi.TransactionContextInterface,
+	jurisdiction string,
+	recordType string,
+	adultYears int,
+	minorYearsAfterMajority int,
+	ageOfMajority int,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	validateJurisdiction(&errs, jurisdiction)
+	if recordType != retentionAny {
+		recordType, err = s.canonicalRecordType(ctx, &errs, recordType)
+		if err != nil {
+			return err
+		}
+	}
+	if adultYears < 0 || adultYears > maxRetentionYears {
+		errs.add("adultYears", "must be between 0 and %d", maxRetentionYears)
+	}
+	if minorYearsAfterMajority < 0 || minorYearsAfterMajority > maxRetentionYears {
+		errs.add("minorYearsAfterMajority", "must be between 0 and %d", maxRetentionYears)
+	}
+	if ageOfMajority == 0 {
+		ageOfMajority = defaultAgeOfMajority
+	}
+	if ageOfMajority < 1 || ageOfMajority > 30 {
+		errs.add("ageOfMajority", "must be between 1 and 30")
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	rule := RetentionRule{
+		Jurisdiction:            jurisdiction,
+		RecordType:              recordType,
+		AdultYears:              adultYears,
+		MinorYearsAfterMajority: minorYearsAfterMajority,
+		AgeOfMajority:           ageOfMajority,
+		UpdatedBy:               callerID,
+		Timestamp:               now,
+	}
+
+	err = s.putStateEntity(ctx, retentionRuleObjectType, retentionRuleID(jurisdiction, recordType), rule)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageRetention, callerID, "", "", "", true,
+		fmt.Sprintf("Retention rule for %s records in %s set to %d years, %d after majority at %d",
+			recordType, jurisdiction, adultYears, minorYearsAfterMajority, ageOfMajority))
+}
+
+// GetRetentionRules returns every configured retention rule
+func (s *SmartContract) GetRetentionRules(
+	ctx contractapi.TransactionContextInterface,
+) ([]*RetentionRule, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(retentionRuleObjectType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retention rules: %v", err)
+	}
+	defer iterator.Close()
+
+	rules := []*RetentionRule{}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read retention rules: %v", err)
+		}
+
+		var rule RetentionRule
+		err = json.Unmarshal(entry.Value, &rule)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal retention rule: %v", err)
+		}
+		rules = append(rules, &rule)
+	}
+
+	return rules, nil
+}
+
+// SetPatientRetentionProfile records the jurisdiction and birth date that retention of a
+// patient's records is computed from
+func (s *SmartContract) SetPatientRetentionProfile(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+	jurisdiction string,
+	birthDate string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	// Patients cannot shorten the retention of their own records
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	if patientID == "" {
+		errs.add("patientId", "is required")
+	}
+	validateJurisdiction(&errs, jurisdiction)
+	if birthDate != "" {
+		_, err = time.Parse(dateLayout, birthDate)
+		if err != nil {
+			errs.add("birthDate", "must be a date in YYYY-MM-DD format")
+		}
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	profile := RetentionProfile{
+		PatientID:    patientID,
+		Jurisdiction: jurisdiction,
+		BirthDate:    birthDate,
+		UpdatedBy:    callerID,
+		Timestamp:    now,
+	}
+
+	err = s.putStateEntity(ctx, retentionProfileObjectType, patientID, profile)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageRetention, callerID, patientID, "", patientID, true,
+		fmt.Sprintf("Retention profile set to jurisdiction %s", jurisdiction))
+}
+
+// RecomputeRecordRetention recomputes the retention end of every version of a record from the
+// current rules and patient profile, for example after a rule changes
+func (s *SmartContract) RecomputeRecordRetention(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	latest := versions[len(versions)-1]
+	err = requireNotErased(latest)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		version.Retention, err = s.computeRetention(ctx, version)
+		if err != nil {
+			return err
+		}
+
+		err = s.putEHRMetadata(ctx, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionManageRetention, callerID, latest.PatientID, latest.RecordID, latest.PatientID, true,
+		fmt.Sprintf("Retention recomputed on %d version(s)", len(versions)))
+}
+
+// GetRecordRetention reports how long a record is retained and which legal holds cover it
+func (s *SmartContract) GetRecordRetention(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) (*RetentionStatus, error) {
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = requireNotErased(metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkRecordAccess(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.retentionStatus(ctx, versions)
+}
+
+// PlaceLegalHold keeps one record, or with recordID * every record of a patient, from being
+// erased or archived until the hold is released
+func (s *SmartContract) PlaceLegalHold(
+	ctx contractapi.TransactionContextInterface,
+	holdID string,
+	patientID string,
+	recordID string,
+	matter string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	validateRecordID(&errs, "holdId", holdID)
+	if patientID == "" {
+		errs.add("patientId", "is required")
+	}
+	if recordID == "" {
+		errs.add("recordId", "is required")
+	}
+	if matter == "" {
+		errs.add("matter", "is required")
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	existing, err := s.readLegalHold(ctx, holdID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("legal hold %s already exists", holdID)
+	}
+
+	// Holds on a record cover all of its versions
+	if recordID != retentionAny {
+		metadata, err := s.readEHR(ctx, recordID)
+		if err != nil {
+			return err
+		}
+		err = requireNotErased(metadata)
+		if err != nil {
+			return err
+		}
+		if metadata.PatientID != patientID {
+			return fmt.Errorf("record %s does not belong to patient %s", recordID, patientID)
+		}
+		recordID = metadata.RootRecordID
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	hold := LegalHold{
+		HoldID:    holdID,
+		PatientID: patientID,
+		RecordID:  recordID,
+		Matter:    matter,
+		Active:    true,
+		PlacedBy:  callerID,
+		PlacedAt:  now,
+	}
+
+	err = s.putStateEntity(ctx, legalHoldObjectType, holdID, hold)
+	if err != nil {
+		return err
+	}
+
+	err = s.putIndexEntry(ctx, legalHoldPatientIndex, patientID, holdID)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionLegalHold, callerID, patientID, recordID, patientID, true,
+		fmt.Sprintf("Legal hold %s placed for %s", holdID, matter))
+}
+
+// ReleaseLegalHold lifts a legal hold. Released holds are kept for the record.
+func (s *SmartContract) ReleaseLegalHold(
+	ctx contractapi.TransactionContextInterface,
+	holdID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return fmt.Errorf("release reason is required")
+	}
+
+	hold, err := s.getLegalHold(ctx, holdID)
+	if err != nil {
+		return err
+	}
+	if !hold.Active {
+		return fmt.Errorf("legal hold %s has already been released", holdID)
+	}
+
+	hold.Active = false
+	hold.ReleasedBy = callerID
+	hold.ReleasedAt, err = txTime(ctx)
+	if err != nil {
+		return err
+	}
+	hold.ReleaseReason = reason
+
+	err = s.putStateEntity(ctx, legalHoldObjectType, holdID, hold)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionLegalHold, callerID, hold.PatientID, hold.RecordID, hold.PatientID, true,
+		fmt.Sprintf("Legal hold %s released: %s", holdID, reason))
+}
+
+// GetLegalHold returns a legal hold
+func (s *SmartContract) GetLegalHold(
+	ctx contractapi.TransactionContextInterface,
+	holdID string,
+) (*LegalHold, error) {
+	hold, err := s.getLegalHold(ctx, holdID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, hold.PatientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// QueryLegalHoldsByPatient returns the active and released legal holds on a patient's records
+func (s *SmartContract) QueryLegalHoldsByPatient(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) ([]*LegalHold, error) {
+	err := s.RequirePatientOrAdmin(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.patientLegalHolds(ctx, patientID)
+}
+
+// ArchiveEHR marks a record and all of its versions as archived once its retention has ended, so
+// off-chain services can move its files to archive storage. Archived records stay readable but
+// can no longer be changed.
+func (s *SmartContract) ArchiveEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return fmt.Errorf("archival reason is required")
+	}
+
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	latest := versions[len(versions)-1]
+	err = requireActive(latest)
+	if err != nil {
+		return err
+	}
+
+	err = s.requireDisposable(ctx, versions)
+	if err != nil {
+		return err
+	}
+
+	event := EHRArchivedEvent{
+		PatientID:  latest.PatientID,
+		Reason:     reason,
+		ArchivedBy: callerID,
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	archival := &ArchivalInfo{
+		Reason:     reason,
+		ArchivedBy: callerID,
+		ArchivedAt: now,
+		TxID:       ctx.GetStub().GetTxID(),
+	}
+
+	for _, version := range versions {
+		version.Status = RecordStatusArchived
+		version.Archival = archival
+
+		err = s.putEHRMetadata(ctx, version)
+		if err != nil {
+			return err
+		}
+
+		event.RecordIDs = append(event.RecordIDs, version.RecordID)
+		if ipfsHash := publicIPFSHash(version); ipfsHash != "" {
+			event.IPFSHashes = append(event.IPFSHashes, ipfsHash)
+		}
+		for _, component := range version.Components {
+			event.IPFSHashes = append(event.IPFSHashes, component.IPFSHash)
+		}
+	}
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %v", err)
+	}
+
+	err = ctx.GetStub().SetEvent(EventEHRArchived, eventJSON)
+	if err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionArchiveEHR, callerID, event.PatientID, recordID, event.PatientID, true,
+		fmt.Sprintf("Archived %d version(s): %s", len(event.RecordIDs), reason))
+}
+
+// applyRetention sets the retention end of a record being written
+func (s *SmartContract) applyRetention(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) error {
+	retention, err := s.computeRetention(ctx, metadata)
+	if err != nil {
+		return err
+	}
+
+	metadata.Retention = retention
+	return nil
+}
+
+// computeRetention applies the most specific rule for the record type and the patient's
+// jurisdiction to a record, or returns nil if no rule applies
+func (s *SmartContract) computeRetention(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) (*RecordRetention, error) {
+	var profile RetentionProfile
+	_, err := s.readStateEntity(ctx, retentionProfileObjectType, metadata.PatientID, &profile)
+	if err != nil {
+		return nil, err
+	}
+
+	jurisdiction := profile.Jurisdiction
+	if jurisdiction == "" {
+		jurisdiction = retentionAny
+	}
+
+	rule, err := s.matchRetentionRule(ctx, jurisdiction, metadata.RecordType)
+	if err != nil || rule == nil {
+		return nil, err
+	}
+
+	retention := &RecordRetention{
+		Jurisdiction:   jurisdiction,
+		RuleRecordType: rule.RecordType,
+		RetainUntil:    metadata.Timestamp.AddDate(rule.AdultYears, 0, 0),
+	}
+
+	// Records of minors are kept until some years after majority
+	if profile.BirthDate != "" {
+		birthDate, err := time.Parse(dateLayout, profile.BirthDate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid birth date in retention profile of %s: %v", metadata.PatientID, err)
+		}
+
+		majority := birthDate.AddDate(rule.AgeOfMajority, 0, 0)
+		if metadata.Timestamp.Before(majority) {
+			retention.Pediatric = true
+			minorUntil := majority.AddDate(rule.MinorYearsAfterMajority, 0, 0)
+			if minorUntil.After(retention.RetainUntil) {
+				retention.RetainUntil = minorUntil
+			}
+		}
+	}
+
+	return retention, nil
+}
+
+// matchRetentionRule finds the rule for a jurisdiction and record type, falling back to the
+// jurisdiction's default, the record type's default and the global default in that order
+func (s *SmartContract) matchRetentionRule(
+	ctx contractapi.TransactionContextInterface,
+	jurisdiction string,
+	recordType string,
+) (*RetentionRule, error) {
+	candidates := [][2]string{
+		{jurisdiction, recordType},
+		{jurisdiction, retentionAny},
+		{retentionAny, recordType},
+		{retentionAny, retentionAny},
+	}
+
+	for _, candidate := range candidates {
+		var rule RetentionRule
+		found, err := s.readStateEntity(ctx, retentionRuleObjectType, retentionRuleID(candidate[0], candidate[1]), &rule)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			return &rule, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// retentionStatus combines the retention of every version of a record with the holds on it.
+// Rules are also applied afresh, so records written before a rule existed are covered too.
+func (s *SmartContract) retentionStatus(
+	ctx contractapi.TransactionContextInterface,
+	versions []*EHRMetadata,
+) (*RetentionStatus, error) {
+	latest := versions[len(versions)-1]
+	status := &RetentionStatus{RecordID: latest.RecordID, LegalHolds: []*LegalHold{}}
+
+	for _, version := range versions {
+		current, err := s.computeRetention(ctx, version)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, retention := range []*RecordRetention{version.Retention, current} {
+			if retention != nil && retention.RetainUntil.After(status.RetainUntil) {
+				status.RetainUntil = retention.RetainUntil
+			}
+		}
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	status.InRetention = now.Before(status.RetainUntil)
+
+	holds, err := s.patientLegalHolds(ctx, latest.PatientID)
+	if err != nil {
+		return nil, err
+	}
+	for _, hold := range holds {
+		if hold.Active && (hold.RecordID == retentionAny || hold.RecordID == latest.RootRecordID) {
+			status.LegalHolds = append(status.LegalHolds, hold)
+		}
+	}
+
+	status.Disposable = !status.InRetention && len(status.LegalHolds) == 0
+	return status, nil
+}
+
+// requireDisposable rejects erasure or archival of records under a legal hold or in retention
+func (s *SmartContract) requireDisposable(
+	ctx contractapi.TransactionContextInterface,
+	versions []*EHRMetadata,
+) error {
+	status, err := s.retentionStatus(ctx, versions)
+	if err != nil {
+		return err
+	}
+
+	if len(status.LegalHolds) > 0 {
+		return fmt.Errorf("record %s is under legal hold %s", status.RecordID, status.LegalHolds[0].HoldID)
+	}
+	if status.InRetention {
+		return fmt.Errorf("record %s must be retained until %s", status.RecordID, status.RetainUntil.Format(dateLayout))
+	}
+
+	return nil
+}
+
+// patientLegalHolds lists every legal hold placed on a patient's records
+func (s *SmartContract) patientLegalHolds(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) ([]*LegalHold, error) {
+	holdIDs, err := s.indexEntries(ctx, legalHoldPatientIndex, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	holds := []*LegalHold{}
+	for _, holdID := range holdIDs {
+		hold, err := s.getLegalHold(ctx, holdID)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, nil
+}
+
+// getLegalHold loads a legal hold, failing if it does not exist
+func (s *SmartContract) getLegalHold(
+	ctx contractapi.TransactionContextInterface,
+	holdID string,
+) (*LegalHold, error) {
+	hold, err := s.readLegalHold(ctx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if hold == nil {
+		return nil, fmt.Errorf("legal hold %s %w", holdID, errNotFound)
+	}
+
+	return hold, nil
+}
+
+// readLegalHold loads a legal hold, or nil if it does not exist
+func (s *SmartContract) readLegalHold(
+	ctx contractapi.TransactionContextInterface,
+	holdID string,
+) (*LegalHold, error) {
+	var hold LegalHold
+	found, err := s.readStateEntity(ctx, legalHoldObjectType, holdID, &hold)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &hold, nil
+}
+
+// retentionRuleID keys a rule by jurisdiction and lower-cased record type
+func retentionRuleID(jurisdiction string, recordType string) string {
+	return jurisdiction + "|" + strings.ToLower(recordType)
+}
+
+// validateJurisdiction checks a jurisdiction code such as US-CA, or * for any
+func validateJurisdiction(errs *ValidationErrors, jurisdiction string) {
+	switch {
+	case jurisdiction == "":
+		errs.add("jurisdiction", "is required")
+	case jurisdiction == retentionAny:
+	case len(jurisdiction) > maxJurisdictionCode:
+		errs.add("jurisdiction", "must be at most %d characters", maxJurisdictionCode)
+	case !recordIDPattern.MatchString(jurisdiction):
+		errs.add("jurisdiction", "must start with a letter or digit and contain only letters, digits and . _ : -")
+	}
+}
+
+// requireActive rejects changes to erased or archived records
+func requireActive(metadata *EHRMetadata) error {
+	err := requireNotErased(metadata)
+	if err != nil {
+		return err
+	}
+	if metadata.Status == RecordStatusArchived {
+		return fmt.Errorf("record %s has been archived", metadata.RecordID)
+	}
+	return nil
+}
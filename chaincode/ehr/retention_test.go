@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+)
+
+// retentionLedger holds a pediatric patient's lab report and X-ray under the California rules,
+// and an appointment note of a patient without a retention profile, whose type is kept for no time
+type retentionLedger struct {
+	s          *SmartContract
+	stub       *shimtest.MockStub
+	adminCtx   *TransactionContext
+	patientCtx *TransactionContext
+	adultCtx   *TransactionContext
+	birthDate  time.Time
+}
+
+func setupRetentionLedger(t *testing.T) *retentionLedger {
+	s := new(SmartContract)
+	stub := newTestStub()
+	l := &retentionLedger{
+		s:          s,
+		stub:       stub,
+		adminCtx:   newTestContext(stub, adminIdentity("admin1")),
+		patientCtx: newTestContext(stub, patientIdentity("patient123")),
+		adultCtx:   newTestContext(stub, patientIdentity("patient999")),
+		birthDate:  time.Now().AddDate(-10, 0, 0),
+	}
+
+	steps := []func() error{
+		func() error { return s.SetRetentionRule(l.adminCtx, retentionAny, retentionAny, 10, 0, 0) },
+		func() error { return s.SetRetentionRule(l.adminCtx, "US-CA", "Lab Report", 7, 1, 18) },
+		func() error { return s.SetRetentionRule(l.adminCtx, retentionAny, "Appointment Note", 0, 0, 0) },
+		func() error {
+			return s.SetPatientRetentionProfile(l.adminCtx, "patient123", "US-CA", l.birthDate.Format(dateLayout))
+		},
+	}
+	for _, record := range []struct{ recordID, recordType string }{{"EHR-LAB", "Lab Report"}, {"EHR-XRAY", "Imaging"}} {
+		recordID, recordType := record.recordID, record.recordType
+		steps = append(steps, func() error {
+			return s.CreateEHRMetadata(l.patientCtx, recordID, "patient123", testCID(recordID), "key", recordType, testChecksum(recordID),
+				testSignature(l.patientCtx, recordID, "patient123", testCID(recordID), testChecksum(recordID), recordType))
+		})
+	}
+	// A patient without a retention profile gets the rules for any jurisdiction
+	steps = append(steps, func() error {
+		return s.CreateEHRMetadata(l.adultCtx, "EHR-NOTE", "patient999", testCID("EHR-NOTE"), "key", "Appointment Note", testChecksum("EHR-NOTE"),
+			testSignature(l.adultCtx, "EHR-NOTE", "patient999", testCID("EHR-NOTE"), testChecksum("EHR-NOTE"), "Appointment Note"))
+	})
+
+	for i, step := range steps {
+		if !assert.NoError(t, inTx(stub, fmt.Sprintf("tx-setup-%d", i+1), step)) {
+			t.FailNow()
+		}
+	}
+
+	return l
+}
+
+// TestSetRetentionRule tests that only admins configure retention, within bounds
+func TestSetRetentionRule(t *testing.T) {
+	l := setupRetentionLedger(t)
+	doctorCtx := newTestContext(l.stub, doctorIdentity("doctor456"))
+
+	rules, err := l.s.GetRetentionRules(l.adminCtx)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 3)
+
+	err = inTx(l.stub, "tx1", func() error {
+		return l.s.SetRetentionRule(l.patientCtx, retentionAny, retentionAny, 1, 0, 0)
+	})
+	assert.ErrorContains(t, err, "unauthorized: requires role admin")
+
+	err = inTx(l.stub, "tx2", func() error {
+		return l.s.SetRetentionRule(doctorCtx, retentionAny, retentionAny, 1, 0, 0)
+	})
+	assert.ErrorContains(t, err, "unauthorized: requires role admin")
+
+	err = inTx(l.stub, "tx3", func() error {
+		return l.s.SetRetentionRule(l.adminCtx, "US-CA", "Lab Report", -1, 0, 0)
+	})
+	assert.ErrorContains(t, err, "adultYears")
+
+	err = inTx(l.stub, "tx4", func() error {
+		return l.s.SetRetentionRule(l.adminCtx, "US CA", "Lab Report", 7, 1, 40)
+	})
+	assert.ErrorContains(t, err, "jurisdiction")
+	assert.ErrorContains(t, err, "ageOfMajority")
+
+	err = inTx(l.stub, "tx5", func() error {
+		return l.s.SetPatientRetentionProfile(l.patientCtx, "patient123", "US-NY", l.birthDate.Format(dateLayout))
+	})
+	assert.ErrorContains(t, err, "unauthorized: requires role admin")
+
+	err = inTx(l.stub, "tx6", func() error {
+		return l.s.SetPatientRetentionProfile(l.adminCtx, "patient123", "US-CA", "10/01/2015")
+	})
+	assert.ErrorContains(t, err, "birthDate")
+
+	rules, err = l.s.GetRetentionRules(l.adminCtx)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 3, "rejected rules are not stored")
+}
+
+// TestRecordRetentionPeriod tests how long records are kept and that records in retention are
+// neither erased nor archived
+func TestRecordRetentionPeriod(t *testing.T) {
+	l := setupRetentionLedger(t)
+
+	// Pediatric records are kept until some years after majority
+	lab, err := l.s.QueryEHR(l.patientCtx, "EHR-LAB")
+	assert.NoError(t, err)
+	if assert.NotNil(t, lab.Retention) {
+		assert.True(t, lab.Retention.Pediatric)
+		assert.Equal(t, "US-CA", lab.Retention.Jurisdiction)
+		assert.Equal(t, l.birthDate.AddDate(19, 0, 0).Format(dateLayout), lab.Retention.RetainUntil.Format(dateLayout))
+	}
+
+	// Types without their own rule fall back to the default
+	xray, err := l.s.QueryEHR(l.patientCtx, "EHR-XRAY")
+	assert.NoError(t, err)
+	if assert.NotNil(t, xray.Retention) {
+		assert.Equal(t, retentionAny, xray.Retention.RuleRecordType)
+		assert.Equal(t, xray.Timestamp.AddDate(10, 0, 0).Format(dateLayout), xray.Retention.RetainUntil.Format(dateLayout))
+	}
+
+	status, err := l.s.GetRecordRetention(l.patientCtx, "EHR-LAB")
+	assert.NoError(t, err)
+	assert.True(t, status.InRetention)
+	assert.False(t, status.Disposable)
+
+	err = inTx(l.stub, "tx1", func() error {
+		return l.s.EraseEHR(l.adminCtx, "EHR-LAB", "Patient request")
+	})
+	assert.ErrorContains(t, err, "must be retained until")
+
+	err = inTx(l.stub, "tx2", func() error {
+		return l.s.ArchiveEHR(l.adminCtx, "EHR-XRAY", "End of retention")
+	})
+	assert.ErrorContains(t, err, "must be retained until")
+
+	// Once retention has expired the record may be disposed of
+	status, err = l.s.GetRecordRetention(l.adultCtx, "EHR-NOTE")
+	assert.NoError(t, err)
+	assert.False(t, status.InRetention)
+	assert.True(t, status.Disposable)
+
+	err = inTx(l.stub, "tx3", func() error {
+		return l.s.EraseEHR(l.adminCtx, "EHR-NOTE", "Patient request")
+	})
+	assert.NoError(t, err)
+}
+
+// TestLegalHolds tests that a legal hold blocks disposal of records outside retention until
+// it is released
+func TestLegalHolds(t *testing.T) {
+	l := setupRetentionLedger(t)
+
+	err := inTx(l.stub, "tx1", func() error {
+		return l.s.PlaceLegalHold(l.adultCtx, "HOLD-1", "patient999", "EHR-NOTE", "Smith v. Hospital")
+	})
+	assert.ErrorContains(t, err, "unauthorized: requires role admin", "only admins place holds")
+
+	err = inTx(l.stub, "tx2", func() error {
+		return l.s.PlaceLegalHold(l.adminCtx, "HOLD-1", "patient123", "EHR-NOTE", "Smith v. Hospital")
+	})
+	assert.ErrorContains(t, err, "record EHR-NOTE does not belong to patient patient123")
+
+	err = inTx(l.stub, "tx3", func() error {
+		return l.s.PlaceLegalHold(l.adminCtx, "HOLD-1", "patient999", "EHR-NOTE", "")
+	})
+	assert.ErrorContains(t, err, "matter")
+
+	err = inTx(l.stub, "tx4", func() error {
+		return l.s.PlaceLegalHold(l.adminCtx, "HOLD-1", "patient999", "EHR-NOTE", "Smith v. Hospital")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(l.stub, "tx5", func() error {
+		return l.s.PlaceLegalHold(l.adminCtx, "HOLD-1", "patient999", "EHR-NOTE", "Smith v. Hospital")
+	})
+	assert.ErrorContains(t, err, "legal hold HOLD-1 already exists")
+
+	status, err := l.s.GetRecordRetention(l.adultCtx, "EHR-NOTE")
+	assert.NoError(t, err)
+	assert.False(t, status.InRetention)
+	assert.False(t, status.Disposable)
+	if assert.Len(t, status.LegalHolds, 1) {
+		assert.Equal(t, "HOLD-1", status.LegalHolds[0].HoldID)
+	}
+
+	err = inTx(l.stub, "tx6", func() error {
+		return l.s.EraseEHR(l.adminCtx, "EHR-NOTE", "Patient request")
+	})
+	assert.ErrorContains(t, err, "under legal hold HOLD-1")
+
+	err = inTx(l.stub, "tx7", func() error {
+		return l.s.ArchiveEHR(l.adminCtx, "EHR-NOTE", "End of retention")
+	})
+	assert.ErrorContains(t, err, "under legal hold HOLD-1")
+
+	// Releasing needs an admin, a reason and an active hold
+	err = inTx(l.stub, "tx8", func() error {
+		return l.s.ReleaseLegalHold(l.adultCtx, "HOLD-1", "Case settled")
+	})
+	assert.ErrorContains(t, err, "unauthorized: requires role admin")
+
+	err = inTx(l.stub, "tx9", func() error {
+		return l.s.ReleaseLegalHold(l.adminCtx, "HOLD-1", "")
+	})
+	assert.ErrorContains(t, err, "release reason is required")
+
+	err = inTx(l.stub, "tx10", func() error {
+		return l.s.ReleaseLegalHold(l.adminCtx, "HOLD-404", "Case settled")
+	})
+	assert.ErrorContains(t, err, "legal hold HOLD-404 does not exist")
+
+	err = inTx(l.stub, "tx11", func() error {
+		return l.s.ReleaseLegalHold(l.adminCtx, "HOLD-1", "Case settled")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(l.stub, "tx12", func() error {
+		return l.s.ReleaseLegalHold(l.adminCtx, "HOLD-1", "Case settled")
+	})
+	assert.ErrorContains(t, err, "legal hold HOLD-1 has already been released")
+
+	holds, err := l.s.QueryLegalHoldsByPatient(l.adultCtx, "patient999")
+	assert.NoError(t, err)
+	if assert.Len(t, holds, 1) {
+		assert.False(t, holds[0].Active)
+		assert.Equal(t, "Case settled", holds[0].ReleaseReason)
+	}
+
+	// Holds on all of a patient's records cover every record
+	err = inTx(l.stub, "tx13", func() error {
+		return l.s.PlaceLegalHold(l.adminCtx, "HOLD-2", "patient999", retentionAny, "Regulator inquiry")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(l.stub, "tx14", func() error {
+		return l.s.EraseEHR(l.adminCtx, "EHR-NOTE", "Patient request")
+	})
+	assert.ErrorContains(t, err, "under legal hold HOLD-2")
+
+	err = inTx(l.stub, "tx15", func() error {
+		return l.s.ReleaseLegalHold(l.adminCtx, "HOLD-2", "Inquiry closed")
+	})
+	assert.NoError(t, err)
+
+	err = inTx(l.stub, "tx16", func() error {
+		return l.s.EraseEHR(l.adminCtx, "EHR-NOTE", "Patient request")
+	})
+	assert.NoError(t, err)
+}
+
+// TestArchiveEHR tests that archived records stay readable but cannot change
+func TestArchiveEHR(t *testing.T) {
+	l := setupRetentionLedger(t)
+
+	err := inTx(l.stub, "tx1", func() error {
+		return l.s.ArchiveEHR(l.adultCtx, "EHR-NOTE", "End of retention")
+	})
+	assert.ErrorContains(t, err, "unauthorized: requires role admin")
+
+	err = inTx(l.stub, "tx2", func() error {
+		return l.s.ArchiveEHR(l.adminCtx, "EHR-NOTE", "")
+	})
+	assert.ErrorContains(t, err, "archival reason is required")
+
+	err = inTx(l.stub, "tx3", func() error {
+		return l.s.ArchiveEHR(l.adminCtx, "EHR-NOTE", "End of retention")
+	})
+	assert.NoError(t, err)
+
+	note, err := l.s.QueryEHR(l.adultCtx, "EHR-NOTE")
+	assert.NoError(t, err)
+	assert.Equal(t, RecordStatusArchived, note.Status)
+	assert.Equal(t, "End of retention", note.Archival.Reason)
+
+	err = inTx(l.stub, "tx4", func() error {
+		return l.s.AmendEHR(l.adultCtx, "EHR-NOTE", "EHR-NOTE-v2", testCID("EHR-NOTE-v2"), "key", testChecksum("EHR-NOTE-v2"), "Late entry",
+			testSignature(l.adultCtx, "EHR-NOTE-v2", "patient999", testCID("EHR-NOTE-v2"), testChecksum("EHR-NOTE-v2"), "Appointment Note"))
+	})
+	assert.ErrorContains(t, err, "has been archived")
+
+	err = inTx(l.stub, "tx5", func() error {
+		return l.s.ArchiveEHR(l.adminCtx, "EHR-NOTE", "End of retention")
+	})
+	assert.ErrorContains(t, err, "record EHR-NOTE has been archived")
+}
+
+// TestRecomputeRecordRetention tests that rules also cover records written before them
+func TestRecomputeRecordRetention(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	metadata, err := s.QueryEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Nil(t, metadata.Retention)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.SetRetentionRule(adminCtx, retentionAny, "lab report", 5, 0, 0)
+	})
+	assert.NoError(t, err)
+
+	// The new rule already applies to disposal
+	err = inTx(stub, "tx3", func() error {
+		return s.EraseEHR(adminCtx, "EHR-001", "Patient request")
+	})
+	assert.ErrorContains(t, err, "must be retained until")
+
+	err = inTx(stub, "tx4", func() error {
+		return s.RecomputeRecordRetention(adminCtx, "EHR-001")
+	})
+	assert.NoError(t, err)
+
+	metadata, err = s.QueryEHR(patientCtx, "EHR-001")
+	assert.NoError(t, err)
+	if assert.NotNil(t, metadata.Retention) {
+		assert.Equal(t, retentionAny, metadata.Retention.Jurisdiction)
+		assert.False(t, metadata.Retention.Pediatric)
+		assert.Equal(t, metadata.Timestamp.AddDate(5, 0, 0).Format(dateLayout), metadata.Retention.RetainUntil.Format(dateLayout))
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Search sort fields
+const (
+	SearchSortTimestamp  = "timestamp"
+	SearchSortRecordType = "recordType"
+)
+
+// Search page sizes
+const (
+	defaultSearchPageSize = 25
+	maxSearchPageSize     = 100
+	maxSearchRecordTypes  = 20
+)
+
+// Indexes in META-INF/statedb/couchdb/indexes that serve the search sorts
+const (
+	searchTimestampIndex  = "indexTimestamp"
+	searchRecordTypeIndex = "indexRecordTypeTimestamp"
+)
+
+// EHRSearchFilter selects records for SearchEHRs. Empty fields do not filter; the page size and
+// bookmark are always sent, like the arguments of a paginated Fabric query.
+type EHRSearchFilter struct {
+	PatientID       string   `json:"patientId,omitempty" metadata:",optional"`
+	RecordTypes     []string `json:"recordTypes,omitempty" metadata:",optional"`     // Any of
+	AuthorID        string   `json:"authorId,omitempty" metadata:",optional"`        // Caller ID of the author
+	AuthorOrg       string   `json:"authorOrg,omitempty" metadata:",optional"`       // MSP ID of the author's organization
+	From            string   `json:"from,omitempty" metadata:",optional"`            // RFC 3339, inclusive
+	To              string   `json:"to,omitempty" metadata:",optional"`              // RFC 3339, exclusive
+	Confidentiality []string `json:"confidentiality,omitempty" metadata:",optional"` // Any of
+	SensitivityTags []string `json:"sensitivityTags,omitempty" metadata:",optional"` // All of
+	EncounterID     string   `json:"encounterId,omitempty" metadata:",optional"`
+	IncludeAmended  bool     `json:"includeAmended,omitempty" metadata:",optional"` // Also return superseded versions
+	SortBy          string   `json:"sortBy,omitempty" metadata:",optional"`         // timestamp (default) or recordType
+	Descending      bool     `json:"descending,omitempty" metadata:",optional"`
+	PageSize        int      `json:"pageSize"` // 0 for the default of 25, at most 100
+	Bookmark        string   `json:"bookmark"` // From the previous page, empty for the first
+}
+
+// EHRSearchResult is one page of search results
+type EHRSearchResult struct {
+	Records  []*EHRMetadata `json:"records"`
+	Bookmark string         `json:"bookmark"` // Pass back to fetch the next page, empty after the last
+}
+
+// SearchEHRs returns one page of the records matching a filter that the caller may read.
+// Records the caller has no consent for are dropped on the peer, so a page can hold fewer
+// records than its size while later pages still have results.
+func (s *SmartContract) SearchEHRs(
+	ctx contractapi.TransactionContextInterface,
+	filter EHRSearchFilter,
+) (*EHRSearchResult, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	role, err := s.GetCallerRole(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller role: %v", err)
+	}
+
+	// Patients search their own records
+	if role == RolePatient {
+		if filter.PatientID != "" && filter.PatientID != callerID {
+			return nil, fmt.Errorf("%w: patients can only search their own records", errUnauthorized)
+		}
+		filter.PatientID = callerID
+	}
+
+	// Merged patient IDs are redirected to the surviving ID
+	if filter.PatientID != "" {
+		filter.PatientID, err = s.resolvePatientID(ctx, filter.PatientID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Match record types as they are spelled in the vocabulary
+	var errs ValidationErrors
+	for i, recordType := range filter.RecordTypes {
+		filter.RecordTypes[i], err = s.canonicalRecordType(ctx, &errs, recordType)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := errs.errOrNil(); err != nil {
+		return nil, err
+	}
+
+	queryString, pageSize, err := buildSearchQuery(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, metadata, err := ctx.GetStub().GetQueryResultWithPagination(queryString, pageSize, filter.Bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %v", err)
+	}
+	defer resultsIterator.Close()
+
+	var records []*EHRMetadata
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var record EHRMetadata
+		err = json.Unmarshal(queryResponse.Value, &record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, &record)
+	}
+
+	// Only return the records the caller may read
+	accessible, err := s.readableRecords(ctx, records)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &EHRSearchResult{Records: accessible}
+	if metadata != nil && int(metadata.FetchedRecordsCount) == int(pageSize) {
+		result.Bookmark = metadata.Bookmark
+	}
+
+	return result, nil
+}
+
+// buildSearchQuery validates a filter and turns it into a CouchDB query and page size. The
+// selector is built as JSON rather than by formatting strings, so filter values cannot change
+// the query.
+func buildSearchQuery(filter EHRSearchFilter) (string, int32, error) {
+	var errs ValidationErrors
+
+	// Only current EHR metadata documents; tombstones carry a status
+	selector := map[string]interface{}{
+		"ipfsHash": map[string]interface{}{"$exists": true},
+		"status":   map[string]interface{}{"$exists": false},
+	}
+	if !filter.IncludeAmended {
+		selector["supersededBy"] = ""
+	}
+
+	if filter.PatientID != "" {
+		selector["patientId"] = filter.PatientID
+	}
+	if filter.AuthorID != "" {
+		selector["createdBy"] = filter.AuthorID
+	}
+	if filter.AuthorOrg != "" {
+		selector["authorOrg"] = filter.AuthorOrg
+	}
+	if filter.EncounterID != "" {
+		validateRecordID(&errs, "encounterId", filter.EncounterID)
+		selector["encounterId"] = filter.EncounterID
+	}
+
+	if len(filter.RecordTypes) > maxSearchRecordTypes {
+		errs.add("recordTypes", "at most %d record types are allowed", maxSearchRecordTypes)
+	}
+	for i, recordType := range filter.RecordTypes {
+		validateRecordTypeFormat(&errs, fmt.Sprintf("recordTypes[%d]", i), recordType)
+	}
+	if len(filter.RecordTypes) > 0 {
+		selector["recordType"] = map[string]interface{}{"$in": filter.RecordTypes}
+	}
+
+	for i, code := range filter.Confidentiality {
+		if !confidentialityCodes[code] {
+			errs.add(fmt.Sprintf("confidentiality[%d]", i), "must be one of U, L, M, N, R, V")
+		}
+	}
+	if len(filter.Confidentiality) > 0 {
+		selector["confidentiality"] = map[string]interface{}{"$in": filter.Confidentiality}
+	}
+
+	if len(filter.SensitivityTags) > 0 {
+		tags, err := normalizeLabels(filter.SensitivityTags)
+		if err != nil {
+			errs.add("sensitivityTags", "%v", err)
+		}
+		selector["sensitivityTags"] = map[string]interface{}{"$all": tags}
+	}
+
+	// The timestamp always has a bound so the sort indexes apply
+	timestamp := map[string]interface{}{"$gt": nil}
+	from := parseSearchTime(&errs, "from", filter.From)
+	to := parseSearchTime(&errs, "to", filter.To)
+	if !from.IsZero() {
+		delete(timestamp, "$gt")
+		timestamp["$gte"] = from
+	}
+	if !to.IsZero() {
+		timestamp["$lt"] = to
+	}
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		errs.add("to", "must be after from")
+	}
+	selector["timestamp"] = timestamp
+
+	direction := "asc"
+	if filter.Descending {
+		direction = "desc"
+	}
+
+	var sort []map[string]string
+	var index string
+	switch filter.SortBy {
+	case "", SearchSortTimestamp:
+		sort = []map[string]string{{"timestamp": direction}}
+		index = searchTimestampIndex
+	case SearchSortRecordType:
+		sort = []map[string]string{{"recordType": direction}, {"timestamp": direction}}
+		index = searchRecordTypeIndex
+		if _, filtered := selector["recordType"]; !filtered {
+			selector["recordType"] = map[string]interface{}{"$gt": nil}
+		}
+	default:
+		errs.add("sortBy", "must be %s or %s", SearchSortTimestamp, SearchSortRecordType)
+	}
+
+	pageSize := filter.PageSize
+	if pageSize == 0 {
+		pageSize = defaultSearchPageSize
+	}
+	if pageSize < 0 || pageSize > maxSearchPageSize {
+		errs.add("pageSize", "must be between 1 and %d", maxSearchPageSize)
+	}
+
+	if err := errs.errOrNil(); err != nil {
+		return "", 0, err
+	}
+
+	query := map[string]interface{}{
+		"selector":  selector,
+		"sort":      sort,
+		"use_index": []string{"_design/" + index, index},
+	}
+	queryJSON, err := json.Marshal(query)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to marshal search query: %v", err)
+	}
+
+	return string(queryJSON), int32(pageSize), nil
+}
+
+// parseSearchTime parses an optional RFC 3339 bound of a search. Bounds are compared with the
+// stored timestamps as strings, so they are converted to UTC, the zone peers run in.
+func parseSearchTime(errs *ValidationErrors, field string, value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		errs.add(field, "must be an RFC 3339 timestamp")
+		return time.Time{}
+	}
+
+	return parsed.UTC()
+}
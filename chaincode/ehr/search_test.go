@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordIDs lists the IDs of search results
+func recordIDs(result *EHRSearchResult) []string {
+	ids := []string{}
+	for _, record := range result.Records {
+		ids = append(ids, record.RecordID)
+	}
+	return ids
+}
+
+// TestSearchEHRs tests that search pages through the caller's readable records only
+func TestSearchEHRs(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newQueryContext(stub, patientIdentity("patient123"))
+	otherCtx := newQueryContext(stub, patientIdentity("patient999"))
+	doctorCtx := newQueryContext(stub, doctorIdentity("doctor456"))
+
+	for _, recordID := range []string{"EHR-1", "EHR-2", "EHR-3"} {
+		recordID := recordID
+		err := inTx(stub, "tx1-"+recordID, func() error {
+			return s.CreateEHRMetadata(patientCtx, recordID, "patient123", testCID(recordID), "key", "Lab Report", testChecksum(recordID),
+				testSignature(patientCtx, recordID, "patient123", testCID(recordID), testChecksum(recordID), "Lab Report"))
+		})
+		assert.NoError(t, err)
+	}
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(otherCtx, "EHR-9", "patient999", testCID("EHR-9"), "key", "Lab Report", testChecksum("EHR-9"),
+			testSignature(otherCtx, "EHR-9", "patient999", testCID("EHR-9"), testChecksum("EHR-9"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	// Patients only search their own records
+	_, err = s.SearchEHRs(patientCtx, EHRSearchFilter{PatientID: "patient999"})
+	assert.Error(t, err)
+
+	result, err := s.SearchEHRs(patientCtx, EHRSearchFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EHR-1", "EHR-2", "EHR-3"}, recordIDs(result))
+	assert.Empty(t, result.Bookmark)
+
+	// Records without consent never leave the peer
+	result, err = s.SearchEHRs(doctorCtx, EHRSearchFilter{})
+	assert.NoError(t, err)
+	assert.Empty(t, result.Records)
+
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.GrantConsent(patientCtx, "patient123-doctor456-EHR-2", "patient123", "doctor456", "EHR-2", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	result, err = s.SearchEHRs(doctorCtx, EHRSearchFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EHR-2"}, recordIDs(result))
+
+	// Superseded versions are left out unless asked for
+	err = inTx(stub, "tx3", func() error {
+		return s.AmendEHR(patientCtx, "EHR-3", "EHR-3-v2", testCID("EHR-3-v2"), "key", testChecksum("EHR-3-v2"), "Corrected",
+			testSignature(patientCtx, "EHR-3-v2", "patient123", testCID("EHR-3-v2"), testChecksum("EHR-3-v2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	result, err = s.SearchEHRs(patientCtx, EHRSearchFilter{PageSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EHR-1", "EHR-2"}, recordIDs(result))
+	assert.NotEmpty(t, result.Bookmark)
+
+	result, err = s.SearchEHRs(patientCtx, EHRSearchFilter{PageSize: 2, Bookmark: result.Bookmark})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EHR-3-v2"}, recordIDs(result))
+	assert.Empty(t, result.Bookmark)
+
+	result, err = s.SearchEHRs(patientCtx, EHRSearchFilter{IncludeAmended: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"EHR-1", "EHR-2", "EHR-3", "EHR-3-v2"}, recordIDs(result))
+}
+
+// TestBuildSearchQuery tests the CouchDB query built from a filter
+func TestBuildSearchQuery(t *testing.T) {
+	query, pageSize, err := buildSearchQuery(EHRSearchFilter{
+		PatientID:       `patient123","$or":[{}]`,
+		RecordTypes:     []string{"Lab Report", "Imaging"},
+		AuthorOrg:       "HospitalMSP",
+		From:            "2025-01-01T00:00:00+02:00",
+		To:              "2025-02-01T00:00:00Z",
+		SensitivityTags: []string{"psy", "HIV"},
+		SortBy:          SearchSortRecordType,
+		Descending:      true,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(defaultSearchPageSize), pageSize)
+
+	var parsed struct {
+		Selector map[string]interface{} `json:"selector"`
+		Sort     []map[string]string    `json:"sort"`
+		UseIndex []string               `json:"use_index"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(query), &parsed))
+
+	// Filter values stay values
+	assert.Equal(t, `patient123","$or":[{}]`, parsed.Selector["patientId"])
+	assert.NotContains(t, parsed.Selector, "$or")
+
+	assert.Equal(t, "", parsed.Selector["supersededBy"])
+	assert.Equal(t, map[string]interface{}{"$in": []interface{}{"Lab Report", "Imaging"}}, parsed.Selector["recordType"])
+	assert.Equal(t, map[string]interface{}{"$all": []interface{}{"HIV", "PSY"}}, parsed.Selector["sensitivityTags"])
+	assert.Equal(t, map[string]interface{}{"$gte": "2024-12-31T22:00:00Z", "$lt": "2025-02-01T00:00:00Z"}, parsed.Selector["timestamp"])
+	assert.Equal(t, []map[string]string{{"recordType": "desc"}, {"timestamp": "desc"}}, parsed.Sort)
+	assert.Equal(t, []string{"_design/" + searchRecordTypeIndex, searchRecordTypeIndex}, parsed.UseIndex)
+
+	// Every invalid field is reported
+	_, _, err = buildSearchQuery(EHRSearchFilter{
+		RecordTypes:     []string{"Lab\nReport"},
+		From:            "yesterday",
+		Confidentiality: []string{"X"},
+		SortBy:          "patientId",
+		PageSize:        500,
+	})
+	var validationErrs ValidationErrors
+	if assert.ErrorAs(t, err, &validationErrs) {
+		fields := []string{}
+		for _, validationErr := range validationErrs {
+			fields = append(fields, validationErr.Field)
+		}
+		assert.ElementsMatch(t, []string{"recordTypes[0]", "from", "confidentiality[0]", "sortBy", "pageSize"}, fields)
+	}
+
+	_, _, err = buildSearchQuery(EHRSearchFilter{From: "2025-02-01T00:00:00Z", To: "2025-01-01T00:00:00Z"})
+	assert.ErrorContains(t, err, "must be after from")
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Share token statuses. Expired is not stored: an active token past its expiry reads as expired.
+const (
+	ShareTokenActive   = "ACTIVE"
+	ShareTokenRedeemed = "REDEEMED"
+	ShareTokenRevoked  = "REVOKED"
+	ShareTokenExpired  = "EXPIRED"
+)
+
+// shareTokenSecretKey is the transient map key of the token secret. Transient data is not
+// written to the ledger.
+const shareTokenSecretKey = "shareTokenSecret"
+
+// shareTokenDomain prefixes the message a recipient signs to redeem a token
+const shareTokenDomain = "medledger-share-token-v1"
+
+// Share token limits
+const (
+	minShareTokenSecret     = 32 // Bytes
+	maxShareTokenRecords    = 50
+	maxShareTokenMinutes    = 7 * 24 * 60
+	maxShareTokenRecipient  = 256
+	maxShareTokenReason     = 1024
+	maxShareTokenWrappedKey = 4096
+)
+
+const (
+	shareTokenObjectType   = "shareToken"
+	shareTokenPatientIndex = "sharetoken~patient"
+)
+
+// ShareToken lets a provider outside the network fetch specific records once, before it
+// expires. The token secret never reaches the ledger: the token is keyed by its SHA-256 hash.
+type ShareToken struct {
+	TokenID              string       `json:"tokenId"` // Hex SHA-256 of the token secret
+	PatientID            string       `json:"patientId"`
+	Recipient            string       `json:"recipient"`            // Name of the receiving provider
+	RecipientKey         string       `json:"recipientKey"`         // PEM public key of the recipient
+	RecipientFingerprint string       `json:"recipientFingerprint"` // Hex SHA-256 of the recipient key
+	Grants               []ShareGrant `json:"grants"`
+	Status               string       `json:"status"`
+	CreatedAt            time.Time    `json:"createdAt"`
+	ExpiresAt            time.Time    `json:"expiresAt"`
+	RedeemedBy           string       `json:"redeemedBy,omitempty" metadata:",optional"` // Service that redeemed it
+	RedeemedAt           time.Time    `json:"redeemedAt"`                                // Zero until redeemed
+	RevokedAt            time.Time    `json:"revokedAt"`                                 // Zero unless revoked
+	RevokeReason         string       `json:"revokeReason,omitempty" metadata:",optional"`
+}
+
+// ShareGrant is one record of a share token with its key re-wrapped for the recipient
+type ShareGrant struct {
+	RecordID   string `json:"recordId"`
+	WrappedKey string `json:"wrappedKey"` // Base64 record key encrypted to the recipient key
+}
+
+// SharedRecord is what a recipient needs to fetch and decrypt one shared record
+type SharedRecord struct {
+	RecordID   string         `json:"recordId"`
+	RecordType string         `json:"recordType"`
+	IPFSHash   string         `json:"ipfsHash"` // Empty when the CID is kept in private data
+	Checksum   string         `json:"checksum"`
+	Components []EHRComponent `json:"components,omitempty" metadata:",optional"`
+	WrappedKey string         `json:"wrappedKey"`
+}
+
+// ShareTokenDisclosure is the result of redeeming a share token
+type ShareTokenDisclosure struct {
+	TokenID              string         `json:"tokenId"`
+	PatientID            string         `json:"patientId"`
+	Recipient            string         `json:"recipient"`
+	RecipientFingerprint string         `json:"recipientFingerprint"`
+	Records              []SharedRecord `json:"records"`
+}
+
+// CreateShareToken issues a single-use token for a patient's records to a provider outside the
+// network. The client generates the token secret and passes it in the transient map under
+// shareTokenSecret, and re-wraps each record key for the recipient's public key.
+func (s *SmartContract) CreateShareToken(
+	ctx contractapi.TransactionContextInterface,
+	recipient string,
+	recipientKey string,
+	grants []ShareGrant,
+	expiresInMinutes int,
+) (*ShareToken, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	// Patients share their own records
+	err = s.RequireRole(ctx, RolePatient)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.requireUnmergedPatient(ctx, callerID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenID, err := shareTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs ValidationErrors
+	if recipient == "" {
+		errs.add("recipient", "is required")
+	} else if len(recipient) > maxShareTokenRecipient {
+		errs.add("recipient", "must be at most %d characters", maxShareTokenRecipient)
+	}
+	_, fingerprint, err := parsePublicKeyPEM(recipientKey)
+	if err != nil {
+		errs.add("recipientKey", "%v", err)
+	}
+	if expiresInMinutes <= 0 || expiresInMinutes > maxShareTokenMinutes {
+		errs.add("expiresInMinutes", "must be between 1 and %d", maxShareTokenMinutes)
+	}
+	if len(grants) == 0 {
+		errs.add("grants", "at least one record is required")
+	} else if len(grants) > maxShareTokenRecords {
+		errs.add("grants", "at most %d records can be shared at once", maxShareTokenRecords)
+	}
+	seen := make(map[string]bool, len(grants))
+	for i, grant := range grants {
+		field := fmt.Sprintf("grants[%d]", i)
+		if grant.RecordID == "" {
+			errs.add(field+".recordId", "is required")
+		} else if seen[grant.RecordID] {
+			errs.add(field+".recordId", "duplicate record %s", grant.RecordID)
+		}
+		seen[grant.RecordID] = true
+		if grant.WrappedKey == "" {
+			errs.add(field+".wrappedKey", "is required")
+		} else if len(grant.WrappedKey) > maxShareTokenWrappedKey {
+			errs.add(field+".wrappedKey", "must be at most %d characters", maxShareTokenWrappedKey)
+		} else if _, err := base64.StdEncoding.DecodeString(grant.WrappedKey); err != nil {
+			errs.add(field+".wrappedKey", "must be base64")
+		}
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := s.readShareToken(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("share token secret has already been used")
+	}
+
+	for _, grant := range grants {
+		metadata, err := s.readEHR(ctx, grant.RecordID)
+		if err != nil {
+			return nil, err
+		}
+		err = requireNotErased(metadata)
+		if err != nil {
+			return nil, err
+		}
+		if metadata.PatientID != callerID {
+			return nil, fmt.Errorf("%w: record %s does not belong to the caller", errUnauthorized, grant.RecordID)
+		}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &ShareToken{
+		TokenID:              tokenID,
+		PatientID:            callerID,
+		Recipient:            recipient,
+		RecipientKey:         recipientKey,
+		RecipientFingerprint: fingerprint,
+		Grants:               grants,
+		Status:               ShareTokenActive,
+		CreatedAt:            now,
+		ExpiresAt:            now.Add(time.Duration(expiresInMinutes) * time.Minute),
+	}
+
+	err = s.putStateEntity(ctx, shareTokenObjectType, tokenID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.putIndexEntry(ctx, shareTokenPatientIndex, callerID, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	err = s.createAuditLog(ctx, ActionCreateShareToken, callerID, callerID, "", token.PatientID, true,
+		fmt.Sprintf("Share token %s issued to %s (key %s) for %d record(s), expires %s",
+			tokenID, recipient, fingerprint, len(grants), token.ExpiresAt.Format(time.RFC3339)))
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// RedeemShareToken is called by the backend's admin identity on behalf of a recipient outside
+// the network. It takes the token secret in the transient map under shareTokenSecret and the
+// recipient's base64 signature over the token ID, proving they hold the key the token is bound
+// to. The token is used up and every record released is audited as an external disclosure.
+func (s *SmartContract) RedeemShareToken(
+	ctx contractapi.TransactionContextInterface,
+	recipientSignature string,
+) (*ShareTokenDisclosure, error) {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenID, err := shareTokenID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := s.readShareToken(ctx, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		return nil, fmt.Errorf("share token is not valid")
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch shareTokenStatus(token, now) {
+	case ShareTokenRedeemed:
+		return nil, fmt.Errorf("share token %s has already been redeemed", tokenID)
+	case ShareTokenRevoked:
+		return nil, fmt.Errorf("share token %s has been revoked", tokenID)
+	case ShareTokenExpired:
+		return nil, fmt.Errorf("share token %s expired at %s", tokenID, token.ExpiresAt.Format(time.RFC3339))
+	}
+
+	recipientKey, _, err := parsePublicKeyPEM(token.RecipientKey)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyPublicKeySignature(recipientKey, shareTokenDigest(tokenID), recipientSignature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient signature for share token %s: %v", tokenID, err)
+	}
+
+	disclosure := &ShareTokenDisclosure{
+		TokenID:              tokenID,
+		PatientID:            token.PatientID,
+		Recipient:            token.Recipient,
+		RecipientFingerprint: token.RecipientFingerprint,
+		Records:              []SharedRecord{},
+	}
+	for _, grant := range token.Grants {
+		metadata, err := s.readEHR(ctx, grant.RecordID)
+		if err != nil {
+			return nil, err
+		}
+		err = requireNotErased(metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		disclosure.Records = append(disclosure.Records, SharedRecord{
+			RecordID:   metadata.RecordID,
+			RecordType: metadata.RecordType,
+			IPFSHash:   publicIPFSHash(metadata),
+			Checksum:   metadata.Checksum,
+			Components: metadata.Components,
+			WrappedKey: grant.WrappedKey,
+		})
+	}
+
+	token.Status = ShareTokenRedeemed
+	token.RedeemedBy = callerID
+	token.RedeemedAt = now
+
+	err = s.putStateEntity(ctx, shareTokenObjectType, tokenID, token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	for _, record := range disclosure.Records {
+		err = s.createAuditLog(ctx, ActionExternalDisclosure, callerID, token.PatientID, record.RecordID, token.PatientID, true,
+			fmt.Sprintf("Disclosed to %s (key %s) with share token %s",
+				token.Recipient, token.RecipientFingerprint, tokenID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return disclosure, nil
+}
+
+// RevokeShareToken withdraws a share token that has not been redeemed yet
+func (s *SmartContract) RevokeShareToken(
+	ctx contractapi.TransactionContextInterface,
+	tokenID string,
+	reason string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	if len(reason) > maxShareTokenReason {
+		return fmt.Errorf("revocation reason must be at most %d characters", maxShareTokenReason)
+	}
+
+	token, err := s.readShareToken(ctx, tokenID)
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return fmt.Errorf("share token %s %w", tokenID, errNotFound)
+	}
+
+	err = s.RequirePatientOrAdmin(ctx, token.PatientID)
+	if err != nil {
+		return err
+	}
+
+	switch token.Status {
+	case ShareTokenRedeemed:
+		return fmt.Errorf("share token %s has already been redeemed", tokenID)
+	case ShareTokenRevoked:
+		return fmt.Errorf("share token %s has already been revoked", tokenID)
+	}
+
+	token.Status = ShareTokenRevoked
+	token.RevokedAt, err = txTime(ctx)
+	if err != nil {
+		return err
+	}
+	token.RevokeReason = reason
+
+	err = s.putStateEntity(ctx, shareTokenObjectType, tokenID, token)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionRevokeShareToken, callerID, token.PatientID, "", token.PatientID, true,
+		fmt.Sprintf("Share token %s for %s revoked", tokenID, token.Recipient))
+}
+
+// QueryShareTokensByPatient lists a patient's share tokens, expired ones marked as such
+func (s *SmartContract) QueryShareTokensByPatient(
+	ctx contractapi.TransactionContextInterface,
+	patientID string,
+) ([]*ShareToken, error) {
+	err := s.RequirePatientOrAdmin(ctx, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenIDs, err := s.indexEntries(ctx, shareTokenPatientIndex, patientID)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*ShareToken{}
+	for _, tokenID := range tokenIDs {
+		token, err := s.readShareToken(ctx, tokenID)
+		if err != nil {
+			return nil, err
+		}
+		if token == nil {
+			continue
+		}
+		token.Status = shareTokenStatus(token, now)
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// readShareToken loads a share token, or nil if it does not exist
+func (s *SmartContract) readShareToken(
+	ctx contractapi.TransactionContextInterface,
+	tokenID string,
+) (*ShareToken, error) {
+	var token ShareToken
+	found, err := s.readStateEntity(ctx, shareTokenObjectType, tokenID, &token)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// shareTokenID hashes the token secret passed in the transient map
+func shareTokenID(ctx contractapi.TransactionContextInterface) (string, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to get transient data: %v", err)
+	}
+
+	secret := transient[shareTokenSecretKey]
+	if len(secret) < minShareTokenSecret {
+		return "", fmt.Errorf("transient %s must be at least %d bytes", shareTokenSecretKey, minShareTokenSecret)
+	}
+
+	digest := sha256.Sum256(secret)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// shareTokenStatus is the stored status, or expired for an active token past its expiry
+func shareTokenStatus(token *ShareToken, now time.Time) string {
+	if token.Status == ShareTokenActive && !now.Before(token.ExpiresAt) {
+		return ShareTokenExpired
+	}
+	return token.Status
+}
+
+// shareTokenDigest is what a recipient signs to redeem a token
+func shareTokenDigest(tokenID string) []byte {
+	digest := sha256.Sum256([]byte(shareTokenDomain + "\n" + tokenID))
+	return digest[:]
+}
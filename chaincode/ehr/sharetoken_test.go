@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// withShareSecret runs fn as a mock transaction with a token secret in the transient map
+func withShareSecret(stub *shimtest.MockStub, txID string, secret string, fn func() error) error {
+	return inTxWithTransient(stub, txID, map[string][]byte{shareTokenSecretKey: []byte(secret)}, fn)
+}
+
+// recipientKeyPair returns an external provider's key and its PEM public key
+func recipientKeyPair(t *testing.T) (*ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// recipientSignature signs a share token ID as its recipient
+func recipientSignature(t *testing.T, key *ecdsa.PrivateKey, tokenID string) string {
+	signature, err := ecdsa.SignASN1(rand.Reader, key, shareTokenDigest(tokenID))
+	assert.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+// TestShareTokens tests issuing, redeeming and revoking share tokens for external providers
+func TestShareTokens(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	otherCtx := newTestContext(stub, patientIdentity("patient999"))
+	backendCtx := newQueryContext(stub, adminIdentity("backend"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	for _, recordID := range []string{"EHR-001", "EHR-002"} {
+		recordID := recordID
+		err := inTx(stub, "tx1-"+recordID, func() error {
+			return s.CreateEHRMetadata(patientCtx, recordID, "patient123", testCID(recordID), "key", "Lab Report", testChecksum(recordID),
+				testSignature(patientCtx, recordID, "patient123", testCID(recordID), testChecksum(recordID), "Lab Report"))
+		})
+		assert.NoError(t, err)
+	}
+
+	recipientKey, recipientPEM := recipientKeyPair(t)
+	wrappedKey := base64.StdEncoding.EncodeToString([]byte("record key wrapped for the clinic"))
+	grants := []ShareGrant{{RecordID: "EHR-001", WrappedKey: wrappedKey}, {RecordID: "EHR-002", WrappedKey: wrappedKey}}
+	secret := strings.Repeat("s", minShareTokenSecret)
+
+	// The secret comes from the transient map and must be long enough
+	_, err := s.CreateShareToken(patientCtx, "Lakeside Clinic", recipientPEM, grants, 60)
+	assert.ErrorContains(t, err, shareTokenSecretKey)
+
+	err = withShareSecret(stub, "tx2", "short", func() error {
+		_, err := s.CreateShareToken(patientCtx, "Lakeside Clinic", recipientPEM, grants, 60)
+		return err
+	})
+	assert.ErrorContains(t, err, "at least 32 bytes")
+
+	// Only the patient shares their records
+	err = withShareSecret(stub, "tx3", secret, func() error {
+		_, err := s.CreateShareToken(doctorCtx, "Lakeside Clinic", recipientPEM, grants, 60)
+		return err
+	})
+	assert.Error(t, err)
+
+	err = withShareSecret(stub, "tx4", secret, func() error {
+		_, err := s.CreateShareToken(otherCtx, "Lakeside Clinic", recipientPEM, grants, 60)
+		return err
+	})
+	assert.ErrorContains(t, err, "does not belong to the caller")
+
+	err = withShareSecret(stub, "tx5", secret, func() error {
+		_, err := s.CreateShareToken(patientCtx, "", "not a key", []ShareGrant{{RecordID: "EHR-001", WrappedKey: "!"}}, 0)
+		return err
+	})
+	assert.ErrorContains(t, err, `"field":"recipient"`)
+	assert.ErrorContains(t, err, `"field":"recipientKey"`)
+	assert.ErrorContains(t, err, `"field":"expiresInMinutes"`)
+	assert.ErrorContains(t, err, `"field":"grants[0].wrappedKey"`)
+
+	var token *ShareToken
+	err = withShareSecret(stub, "tx6", secret, func() error {
+		var err error
+		token, err = s.CreateShareToken(patientCtx, "Lakeside Clinic", recipientPEM, grants, 60)
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ShareTokenActive, token.Status)
+	assert.Len(t, token.RecipientFingerprint, 64)
+
+	// The secret itself is never stored
+	for key, value := range stub.State {
+		assert.NotContains(t, string(value), secret, key)
+	}
+
+	// Redeeming takes the backend identity, the secret and the recipient's signature
+	err = withShareSecret(stub, "tx7", secret, func() error {
+		_, err := s.RedeemShareToken(patientCtx, recipientSignature(t, recipientKey, token.TokenID))
+		return err
+	})
+	assert.Error(t, err)
+
+	err = withShareSecret(stub, "tx8", strings.Repeat("x", minShareTokenSecret), func() error {
+		_, err := s.RedeemShareToken(backendCtx, recipientSignature(t, recipientKey, token.TokenID))
+		return err
+	})
+	assert.ErrorContains(t, err, "share token is not valid")
+
+	otherKey, _ := recipientKeyPair(t)
+	err = withShareSecret(stub, "tx9", secret, func() error {
+		_, err := s.RedeemShareToken(backendCtx, recipientSignature(t, otherKey, token.TokenID))
+		return err
+	})
+	assert.ErrorContains(t, err, "invalid recipient signature")
+
+	var disclosure *ShareTokenDisclosure
+	err = withShareSecret(stub, "tx10", secret, func() error {
+		var err error
+		disclosure, err = s.RedeemShareToken(backendCtx, recipientSignature(t, recipientKey, token.TokenID))
+		return err
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, disclosure.Records, 2) {
+		assert.Equal(t, "EHR-001", disclosure.Records[0].RecordID)
+		assert.Equal(t, testCID("EHR-001"), disclosure.Records[0].IPFSHash)
+		assert.Equal(t, wrappedKey, disclosure.Records[0].WrappedKey)
+	}
+
+	logs, err := s.QueryAuditLogsByAction(backendCtx, ActionExternalDisclosure)
+	assert.NoError(t, err)
+	assert.Len(t, logs, 2)
+
+	// Tokens are single use
+	err = withShareSecret(stub, "tx11", secret, func() error {
+		_, err := s.RedeemShareToken(backendCtx, recipientSignature(t, recipientKey, token.TokenID))
+		return err
+	})
+	assert.ErrorContains(t, err, "already been redeemed")
+
+	err = inTx(stub, "tx12", func() error {
+		return s.RevokeShareToken(patientCtx, token.TokenID, "")
+	})
+	assert.ErrorContains(t, err, "already been redeemed")
+
+	// Revoked tokens cannot be redeemed
+	secondSecret := strings.Repeat("t", minShareTokenSecret)
+	var second *ShareToken
+	err = withShareSecret(stub, "tx13", secondSecret, func() error {
+		var err error
+		second, err = s.CreateShareToken(patientCtx, "Hillview Dental", recipientPEM, grants[:1], 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx14", func() error {
+		return s.RevokeShareToken(otherCtx, second.TokenID, "")
+	})
+	assert.Error(t, err)
+
+	err = inTx(stub, "tx15", func() error {
+		return s.RevokeShareToken(patientCtx, second.TokenID, "Sent to the wrong clinic")
+	})
+	assert.NoError(t, err)
+
+	err = withShareSecret(stub, "tx16", secondSecret, func() error {
+		_, err := s.RedeemShareToken(backendCtx, recipientSignature(t, recipientKey, second.TokenID))
+		return err
+	})
+	assert.ErrorContains(t, err, "has been revoked")
+
+	tokens, err := s.QueryShareTokensByPatient(patientCtx, "patient123")
+	assert.NoError(t, err)
+	statuses := map[string]string{}
+	for _, token := range tokens {
+		statuses[token.Recipient] = token.Status
+	}
+	assert.Equal(t, map[string]string{"Lakeside Clinic": ShareTokenRedeemed, "Hillview Dental": ShareTokenRevoked}, statuses)
+
+	_, err = s.QueryShareTokensByPatient(otherCtx, "patient123")
+	assert.Error(t, err)
+}
+
+// TestShareTokenExpiry tests that expired tokens are listed as expired and cannot be redeemed
+func TestShareTokenExpiry(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	backendCtx := newTestContext(stub, adminIdentity("backend"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), "key", "Lab Report", testChecksum("EHR-001"),
+			testSignature(patientCtx, "EHR-001", "patient123", testCID("EHR-001"), testChecksum("EHR-001"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	recipientKey, recipientPEM := recipientKeyPair(t)
+	secret := strings.Repeat("s", minShareTokenSecret)
+	var token *ShareToken
+	err = withShareSecret(stub, "tx2", secret, func() error {
+		var err error
+		token, err = s.CreateShareToken(patientCtx, "Lakeside Clinic", recipientPEM,
+			[]ShareGrant{{RecordID: "EHR-001", WrappedKey: base64.StdEncoding.EncodeToString([]byte("wrapped"))}}, 5)
+		return err
+	})
+	assert.NoError(t, err)
+
+	// Expiry is judged at the time of the transaction
+	expired := timestamppb.New(token.ExpiresAt.Add(time.Second))
+	var tokens []*ShareToken
+	err = inTx(stub, "tx3", func() error {
+		stub.TxTimestamp = expired
+		var err error
+		tokens, err = s.QueryShareTokensByPatient(patientCtx, "patient123")
+		return err
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, ShareTokenExpired, tokens[0].Status)
+	}
+
+	err = withShareSecret(stub, "tx4", secret, func() error {
+		stub.TxTimestamp = expired
+		_, err := s.RedeemShareToken(backendCtx, recipientSignature(t, recipientKey, token.TokenID))
+		return err
+	})
+	assert.ErrorContains(t, err, "expired at")
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Field limits
+const (
+	maxRecordIDLength     = 128
+	maxPatientIDLength    = 512 // Patient IDs are base64 X.509 identities
+	maxEncryptedKeyLength = 16384
+	maxRecordTypeLength   = 64
+	maxRecordTypes        = 200
+)
+
+// Multihash codes
+const (
+	multihashSHA256    = 0x12
+	multihashSHA256Len = 32
+)
+
+const (
+	configObjectType       = "config"
+	configRecordTypesKey   = "recordTypes"
+	base58BitcoinAlphabet  = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	cidV0Length            = 46
+	multibaseBase58BTC     = 'z'
+	multibaseBase32Lower   = 'b'
+	multibaseBase32Upper   = 'B'
+	multibaseBase16Lower   = 'f'
+	recordTypeAllowedChars = "letters, digits, spaces and . _ , & + / ( ) -"
+)
+
+var (
+	recordIDPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]*$`)
+	patientIDPattern  = regexp.MustCompile(`^[A-Za-z0-9+/=._:@-]+$`)
+	checksumPattern   = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	recordTypePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 ._,&+/()-]*$`)
+	mimeTypePattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9!#$&^_.+-]*/[a-z0-9][a-z0-9!#$&^_.+-]*$`)
+)
+
+// ValidationError describes one invalid field
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationErrors lists every invalid field of a request. Its message carries the list as JSON
+// so clients can map errors back to form fields.
+type ValidationErrors []ValidationError
+
+// Error implements error
+func (e ValidationErrors) Error() string {
+	errorsJSON, err := json.Marshal([]ValidationError(e))
+	if err != nil {
+		return fmt.Sprintf("validation failed: %d invalid fields", len(e))
+	}
+	return "validation failed: " + string(errorsJSON)
+}
+
+// add records an invalid field
+func (e *ValidationErrors) add(field string, format string, args ...interface{}) {
+	*e = append(*e, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// errOrNil returns the errors as an error, or nil if there are none
+func (e ValidationErrors) errOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// SetRecordTypeVocabulary configures the record types accepted for new records
+func (s *SmartContract) SetRecordTypeVocabulary(
+	ctx contractapi.TransactionContextInterface,
+	recordTypes []string,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	err = s.RequireRole(ctx, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var errs ValidationErrors
+	if len(recordTypes) > maxRecordTypes {
+		errs.add("recordTypes", "at most %d record types are allowed", maxRecordTypes)
+	}
+	seen := make(map[string]bool, len(recordTypes))
+	for i, recordType := range recordTypes {
+		field := fmt.Sprintf("recordTypes[%d]", i)
+		validateRecordTypeFormat(&errs, field, recordType)
+		if seen[strings.ToLower(recordType)] {
+			errs.add(field, "duplicate record type %q", recordType)
+		}
+		seen[strings.ToLower(recordType)] = true
+	}
+	err = errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	vocabularyKey, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{configRecordTypesKey})
+	if err != nil {
+		return fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	vocabularyJSON, err := json.Marshal(recordTypes)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record types: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(vocabularyKey, vocabularyJSON)
+	if err != nil {
+		return fmt.Errorf("failed to put to world state: %v", err)
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionSetRecordTypes, callerID, "", "", "", true,
+		fmt.Sprintf("Record type vocabulary set to %d types", len(recordTypes)))
+}
+
+// GetRecordTypeVocabulary returns the configured record types, empty if any type is accepted
+func (s *SmartContract) GetRecordTypeVocabulary(
+	ctx contractapi.TransactionContextInterface,
+) ([]string, error) {
+	vocabularyKey, err := ctx.GetStub().CreateCompositeKey(configObjectType, []string{configRecordTypesKey})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create composite key: %v", err)
+	}
+
+	vocabularyJSON, err := ctx.GetStub().GetState(vocabularyKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	recordTypes := []string{}
+	if vocabularyJSON != nil {
+		err = json.Unmarshal(vocabularyJSON, &recordTypes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal record types: %v", err)
+		}
+	}
+
+	return recordTypes, nil
+}
+
+// validateEHRMetadata checks every field of a record before it is written. It normalizes the
+// checksum to lower case and, when checkRecordType is set, the record type to its vocabulary
+// spelling.
+func (s *SmartContract) validateEHRMetadata(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+	checkRecordType bool,
+) error {
+	var errs ValidationErrors
+
+	validateRecordID(&errs, "recordId", metadata.RecordID)
+
+	if metadata.PatientID == "" {
+		errs.add("patientId", "is required")
+	} else if len(metadata.PatientID) > maxPatientIDLength {
+		errs.add("patientId", "must be at most %d characters", maxPatientIDLength)
+	} else if !patientIDPattern.MatchString(metadata.PatientID) {
+		errs.add("patientId", "contains invalid characters")
+	}
+
+	if len(metadata.EncryptedKey) > maxEncryptedKeyLength {
+		errs.add("encryptedKey", "must be at most %d characters", maxEncryptedKeyLength)
+	}
+
+	if len(metadata.Components) == 0 {
+		validateCIDField(&errs, "ipfsHash", metadata.IPFSHash)
+		validateChecksumField(&errs, "checksum", metadata.Checksum)
+		if metadata.EncryptedKey == "" {
+			errs.add("encryptedKey", "is required")
+		}
+	} else {
+		validateBundleComponents(&errs, metadata.EncryptedKey, metadata.Components)
+	}
+
+	if checkRecordType {
+		canonical, err := s.canonicalRecordType(ctx, &errs, metadata.RecordType)
+		if err != nil {
+			return err
+		}
+		metadata.RecordType = canonical
+	}
+
+	err := errs.errOrNil()
+	if err != nil {
+		return err
+	}
+
+	metadata.Checksum = strings.ToLower(metadata.Checksum)
+	for i := range metadata.Components {
+		metadata.Components[i].Checksum = strings.ToLower(metadata.Components[i].Checksum)
+	}
+
+	return nil
+}
+
+// canonicalRecordType checks a record type against the ledger vocabulary, if one is configured
+func (s *SmartContract) canonicalRecordType(
+	ctx contractapi.TransactionContextInterface,
+	errs *ValidationErrors,
+	recordType string,
+) (string, error) {
+	if !validateRecordTypeFormat(errs, "recordType", recordType) {
+		return recordType, nil
+	}
+
+	vocabulary, err := s.GetRecordTypeVocabulary(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(vocabulary) == 0 {
+		return recordType, nil
+	}
+
+	for _, allowed := range vocabulary {
+		if strings.EqualFold(allowed, recordType) {
+			return allowed, nil
+		}
+	}
+
+	errs.add("recordType", "%q is not in the record type vocabulary", recordType)
+	return recordType, nil
+}
+
+// validateRecordTypeFormat checks the length and characters of a record type
+func validateRecordTypeFormat(errs *ValidationErrors, field string, recordType string) bool {
+	switch {
+	case recordType == "":
+		errs.add(field, "is required")
+	case len(recordType) > maxRecordTypeLength:
+		errs.add(field, "must be at most %d characters", maxRecordTypeLength)
+	case !recordTypePattern.MatchString(recordType):
+		errs.add(field, "may only contain %s", recordTypeAllowedChars)
+	default:
+		return true
+	}
+	return false
+}
+
+// validateRecordID checks the length and characters of a record ID
+func validateRecordID(errs *ValidationErrors, field string, recordID string) {
+	switch {
+	case recordID == "":
+		errs.add(field, "is required")
+	case len(recordID) > maxRecordIDLength:
+		errs.add(field, "must be at most %d characters", maxRecordIDLength)
+	case !recordIDPattern.MatchString(recordID):
+		errs.add(field, "must start with a letter or digit and contain only letters, digits and . _ : -")
+	}
+}
+
+// validateCIDField checks that a value is an IPFS CIDv0 or CIDv1
+func validateCIDField(errs *ValidationErrors, field string, cid string) {
+	if cid == "" {
+		errs.add(field, "is required")
+		return
+	}
+
+	err := parseCID(cid)
+	if err != nil {
+		errs.add(field, "is not a valid CID: %v", err)
+	}
+}
+
+// validateChecksumField checks that a value is a hex SHA-256 digest
+func validateChecksumField(errs *ValidationErrors, field string, checksum string) {
+	if !checksumPattern.MatchString(checksum) {
+		errs.add(field, "must be a hex SHA-256 digest (64 hex characters)")
+	}
+}
+
+// validateBundleComponents checks that a manifest is complete and every component can be decrypted
+func validateBundleComponents(errs *ValidationErrors, encryptedKey string, components []EHRComponent) {
+	if len(components) > maxBundleComponents {
+		errs.add("components", "a bundle can have at most %d components", maxBundleComponents)
+		return
+	}
+
+	seen := make(map[string]bool, len(components))
+	for i, component := range components {
+		field := fmt.Sprintf("components[%d]", i)
+
+		validateRecordID(errs, field+".componentId", component.ComponentID)
+		if seen[component.ComponentID] {
+			errs.add(field+".componentId", "duplicate componentId %s", component.ComponentID)
+		}
+		seen[component.ComponentID] = true
+
+		validateCIDField(errs, field+".ipfsHash", component.IPFSHash)
+		validateChecksumField(errs, field+".checksum", component.Checksum)
+		if !mimeTypePattern.MatchString(component.MimeType) {
+			errs.add(field+".mimeType", "must be a MIME type such as application/pdf")
+		}
+		if component.Size <= 0 {
+			errs.add(field+".size", "must be positive")
+		}
+		if component.EncryptedKey == "" && encryptedKey == "" {
+			errs.add(field+".encryptedKey", "is required when the bundle has no key")
+		}
+		if len(component.EncryptedKey) > maxEncryptedKeyLength {
+			errs.add(field+".encryptedKey", "must be at most %d characters", maxEncryptedKeyLength)
+		}
+	}
+}
+
+// parseCID validates a CIDv0 (base58btc sha2-256 multihash) or a CIDv1 (multibase, version,
+// codec and multihash)
+func parseCID(cid string) error {
+	if len(cid) == cidV0Length && strings.HasPrefix(cid, "Qm") {
+		digest, err := decodeBase58(cid)
+		if err != nil {
+			return err
+		}
+		return parseMultihash(digest, true)
+	}
+
+	var data []byte
+	var err error
+	switch cid[0] {
+	case multibaseBase58BTC:
+		data, err = decodeBase58(cid[1:])
+	case multibaseBase32Lower, multibaseBase32Upper:
+		data, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(cid[1:]))
+	case multibaseBase16Lower:
+		data, err = hex.DecodeString(cid[1:])
+	default:
+		return fmt.Errorf("unsupported multibase prefix %q", cid[0])
+	}
+	if err != nil {
+		return fmt.Errorf("invalid multibase encoding: %v", err)
+	}
+
+	version, n := binary.Uvarint(data)
+	if n <= 0 || version != 1 {
+		return fmt.Errorf("unsupported CID version")
+	}
+	data = data[n:]
+
+	_, n = binary.Uvarint(data)
+	if n <= 0 {
+		return fmt.Errorf("missing codec")
+	}
+
+	return parseMultihash(data[n:], false)
+}
+
+// parseMultihash checks that a multihash's declared length matches its digest
+func parseMultihash(data []byte, requireSHA256 bool) error {
+	code, n := binary.Uvarint(data)
+	if n <= 0 {
+		return fmt.Errorf("missing multihash code")
+	}
+	data = data[n:]
+
+	length, n := binary.Uvarint(data)
+	if n <= 0 {
+		return fmt.Errorf("missing multihash length")
+	}
+	data = data[n:]
+
+	switch {
+	case requireSHA256 && code != multihashSHA256:
+		return fmt.Errorf("CIDv0 must use sha2-256")
+	case code == multihashSHA256 && length != multihashSHA256Len:
+		return fmt.Errorf("sha2-256 digest must be %d bytes", multihashSHA256Len)
+	case length == 0 || uint64(len(data)) != length:
+		return fmt.Errorf("digest length %d does not match multihash length %d", len(data), length)
+	}
+
+	return nil
+}
+
+// decodeBase58 decodes base58btc (Bitcoin alphabet)
+func decodeBase58(encoded string) ([]byte, error) {
+	value := new(big.Int)
+	radix := big.NewInt(58)
+	for _, r := range encoded {
+		digit := strings.IndexRune(base58BitcoinAlphabet, r)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", r)
+		}
+		value.Mul(value, radix)
+		value.Add(value, big.NewInt(int64(digit)))
+	}
+
+	// Leading '1's encode leading zero bytes
+	zeros := 0
+	for zeros < len(encoded) && encoded[zeros] == base58BitcoinAlphabet[0] {
+		zeros++
+	}
+
+	return append(make([]byte, zeros), value.Bytes()...), nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseCID tests CIDv0 and CIDv1 parsing
+func TestParseCID(t *testing.T) {
+	valid := []string{
+		"QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG",
+		"bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi",
+		"BAFYBEIGDYRZT5SFP7UDM7HU76UH7Y26NF3EFUYLQABF3OCLGTQY55FBZDI",
+		testCID("sample"),
+	}
+	for _, cid := range valid {
+		assert.NoError(t, parseCID(cid), cid)
+	}
+
+	invalid := []string{
+		"QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbd0", // '0' is not base58
+		"QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdGG",
+		"bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbz", // truncated digest
+		"QmTestHash123",
+		"not-a-cid",
+	}
+	for _, cid := range invalid {
+		assert.Error(t, parseCID(cid), cid)
+	}
+}
+
+// TestCreateEHRMetadataValidation tests that every invalid field is reported together
+func TestCreateEHRMetadataValidation(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	adminCtx := newTestContext(stub, adminIdentity("admin1"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(adminCtx, "EHR 001", "", "QmTestHash123", "key1", "", "checksum1", testSignature(adminCtx, "EHR 001", "", "QmTestHash123", "checksum1", ""))
+	})
+
+	var validationErrors ValidationErrors
+	if assert.True(t, errors.As(err, &validationErrors)) {
+		var fields []string
+		for _, validationError := range validationErrors {
+			fields = append(fields, validationError.Field)
+		}
+		assert.ElementsMatch(t, []string{"recordId", "patientId", "ipfsHash", "checksum", "recordType"}, fields)
+	}
+	assert.Contains(t, err.Error(), `"field":"ipfsHash"`)
+
+	// Once a vocabulary is configured, record types must come from it
+	err = inTx(stub, "tx2", func() error {
+		return s.SetRecordTypeVocabulary(ctx, []string{"Lab Report", "Imaging"})
+	})
+	assert.Error(t, err, "only admins configure the vocabulary")
+
+	err = inTx(stub, "tx3", func() error {
+		return s.SetRecordTypeVocabulary(adminCtx, []string{"Lab Report", "Imaging"})
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("lab"), "key1", "Blood Test", testChecksum("lab"), testSignature(ctx, "EHR-001", "patient123", testCID("lab"), testChecksum("lab"), "Blood Test"))
+	})
+	assert.ErrorContains(t, err, "not in the record type vocabulary")
+
+	err = inTx(stub, "tx5", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("lab"), "key1", "lab report", testChecksum("lab"), testSignature(ctx, "EHR-001", "patient123", testCID("lab"), testChecksum("lab"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	metadata, err := s.QueryEHR(ctx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "Lab Report", metadata.RecordType)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxVersionChain bounds amendment chain walks
+const maxVersionChain = 1000
+
+// AmendEHR creates a new version of a record that supersedes the current latest version
+func (s *SmartContract) AmendEHR(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	newRecordID string,
+	ipfsHash string,
+	encryptedKey string,
+	checksum string,
+	reason string,
+	authorSignature string,
+) error {
+	return s.amendRecord(ctx, recordID, newRecordID, reason, authorSignature, func(previous *EHRMetadata, amended *EHRMetadata) error {
+		if len(previous.Components) > 0 {
+			return fmt.Errorf("record %s is a bundle, amend it with AmendEHRBundle", recordID)
+		}
+
+		amended.IPFSHash = ipfsHash
+		amended.EncryptedKey = encryptedKey
+		amended.Checksum = checksum
+		return nil
+	})
+}
+
+// amendRecord writes a new latest version of a record. fill sets the content of the new version.
+func (s *SmartContract) amendRecord(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+	newRecordID string,
+	reason string,
+	authorSignature string,
+	fill func(previous *EHRMetadata, amended *EHRMetadata) error,
+) error {
+	// Get caller identity
+	callerID, err := s.GetCallerID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get caller ID: %v", err)
+	}
+
+	callerOrg, err := s.GetCallerMSPID(ctx)
+	if err != nil {
+		return err
+	}
+
+	if reason == "" {
+		return fmt.Errorf("amendment reason is required")
+	}
+
+	previous, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return err
+	}
+
+	err = requireActive(previous)
+	if err != nil {
+		return err
+	}
+
+	// Only the latest version can be amended, so the chain never forks
+	if previous.SupersededBy != "" {
+		return fmt.Errorf("record %s has already been amended by %s", recordID, previous.SupersededBy)
+	}
+
+	// The record's patient or an admin may amend it, and so may its author while still
+	// allowed to write the patient's records
+	if callerID != previous.CreatedBy {
+		err = s.RequirePatientOrAdmin(ctx, previous.PatientID)
+	} else {
+		_, err = s.requireRecordAuthor(ctx, previous.PatientID)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Clinician authors still need their credential
+	credential, err := s.authorCredential(ctx)
+	if err != nil {
+		return err
+	}
+
+	exists, err := s.ehrRecordExists(ctx, newRecordID)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("record %s already exists", newRecordID)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	amended := EHRMetadata{
+		RecordID:         newRecordID,
+		PatientID:        previous.PatientID,
+		Timestamp:        now,
+		RecordType:       previous.RecordType,
+		CreatedBy:        callerID,
+		AuthorOrg:        callerOrg,
+		AuthorCredential: credential,
+		Version:          previous.Version + 1,
+		RootRecordID:     previous.RootRecordID,
+		Supersedes:       previous.RecordID,
+		AmendReason:      reason,
+		// Labels carry over to the corrected version
+		Confidentiality: previous.Confidentiality,
+		SensitivityTags: previous.SensitivityTags,
+		EncounterID:     previous.EncounterID,
+	}
+
+	err = fill(previous, &amended)
+	if err != nil {
+		return err
+	}
+
+	// Versions of a record keep their key material where the previous one did
+	err = s.applyPrivateRecordData(ctx, &amended, previous.PrivateData)
+	if err != nil {
+		return err
+	}
+
+	// The record type is inherited, so it is not checked against the current vocabulary
+	err = s.validateEHRMetadata(ctx, &amended, false)
+	if err != nil {
+		return err
+	}
+
+	// Retention follows the record type and the patient's jurisdiction
+	err = s.applyRetention(ctx, &amended)
+	if err != nil {
+		return err
+	}
+
+	err = s.signRecord(ctx, &amended, authorSignature)
+	if err != nil {
+		return err
+	}
+	previous.SupersededBy = newRecordID
+
+	for _, metadata := range []*EHRMetadata{previous, &amended} {
+		err = s.putEHRMetadata(ctx, metadata)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = notifyPatient(ctx, &amended)
+	if err != nil {
+		return err
+	}
+
+	// Create audit log
+	return s.createAuditLog(ctx, ActionAmendEHR, callerID, previous.PatientID, newRecordID, previous.PatientID, true,
+		fmt.Sprintf("Record %s amended as version %d: %s", recordID, amended.Version, reason))
+}
+
+// GetEHRVersions returns the versions of a record the caller may read, oldest first. A
+// consent covers the version it names and later amendments, so a consent on a newer version
+// does not reveal the versions it corrected.
+func (s *SmartContract) GetEHRVersions(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) ([]*EHRMetadata, error) {
+	metadata, err := s.readEHR(ctx, recordID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkRecordAccess(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := s.ehrVersions(ctx, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.readableRecords(ctx, versions)
+}
+
+// ehrVersions walks the amendment chain of a record without access checks
+func (s *SmartContract) ehrVersions(
+	ctx contractapi.TransactionContextInterface,
+	metadata *EHRMetadata,
+) ([]*EHRMetadata, error) {
+	var err error
+
+	// Walk back to the original version
+	for hops := 0; metadata.Supersedes != "" && hops < maxVersionChain; hops++ {
+		metadata, err = s.readEHR(ctx, metadata.Supersedes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Then forward to the latest
+	versions := []*EHRMetadata{metadata}
+	for hops := 0; metadata.SupersededBy != "" && hops < maxVersionChain; hops++ {
+		metadata, err = s.readEHR(ctx, metadata.SupersededBy)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, metadata)
+	}
+
+	return versions, nil
+}
+
+// recordLineage returns a record ID followed by the IDs of the versions it amends,
+// newest first. Unknown records yield just the given ID.
+func (s *SmartContract) recordLineage(
+	ctx contractapi.TransactionContextInterface,
+	recordID string,
+) ([]string, error) {
+	lineage := []string{recordID}
+
+	metadataJSON, err := ctx.GetStub().GetState(recordID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if metadataJSON == nil {
+		return lineage, nil
+	}
+
+	var metadata EHRMetadata
+	err = json.Unmarshal(metadataJSON, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
+	}
+
+	for hops := 0; metadata.Supersedes != "" && hops < maxVersionChain; hops++ {
+		lineage = append(lineage, metadata.Supersedes)
+
+		previous, err := s.readEHR(ctx, metadata.Supersedes)
+		if err != nil {
+			return nil, err
+		}
+		metadata = *previous
+	}
+
+	return lineage, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAmendEHR tests the amendment chain, latest-version lookup and consent carry-over
+func TestAmendEHR(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("original"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(ctx, "EHR-001", "patient123", testCID("original"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001", "patient123", "doctor456", "EHR-001", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx3", func() error {
+		return s.AmendEHR(ctx, "EHR-001", "EHR-001-v2", testCID("corrected"), "key2", testChecksum("checksum2"), "Corrected potassium value", testSignature(ctx, "EHR-001-v2", "patient123", testCID("corrected"), testChecksum("checksum2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	// Amending a superseded version would fork the chain
+	err = inTx(stub, "tx4", func() error {
+		return s.AmendEHR(ctx, "EHR-001", "EHR-001-v3", testCID("other"), "key3", testChecksum("checksum3"), "Second correction", testSignature(ctx, "EHR-001-v3", "patient123", testCID("other"), testChecksum("checksum3"), "Lab Report"))
+	})
+	assert.ErrorContains(t, err, "already been amended")
+
+	// Other patients cannot amend the record
+	err = inTx(stub, "tx5", func() error {
+		return s.AmendEHR(newTestContext(stub, patientIdentity("patient999")), "EHR-001-v2", "EHR-001-v3", testCID("other"), "key3", testChecksum("checksum3"), "Not mine", testSignature(newTestContext(stub, patientIdentity("patient999")), "EHR-001-v3", "patient123", testCID("other"), testChecksum("checksum3"), "Lab Report"))
+	})
+	assert.Error(t, err)
+
+	latest, err := s.QueryEHR(ctx, "EHR-001")
+	assert.NoError(t, err)
+	assert.Equal(t, "EHR-001-v2", latest.RecordID)
+	assert.Equal(t, 2, latest.Version)
+	assert.Equal(t, "EHR-001", latest.Supersedes)
+	assert.Equal(t, "EHR-001", latest.RootRecordID)
+	assert.Equal(t, "Corrected potassium value", latest.AmendReason)
+
+	versions, err := s.GetEHRVersions(ctx, "EHR-001-v2")
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 2) {
+		assert.Equal(t, "EHR-001", versions[0].RecordID)
+		assert.Equal(t, "EHR-001-v2", versions[0].SupersededBy)
+		assert.Equal(t, testCID("corrected"), versions[1].IPFSHash)
+	}
+
+	hasConsent, err := s.CheckConsent(ctx, "patient123", "doctor456", "EHR-001-v2")
+	assert.NoError(t, err)
+	assert.True(t, hasConsent, "consent on the original should cover its amendment")
+}
+
+// TestAmendEHRRequiresWriteConsent tests that a doctor stops amending their records once the
+// patient revokes the write consent
+func TestAmendEHRRequiresWriteConsent(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	patientCtx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := grantWriteConsent(s, stub, "tx1", "patient123", "doctor456")
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.CreateEHRMetadata(doctorCtx, "EHR-001", "patient123", testCID("original"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(doctorCtx, "EHR-001", "patient123", testCID("original"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx3", func() error {
+		return s.RevokeConsent(patientCtx, consentIDFor("patient123", "doctor456", "*"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx4", func() error {
+		return s.AmendEHR(doctorCtx, "EHR-001", "EHR-001-v2", testCID("corrected"), "key2", testChecksum("checksum2"), "Corrected value", testSignature(doctorCtx, "EHR-001-v2", "patient123", testCID("corrected"), testChecksum("checksum2"), "Lab Report"))
+	})
+	assert.ErrorIs(t, err, errUnauthorized)
+	assert.ErrorContains(t, err, "no write consent")
+
+	// The patient still can
+	err = inTx(stub, "tx5", func() error {
+		return s.AmendEHR(patientCtx, "EHR-001", "EHR-001-v2", testCID("corrected"), "key2", testChecksum("checksum2"), "Corrected value", testSignature(patientCtx, "EHR-001-v2", "patient123", testCID("corrected"), testChecksum("checksum2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+}
+
+// TestGetEHRVersionsFiltersUnreadable tests that a consent on a newer version does not reveal
+// the versions it corrected
+func TestGetEHRVersionsFiltersUnreadable(t *testing.T) {
+	s := new(SmartContract)
+	stub := newTestStub()
+	ctx := newTestContext(stub, patientIdentity("patient123"))
+	doctorCtx := newTestContext(stub, doctorIdentity("doctor456"))
+
+	err := inTx(stub, "tx1", func() error {
+		return s.CreateEHRMetadata(ctx, "EHR-001", "patient123", testCID("original"), "key1", "Lab Report", testChecksum("checksum1"), testSignature(ctx, "EHR-001", "patient123", testCID("original"), testChecksum("checksum1"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx2", func() error {
+		return s.AmendEHR(ctx, "EHR-001", "EHR-001-v2", testCID("corrected"), "key2", testChecksum("checksum2"), "Corrected potassium value", testSignature(ctx, "EHR-001-v2", "patient123", testCID("corrected"), testChecksum("checksum2"), "Lab Report"))
+	})
+	assert.NoError(t, err)
+
+	err = inTx(stub, "tx3", func() error {
+		_, err := s.GrantConsent(ctx, "patient123-doctor456-EHR-001-v2", "patient123", "doctor456", "EHR-001-v2", 30)
+		return err
+	})
+	assert.NoError(t, err)
+
+	versions, err := s.GetEHRVersions(doctorCtx, "EHR-001-v2")
+	assert.NoError(t, err)
+	if assert.Len(t, versions, 1) {
+		assert.Equal(t, "EHR-001-v2", versions[0].RecordID)
+	}
+
+	// The patient sees the whole chain
+	versions, err = s.GetEHRVersions(ctx, "EHR-001-v2")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+
+	// The superseded version itself stays closed to the doctor
+	_, err = s.GetEHRVersions(doctorCtx, "EHR-001")
+	assert.ErrorIs(t, err, errUnauthorized)
+}
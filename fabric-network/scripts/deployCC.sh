@@ -10,7 +10,7 @@ CC_VERSION="1.0"
 CC_SEQUENCE=1
 CC_INIT_FCN="Init"
 CC_END_POLICY="OR('HospitalMSP.peer','PatientMSP.peer')"
-CC_COLL_CONFIG=""
+CC_COLL_CONFIG="--collections-config ${CC_SRC_PATH}/collections_config.json"
 DELAY=3
 MAX_RETRY=5
 
@@ -80,6 +80,7 @@ function approveForMyOrg() {
     --version ${CC_VERSION} \
     --package-id ${PACKAGE_ID} \
     --sequence ${CC_SEQUENCE} \
+    ${CC_COLL_CONFIG} \
     --init-required
   
   verifyResult $? "Chaincode approval failed for ${ORG}"
@@ -96,6 +97,7 @@ function checkCommitReadiness() {
     --name ${CC_NAME} \
     --version ${CC_VERSION} \
     --sequence ${CC_SEQUENCE} \
+    ${CC_COLL_CONFIG} \
     --init-required \
     --output json
 }
@@ -118,6 +120,7 @@ function commitChaincodeDefinition() {
     --tlsRootCertFiles ${PWD}/crypto-config/peerOrganizations/patient.ehr.com/peers/peer0.patient.ehr.com/tls/ca.crt \
     --version ${CC_VERSION} \
     --sequence ${CC_SEQUENCE} \
+    ${CC_COLL_CONFIG} \
     --init-required
   
   verifyResult $? "Chaincode commit failed"